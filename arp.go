@@ -3,7 +3,9 @@ package tcpip
 import (
 	"fmt"
 	"log"
+	"sync"
 	"syscall"
+	"time"
 )
 
 // htons converts a short (uint16) from host-to-network byte order.
@@ -111,3 +113,111 @@ func arp() {
 	arpreply := arpReq.Send(localif.Index, sendArp)
 	fmt.Printf("ARP Reply : %s\n", printByteArr(arpreply.SenderMacAddr))
 }
+
+func NewArpReply(localif LocalIpMacAddr, request Arp) Arp {
+	return Arp{
+		HardwareType: []byte{0x00, 0x01},
+		ProtocolType: []byte{0x08, 0x00},
+		HardwareSize: []byte{0x06},
+		ProtocolSize: []byte{0x04},
+		// ARPリプライ:0x0002
+		Opcode:        []byte{0x00, 0x02},
+		SenderMacAddr: localif.LocalMacAddr,
+		SenderIpAddr:  localif.LocalIpAddr,
+		// リクエストを送ってきた相手に返す
+		TargetMacAddr: request.SenderMacAddr,
+		TargetIpAddr:  request.SenderIpAddr,
+	}
+}
+
+type arpEntry struct {
+	macAddr []byte
+	expire  time.Time
+}
+
+// ArpCache はIPアドレスからMACアドレスを引くテーブル
+type ArpCache struct {
+	mu      sync.Mutex
+	entries map[[4]byte]arpEntry
+	waiters map[[4]byte][]chan struct{}
+	// エントリの有効期間
+	Timeout time.Duration
+}
+
+func NewArpCache() *ArpCache {
+	return &ArpCache{
+		entries: make(map[[4]byte]arpEntry),
+		waiters: make(map[[4]byte][]chan struct{}),
+		Timeout: 5 * time.Minute,
+	}
+}
+
+func toIPv4Key(ip []byte) (key [4]byte) {
+	copy(key[:], ip)
+	return key
+}
+
+func (c *ArpCache) Lookup(ip []byte) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[toIPv4Key(ip)]
+	if !ok || time.Now().After(entry.expire) {
+		return nil, false
+	}
+	return entry.macAddr, true
+}
+
+// Update はエントリを追加して、リプライを待っている人に知らせる
+func (c *ArpCache) Update(ip, mac []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := toIPv4Key(ip)
+	c.entries[key] = arpEntry{
+		macAddr: append([]byte{}, mac...),
+		expire:  time.Now().Add(c.Timeout),
+	}
+	for _, ch := range c.waiters[key] {
+		close(ch)
+	}
+	delete(c.waiters, key)
+}
+
+func (c *ArpCache) Delete(ip []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, toIPv4Key(ip))
+}
+
+// waitch はipのエントリが追加されたら閉じられるchannelを返す
+func (c *ArpCache) waitch(ip []byte) chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := toIPv4Key(ip)
+	ch := make(chan struct{})
+	c.waiters[key] = append(c.waiters[key], ch)
+	return ch
+}
+
+// unwait はwaitchで返したchannelを待つのをやめる
+// 返事が来ないままタイムアウトしたときに呼ばないと、channelが残り続ける
+func (c *ArpCache) unwait(ip []byte, ch chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := toIPv4Key(ip)
+	waiters := c.waiters[key]
+	for i, w := range waiters {
+		if w == ch {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(c.waiters, key)
+		return
+	}
+	c.waiters[key] = waiters
+}
@@ -100,7 +100,11 @@ func UintTo4byte(data uint32) []byte {
 func checksum(sum uint) []byte {
 	// https://el.jibun.atmarkit.co.jp/hiro/2013/07/tcp-f933.html
 	// 22DA6 - 20000 + 2 = 2DA8となり、2DA8をビット反転
-	val := sum - (sum>>16)<<16 + (sum >> 16) ^ 0xffff
+	// 足した結果がまた16bitを超えることがあるので、超えなくなるまで繰り返す
+	for sum>>16 != 0 {
+		sum = sum - (sum>>16)<<16 + (sum >> 16)
+	}
+	val := sum ^ 0xffff
 	return UintTo2byte(uint16(val))
 }
 
@@ -115,3 +119,14 @@ func CalcChecksum(sum uint) []byte {
 func ToPacket(value interface{}) []byte {
 	return toByteArr(value)
 }
+
+// チェックサムの対象の16bitがoldからnewに変わったときのチェックサムを差分で計算する
+// https://datatracker.ietf.org/doc/html/rfc1624
+// HC' = ~(~HC + ~m + m')
+func updateChecksum(sum []byte, old, new uint16) []byte {
+	s := uint(^binary.BigEndian.Uint16(sum)) + uint(^old) + uint(new)
+	for s>>16 != 0 {
+		s = (s & 0xffff) + (s >> 16)
+	}
+	return UintTo2byte(^uint16(s))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"tcpip"
+	"time"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: ping [options] destination\n")
+	flag.PrintDefaults()
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func main() {
+	count := flag.Int("c", 0, "stop after sending count packets (0 = until interrupted)")
+	interval := flag.Duration("i", time.Second, "wait interval between sending each packet")
+	size := flag.Int("s", 56, "number of data bytes to be sent")
+	timeout := flag.Duration("W", time.Second, "time to wait for a response")
+	ttl := flag.Int("t", 64, "IP time to live")
+	ifname := flag.String("I", "eth0", "source interface")
+	gateway := flag.String("g", "", "default gateway (only the connected network is reachable if empty)")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+	if *ttl < 1 || *ttl > 255 {
+		log.Fatalf("ttl must be between 1 and 255 : %d", *ttl)
+	}
+	if *size < 0 {
+		log.Fatalf("invalid packet size : %d", *size)
+	}
+	dest := net.ParseIP(flag.Arg(0)).To4()
+	if dest == nil {
+		log.Fatalf("destination must be an IPv4 address : %s", flag.Arg(0))
+	}
+
+	stack := tcpip.NewStack()
+	// カーネルと二重に返事をしないようにpingには答えない
+	stack.IgnoreEcho = true
+	ifc, err := tcpip.NewNetInterface(*ifname)
+	if err != nil {
+		log.Fatalf("NewNetInterface err : %v", err)
+	}
+	stack.AddInterface(ifc)
+	defer stack.Close()
+	if *gateway != "" {
+		stack.Routes.Add(tcpip.Route{
+			Dest:    tcpip.Iptobyte("0.0.0.0"),
+			Netmask: tcpip.Iptobyte("0.0.0.0"),
+			Gateway: tcpip.Iptobyte(*gateway),
+			Ifname:  *ifname,
+		})
+	}
+
+	pinger := tcpip.NewPinger(stack, dest.String())
+	pinger.Count = *count
+	pinger.Interval = *interval
+	pinger.Size = *size
+	pinger.Timeout = *timeout
+	pinger.TTL = byte(*ttl)
+	pinger.Ifname = *ifname
+	pinger.OnRecv = func(r tcpip.PingReply) {
+		var icmpErr *tcpip.ICMPError
+		if errors.As(r.Err, &icmpErr) {
+			fmt.Printf("From %s icmp_seq=%d %v\n", net.IP(r.From), r.Seq, r.Err)
+			return
+		}
+		fmt.Printf("%d bytes from %s: icmp_seq=%d ttl=%d time=%.3f ms\n", r.Size, net.IP(r.From), r.Seq, r.TTL, ms(r.RTT))
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	fmt.Printf("PING %s (%s) %d(%d) bytes of data.\n", dest, dest, *size, *size+28)
+	stats, err := pinger.Run(ctx)
+	if err != nil {
+		log.Printf("ping err : %v", err)
+	}
+
+	fmt.Printf("\n--- %s ping statistics ---\n", dest)
+	fmt.Printf("%d packets transmitted, %d received", stats.Transmitted, stats.Received)
+	if stats.Duplicates > 0 {
+		fmt.Printf(", +%d duplicates", stats.Duplicates)
+	}
+	if stats.Errors > 0 {
+		fmt.Printf(", +%d errors", stats.Errors)
+	}
+	fmt.Printf(", %.4g%% packet loss, time %dms\n", stats.Loss, stats.Time.Milliseconds())
+	if stats.Received > 0 {
+		fmt.Printf("rtt min/avg/max/mdev = %.3f/%.3f/%.3f/%.3f ms\n", ms(stats.Min), ms(stats.Avg), ms(stats.Max), ms(stats.Mdev))
+	}
+	if stats.Received == 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"tcpip"
+	"time"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: tcpipdump [options] [expression]\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, `
+expression:
+  [src|dst] host ADDR, [src|dst] net ADDR/LEN, [src|dst] port N,
+  tcp, udp, icmp, icmp6, igmp, ip, ip6, arp, tcpflags syn,ack, vlan [ID]
+  combined with and, or, not and parentheses
+`)
+}
+
+// source はキャプチャの読み込み元
+type source interface {
+	next() (time.Time, []byte, error)
+	close() error
+}
+
+// liveSource はAF_PACKETのソケットから読む
+type liveSource struct {
+	link *tcpip.RawLinkEndpoint
+}
+
+func (s *liveSource) next() (time.Time, []byte, error) {
+	frame, err := s.link.ReadFrame()
+	return time.Now(), frame, err
+}
+
+func (s *liveSource) close() error {
+	return s.link.Close()
+}
+
+// fileSource はpcapかpcapngのファイルから読む。Ethernet以外のリンクは飛ばす
+type fileSource struct {
+	f      *os.File
+	reader *tcpip.PcapReader
+}
+
+func (s *fileSource) next() (time.Time, []byte, error) {
+	for {
+		p, err := s.reader.Next()
+		if err != nil {
+			return time.Time{}, nil, err
+		}
+		if p.LinkType == tcpip.PcapLinkTypeEthernet {
+			return p.Timestamp, p.Data, nil
+		}
+	}
+}
+
+func (s *fileSource) close() error {
+	return s.f.Close()
+}
+
+func openLive(ifname string, filter *tcpip.PacketFilter, promisc, kernelFilter bool) (source, error) {
+	link, err := tcpip.NewRawLinkEndpoint(ifname)
+	if err != nil {
+		return nil, err
+	}
+	// ループバックは送ったフレームがそのまま受信にも見えるので、libpcapと同じく送信側は捨てる
+	if nif, err := net.InterfaceByName(ifname); err == nil && nif.Flags&net.FlagLoopback == 0 {
+		link.IncludeOutgoing = true
+	}
+	if promisc {
+		if err := link.SetPromiscuous(true); err != nil {
+			link.Close()
+			return nil, err
+		}
+	}
+	if kernelFilter {
+		prog, err := filter.BPF()
+		switch {
+		case errors.Is(err, tcpip.ErrFilterNotCompilable):
+			log.Printf("filter is applied in user space : %v", err)
+		case err != nil:
+			link.Close()
+			return nil, err
+		case prog != nil:
+			if err := link.AttachFilter(prog); err != nil {
+				link.Close()
+				return nil, err
+			}
+		}
+	}
+	return &liveSource{link: link}, nil
+}
+
+func openFile(name string) (source, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := tcpip.NewPcapReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileSource{f: f, reader: reader}, nil
+}
+
+// stats はCtrl-Cで止めたときにも表示するのでロックで守る
+type stats struct {
+	mu       sync.Mutex
+	received int
+	matched  int
+}
+
+func (s *stats) print() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(os.Stderr, "%d packets captured\n%d packets received\n", s.matched, s.received)
+}
+
+func main() {
+	ifname := flag.String("i", "", "capture from the interface with an AF_PACKET socket")
+	file := flag.String("r", "", "read packets from a pcap or pcapng file")
+	write := flag.String("w", "", "write matched packets to a pcapng file")
+	count := flag.Int("c", 0, "exit after receiving count matched packets (0 = unlimited)")
+	verbose := flag.Bool("v", false, "print the full decode tree of each packet")
+	jsonOut := flag.Bool("json", false, "print each packet as JSON")
+	noPromisc := flag.Bool("p", false, "don't put the interface into promiscuous mode")
+	noBPF := flag.Bool("nobpf", false, "don't attach the filter to the socket as classic BPF")
+	dumpBPF := flag.Bool("d", false, "print the compiled BPF program and exit")
+	flag.Usage = usage
+	flag.Parse()
+
+	filter, err := tcpip.ParsePacketFilter(strings.Join(flag.Args(), " "))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *dumpBPF {
+		prog, err := filter.BPF()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for i, ins := range prog {
+			fmt.Printf("(%03d) %v\n", i, ins)
+		}
+		return
+	}
+	if (*ifname == "") == (*file == "") {
+		usage()
+		os.Exit(2)
+	}
+
+	var src source
+	if *file != "" {
+		src, err = openFile(*file)
+	} else {
+		src, err = openLive(*ifname, filter, !*noPromisc, !*noBPF)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer src.close()
+
+	var out *tcpip.PcapngWriter
+	ifid := 0
+	if *write != "" {
+		f, err := os.Create(*write)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		if out, err = tcpip.NewPcapngWriter(f); err != nil {
+			log.Fatal(err)
+		}
+		name := *ifname
+		if name == "" {
+			name = *file
+		}
+		if ifid, err = out.AddInterface(name, tcpip.PcapLinkTypeEthernet); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var st stats
+	if *ifname != "" {
+		fmt.Fprintf(os.Stderr, "listening on %s\n", *ifname)
+		// ReadFrameはソケットを閉じても戻らないので、ここで終わる
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt)
+		go func() {
+			<-sig
+			st.print()
+			os.Exit(0)
+		}()
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for *count == 0 || st.matched < *count {
+		ts, data, err := src.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		p := tcpip.DecodePacket(data, tcpip.DecodeEthernet)
+		st.mu.Lock()
+		st.received++
+		matched := filter.Match(p)
+		if matched {
+			st.matched++
+		}
+		st.mu.Unlock()
+		if !matched {
+			continue
+		}
+
+		if out != nil {
+			if err := out.WritePacket(ifid, ts, data, tcpip.PcapDirectionUnknown); err != nil {
+				log.Fatal(err)
+			}
+			if !*verbose && !*jsonOut {
+				continue
+			}
+		}
+		switch {
+		case *jsonOut:
+			enc.Encode(struct {
+				Time   time.Time            `json:"time"`
+				Packet *tcpip.DecodedPacket `json:"packet"`
+			}{ts, p})
+		case *verbose:
+			fmt.Printf("%s %s\n%s\n", ts.Format("15:04:05.000000"), p.Summary(), p)
+		default:
+			fmt.Printf("%s %s\n", ts.Format("15:04:05.000000"), p.Summary())
+		}
+	}
+	if *ifname != "" {
+		st.print()
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"tcpip"
+	"time"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: traceroute [options] destination\n")
+	flag.PrintDefaults()
+}
+
+// Destination Unreachableのコードをtracerouteと同じ記号にする
+func unreachableMark(err error) string {
+	var icmpErr *tcpip.ICMPError
+	if !errors.As(err, &icmpErr) {
+		return ""
+	}
+	switch icmpErr.Code {
+	case tcpip.ICMPCodeNetUnreachable:
+		return " !N"
+	case tcpip.ICMPCodeHostUnreachable:
+		return " !H"
+	case tcpip.ICMPCodeProtocolUnreachable:
+		return " !P"
+	case tcpip.ICMPCodeFragmentationNeeded:
+		return " !F"
+	case tcpip.ICMPCodeAdminProhibited:
+		return " !X"
+	}
+	return fmt.Sprintf(" !<%d>", icmpErr.Code)
+}
+
+func main() {
+	method := flag.String("P", "udp", "probe method (udp, icmp or tcp)")
+	port := flag.Int("p", 0, "destination port (udp: base port 33434, tcp: 80)")
+	firstTTL := flag.Int("f", 1, "first TTL")
+	maxTTL := flag.Int("m", 30, "max TTL")
+	probes := flag.Int("q", 3, "number of probes per hop")
+	timeout := flag.Duration("w", 3*time.Second, "time to wait for a response")
+	paris := flag.Bool("paris", false, "keep flow identifiers constant (Paris traceroute)")
+	ifname := flag.String("I", "eth0", "source interface")
+	gateway := flag.String("g", "", "default gateway (only the connected network is reachable if empty)")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+	dest := net.ParseIP(flag.Arg(0)).To4()
+	if dest == nil {
+		log.Fatalf("destination must be an IPv4 address : %s", flag.Arg(0))
+	}
+
+	stack := tcpip.NewStack()
+	stack.IgnoreEcho = true
+	ifc, err := tcpip.NewNetInterface(*ifname)
+	if err != nil {
+		log.Fatalf("NewNetInterface err : %v", err)
+	}
+	stack.AddInterface(ifc)
+	defer stack.Close()
+	if *gateway != "" {
+		stack.Routes.Add(tcpip.Route{
+			Dest:    tcpip.Iptobyte("0.0.0.0"),
+			Netmask: tcpip.Iptobyte("0.0.0.0"),
+			Gateway: tcpip.Iptobyte(*gateway),
+			Ifname:  *ifname,
+		})
+	}
+
+	tr := tcpip.NewTracerouter(stack, dest.String())
+	tr.Method = strings.ToUpper(*method)
+	if *port != 0 {
+		tr.Port = uint16(*port)
+	} else if tr.Method == "TCP" {
+		tr.Port = 80
+	}
+	tr.FirstTTL = *firstTTL
+	tr.MaxTTL = *maxTTL
+	tr.Probes = *probes
+	tr.Timeout = *timeout
+	tr.Paris = *paris
+	tr.Ifname = *ifname
+
+	// 同じホップでアドレスが変わったときだけアドレスを表示する
+	var last []byte
+	tr.OnProbe = func(p tcpip.TracerouteProbe) {
+		if p.Probe == 0 {
+			fmt.Printf("%2d ", p.TTL)
+			last = nil
+		}
+		if p.From == nil {
+			fmt.Printf(" *")
+		} else {
+			if !net.IP(p.From).Equal(last) {
+				fmt.Printf(" %s ", net.IP(p.From))
+				last = p.From
+			}
+			fmt.Printf(" %.3f ms%s", float64(p.RTT)/float64(time.Millisecond), unreachableMark(p.Err))
+		}
+		if p.Probe == tr.Probes-1 {
+			fmt.Println()
+		}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	fmt.Printf("traceroute to %s (%s), %d hops max\n", dest, dest, *maxTTL)
+	if _, err := tr.Run(ctx); err != nil {
+		log.Fatalf("traceroute err : %v", err)
+	}
+}
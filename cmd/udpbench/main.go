@@ -0,0 +1,325 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"tcpip"
+	"time"
+)
+
+// result は1つの送り方で測った結果
+type result struct {
+	name     string
+	sent     int
+	received int
+	elapsed  time.Duration
+}
+
+func (r result) String() string {
+	sec := r.elapsed.Seconds()
+	return fmt.Sprintf("%-22s sent %8d  recv %8d  loss %5.1f%%  %10.0f pkt/s  %8.1f Mbit/s",
+		r.name, r.sent, r.received, 100*float64(r.sent-r.received)/float64(r.sent),
+		float64(r.received)/sec, float64(r.received*size*8)/sec/1e6)
+}
+
+var (
+	count = flag.Int("n", 200000, "number of datagrams to send in each run")
+	size  = 0
+	batch = flag.Int("b", 64, "number of datagrams per batch")
+)
+
+func main() {
+	path := flag.String("path", "all", "which path to measure: kernel, stack or all")
+	flag.IntVar(&size, "s", 1200, "datagram payload size")
+	flag.Parse()
+
+	if *path == "kernel" || *path == "all" {
+		fmt.Println("kernel UDP socket (127.0.0.1)")
+		for _, run := range []struct {
+			name string
+			send func(c *tcpip.KernelUDPConn, dst *net.UDPAddr) error
+			recv func(c *tcpip.KernelUDPConn) func() (int, error)
+			gro  bool
+		}{
+			{"sendto/recvfrom", kernelSendEach, kernelRecvEach, false},
+			{"sendmmsg/recvmmsg", kernelSendBatch, kernelRecvBatch, false},
+			{"GSO/GRO", kernelSendGSO, kernelRecvBatch, true},
+		} {
+			r, err := benchKernel(run.name, run.send, run.recv, run.gro)
+			if err != nil {
+				log.Printf("%s : %v", run.name, err)
+				continue
+			}
+			fmt.Println(r)
+		}
+	}
+	if *path == "stack" || *path == "all" {
+		fmt.Println("userspace stack (channel link)")
+		for _, run := range []struct {
+			name string
+			send func(c *tcpip.UDPConn) error
+			recv func(c *tcpip.UDPConn) func() (int, error)
+			gro  bool
+		}{
+			{"WriteTo/ReadFrom", stackSendEach, stackRecvEach, false},
+			{"WriteBatch/ReadBatch", stackSendBatch, stackRecvBatch, false},
+			{"GSO/GRO", stackSendGSO, stackRecvBatch, true},
+		} {
+			r, err := benchStack(run.name, run.send, run.recv, run.gro)
+			if err != nil {
+				log.Printf("%s : %v", run.name, err)
+				continue
+			}
+			fmt.Println(r)
+		}
+	}
+}
+
+type received struct {
+	count int
+	last  time.Time
+}
+
+// receive は全部受け取るかタイムアウトするまで受け取って、受け取った数と最後に受け取った時刻を返す
+func receive(recv func() (int, error), done chan<- received) {
+	var r received
+	for r.count < *count {
+		n, err := recv()
+		if err != nil {
+			break
+		}
+		r.count += n
+		r.last = time.Now()
+	}
+	done <- r
+}
+
+func newResult(name string, start time.Time, r received) result {
+	return result{name: name, sent: *count, received: r.count, elapsed: r.last.Sub(start)}
+}
+
+func benchKernel(name string, send func(*tcpip.KernelUDPConn, *net.UDPAddr) error,
+	recv func(*tcpip.KernelUDPConn) func() (int, error), gro bool) (result, error) {
+	rx, err := tcpip.NewKernelUDPConn(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return result{}, err
+	}
+	defer rx.Close()
+	tx, err := tcpip.NewKernelUDPConn(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return result{}, err
+	}
+	defer tx.Close()
+	if gro {
+		if err := rx.EnableGRO(); err != nil {
+			return result{}, err
+		}
+	}
+	rx.SetReadTimeout(500 * time.Millisecond)
+	// 受信側が追いつかずに捨てられないように受信バッファを大きくする
+	rx.SetReadBuffer(16 << 20)
+
+	done := make(chan received)
+	go receive(recv(rx), done)
+	start := time.Now()
+	if err := send(tx, rx.LocalAddr().(*net.UDPAddr)); err != nil {
+		return result{}, err
+	}
+	return newResult(name, start, <-done), nil
+}
+
+func kernelSendEach(c *tcpip.KernelUDPConn, dst *net.UDPAddr) error {
+	buf := make([]byte, size)
+	for i := 0; i < *count; i++ {
+		if _, err := c.WriteTo(buf, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func kernelRecvEach(c *tcpip.KernelUDPConn) func() (int, error) {
+	buf := make([]byte, 65536)
+	return func() (int, error) {
+		if _, _, err := c.ReadFrom(buf); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+}
+
+func kernelSendBatch(c *tcpip.KernelUDPConn, dst *net.UDPAddr) error {
+	msgs := make([]tcpip.UDPMessage, *batch)
+	for i := range msgs {
+		msgs[i] = tcpip.UDPMessage{Buffer: make([]byte, size), Addr: dst}
+	}
+	for sent := 0; sent < *count; sent += len(msgs) {
+		if rest := *count - sent; rest < len(msgs) {
+			msgs = msgs[:rest]
+		}
+		if _, err := c.WriteBatch(msgs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func kernelSendGSO(c *tcpip.KernelUDPConn, dst *net.UDPAddr) error {
+	// 1つのsendmmsgに64KBまでのバッファをいくつか入れる
+	perBuffer := 65000 / size
+	msgs := make([]tcpip.UDPMessage, 0, *batch)
+	for sent := 0; sent < *count; {
+		msgs = msgs[:0]
+		for len(msgs) < cap(msgs) && sent < *count {
+			n := perBuffer
+			if rest := *count - sent; rest < n {
+				n = rest
+			}
+			msgs = append(msgs, tcpip.UDPMessage{Buffer: make([]byte, n*size), Addr: dst, SegmentSize: size})
+			sent += n
+		}
+		if _, err := c.WriteBatch(msgs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func kernelRecvBatch(c *tcpip.KernelUDPConn) func() (int, error) {
+	msgs := newRecvMessages()
+	return func() (int, error) {
+		n, err := c.ReadBatch(msgs)
+		if err != nil {
+			return 0, err
+		}
+		return countDatagrams(msgs[:n]), nil
+	}
+}
+
+func newRecvMessages() []tcpip.UDPMessage {
+	msgs := make([]tcpip.UDPMessage, *batch)
+	for i := range msgs {
+		msgs[i].Buffer = make([]byte, 65536)
+	}
+	return msgs
+}
+
+// countDatagrams はGROでまとめられたものも含めてデータグラムの数を数える
+func countDatagrams(msgs []tcpip.UDPMessage) int {
+	total := 0
+	for _, m := range msgs {
+		if m.SegmentSize > 0 {
+			total += (m.N + m.SegmentSize - 1) / m.SegmentSize
+		} else {
+			total++
+		}
+	}
+	return total
+}
+
+func benchStack(name string, send func(*tcpip.UDPConn) error, recv func(*tcpip.UDPConn) func() (int, error), gro bool) (result, error) {
+	la, lb := tcpip.NewChannelLinkPair(1500)
+	a, b := tcpip.NewStack(), tcpip.NewStack()
+	a.AddInterface(&tcpip.NetInterface{Name: "a0", MacAddr: []byte{0x02, 0, 0, 0, 0, 0x01},
+		IpAddr: tcpip.Iptobyte("10.0.0.1"), Netmask: tcpip.Iptobyte("255.255.255.0"), Link: la})
+	b.AddInterface(&tcpip.NetInterface{Name: "b0", MacAddr: []byte{0x02, 0, 0, 0, 0, 0x02},
+		IpAddr: tcpip.Iptobyte("10.0.0.2"), Netmask: tcpip.Iptobyte("255.255.255.0"), Link: lb})
+	defer a.Close()
+	defer b.Close()
+
+	rx, err := b.ListenUDP(&net.UDPAddr{Port: 9000})
+	if err != nil {
+		return result{}, err
+	}
+	defer rx.Close()
+	rx.GRO = gro
+	// 受信側が追いつかずに捨てられないように全部溜めておけるようにする
+	rx.SetReadBuffer(*count * size)
+	tx, err := a.DialUDP(nil, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 9000})
+	if err != nil {
+		return result{}, err
+	}
+	defer tx.Close()
+
+	// ARPを解決しておく
+	tx.Write([]byte("warmup"))
+	rx.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, _, err := rx.ReadFrom(make([]byte, 16)); err != nil {
+		return result{}, err
+	}
+
+	done := make(chan received)
+	read := recv(rx)
+	go receive(func() (int, error) {
+		rx.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		return read()
+	}, done)
+	start := time.Now()
+	if err := send(tx); err != nil {
+		return result{}, err
+	}
+	return newResult(name, start, <-done), nil
+}
+
+func stackSendEach(c *tcpip.UDPConn) error {
+	buf := make([]byte, size)
+	for i := 0; i < *count; i++ {
+		if _, err := c.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func stackRecvEach(c *tcpip.UDPConn) func() (int, error) {
+	buf := make([]byte, 65536)
+	return func() (int, error) {
+		if _, _, err := c.ReadFrom(buf); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+}
+
+func stackSendBatch(c *tcpip.UDPConn) error {
+	msgs := make([]tcpip.UDPMessage, *batch)
+	for i := range msgs {
+		msgs[i] = tcpip.UDPMessage{Buffer: make([]byte, size)}
+	}
+	for sent := 0; sent < *count; sent += len(msgs) {
+		if rest := *count - sent; rest < len(msgs) {
+			msgs = msgs[:rest]
+		}
+		if _, err := c.WriteBatch(msgs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func stackSendGSO(c *tcpip.UDPConn) error {
+	for sent := 0; sent < *count; sent += *batch {
+		n := *batch
+		if rest := *count - sent; rest < n {
+			n = rest
+		}
+		msg := []tcpip.UDPMessage{{Buffer: make([]byte, n*size), SegmentSize: size}}
+		if _, err := c.WriteBatch(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func stackRecvBatch(c *tcpip.UDPConn) func() (int, error) {
+	msgs := newRecvMessages()
+	return func() (int, error) {
+		n, err := c.ReadBatch(msgs)
+		if err != nil {
+			return 0, err
+		}
+		return countDatagrams(msgs[:n]), nil
+	}
+}
@@ -0,0 +1,469 @@
+package tcpip
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConnTuple は接続の片方向の5-tuple
+// ICMPのEchoはIdentifierを送信元と宛先の両方のポートに入れる
+type ConnTuple struct {
+	Protocol   byte
+	SourceAddr [4]byte
+	DestAddr   [4]byte
+	SourcePort uint16
+	DestPort   uint16
+}
+
+// Inverse は逆向きのパケットのタプルを返す
+func (t ConnTuple) Inverse() ConnTuple {
+	return ConnTuple{
+		Protocol:   t.Protocol,
+		SourceAddr: t.DestAddr,
+		DestAddr:   t.SourceAddr,
+		SourcePort: t.DestPort,
+		DestPort:   t.SourcePort,
+	}
+}
+
+func (t ConnTuple) String() string {
+	name := ipProtocolNames[t.Protocol]
+	if t.Protocol == IPProtoICMP {
+		return fmt.Sprintf("%s src=%s dst=%s id=%d", name, net.IP(t.SourceAddr[:]), net.IP(t.DestAddr[:]), t.SourcePort)
+	}
+	return fmt.Sprintf("%s src=%s dst=%s sport=%d dport=%d", name,
+		net.IP(t.SourceAddr[:]), net.IP(t.DestAddr[:]), t.SourcePort, t.DestPort)
+}
+
+// packetTuple はIPパケットのタプルを取り出す
+// 追跡するのはTCP, UDPとICMPのEchoだけで、2番目以降のフラグメントはtrackFragmentで最初のフラグメントの接続に入れる
+func packetTuple(packet []byte) (ConnTuple, bool) {
+	hlen := ipHeaderLength(packet)
+	if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+		return ConnTuple{}, false
+	}
+	t := ConnTuple{Protocol: packet[9]}
+	copy(t.SourceAddr[:], packet[12:16])
+	copy(t.DestAddr[:], packet[16:20])
+	l4 := packet[hlen:]
+	// ICMPエラーに引用されたパケットも読めるように、先頭の8byteだけあればよい
+	switch t.Protocol {
+	case IPProtoTCP, IPProtoUDP:
+		if len(l4) < 8 {
+			return ConnTuple{}, false
+		}
+	case IPProtoICMP:
+		if len(l4) < 8 || (l4[0] != ICMPTypeEchoRequest && l4[0] != ICMPTypeEchoReply) {
+			return ConnTuple{}, false
+		}
+		id := binary.BigEndian.Uint16(l4[4:6])
+		t.SourcePort, t.DestPort = id, id
+		return t, true
+	default:
+		return ConnTuple{}, false
+	}
+	t.SourcePort = binary.BigEndian.Uint16(l4[0:2])
+	t.DestPort = binary.BigEndian.Uint16(l4[2:4])
+	return t, true
+}
+
+// fragmentKey は同じIPパケットから分かれたフラグメントを見分ける
+type fragmentKey struct {
+	protocol   byte
+	sourceAddr [4]byte
+	destAddr   [4]byte
+	id         uint16
+}
+
+func newFragmentKey(packet []byte) fragmentKey {
+	k := fragmentKey{protocol: packet[9], id: binary.BigEndian.Uint16(packet[4:6])}
+	copy(k.sourceAddr[:], packet[12:16])
+	copy(k.destAddr[:], packet[16:20])
+	return k
+}
+
+// trackedFragment は最初のフラグメントが属していた接続
+type trackedFragment struct {
+	conn    *trackedConn
+	reply   bool
+	expires time.Time
+}
+
+// 最初のフラグメントの接続を覚えておく時間。Linuxのipfrag_timeと同じ
+const fragmentTimeout = 30 * time.Second
+
+// ConnState は追跡している接続の状態
+type ConnState int
+
+const (
+	ConnStateSynSent ConnState = iota
+	ConnStateSynRecv
+	ConnStateEstablished
+	ConnStateFinWait
+	ConnStateTimeWait
+	ConnStateClose
+	// UDPとICMPで、返事をまだ見ていない
+	ConnStateUnreplied
+	ConnStateReplied
+)
+
+var connStateNames = map[ConnState]string{
+	ConnStateSynSent:     "SYN_SENT",
+	ConnStateSynRecv:     "SYN_RECV",
+	ConnStateEstablished: "ESTABLISHED",
+	ConnStateFinWait:     "FIN_WAIT",
+	ConnStateTimeWait:    "TIME_WAIT",
+	ConnStateClose:       "CLOSE",
+	ConnStateUnreplied:   "UNREPLIED",
+	ConnStateReplied:     "REPLIED",
+}
+
+func (s ConnState) String() string {
+	return connStateNames[s]
+}
+
+// ConnTimeouts は状態ごとに、パケットが来なくなってから接続を忘れるまでの時間
+type ConnTimeouts struct {
+	TCPSynSent     time.Duration
+	TCPSynRecv     time.Duration
+	TCPEstablished time.Duration
+	TCPFinWait     time.Duration
+	TCPTimeWait    time.Duration
+	TCPClose       time.Duration
+	UDPUnreplied   time.Duration
+	UDPReplied     time.Duration
+	ICMP           time.Duration
+}
+
+// DefaultConnTimeouts はLinuxのnf_conntrackの初期値に合わせている
+var DefaultConnTimeouts = ConnTimeouts{
+	TCPSynSent:     2 * time.Minute,
+	TCPSynRecv:     60 * time.Second,
+	TCPEstablished: 5 * 24 * time.Hour,
+	TCPFinWait:     2 * time.Minute,
+	TCPTimeWait:    2 * time.Minute,
+	TCPClose:       10 * time.Second,
+	UDPUnreplied:   30 * time.Second,
+	UDPReplied:     180 * time.Second,
+	ICMP:           30 * time.Second,
+}
+
+func (c ConnTimeouts) timeout(proto byte, state ConnState) time.Duration {
+	switch {
+	case proto == IPProtoICMP:
+		return c.ICMP
+	case state == ConnStateUnreplied:
+		return c.UDPUnreplied
+	case state == ConnStateReplied:
+		return c.UDPReplied
+	case state == ConnStateSynSent:
+		return c.TCPSynSent
+	case state == ConnStateSynRecv:
+		return c.TCPSynRecv
+	case state == ConnStateEstablished:
+		return c.TCPEstablished
+	case state == ConnStateFinWait:
+		return c.TCPFinWait
+	case state == ConnStateTimeWait:
+		return c.TCPTimeWait
+	}
+	return c.TCPClose
+}
+
+// ConnEntry は追跡している接続のスナップショット
+// Originalは最初のパケットの変換前、Replyは返事が変換前に持っているタプル
+type ConnEntry struct {
+	Original ConnTuple
+	Reply    ConnTuple
+	State    ConnState
+	Expires  time.Time
+}
+
+func (e ConnEntry) String() string {
+	return fmt.Sprintf("%s %s [%s] expires in %s", e.Original, e.Reply, e.State, time.Until(e.Expires).Round(time.Second))
+}
+
+type trackedConn struct {
+	orig, reply ConnTuple
+	state       ConnState
+	expires     time.Time
+	// TCPのFINをそれぞれの方向で見たか
+	finOrig, finReply bool
+}
+
+// newConnState は最初のパケットから状態を決める
+// 途中から見えたTCPの接続も(LinuxのTCP looseと同じく)確立済みとして追跡する
+func newConnState(proto byte, l4 []byte) ConnState {
+	if proto != IPProtoTCP {
+		return ConnStateUnreplied
+	}
+	flags := l4[13]
+	switch {
+	case flags&RST != 0:
+		return ConnStateClose
+	case flags&SYN != 0 && flags&ACK == 0:
+		return ConnStateSynSent
+	}
+	return ConnStateEstablished
+}
+
+// update はパケットを見て状態を進める
+func (c *trackedConn) update(reply bool, l4 []byte) {
+	if c.orig.Protocol != IPProtoTCP {
+		if reply {
+			c.state = ConnStateReplied
+		}
+		return
+	}
+	flags := l4[13]
+	switch {
+	case flags&RST != 0:
+		c.state = ConnStateClose
+		return
+	case flags&SYN != 0 && flags&ACK != 0 && reply && c.state == ConnStateSynSent:
+		c.state = ConnStateSynRecv
+	case flags&ACK != 0 && !reply && c.state == ConnStateSynRecv:
+		c.state = ConnStateEstablished
+	}
+	if flags&FIN != 0 {
+		if reply {
+			c.finReply = true
+		} else {
+			c.finOrig = true
+		}
+		c.state = ConnStateFinWait
+	}
+	if c.finOrig && c.finReply && flags&ACK != 0 && flags&FIN == 0 {
+		c.state = ConnStateTimeWait
+	}
+}
+
+func (c *trackedConn) entry() ConnEntry {
+	return ConnEntry{Original: c.orig, Reply: c.reply, State: c.state, Expires: c.expires}
+}
+
+// ConnTrackState はファイアウォールのルールで見る、パケットの接続の中での状態
+type ConnTrackState uint8
+
+const (
+	// 接続の最初のパケット
+	CTStateNew ConnTrackState = 1 << iota
+	// 追跡している接続のパケット。返事の方向の最初のパケットも含む
+	CTStateEstablished
+	// 追跡している接続へのICMPエラー
+	CTStateRelated
+	// どの接続にも属さないICMPエラーや、Echoの返事
+	CTStateInvalid
+	// 追跡しないプロトコルと、マルチキャスト、ブロードキャスト
+	CTStateUntracked
+)
+
+// ConnTrack は接続を追跡する表。NATとファイアウォールが使う
+// 接続は最初の方向と返事の方向の両方のタプルで引ける
+type ConnTrack struct {
+	Timeouts ConnTimeouts
+
+	mu    sync.Mutex
+	conns map[ConnTuple]*trackedConn
+	// 後から来るフラグメントのために、最初のフラグメントの接続を覚えておく
+	frags  map[fragmentKey]*trackedFragment
+	lastGC time.Time
+}
+
+// 期限切れの接続をまとめて消す間隔
+const connGCInterval = 10 * time.Second
+
+func NewConnTrack() *ConnTrack {
+	return &ConnTrack{
+		Timeouts: DefaultConnTimeouts,
+		conns:    make(map[ConnTuple]*trackedConn),
+		frags:    make(map[fragmentKey]*trackedFragment),
+	}
+}
+
+// Conns は追跡している接続の一覧を返す
+func (ct *ConnTrack) Conns() []ConnEntry {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	now := time.Now()
+	var entries []ConnEntry
+	for t, c := range ct.conns {
+		if t == c.orig && now.Before(c.expires) {
+			entries = append(entries, c.entry())
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Original.String() < entries[j].Original.String()
+	})
+	return entries
+}
+
+// Flush は追跡している接続を全部忘れる
+func (ct *ConnTrack) Flush() {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.conns = make(map[ConnTuple]*trackedConn)
+	ct.frags = make(map[fragmentKey]*trackedFragment)
+}
+
+func (ct *ConnTrack) lookup(t ConnTuple, now time.Time) (*trackedConn, bool) {
+	c, ok := ct.conns[t]
+	if !ok {
+		return nil, false
+	}
+	if now.After(c.expires) {
+		ct.remove(c)
+		return nil, false
+	}
+	return c, t == c.reply
+}
+
+func (ct *ConnTrack) remove(c *trackedConn) {
+	delete(ct.conns, c.orig)
+	delete(ct.conns, c.reply)
+}
+
+func (ct *ConnTrack) gc(now time.Time) {
+	if now.Sub(ct.lastGC) < connGCInterval {
+		return
+	}
+	ct.lastGC = now
+	for _, c := range ct.conns {
+		if now.After(c.expires) {
+			ct.remove(c)
+		}
+	}
+	for k, f := range ct.frags {
+		if now.After(f.expires) {
+			delete(ct.frags, k)
+		}
+	}
+}
+
+// connRef はパケットが属する接続。ファイアウォールとNATのフックの間で受け渡す
+type connRef struct {
+	conn  *trackedConn
+	reply bool
+	// まだ表に入れていない新しい接続
+	isNew bool
+	// 接続へのICMPエラー
+	related bool
+	state   ConnTrackState
+	// 変換前のパケット。ルータが返すICMPエラーではこちらを引用する
+	original []byte
+}
+
+// track はパケットが属する接続を探して状態を進める
+// 新しい接続はconfirmするまで表に入れない
+func (ct *ConnTrack) track(packet []byte) *connRef {
+	ref := &connRef{original: packet, state: CTStateUntracked}
+	hlen := ipHeaderLength(packet)
+	if packet[9] == IPProtoICMP && len(packet) > hlen && isICMPErrorType(packet[hlen]) {
+		ref.state = CTStateInvalid
+		inner := packet[hlen:]
+		if len(inner) < 8+20 || inner[8]>>4 != 4 || len(inner) < 8+ipHeaderLength(inner[8:])+8 {
+			return ref
+		}
+		// 引用されているのは逆向きに送ったパケット
+		t, ok := packetTuple(inner[8:])
+		if !ok {
+			return ref
+		}
+		ct.mu.Lock()
+		defer ct.mu.Unlock()
+		if c, reply := ct.lookup(t.Inverse(), time.Now()); c != nil {
+			ref.conn, ref.reply, ref.related, ref.state = c, reply, true, CTStateRelated
+		}
+		return ref
+	}
+	if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+		return ct.trackFragment(packet, ref)
+	}
+	t, ok := packetTuple(packet)
+	if !ok {
+		return ref
+	}
+	l4 := packet[hlen:]
+	if t.Protocol == IPProtoTCP && len(l4) < 20 {
+		ref.state = CTStateInvalid
+		return ref
+	}
+
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	now := time.Now()
+	c, reply := ct.lookup(t, now)
+	// 閉じた接続と同じタプルで新しいSYNが来たら、作り直す
+	if c != nil && !reply && t.Protocol == IPProtoTCP && l4[13]&(SYN|ACK) == SYN &&
+		(c.state == ConnStateTimeWait || c.state == ConnStateClose) {
+		ct.remove(c)
+		c = nil
+	}
+	if c != nil {
+		c.update(reply, l4)
+		c.expires = now.Add(ct.Timeouts.timeout(t.Protocol, c.state))
+		ref.conn, ref.reply, ref.state = c, reply, CTStateEstablished
+		ct.rememberFragment(packet, ref, now)
+		return ref
+	}
+	// 返事のEchoからは接続を作らない
+	if t.Protocol == IPProtoICMP && l4[0] != ICMPTypeEchoRequest {
+		ref.state = CTStateInvalid
+		return ref
+	}
+	ref.conn = &trackedConn{orig: t, reply: t.Inverse(), state: newConnState(t.Protocol, l4)}
+	ref.isNew, ref.state = true, CTStateNew
+	ct.rememberFragment(packet, ref, now)
+	return ref
+}
+
+// rememberFragment は後ろにフラグメントが続く最初のフラグメントなら、その接続を覚えておく。ct.muを持って呼ぶ
+func (ct *ConnTrack) rememberFragment(packet []byte, ref *connRef, now time.Time) {
+	if packet[6]&0x20 == 0 {
+		return
+	}
+	ct.frags[newFragmentKey(packet)] = &trackedFragment{conn: ref.conn, reply: ref.reply, expires: now.Add(fragmentTimeout)}
+}
+
+// trackFragment は2番目以降のフラグメントを、最初のフラグメントと同じ接続に入れる
+// NATは最初のフラグメントと同じようにアドレスを書き換える
+// 最初のフラグメントより先に届いたものや、最初のフラグメントの接続が表に入らなかったものは追跡しない
+func (ct *ConnTrack) trackFragment(packet []byte, ref *connRef) *connRef {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	f, ok := ct.frags[newFragmentKey(packet)]
+	if !ok || time.Now().After(f.expires) || ct.conns[f.conn.orig] != f.conn {
+		return ref
+	}
+	ref.conn, ref.reply, ref.state = f.conn, f.reply, CTStateEstablished
+	return ref
+}
+
+// confirm は新しい接続を表に入れる
+// 返事のタプルがほかの接続と重なって区別できないときはfalseを返す
+func (ct *ConnTrack) confirm(ref *connRef) bool {
+	if ref == nil || !ref.isNew {
+		return true
+	}
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	now := time.Now()
+	c := ref.conn
+	if other, _ := ct.lookup(c.orig, now); other != nil {
+		// 同じ接続の最初のパケットが続けて来た
+		return true
+	}
+	if other, _ := ct.lookup(c.reply, now); other != nil {
+		return false
+	}
+	ct.gc(now)
+	c.expires = now.Add(ct.Timeouts.timeout(c.orig.Protocol, c.state))
+	ct.conns[c.orig] = c
+	ct.conns[c.reply] = c
+	ref.isNew = false
+	return true
+}
@@ -0,0 +1,265 @@
+package tcpip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	DHCPServerPort = 67
+	DHCPClientPort = 68
+)
+
+const (
+	DHCPOpRequest = 1
+	DHCPOpReply   = 2
+)
+
+// DHCPメッセージの種類(option 53, RFC2132 9.6)
+const (
+	DHCPDiscover = 1
+	DHCPOffer    = 2
+	DHCPRequest  = 3
+	DHCPDecline  = 4
+	DHCPAck      = 5
+	DHCPNak      = 6
+	DHCPRelease  = 7
+	DHCPInform   = 8
+)
+
+// DHCPのオプション(RFC2132)
+const (
+	DHCPOptPad            = 0
+	DHCPOptSubnetMask     = 1
+	DHCPOptRouter         = 3
+	DHCPOptDNSServer      = 6
+	DHCPOptHostName       = 12
+	DHCPOptDomainName     = 15
+	DHCPOptBroadcastAddr  = 28
+	DHCPOptRequestedIP    = 50
+	DHCPOptLeaseTime      = 51
+	DHCPOptOverload       = 52
+	DHCPOptMessageType    = 53
+	DHCPOptServerID       = 54
+	DHCPOptParameterList  = 55
+	DHCPOptMessage        = 56
+	DHCPOptMaxMessageSize = 57
+	DHCPOptRenewalTime    = 58
+	DHCPOptRebindingTime  = 59
+	DHCPOptClientID       = 61
+	DHCPOptEnd            = 255
+)
+
+// Flagsの先頭のbit。返事をブロードキャストで送ってもらう
+const dhcpFlagBroadcast = 0x8000
+
+// BOOTPのリレーエージェントが受け取れる最小の長さ(RFC1542 2.1)
+const dhcpMinMessageLength = 300
+
+var dhcpMagicCookie = []byte{0x63, 0x82, 0x53, 0x63}
+
+var ErrInvalidDHCP = errors.New("invalid dhcp message")
+
+// DHCPMessage はDHCP(BOOTP)のメッセージ
+// https://datatracker.ietf.org/doc/html/rfc2131#section-2
+type DHCPMessage struct {
+	Op     []byte
+	HType  []byte
+	HLen   []byte
+	Hops   []byte
+	XID    []byte
+	Secs   []byte
+	Flags  []byte
+	CIAddr []byte
+	YIAddr []byte
+	SIAddr []byte
+	GIAddr []byte
+	CHAddr []byte
+	SName  []byte
+	File   []byte
+	// 99.130.83.99
+	MagicCookie []byte
+	Options     []byte
+}
+
+// DHCPOption はオプションを1つ作るときに使う
+type DHCPOption struct {
+	Code byte
+	Data []byte
+}
+
+// NewDHCPMessage はchaddrのMACアドレスを入れたメッセージを作る
+// アドレスは0.0.0.0にしておくので、必要なものは後から入れる
+func NewDHCPMessage(op byte, xid, chaddr []byte, options []DHCPOption) DHCPMessage {
+	m := DHCPMessage{
+		Op:          []byte{op},
+		HType:       []byte{0x01},
+		HLen:        []byte{byte(len(chaddr))},
+		Hops:        []byte{0x00},
+		XID:         xid,
+		Secs:        []byte{0x00, 0x00},
+		Flags:       []byte{0x00, 0x00},
+		CIAddr:      []byte{0x00, 0x00, 0x00, 0x00},
+		YIAddr:      []byte{0x00, 0x00, 0x00, 0x00},
+		SIAddr:      []byte{0x00, 0x00, 0x00, 0x00},
+		GIAddr:      []byte{0x00, 0x00, 0x00, 0x00},
+		CHAddr:      make([]byte, 16),
+		SName:       make([]byte, 64),
+		File:        make([]byte, 128),
+		MagicCookie: dhcpMagicCookie,
+	}
+	copy(m.CHAddr, chaddr)
+	m.Options = encodeDHCPOptions(options)
+	if n := int(toByteLen(m)); n < dhcpMinMessageLength {
+		m.Options = append(m.Options, make([]byte, dhcpMinMessageLength-n)...)
+	}
+	return m
+}
+
+// encodeDHCPOptions はオプションを並べて最後にEndを付ける
+// 255byteより長いデータは同じコードのオプションに分ける(RFC3396)
+func encodeDHCPOptions(options []DHCPOption) []byte {
+	var b []byte
+	for _, opt := range options {
+		data := opt.Data
+		for {
+			n := len(data)
+			if n > 255 {
+				n = 255
+			}
+			b = append(b, opt.Code, byte(n))
+			b = append(b, data[:n]...)
+			data = data[n:]
+			if len(data) == 0 {
+				break
+			}
+		}
+	}
+	return append(b, DHCPOptEnd)
+}
+
+func ParseDHCPMessage(b []byte) (DHCPMessage, error) {
+	if len(b) < 240 || !bytes.Equal(b[236:240], dhcpMagicCookie) {
+		return DHCPMessage{}, ErrInvalidDHCP
+	}
+	m := DHCPMessage{
+		Op:          b[0:1],
+		HType:       b[1:2],
+		HLen:        b[2:3],
+		Hops:        b[3:4],
+		XID:         b[4:8],
+		Secs:        b[8:10],
+		Flags:       b[10:12],
+		CIAddr:      b[12:16],
+		YIAddr:      b[16:20],
+		SIAddr:      b[20:24],
+		GIAddr:      b[24:28],
+		CHAddr:      b[28:44],
+		SName:       b[44:108],
+		File:        b[108:236],
+		MagicCookie: b[236:240],
+		Options:     b[240:],
+	}
+	if m.HLen[0] > 16 {
+		return DHCPMessage{}, ErrInvalidDHCP
+	}
+	if _, err := m.options(); err != nil {
+		return DHCPMessage{}, err
+	}
+	return m, nil
+}
+
+// options はオプションをコードごとにまとめる
+// 同じコードが何回も出てきたらつなげ(RFC3396)、option 52があればfileとsnameの中も読む
+func (m DHCPMessage) options() (map[byte][]byte, error) {
+	opts := make(map[byte][]byte)
+	if err := parseDHCPOptions(m.Options, opts); err != nil {
+		return nil, err
+	}
+	if overload, ok := opts[DHCPOptOverload]; ok && len(overload) == 1 {
+		if overload[0]&0x01 != 0 {
+			if err := parseDHCPOptions(m.File, opts); err != nil {
+				return nil, err
+			}
+		}
+		if overload[0]&0x02 != 0 {
+			if err := parseDHCPOptions(m.SName, opts); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return opts, nil
+}
+
+func parseDHCPOptions(b []byte, opts map[byte][]byte) error {
+	for i := 0; i < len(b); {
+		code := b[i]
+		switch code {
+		case DHCPOptPad:
+			i++
+			continue
+		case DHCPOptEnd:
+			return nil
+		}
+		if i+2 > len(b) || i+2+int(b[i+1]) > len(b) {
+			return ErrInvalidDHCP
+		}
+		data := b[i+2 : i+2+int(b[i+1])]
+		opts[code] = append(opts[code], data...)
+		i += 2 + len(data)
+	}
+	return nil
+}
+
+// Option はcodeのオプションのデータを返す。なければnil
+func (m DHCPMessage) Option(code byte) []byte {
+	opts, err := m.options()
+	if err != nil {
+		return nil
+	}
+	return opts[code]
+}
+
+// MessageType はoption 53のメッセージの種類を返す。なければ0(BOOTP)
+func (m DHCPMessage) MessageType() byte {
+	if t := m.Option(DHCPOptMessageType); len(t) == 1 {
+		return t[0]
+	}
+	return 0
+}
+
+// HardwareAddr はchaddrのMACアドレスを返す
+func (m DHCPMessage) HardwareAddr() net.HardwareAddr {
+	return net.HardwareAddr(m.CHAddr[:m.HLen[0]])
+}
+
+// Broadcast は返事をブロードキャストで送ってほしいならtrue
+func (m DHCPMessage) Broadcast() bool {
+	return binary.BigEndian.Uint16(m.Flags)&dhcpFlagBroadcast != 0
+}
+
+// dhcpOptionAddrs はアドレスが並んだオプションを読む
+func dhcpOptionAddrs(b []byte) []net.IP {
+	var addrs []net.IP
+	for i := 0; i+4 <= len(b); i += 4 {
+		addrs = append(addrs, net.IP(append([]byte{}, b[i:i+4]...)))
+	}
+	return addrs
+}
+
+// dhcpOptionDuration は秒数のオプションを読む。なければ0
+func dhcpOptionDuration(b []byte) time.Duration {
+	if len(b) != 4 {
+		return 0
+	}
+	return time.Duration(binary.BigEndian.Uint32(b)) * time.Second
+}
+
+func dhcpDurationOption(code byte, d time.Duration) DHCPOption {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(d/time.Second))
+	return DHCPOption{Code: code, Data: b}
+}
@@ -0,0 +1,530 @@
+package tcpip
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DISCOVERとREQUESTを送り直す間隔の最初と最大(RFC2131 4.1)
+	dhcpInitialRetransmit = 4 * time.Second
+	dhcpMaxRetransmit     = 64 * time.Second
+	// SELECTINGでREQUESTを送る回数。返事がなければDISCOVERからやり直す
+	dhcpRequestAttempts = 4
+	// RENEWINGとREBINDINGで送り直す間隔の最小(RFC2131 4.4.5)
+	dhcpMinRenewRetransmit = 60 * time.Second
+	// 借りたアドレスを使っている人がいないかARPの返事を待つ時間
+	dhcpProbeWait = time.Second
+	// DECLINEしたあと最初からやり直すまで待つ時間(RFC2131 3.1)
+	dhcpDeclineDelay = 10 * time.Second
+)
+
+var (
+	ErrDHCPNak     = errors.New("dhcp server refused the request")
+	ErrDHCPTimeout = errors.New("dhcp server did not respond")
+	ErrDHCPNoLease = errors.New("dhcp client has no lease")
+)
+
+// DHCPLease はDHCPサーバから借りたアドレスと設定
+type DHCPLease struct {
+	Addr    net.IP
+	Netmask net.IP
+	// デフォルトゲートウェイ。なければnil
+	Router     net.IP
+	DNSServers []net.IP
+	DomainName string
+	// 貸してくれたサーバ(option 54)
+	Server net.IP
+	// 借りている期間とT1(RENEWING), T2(REBINDING)になるまでの時間
+	LeaseTime     time.Duration
+	RenewalTime   time.Duration
+	RebindingTime time.Duration
+	// REQUESTを送った時刻。期間はここから数える(RFC2131 4.4.1)
+	Start time.Time
+}
+
+func newDHCPLease(ack DHCPMessage, start time.Time) *DHCPLease {
+	opts, _ := ack.options()
+	l := &DHCPLease{
+		Addr:          net.IP(append([]byte{}, ack.YIAddr...)),
+		DNSServers:    dhcpOptionAddrs(opts[DHCPOptDNSServer]),
+		DomainName:    string(opts[DHCPOptDomainName]),
+		LeaseTime:     dhcpOptionDuration(opts[DHCPOptLeaseTime]),
+		RenewalTime:   dhcpOptionDuration(opts[DHCPOptRenewalTime]),
+		RebindingTime: dhcpOptionDuration(opts[DHCPOptRebindingTime]),
+		Start:         start,
+	}
+	if mask := opts[DHCPOptSubnetMask]; len(mask) == 4 {
+		l.Netmask = net.IP(append([]byte{}, mask...))
+	} else {
+		l.Netmask = net.IP(l.Addr.DefaultMask())
+	}
+	if routers := dhcpOptionAddrs(opts[DHCPOptRouter]); len(routers) != 0 {
+		l.Router = routers[0]
+	}
+	if servers := dhcpOptionAddrs(opts[DHCPOptServerID]); len(servers) != 0 {
+		l.Server = servers[0]
+	}
+	// T1, T2がなければ期間の1/2と7/8にする(RFC2131 4.4.5)
+	if l.RenewalTime == 0 || l.RenewalTime > l.LeaseTime {
+		l.RenewalTime = l.LeaseTime / 2
+	}
+	if l.RebindingTime == 0 || l.RebindingTime > l.LeaseTime || l.RebindingTime < l.RenewalTime {
+		l.RebindingTime = l.LeaseTime * 7 / 8
+	}
+	return l
+}
+
+// validDHCPAck はACKに0でない期間(option 51)が入っていればtrue
+// 期間のないACKを受け取るとT1, T2も0になってすぐにREQUESTを送り続けるので、壊れたものとして無視する(RFC2131 4.3.1)
+func validDHCPAck(ack DHCPMessage) bool {
+	return dhcpOptionDuration(ack.Option(DHCPOptLeaseTime)) > 0
+}
+
+func (l *DHCPLease) renewAt() time.Time  { return l.Start.Add(l.RenewalTime) }
+func (l *DHCPLease) rebindAt() time.Time { return l.Start.Add(l.RebindingTime) }
+
+// Expiry はアドレスを使えなくなる時刻
+func (l *DHCPLease) Expiry() time.Time { return l.Start.Add(l.LeaseTime) }
+
+// DHCPClient はDHCPv4でアドレスを借りて、Stackのインターフェイスに設定する
+// 1つのStackでUDPの68番ポートを使えるのは1つだけなので、DHCPClientも1つしか作れない
+type DHCPClient struct {
+	stack  *Stack
+	ifname string
+	conn   *UDPConn
+	// 受け取ったBOOTREPLY
+	replies chan DHCPMessage
+
+	// 借りたDNSサーバを入れるリゾルバ。nilなら入れない
+	Resolver *DNSResolver
+	// option 12でサーバに伝えるホスト名
+	Hostname string
+	// アドレスを借りたり延長したりしたら呼ぶ。アドレスを失ったらnilで呼ぶ
+	OnLease func(*DHCPLease)
+
+	mu     sync.Mutex
+	lease  *DHCPLease
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewDHCPClient はifnameのインターフェイスのDHCPクライアントを作る
+func NewDHCPClient(stack *Stack, ifname string) (*DHCPClient, error) {
+	if stack.Interface(ifname) == nil {
+		return nil, fmt.Errorf("no such interface : %s", ifname)
+	}
+	conn, err := stack.ListenUDP(&net.UDPAddr{Port: DHCPClientPort})
+	if err != nil {
+		return nil, err
+	}
+	c := &DHCPClient{
+		stack:   stack,
+		ifname:  ifname,
+		conn:    conn,
+		replies: make(chan DHCPMessage, 16),
+		closed:  make(chan struct{}),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// readLoop は自分のMACアドレス宛てのBOOTREPLYだけをrepliesに入れる
+func (c *DHCPClient) readLoop() {
+	mac := c.stack.Interface(c.ifname).MacAddr
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		m, err := ParseDHCPMessage(append([]byte{}, buf[:n]...))
+		if err != nil || m.Op[0] != DHCPOpReply || !bytes.Equal(m.HardwareAddr(), mac) {
+			continue
+		}
+		select {
+		case c.replies <- m:
+		default:
+		}
+	}
+}
+
+// Start はアドレスを借りてインターフェイス, ルーティングテーブル, リゾルバに設定する
+// 借りられるかctxが終わるまで待ち、借りたあとは裏でT1, T2に合わせて延長し続ける
+func (c *DHCPClient) Start(ctx context.Context) (*DHCPLease, error) {
+	lease, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.bind(lease)
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	c.mu.Lock()
+	c.cancel = cancel
+	c.mu.Unlock()
+	c.wg.Add(1)
+	go c.run(runCtx)
+	return lease, nil
+}
+
+// Lease は今借りているアドレスを返す。借りていなければnil
+func (c *DHCPClient) Lease() *DHCPLease {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lease
+}
+
+// Release はアドレスをサーバに返して、インターフェイスからアドレスとルートを外す
+func (c *DHCPClient) Release() error {
+	c.stop()
+	lease := c.Lease()
+	if lease == nil {
+		return ErrDHCPNoLease
+	}
+	msg := c.newMessage(DHCPRelease, randomByte(4), []DHCPOption{
+		{Code: DHCPOptServerID, Data: lease.Server.To4()},
+	})
+	msg.CIAddr = lease.Addr.To4()
+	err := c.send(msg, lease.Server.To4())
+	c.unbind()
+	return err
+}
+
+// Close は延長するのをやめてソケットを閉じる。アドレスは設定したままにする
+func (c *DHCPClient) Close() error {
+	c.stop()
+	c.once.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+	return nil
+}
+
+func (c *DHCPClient) stop() {
+	c.mu.Lock()
+	cancel := c.cancel
+	c.cancel = nil
+	c.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	c.wg.Wait()
+}
+
+// run はBOUND, RENEWING, REBINDINGを繰り返し、延長できなければアドレスを外して借り直す(RFC2131 4.4)
+func (c *DHCPClient) run(ctx context.Context) {
+	defer c.wg.Done()
+	for {
+		lease := c.Lease()
+		if !sleepUntil(ctx, lease.renewAt()) {
+			return
+		}
+		next, err := c.extend(ctx, lease)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			c.bind(next)
+			continue
+		}
+		c.unbind()
+		next, err = c.acquire(ctx)
+		if err != nil {
+			return
+		}
+		c.bind(next)
+	}
+}
+
+// acquire はDISCOVER, OFFER, REQUEST, ACKでアドレスを借りる(RFC2131 3.1)
+func (c *DHCPClient) acquire(ctx context.Context) (*DHCPLease, error) {
+	for {
+		xid := randomByte(4)
+		discover := c.newMessage(DHCPDiscover, xid, nil)
+		discover.Flags = UintTo2byte(dhcpFlagBroadcast)
+		offer, err := c.exchange(ctx, discover, broadcastIPAddr, dhcpBackoff(0), func(m DHCPMessage) bool {
+			return m.MessageType() == DHCPOffer && m.Option(DHCPOptServerID) != nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// 同じxidで、選んだサーバとアドレスをブロードキャストで伝える
+		server := offer.Option(DHCPOptServerID)
+		request := c.newMessage(DHCPRequest, xid, []DHCPOption{
+			{Code: DHCPOptRequestedIP, Data: offer.YIAddr},
+			{Code: DHCPOptServerID, Data: server},
+		})
+		request.Flags = UintTo2byte(dhcpFlagBroadcast)
+		start := time.Now()
+		ack, err := c.exchange(ctx, request, broadcastIPAddr, dhcpBackoff(dhcpRequestAttempts), func(m DHCPMessage) bool {
+			t := m.MessageType()
+			return (t == DHCPAck && validDHCPAck(m) || t == DHCPNak) && bytes.Equal(m.Option(DHCPOptServerID), server)
+		})
+		if err != nil && !errors.Is(err, ErrDHCPTimeout) {
+			return nil, err
+		}
+		// 返事がないか断られたらDISCOVERからやり直す
+		if err != nil || ack.MessageType() == DHCPNak {
+			continue
+		}
+
+		lease := newDHCPLease(ack, start)
+		if c.conflict(ctx, lease.Addr.To4()) {
+			decline := c.newMessage(DHCPDecline, randomByte(4), []DHCPOption{
+				{Code: DHCPOptRequestedIP, Data: lease.Addr.To4()},
+				{Code: DHCPOptServerID, Data: server},
+			})
+			c.send(decline, broadcastIPAddr)
+			if !sleepUntil(ctx, time.Now().Add(dhcpDeclineDelay)) {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		return lease, nil
+	}
+}
+
+// extend はT1からは借りたサーバに、T2からはブロードキャストでREQUESTを送って期間を延ばす(RFC2131 4.4.5)
+// 期限までに延ばせなければErrDHCPTimeout、断られたらErrDHCPNak
+func (c *DHCPClient) extend(ctx context.Context, lease *DHCPLease) (*DHCPLease, error) {
+	for _, phase := range []struct {
+		dst   []byte
+		until time.Time
+	}{
+		{lease.Server.To4(), lease.rebindAt()},
+		{broadcastIPAddr, lease.Expiry()},
+	} {
+		if phase.dst == nil {
+			continue
+		}
+		request := c.newMessage(DHCPRequest, randomByte(4), nil)
+		request.CIAddr = lease.Addr.To4()
+		start := time.Now()
+		until := phase.until
+		ack, err := c.exchange(ctx, request, phase.dst, func(n int) time.Duration {
+			// 残り時間の半分だけ待つ。ただし60秒より短くはしない
+			remaining := time.Until(until)
+			wait := remaining / 2
+			if wait < dhcpMinRenewRetransmit {
+				wait = dhcpMinRenewRetransmit
+			}
+			if wait > remaining {
+				wait = remaining
+			}
+			return wait
+		}, func(m DHCPMessage) bool {
+			t := m.MessageType()
+			return t == DHCPAck && validDHCPAck(m) || t == DHCPNak
+		})
+		if errors.Is(err, ErrDHCPTimeout) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ack.MessageType() == DHCPNak {
+			return nil, ErrDHCPNak
+		}
+		next := newDHCPLease(ack, start)
+		if next.Server == nil {
+			next.Server = lease.Server
+		}
+		return next, nil
+	}
+	return nil, ErrDHCPTimeout
+}
+
+// dhcpBackoff は4秒, 8秒, 16秒...64秒と倍にしながら±1秒ずらした間隔を返す(RFC2131 4.1)
+// attemptsが0でなければその回数だけ送る
+func dhcpBackoff(attempts int) func(n int) time.Duration {
+	return func(n int) time.Duration {
+		if attempts != 0 && n >= attempts {
+			return 0
+		}
+		wait := dhcpMaxRetransmit
+		if n < 4 {
+			wait = dhcpInitialRetransmit << n
+		}
+		return wait + randomDuration(2*time.Second) - time.Second
+	}
+}
+
+// exchange はmsgを送り、acceptがtrueを返す返事が届くまで送り直す
+// interval(n)はn回目に送ったあとに待つ時間で、0を返したらErrDHCPTimeoutにする
+func (c *DHCPClient) exchange(ctx context.Context, msg DHCPMessage, dst []byte, interval func(n int) time.Duration, accept func(DHCPMessage) bool) (DHCPMessage, error) {
+	for n := 0; ; n++ {
+		wait := interval(n)
+		if wait <= 0 {
+			return DHCPMessage{}, ErrDHCPTimeout
+		}
+		if err := c.send(msg, dst); err != nil {
+			return DHCPMessage{}, err
+		}
+		timer := time.NewTimer(wait)
+	recv:
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return DHCPMessage{}, ctx.Err()
+			case <-c.closed:
+				timer.Stop()
+				return DHCPMessage{}, net.ErrClosed
+			case <-timer.C:
+				break recv
+			case m := <-c.replies:
+				if bytes.Equal(m.XID, msg.XID) && accept(m) {
+					timer.Stop()
+					return m, nil
+				}
+			}
+		}
+	}
+}
+
+// newMessage はクライアントIDと欲しいオプションの一覧を付けたBOOTREQUESTを作る
+func (c *DHCPClient) newMessage(msgType byte, xid []byte, options []DHCPOption) DHCPMessage {
+	mac := c.stack.Interface(c.ifname).MacAddr
+	opts := []DHCPOption{
+		{Code: DHCPOptMessageType, Data: []byte{msgType}},
+		// ハードウェアの種類(Ethernet)とMACアドレス
+		{Code: DHCPOptClientID, Data: append([]byte{0x01}, mac...)},
+	}
+	opts = append(opts, options...)
+	if msgType == DHCPDiscover || msgType == DHCPRequest {
+		if c.Hostname != "" {
+			opts = append(opts, DHCPOption{Code: DHCPOptHostName, Data: []byte(c.Hostname)})
+		}
+		opts = append(opts, DHCPOption{Code: DHCPOptParameterList, Data: []byte{
+			DHCPOptSubnetMask, DHCPOptRouter, DHCPOptDNSServer, DHCPOptDomainName,
+			DHCPOptLeaseTime, DHCPOptRenewalTime, DHCPOptRebindingTime,
+		}})
+	}
+	return NewDHCPMessage(DHCPOpRequest, xid, mac, opts)
+}
+
+// send はサーバのポートにmsgを送る
+// アドレスがまだなければ0.0.0.0から、ルートがなくてもインターフェイスから直接送る
+func (c *DHCPClient) send(msg DHCPMessage, dst []byte) error {
+	ifc, nexthop, err := c.stack.lookupRouteOn(dst, c.ifname)
+	if err != nil {
+		return err
+	}
+	src, _ := c.stack.interfaceAddr(ifc)
+	if src == nil {
+		src = []byte{0x00, 0x00, 0x00, 0x00}
+	}
+	// RELEASEのあとすぐアドレスを外すので、ARPは送る前に済ませておく
+	if !bytes.Equal(dst, broadcastIPAddr) {
+		if _, err := c.stack.resolve(ifc, nexthop); err != nil {
+			return err
+		}
+	}
+	header := NewIPHeader(src, dst, "UDP")
+	header.Flags = []byte{0x00, 0x00}
+	return c.stack.sendIPv4(ifc, nexthop, header, newUDPPacket(header, DHCPClientPort, DHCPServerPort, toByteArr(msg)))
+}
+
+// conflict はaddrを他のホストが使っていればtrue
+// 送信元0.0.0.0のARP probeを送って返事が来るか見る(RFC2131 4.4.1, RFC5227)
+func (c *DHCPClient) conflict(ctx context.Context, addr []byte) bool {
+	ifc := c.stack.Interface(c.ifname)
+	c.stack.Arp.Delete(addr)
+	wait := c.stack.Arp.waitch(addr)
+	defer c.stack.Arp.unwait(addr, wait)
+	probe := NewArpRequest(LocalIpMacAddr{LocalMacAddr: ifc.MacAddr, LocalIpAddr: []byte{0x00, 0x00, 0x00, 0x00}}, net.IP(addr).String())
+	var frame []byte
+	frame = append(frame, toByteArr(NewEthernet(broadcastMacAddr, ifc.MacAddr, "ARP"))...)
+	frame = append(frame, toByteArr(probe)...)
+	if err := ifc.Link.WriteFrame(frame); err != nil {
+		return false
+	}
+	select {
+	case <-wait:
+		return true
+	case <-time.After(dhcpProbeWait):
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// bind は借りたアドレス, デフォルトルート, DNSサーバを設定する
+func (c *DHCPClient) bind(lease *DHCPLease) {
+	c.mu.Lock()
+	old := c.lease
+	c.lease = lease
+	c.mu.Unlock()
+
+	c.stack.SetInterfaceAddr(c.ifname, lease.Addr.To4(), lease.Netmask.To4())
+	if lease.Router != nil {
+		c.stack.Routes.Add(Route{
+			Dest:    defaultRouteAddr,
+			Netmask: defaultRouteAddr,
+			Gateway: lease.Router.To4(),
+			Ifname:  c.ifname,
+		})
+	} else if old != nil && old.Router != nil {
+		c.deleteDefaultRoute(old.Router)
+	}
+	if c.Resolver != nil && len(lease.DNSServers) != 0 {
+		var servers []string
+		for _, addr := range lease.DNSServers {
+			servers = append(servers, addr.String())
+		}
+		c.Resolver.SetServers(servers)
+	}
+	if c.OnLease != nil {
+		c.OnLease(lease)
+	}
+}
+
+// unbind はbindで設定したアドレスとデフォルトルートを外す
+func (c *DHCPClient) unbind() {
+	c.mu.Lock()
+	old := c.lease
+	c.lease = nil
+	c.mu.Unlock()
+	if old == nil {
+		return
+	}
+	c.stack.SetInterfaceAddr(c.ifname, nil, nil)
+	if old.Router != nil {
+		c.deleteDefaultRoute(old.Router)
+	}
+	if c.OnLease != nil {
+		c.OnLease(nil)
+	}
+}
+
+// deleteDefaultRoute はrouterに向けた自分のデフォルトルートだけを消す
+func (c *DHCPClient) deleteDefaultRoute(router net.IP) {
+	if r, ok := c.stack.Routes.LookupOn(defaultRouteAddr, c.ifname); ok &&
+		maskLength(r.Netmask) == 0 && bytes.Equal(r.Gateway, router.To4()) {
+		c.stack.Routes.Delete(defaultRouteAddr, defaultRouteAddr)
+	}
+}
+
+var (
+	broadcastIPAddr  = []byte{0xff, 0xff, 0xff, 0xff}
+	defaultRouteAddr = []byte{0x00, 0x00, 0x00, 0x00}
+)
+
+// sleepUntil はtまで待つ。ctxが先に終わったらfalse
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,576 @@
+package tcpip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dhcpDefaultLeaseTime = time.Hour
+	// OFFERしたアドレスをREQUESTが来るまで他のクライアントに貸さずに取っておく時間
+	dhcpOfferHold = 30 * time.Second
+	// DECLINEされたアドレスを貸さないでおく時間
+	dhcpDeclineHold = 10 * time.Minute
+)
+
+// DHCPPool は貸すアドレスの範囲。StartからEndまでを含む
+type DHCPPool struct {
+	Start net.IP
+	End   net.IP
+}
+
+func (p DHCPPool) contains(ip []byte) bool {
+	return bytes.Compare(ip, p.Start.To4()) >= 0 && bytes.Compare(ip, p.End.To4()) <= 0
+}
+
+// DHCPServerLease はサーバが貸しているアドレス
+type DHCPServerLease struct {
+	Addr         net.IP
+	HardwareAddr net.HardwareAddr
+	// option 61。送ってこなければnil
+	ClientID []byte
+	Hostname string
+	Expiry   time.Time
+}
+
+// owns はreqを送ってきたクライアントのリースならtrue
+// クライアントIDがあればそれで、なければMACアドレスで比べる(RFC2131 4.2)
+func (l *DHCPServerLease) owns(req DHCPMessage) bool {
+	if id := req.Option(DHCPOptClientID); id != nil && l.ClientID != nil {
+		return bytes.Equal(id, l.ClientID)
+	}
+	return bytes.Equal(l.HardwareAddr, req.HardwareAddr())
+}
+
+type dhcpOfferEntry struct {
+	lease  *DHCPServerLease
+	expire time.Time
+}
+
+// DHCPServer はプールのアドレスとオプション1, 3, 6, 15, 51を貸すDHCPv4サーバ
+type DHCPServer struct {
+	// option 54。Startで空ならインターフェイスのアドレスを使う
+	ServerID   net.IP
+	Netmask    net.IP
+	Router     net.IP
+	DNSServers []net.IP
+	DomainName string
+	// 0なら1時間
+	LeaseTime time.Duration
+	Pools     []DHCPPool
+	// 空でなければリースをdnsmasqと同じ形式で保存し、Startで読み込む
+	LeaseFile string
+	// リースを保存できなかったときに使う。nilならlog.Printf
+	Logf func(format string, v ...interface{})
+
+	mu           sync.Mutex
+	reservations map[string]net.IP
+	leases       map[[4]byte]*DHCPServerLease
+	offers       map[[4]byte]dhcpOfferEntry
+	declined     map[[4]byte]time.Time
+
+	stack  *Stack
+	ifname string
+	conn   *UDPConn
+	wg     sync.WaitGroup
+}
+
+func NewDHCPServer(pools ...DHCPPool) *DHCPServer {
+	return &DHCPServer{
+		Pools:        pools,
+		reservations: make(map[string]net.IP),
+		leases:       make(map[[4]byte]*DHCPServerLease),
+		offers:       make(map[[4]byte]dhcpOfferEntry),
+		declined:     make(map[[4]byte]time.Time),
+	}
+}
+
+// Reserve はmacのクライアントにいつもipを貸すようにする。ipはプールの外でもいい
+func (s *DHCPServer) Reserve(mac net.HardwareAddr, ip net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reservations[mac.String()] = ip.To4()
+}
+
+// Leases は有効なリースをアドレスの順に返す
+func (s *DHCPServer) Leases() []DHCPServerLease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var leases []DHCPServerLease
+	now := time.Now()
+	for _, l := range s.leases {
+		if l.Expiry.After(now) {
+			leases = append(leases, *l)
+		}
+	}
+	sort.Slice(leases, func(i, j int) bool { return bytes.Compare(leases[i].Addr, leases[j].Addr) < 0 })
+	return leases
+}
+
+func (s *DHCPServer) leaseTime(req DHCPMessage) time.Duration {
+	max := s.LeaseTime
+	if max == 0 {
+		max = dhcpDefaultLeaseTime
+	}
+	// クライアントが短い期間を欲しがっていればそれにする
+	if d := dhcpOptionDuration(req.Option(DHCPOptLeaseTime)); d != 0 && d < max {
+		return d
+	}
+	return max
+}
+
+// Answer はクライアントのメッセージへの返事を作る。返事をしないならfalse(RFC2131 4.3)
+func (s *DHCPServer) Answer(req DHCPMessage) (DHCPMessage, bool) {
+	if req.Op[0] != DHCPOpRequest || req.HType[0] != 0x01 || req.HLen[0] != 6 {
+		return DHCPMessage{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch req.MessageType() {
+	case DHCPDiscover:
+		lease := s.allocate(req)
+		if lease == nil {
+			return DHCPMessage{}, false
+		}
+		s.offers[toIPv4Key(lease.Addr)] = dhcpOfferEntry{lease: lease, expire: time.Now().Add(dhcpOfferHold)}
+		return s.reply(req, DHCPOffer, lease.Addr, s.leaseTime(req)), true
+	case DHCPRequest:
+		return s.request(req)
+	case DHCPDecline:
+		if !s.isOwnServerID(req) {
+			return DHCPMessage{}, false
+		}
+		addr := toIPv4Key(req.Option(DHCPOptRequestedIP))
+		if l, ok := s.leases[addr]; ok && l.owns(req) {
+			delete(s.leases, addr)
+		}
+		s.declined[addr] = time.Now().Add(dhcpDeclineHold)
+		s.persistLeases()
+	case DHCPRelease:
+		if !s.isOwnServerID(req) {
+			return DHCPMessage{}, false
+		}
+		// 次に同じクライアントが来たら同じアドレスを貸せるように、期限切れにして覚えておく
+		if l, ok := s.leases[toIPv4Key(req.CIAddr)]; ok && l.owns(req) {
+			l.Expiry = time.Now()
+			s.persistLeases()
+		}
+	case DHCPInform:
+		// アドレスは貸さずにオプションだけ返す
+		resp := s.reply(req, DHCPAck, nil, 0)
+		resp.CIAddr = req.CIAddr
+		return resp, true
+	}
+	return DHCPMessage{}, false
+}
+
+func (s *DHCPServer) isOwnServerID(req DHCPMessage) bool {
+	return bytes.Equal(req.Option(DHCPOptServerID), s.ServerID.To4())
+}
+
+// request はREQUESTがどの状態から送られたかで分けて、ACKかNAKを返す(RFC2131 4.3.2)
+func (s *DHCPServer) request(req DHCPMessage) (DHCPMessage, bool) {
+	requested := req.Option(DHCPOptRequestedIP)
+	var addr []byte
+	switch {
+	case req.Option(DHCPOptServerID) != nil:
+		// SELECTING: 他のサーバが選ばれたらOFFERを取り消す
+		if !s.isOwnServerID(req) {
+			for key, offer := range s.offers {
+				if offer.lease.owns(req) {
+					delete(s.offers, key)
+				}
+			}
+			return DHCPMessage{}, false
+		}
+		addr = requested
+	case !isUnspecifiedAddr(req.CIAddr):
+		// RENEWING, REBINDING
+		addr = req.CIAddr
+	case len(requested) == 4:
+		// INIT-REBOOT: 知らないクライアントなら黙っている
+		if l, ok := s.leases[toIPv4Key(requested)]; !ok || !l.owns(req) {
+			if !s.inSubnet(requested) || ok {
+				return s.reply(req, DHCPNak, nil, 0), true
+			}
+			return DHCPMessage{}, false
+		}
+		addr = requested
+	default:
+		return DHCPMessage{}, false
+	}
+	if len(addr) != 4 || !s.available(addr, req) {
+		return s.reply(req, DHCPNak, nil, 0), true
+	}
+
+	key := toIPv4Key(addr)
+	delete(s.offers, key)
+	// 同じクライアントが前に借りていた別のアドレスは返してもらったことにする
+	for k, l := range s.leases {
+		if k != key && l.owns(req) {
+			delete(s.leases, k)
+		}
+	}
+	d := s.leaseTime(req)
+	s.leases[key] = &DHCPServerLease{
+		Addr:         net.IP(append([]byte{}, addr...)),
+		HardwareAddr: append(net.HardwareAddr{}, req.HardwareAddr()...),
+		ClientID:     append([]byte(nil), req.Option(DHCPOptClientID)...),
+		Hostname:     string(req.Option(DHCPOptHostName)),
+		Expiry:       time.Now().Add(d),
+	}
+	s.persistLeases()
+	return s.reply(req, DHCPAck, addr, d), true
+}
+
+func (s *DHCPServer) inSubnet(ip []byte) bool {
+	mask := s.netmask()
+	return bytes.Equal(maskedAddr(ip, mask), maskedAddr(s.ServerID.To4(), mask))
+}
+
+func (s *DHCPServer) netmask() []byte {
+	if s.Netmask != nil {
+		return s.Netmask.To4()
+	}
+	return s.ServerID.DefaultMask()
+}
+
+// available はaddrをreqのクライアントに貸せるならtrue
+func (s *DHCPServer) available(addr []byte, req DHCPMessage) bool {
+	key := toIPv4Key(addr)
+	if reserved, ok := s.reservations[req.HardwareAddr().String()]; ok {
+		return bytes.Equal(reserved, addr)
+	}
+	for mac, reserved := range s.reservations {
+		if bytes.Equal(reserved, addr) && mac != req.HardwareAddr().String() {
+			return false
+		}
+	}
+	if bytes.Equal(addr, s.ServerID.To4()) || !s.inPool(addr) {
+		return false
+	}
+	if until, ok := s.declined[key]; ok && time.Now().Before(until) {
+		return false
+	}
+	if l, ok := s.leases[key]; ok && !l.owns(req) && l.Expiry.After(time.Now()) {
+		return false
+	}
+	if o, ok := s.offers[key]; ok && !o.lease.owns(req) && o.expire.After(time.Now()) {
+		return false
+	}
+	return true
+}
+
+func (s *DHCPServer) inPool(addr []byte) bool {
+	for _, p := range s.Pools {
+		if p.contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// allocate はDISCOVERに貸すアドレスを選ぶ(RFC2131 4.3.1)
+// 予約, 今か前に貸していたアドレス, クライアントが欲しがったアドレス, プールの空きの順に探す
+func (s *DHCPServer) allocate(req DHCPMessage) *DHCPServerLease {
+	lease := &DHCPServerLease{
+		HardwareAddr: append(net.HardwareAddr{}, req.HardwareAddr()...),
+		ClientID:     append([]byte(nil), req.Option(DHCPOptClientID)...),
+	}
+	if reserved, ok := s.reservations[req.HardwareAddr().String()]; ok {
+		lease.Addr = reserved
+		return lease
+	}
+	var candidates [][]byte
+	for _, l := range s.leases {
+		if l.owns(req) {
+			candidates = append(candidates, l.Addr.To4())
+		}
+	}
+	if requested := req.Option(DHCPOptRequestedIP); len(requested) == 4 {
+		candidates = append(candidates, requested)
+	}
+	for _, addr := range candidates {
+		if s.available(addr, req) {
+			lease.Addr = net.IP(append([]byte{}, addr...))
+			return lease
+		}
+	}
+	// 期限切れのリースのアドレスは、他に空きがなくなるまで取っておく
+	var expired []byte
+	for _, p := range s.Pools {
+		start, end := binary.BigEndian.Uint32(p.Start.To4()), binary.BigEndian.Uint32(p.End.To4())
+		for n := start; n <= end && n >= start; n++ {
+			addr := make([]byte, 4)
+			binary.BigEndian.PutUint32(addr, n)
+			if !s.available(addr, req) {
+				continue
+			}
+			if _, ok := s.leases[toIPv4Key(addr)]; !ok {
+				lease.Addr = addr
+				return lease
+			}
+			if expired == nil {
+				expired = addr
+			}
+		}
+	}
+	if expired == nil {
+		return nil
+	}
+	lease.Addr = expired
+	return lease
+}
+
+// reply はreqへの返事を作る。yiaddrがnilなら0.0.0.0にする
+func (s *DHCPServer) reply(req DHCPMessage, msgType byte, yiaddr []byte, leaseTime time.Duration) DHCPMessage {
+	opts := []DHCPOption{
+		{Code: DHCPOptMessageType, Data: []byte{msgType}},
+		{Code: DHCPOptServerID, Data: s.ServerID.To4()},
+	}
+	if msgType != DHCPNak {
+		if leaseTime != 0 {
+			opts = append(opts, dhcpDurationOption(DHCPOptLeaseTime, leaseTime))
+		}
+		opts = append(opts, DHCPOption{Code: DHCPOptSubnetMask, Data: s.netmask()})
+		if s.Router != nil {
+			opts = append(opts, DHCPOption{Code: DHCPOptRouter, Data: s.Router.To4()})
+		}
+		if len(s.DNSServers) != 0 {
+			var b []byte
+			for _, addr := range s.DNSServers {
+				b = append(b, addr.To4()...)
+			}
+			opts = append(opts, DHCPOption{Code: DHCPOptDNSServer, Data: b})
+		}
+		if s.DomainName != "" {
+			opts = append(opts, DHCPOption{Code: DHCPOptDomainName, Data: []byte(s.DomainName)})
+		}
+	}
+	resp := NewDHCPMessage(DHCPOpReply, req.XID, req.HardwareAddr(), opts)
+	resp.Flags = req.Flags
+	resp.GIAddr = req.GIAddr
+	if yiaddr != nil {
+		resp.YIAddr = yiaddr
+	}
+	return resp
+}
+
+// replyDest は返事を送る宛先を決める(RFC2131 4.1)
+// リレーエージェント, ciaddr, ブロードキャスト, 貸したアドレスの順に選ぶ
+func replyDest(req, resp DHCPMessage) (dst []byte, port uint16) {
+	switch {
+	case !isUnspecifiedAddr(req.GIAddr):
+		return req.GIAddr, DHCPServerPort
+	case resp.MessageType() == DHCPNak:
+		return broadcastIPAddr, DHCPClientPort
+	case !isUnspecifiedAddr(req.CIAddr):
+		return req.CIAddr, DHCPClientPort
+	case req.Broadcast() || isUnspecifiedAddr(resp.YIAddr):
+		return broadcastIPAddr, DHCPClientPort
+	}
+	return resp.YIAddr, DHCPClientPort
+}
+
+// Start はstackのifnameのインターフェイスでDHCPのメッセージを待ち受けて答え始める
+// UDPの67番ポートは1つしか使えないので、他のインターフェイスに届いたメッセージにも答えてしまう
+func (s *DHCPServer) Start(stack *Stack, ifname string) error {
+	ifc := stack.Interface(ifname)
+	if ifc == nil {
+		return fmt.Errorf("no such interface : %s", ifname)
+	}
+	addr, netmask := stack.interfaceAddr(ifc)
+	s.mu.Lock()
+	if s.ServerID == nil && addr != nil {
+		s.ServerID = net.IP(append([]byte{}, addr...))
+	}
+	if s.Netmask == nil && netmask != nil {
+		s.Netmask = net.IP(append([]byte{}, netmask...))
+	}
+	s.mu.Unlock()
+	if s.ServerID.To4() == nil {
+		return fmt.Errorf("dhcp server needs an address on %s", ifname)
+	}
+	if err := s.loadLeases(); err != nil {
+		return err
+	}
+	conn, err := stack.ListenUDP(&net.UDPAddr{Port: DHCPServerPort})
+	if err != nil {
+		return err
+	}
+	s.stack, s.ifname, s.conn = stack, ifname, conn
+	s.wg.Add(1)
+	go s.serve()
+	return nil
+}
+
+func (s *DHCPServer) serve() {
+	defer s.wg.Done()
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req, err := ParseDHCPMessage(append([]byte{}, buf[:n]...))
+		if err != nil {
+			continue
+		}
+		resp, ok := s.Answer(req)
+		if !ok {
+			continue
+		}
+		s.send(req, resp)
+	}
+}
+
+// send はブロードキャストや、まだARPに答えられないクライアントにも届くように、自分で経路を決めて送る
+func (s *DHCPServer) send(req, resp DHCPMessage) error {
+	dst, port := replyDest(req, resp)
+	ifc := s.stack.Interface(s.ifname)
+	nexthop := dst
+	switch {
+	case port == DHCPServerPort:
+		var err error
+		if ifc, nexthop, err = s.stack.lookupRoute(dst); err != nil {
+			return err
+		}
+	case !bytes.Equal(dst, broadcastIPAddr):
+		// 貸したばかりのアドレスにはARPで聞けないので、chaddrのMACアドレスに送る
+		s.stack.Arp.Update(dst, req.HardwareAddr())
+	}
+	src, _ := s.stack.interfaceAddr(ifc)
+	if src == nil {
+		return fmt.Errorf("no ipv4 address on %s", ifc.Name)
+	}
+	header := NewIPHeader(src, dst, "UDP")
+	header.Flags = []byte{0x00, 0x00}
+	return s.stack.sendIPv4(ifc, nexthop, header, newUDPPacket(header, DHCPServerPort, port, toByteArr(resp)))
+}
+
+// Close は待ち受けをやめる
+func (s *DHCPServer) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.wg.Wait()
+	return err
+}
+
+// persistLeases はリースを保存して、失敗したらログに書く。s.muを持って呼ぶ
+// 保存できなくてもメモリ上のリースで答え続ける
+func (s *DHCPServer) persistLeases() {
+	if err := s.saveLeases(); err != nil {
+		logf := s.Logf
+		if logf == nil {
+			logf = log.Printf
+		}
+		logf("dhcp server could not save leases to %s : %v", s.LeaseFile, err)
+	}
+}
+
+// saveLeases はリースを"期限 MACアドレス IPアドレス ホスト名 クライアントID"の行で書き出す。s.muを持って呼ぶ
+// 途中で止まっても壊れないように、一時ファイルに書いてから置き換える
+func (s *DHCPServer) saveLeases() error {
+	if s.LeaseFile == "" {
+		return nil
+	}
+	var b strings.Builder
+	for _, l := range s.leases {
+		hostname, clientID := "*", "*"
+		if l.Hostname != "" {
+			hostname = strings.Join(strings.Fields(l.Hostname), "-")
+		}
+		if l.ClientID != nil {
+			clientID = colonHex(l.ClientID)
+		}
+		fmt.Fprintf(&b, "%d %s %s %s %s\n", l.Expiry.Unix(), l.HardwareAddr, l.Addr, hostname, clientID)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.LeaseFile), filepath.Base(s.LeaseFile)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.LeaseFile)
+}
+
+// loadLeases はsaveLeasesで書き出したリースを読み込む。ファイルがなければ何もしない
+func (s *DHCPServer) loadLeases() error {
+	if s.LeaseFile == "" {
+		return nil
+	}
+	f, err := os.Open(s.LeaseFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 5 {
+			return fmt.Errorf("%s:%d: invalid lease", s.LeaseFile, line)
+		}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", s.LeaseFile, line, err)
+		}
+		mac, err := net.ParseMAC(fields[1])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", s.LeaseFile, line, err)
+		}
+		addr := net.ParseIP(fields[2]).To4()
+		if addr == nil {
+			return fmt.Errorf("%s:%d: invalid address %q", s.LeaseFile, line, fields[2])
+		}
+		l := &DHCPServerLease{Addr: addr, HardwareAddr: mac, Expiry: time.Unix(expiry, 0)}
+		if fields[3] != "*" {
+			l.Hostname = fields[3]
+		}
+		if fields[4] != "*" {
+			if l.ClientID, err = hex.DecodeString(strings.ReplaceAll(fields[4], ":", "")); err != nil {
+				return fmt.Errorf("%s:%d: %w", s.LeaseFile, line, err)
+			}
+		}
+		s.leases[toIPv4Key(addr)] = l
+	}
+	return scanner.Err()
+}
+
+func colonHex(b []byte) string {
+	s := make([]string, len(b))
+	for i, c := range b {
+		s[i] = fmt.Sprintf("%02x", c)
+	}
+	return strings.Join(s, ":")
+}
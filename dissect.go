@@ -0,0 +1,272 @@
+package tcpip
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// LayerField は層の中の1つの項目。DNSの質問のように子の項目を持つこともある
+type LayerField struct {
+	Name     string       `json:"name"`
+	Value    string       `json:"value,omitempty"`
+	Children []LayerField `json:"children,omitempty"`
+}
+
+// Layer はデコードしたプロトコルの1つの層
+type Layer interface {
+	// "Ethernet", "IPv4"のような層の名前
+	LayerName() string
+	// 表示とJSONで使う項目
+	Fields() []LayerField
+	// ヘッダを除いた残り。次の層に渡す
+	LayerPayload() []byte
+	// 次の層のデコーダ。最後の層ならnil
+	NextDecoder() LayerDecoder
+}
+
+// LayerDecoder はdataの先頭から1つの層をデコードする
+type LayerDecoder func(data []byte) (Layer, error)
+
+// DecodedPacket はデコードした層を外側から順番に持つ
+type DecodedPacket struct {
+	Data   []byte
+	Layers []Layer
+	// 途中でデコードに失敗したときのエラー。それまでの層はLayersに残る
+	Err error
+}
+
+// DecodePacket はfirstから始めて、各層が返す次のデコーダで順番にデコードする
+// デコードできなかった残りはPayloadの層になる
+func DecodePacket(data []byte, first LayerDecoder) *DecodedPacket {
+	p := &DecodedPacket{Data: data}
+	decoder := first
+	for len(data) > 0 {
+		if decoder == nil {
+			p.Layers = append(p.Layers, &PayloadLayer{Data: data})
+			break
+		}
+		layer, err := decoder(data)
+		if err != nil {
+			p.Err = err
+			p.Layers = append(p.Layers, &PayloadLayer{Data: data})
+			break
+		}
+		p.Layers = append(p.Layers, layer)
+		data = layer.LayerPayload()
+		decoder = layer.NextDecoder()
+	}
+	return p
+}
+
+// Layer は名前が一致する最初の層を返す。なければnil
+func (p *DecodedPacket) Layer(name string) Layer {
+	for _, l := range p.Layers {
+		if l.LayerName() == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// String は層と項目を字下げした木にする
+func (p *DecodedPacket) String() string {
+	var b strings.Builder
+	for _, l := range p.Layers {
+		b.WriteString(l.LayerName())
+		b.WriteString("\n")
+		writeLayerFields(&b, l.Fields(), 1)
+	}
+	if p.Err != nil {
+		fmt.Fprintf(&b, "Error: %v\n", p.Err)
+	}
+	return b.String()
+}
+
+func writeLayerFields(b *strings.Builder, fields []LayerField, depth int) {
+	for _, f := range fields {
+		b.WriteString(strings.Repeat("    ", depth))
+		b.WriteString(f.Name)
+		if f.Value != "" {
+			b.WriteString(": ")
+			b.WriteString(f.Value)
+		}
+		b.WriteString("\n")
+		writeLayerFields(b, f.Children, depth+1)
+	}
+}
+
+// LayerSummary はtcpdumpのような1行の表示を持つ層
+type LayerSummary interface {
+	Summary() string
+}
+
+// Summary は"IP 10.0.0.1.40000 > 10.0.0.2.53: UDP, length 29, DNS query 0x1234 A example.com."のような1行にする
+func (p *DecodedPacket) Summary() string {
+	var prefix []string
+	var addrs string
+	var details []string
+	for _, l := range p.Layers {
+		switch l := l.(type) {
+		case *EthernetLayer:
+			addrs = fmt.Sprintf("%s > %s, ethertype %s", l.SourceMacAddr, l.DstMacAddr, etherTypeString(l.EtherType))
+		case *VLANLayer:
+			prefix = append(prefix, l.Summary())
+		case *IPv4Layer:
+			addrs = packetAddrSummary("IP", l.SourceIPAddr.String(), l.DstIPAddr.String(), p)
+			if l.Fragmented() {
+				details = append(details, fmt.Sprintf("frag (id 0x%04x, offset %d, proto %s)", l.ID, l.FragmentOffset*8, ipProtocolString(l.Protocol)))
+			}
+		case *IPv6Layer:
+			addrs = packetAddrSummary("IP6", l.SourceIPAddr.String(), l.DstIPAddr.String(), p)
+			if l.Fragmented {
+				details = append(details, fmt.Sprintf("frag (proto %s)", ipProtocolString(l.Protocol)))
+			}
+		case *ARPLayer:
+			addrs = l.Summary()
+		case LayerSummary:
+			if s := l.Summary(); s != "" {
+				details = append(details, s)
+			}
+		}
+	}
+	line := strings.Join(append(prefix, addrs), ", ")
+	if len(details) != 0 {
+		line += ": " + strings.Join(details, ", ")
+	}
+	if p.Err != nil {
+		line += fmt.Sprintf(" [%v]", p.Err)
+	}
+	return line
+}
+
+// packetAddrSummary はTCPかUDPならアドレスの後ろにポートを付ける
+func packetAddrSummary(name, src, dst string, p *DecodedPacket) string {
+	if sport, dport, ok := packetPorts(p); ok {
+		return fmt.Sprintf("%s %s.%d > %s.%d", name, src, sport, dst, dport)
+	}
+	return fmt.Sprintf("%s %s > %s", name, src, dst)
+}
+
+type layerJSON struct {
+	Name   string       `json:"name"`
+	Fields []LayerField `json:"fields"`
+}
+
+// MarshalJSON は{"layers":[{"name":"Ethernet","fields":[...]}, ...]}の形にする
+func (p *DecodedPacket) MarshalJSON() ([]byte, error) {
+	v := struct {
+		Layers []layerJSON `json:"layers"`
+		Error  string      `json:"error,omitempty"`
+	}{}
+	for _, l := range p.Layers {
+		v.Layers = append(v.Layers, layerJSON{Name: l.LayerName(), Fields: l.Fields()})
+	}
+	if p.Err != nil {
+		v.Error = p.Err.Error()
+	}
+	return json.Marshal(v)
+}
+
+// PayloadLayer はデコーダがないか、デコードに失敗した残りのデータ
+type PayloadLayer struct {
+	Data []byte
+}
+
+func (l *PayloadLayer) LayerName() string { return "Payload" }
+
+func (l *PayloadLayer) Fields() []LayerField {
+	return []LayerField{{Name: "Length", Value: fmt.Sprint(len(l.Data))}}
+}
+
+func (l *PayloadLayer) LayerPayload() []byte      { return nil }
+func (l *PayloadLayer) NextDecoder() LayerDecoder { return nil }
+
+// 次の層のデコーダを探すときのキーの種類
+const (
+	decoderEtherType = iota
+	decoderIPProtocol
+	decoderTCPPort
+	decoderUDPPort
+)
+
+type decoderKey struct {
+	kind  int
+	value uint16
+}
+
+var (
+	decoderMu     sync.RWMutex
+	layerDecoders = make(map[decoderKey]LayerDecoder)
+)
+
+func registerDecoder(kind int, value uint16, decoder LayerDecoder) {
+	decoderMu.Lock()
+	defer decoderMu.Unlock()
+	if decoder == nil {
+		delete(layerDecoders, decoderKey{kind, value})
+		return
+	}
+	layerDecoders[decoderKey{kind, value}] = decoder
+}
+
+func lookupDecoder(kind int, value uint16) LayerDecoder {
+	decoderMu.RLock()
+	defer decoderMu.RUnlock()
+	return layerDecoders[decoderKey{kind, value}]
+}
+
+// RegisterEtherType はEthernet(とVLANタグ)のTypeに続く層のデコーダを登録する
+// nilなら登録を消す
+func RegisterEtherType(etherType uint16, decoder LayerDecoder) {
+	registerDecoder(decoderEtherType, etherType, decoder)
+}
+
+// RegisterIPProtocol はIPv4のProtocol, IPv6のNext Headerに続く層のデコーダを登録する
+func RegisterIPProtocol(protocol byte, decoder LayerDecoder) {
+	registerDecoder(decoderIPProtocol, uint16(protocol), decoder)
+}
+
+// RegisterTCPPort はTCPのポートで使われるアプリケーションの層のデコーダを登録する
+func RegisterTCPPort(port uint16, decoder LayerDecoder) {
+	registerDecoder(decoderTCPPort, port, decoder)
+}
+
+func RegisterUDPPort(port uint16, decoder LayerDecoder) {
+	registerDecoder(decoderUDPPort, port, decoder)
+}
+
+// portDecoder は送信元と宛先のポートのうち、小さいほうから先に探す
+// クライアントのエフェメラルポートよりサーバのwell-knownポートを優先するため
+func portDecoder(kind int, sourcePort, destPort uint16) LayerDecoder {
+	low, high := sourcePort, destPort
+	if high < low {
+		low, high = high, low
+	}
+	if d := lookupDecoder(kind, low); d != nil {
+		return d
+	}
+	return lookupDecoder(kind, high)
+}
+
+func init() {
+	RegisterEtherType(0x0800, DecodeIPv4)
+	RegisterEtherType(0x0806, DecodeARP)
+	RegisterEtherType(0x86dd, DecodeIPv6)
+	RegisterEtherType(0x8100, DecodeVLAN)
+	RegisterEtherType(0x88a8, DecodeVLAN)
+
+	RegisterIPProtocol(IPProtoICMP, DecodeICMP)
+	RegisterIPProtocol(IPProtoTCP, DecodeTCP)
+	RegisterIPProtocol(IPProtoUDP, DecodeUDP)
+	RegisterIPProtocol(IPProtoICMPv6, DecodeICMPv6)
+
+	RegisterUDPPort(53, DecodeDNS)
+	RegisterUDPPort(5353, DecodeDNS)
+	RegisterTCPPort(53, DecodeDNSOverTCP)
+	RegisterTCPPort(80, DecodeHTTP)
+	RegisterTCPPort(8080, DecodeHTTP)
+	RegisterTCPPort(443, DecodeTLS)
+	RegisterTCPPort(853, DecodeTLS)
+}
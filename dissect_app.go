@@ -0,0 +1,376 @@
+package tcpip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DNSLayer はDNSのメッセージ。TCPなら先頭の2byteの長さを外したもの
+type DNSLayer struct {
+	DNSMessage
+	TCP bool
+}
+
+func DecodeDNS(data []byte) (Layer, error) {
+	m, err := ParseDNSMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	return &DNSLayer{DNSMessage: m}, nil
+}
+
+// DecodeDNSOverTCP はセグメントに1つのメッセージが全部入っているときだけデコードする
+func DecodeDNSOverTCP(data []byte) (Layer, error) {
+	if len(data) < 2 {
+		return nil, layerTooShort("dns over tcp", len(data))
+	}
+	length := int(binary.BigEndian.Uint16(data[0:2]))
+	if len(data) < 2+length {
+		return nil, layerTooShort("dns over tcp", len(data))
+	}
+	m, err := ParseDNSMessage(data[2 : 2+length])
+	if err != nil {
+		return nil, err
+	}
+	return &DNSLayer{DNSMessage: m, TCP: true}, nil
+}
+
+func (l *DNSLayer) LayerName() string { return "DNS" }
+
+func (l *DNSLayer) Fields() []LayerField {
+	kind := "query"
+	if l.IsResponse() {
+		kind = "response"
+	}
+	fields := []LayerField{
+		{Name: "ID", Value: fmt.Sprintf("0x%04x", l.ID)},
+		{Name: "Flags", Value: fmt.Sprintf("0x%04x (%s)", l.Flags, kind)},
+		{Name: "RCode", Value: DNSRCodeString(l.RCode())},
+	}
+	if len(l.Questions) != 0 {
+		f := LayerField{Name: "Questions", Value: fmt.Sprint(len(l.Questions))}
+		for _, q := range l.Questions {
+			f.Children = append(f.Children, LayerField{
+				Name:  strings.TrimSuffix(q.Name, ".") + ".",
+				Value: DNSTypeString(q.Type),
+			})
+		}
+		fields = append(fields, f)
+	}
+	sections := []struct {
+		name    string
+		records []DNSResourceRecord
+	}{
+		{"Answers", l.Answers},
+		{"Authorities", l.Authorities},
+		{"Additionals", l.Additionals},
+	}
+	for _, s := range sections {
+		if len(s.records) == 0 {
+			continue
+		}
+		f := LayerField{Name: s.name, Value: fmt.Sprint(len(s.records))}
+		for _, rr := range s.records {
+			f.Children = append(f.Children, LayerField{Name: rr.String()})
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func (l *DNSLayer) Summary() string {
+	var s string
+	if l.IsResponse() {
+		s = fmt.Sprintf("DNS response 0x%04x %s", l.ID, DNSRCodeString(l.RCode()))
+		for _, rr := range l.Answers {
+			s += " " + strings.Join(strings.Fields(rr.String())[3:], " ")
+		}
+		return s
+	}
+	s = fmt.Sprintf("DNS query 0x%04x", l.ID)
+	for _, q := range l.Questions {
+		s += fmt.Sprintf(" %s %s.", DNSTypeString(q.Type), strings.TrimSuffix(q.Name, "."))
+	}
+	return s
+}
+
+func (l *DNSLayer) LayerPayload() []byte      { return nil }
+func (l *DNSLayer) NextDecoder() LayerDecoder { return nil }
+
+var tlsContentTypeNames = map[byte]string{
+	HandshakeTypeChangeCipherSpec: "ChangeCipherSpec",
+	ContentTypeAlert:              "Alert",
+	ContentTypeHandShake:          "Handshake",
+	ContentTypeApplicationData:    "ApplicationData",
+}
+
+var tlsHandshakeTypeNames = map[byte]string{
+	HandshakeTypeClientHello:         "ClientHello",
+	HandshakeTypeServerHello:         "ServerHello",
+	HandshakeTypeNewSessionTicket:    "NewSessionTicket",
+	HandshakeTypeEncryptedExtensions: "EncryptedExtensions",
+	HandshakeTypeCertificate:         "Certificate",
+	HandshakeTypeServerKeyExchange:   "ServerKeyExchange",
+	HandshakeTypeCertificateRequest:  "CertificateRequest",
+	HandshakeTypeServerHelloDone:     "ServerHelloDone",
+	HandshakeTypeCertificateVerify:   "CertificateVerify",
+	HandshakeTypeClientKeyExchange:   "ClientKeyExchange",
+	HandshakeTypeFinished:            "Finished",
+	HandshakeTypeKeyUpdate:           "KeyUpdate",
+}
+
+func tlsVersionString(v uint16) string {
+	switch v {
+	case 0x0301:
+		return "TLS1.0"
+	case 0x0302:
+		return "TLS1.1"
+	case 0x0303:
+		return "TLS1.2"
+	case 0x0304:
+		return "TLS1.3"
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// TLSRecord はTLSのレコード1つ。Fragmentはセグメントで切れていれば途中まで
+type TLSRecord struct {
+	ContentType byte
+	Version     uint16
+	Length      uint16
+	Fragment    []byte
+}
+
+// HandshakeType は平文のハンドシェイクのレコードならその種類を返す
+// 暗号化されていそうなら0とfalse
+func (r TLSRecord) HandshakeType() (byte, bool) {
+	if r.ContentType != ContentTypeHandShake || len(r.Fragment) < 4 {
+		return 0, false
+	}
+	if _, ok := tlsHandshakeTypeNames[r.Fragment[0]]; !ok {
+		return 0, false
+	}
+	length := int(r.Fragment[1])<<16 | int(r.Fragment[2])<<8 | int(r.Fragment[3])
+	if 4+length > int(r.Length) {
+		return 0, false
+	}
+	return r.Fragment[0], true
+}
+
+// TLSLayer はTCPのセグメントに入っているTLSのレコード
+// レコードの途中から始まるセグメントはContinuationにする
+type TLSLayer struct {
+	Records      []TLSRecord
+	Continuation []byte
+}
+
+func isTLSRecordHeader(b []byte) bool {
+	if len(b) < 5 {
+		return false
+	}
+	if _, ok := tlsContentTypeNames[b[0]]; !ok {
+		return false
+	}
+	return b[1] == 0x03 && b[2] <= 0x04
+}
+
+func DecodeTLS(data []byte) (Layer, error) {
+	l := &TLSLayer{}
+	if !isTLSRecordHeader(data) {
+		l.Continuation = data
+		return l, nil
+	}
+	for isTLSRecordHeader(data) {
+		r := TLSRecord{
+			ContentType: data[0],
+			Version:     binary.BigEndian.Uint16(data[1:3]),
+			Length:      binary.BigEndian.Uint16(data[3:5]),
+		}
+		end := 5 + int(r.Length)
+		if end > len(data) {
+			end = len(data)
+		}
+		r.Fragment = data[5:end]
+		l.Records = append(l.Records, r)
+		data = data[end:]
+	}
+	return l, nil
+}
+
+func (l *TLSLayer) LayerName() string { return "TLS" }
+
+func (l *TLSLayer) Fields() []LayerField {
+	if l.Continuation != nil {
+		return []LayerField{{Name: "Continuation", Value: fmt.Sprintf("%d bytes", len(l.Continuation))}}
+	}
+	var fields []LayerField
+	for _, r := range l.Records {
+		f := LayerField{
+			Name:  "Record",
+			Value: fmt.Sprintf("%s (%d)", tlsContentTypeNames[r.ContentType], r.ContentType),
+			Children: []LayerField{
+				{Name: "Version", Value: tlsVersionString(r.Version)},
+				{Name: "Length", Value: fmt.Sprint(r.Length)},
+			},
+		}
+		if t, ok := r.HandshakeType(); ok {
+			f.Children = append(f.Children, LayerField{Name: "Handshake Type", Value: tlsHandshakeTypeNames[t]})
+		} else if r.ContentType == ContentTypeHandShake {
+			f.Children = append(f.Children, LayerField{Name: "Handshake Type", Value: "Encrypted"})
+		}
+		if len(r.Fragment) < int(r.Length) {
+			f.Children = append(f.Children, LayerField{Name: "Truncated", Value: fmt.Sprintf("%d bytes", len(r.Fragment))})
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func (l *TLSLayer) Summary() string {
+	if l.Continuation != nil {
+		return "TLS continuation"
+	}
+	var records []string
+	for _, r := range l.Records {
+		name := tlsContentTypeNames[r.ContentType]
+		if t, ok := r.HandshakeType(); ok {
+			name += "(" + tlsHandshakeTypeNames[t] + ")"
+		}
+		records = append(records, name)
+	}
+	return "TLS " + strings.Join(records, " ")
+}
+
+func (l *TLSLayer) LayerPayload() []byte      { return nil }
+func (l *TLSLayer) NextDecoder() LayerDecoder { return nil }
+
+// HTTPLayer はHTTP/1.xのリクエストかレスポンスの開始行とヘッダ
+// メッセージの途中から始まるセグメントはContinuationにする
+type HTTPLayer struct {
+	Request bool
+	Method  string
+	URI     string
+	// "HTTP/1.1"
+	Version    string
+	StatusCode int
+	Reason     string
+	// 名前と値の組を出てきた順番で
+	Headers [][2]string
+	Body    []byte
+	// ヘッダの終わりまでセグメントに入っていなければfalse
+	Complete     bool
+	Continuation []byte
+}
+
+var httpMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH"}
+
+// parseHTTPStartLine はリクエスト行かステータス行をパースする
+func parseHTTPStartLine(l *HTTPLayer, line string) bool {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	if strings.HasPrefix(parts[0], "HTTP/1.") {
+		code, err := strconv.Atoi(parts[1])
+		if err != nil || len(parts[1]) != 3 {
+			return false
+		}
+		l.Version, l.StatusCode = parts[0], code
+		if len(parts) == 3 {
+			l.Reason = parts[2]
+		}
+		return true
+	}
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "HTTP/1.") {
+		return false
+	}
+	for _, m := range httpMethods {
+		if parts[0] == m {
+			l.Request = true
+			l.Method, l.URI, l.Version = parts[0], parts[1], parts[2]
+			return true
+		}
+	}
+	return false
+}
+
+func DecodeHTTP(data []byte) (Layer, error) {
+	l := &HTTPLayer{}
+	head := data
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		head = data[:i]
+		l.Body = data[i+4:]
+		l.Complete = true
+	}
+	lines := strings.Split(string(head), "\r\n")
+	if !parseHTTPStartLine(l, lines[0]) {
+		return &HTTPLayer{Continuation: data}, nil
+	}
+	for _, line := range lines[1:] {
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			// 途中で切れたヘッダ
+			continue
+		}
+		l.Headers = append(l.Headers, [2]string{line[:i], strings.TrimSpace(line[i+1:])})
+	}
+	return l, nil
+}
+
+// Header はnameのヘッダの最初の値を返す。大文字小文字は区別しない
+func (l *HTTPLayer) Header(name string) string {
+	for _, h := range l.Headers {
+		if strings.EqualFold(h[0], name) {
+			return h[1]
+		}
+	}
+	return ""
+}
+
+func (l *HTTPLayer) LayerName() string { return "HTTP" }
+
+func (l *HTTPLayer) Fields() []LayerField {
+	if l.Continuation != nil {
+		return []LayerField{{Name: "Continuation", Value: fmt.Sprintf("%d bytes", len(l.Continuation))}}
+	}
+	var fields []LayerField
+	if l.Request {
+		fields = append(fields,
+			LayerField{Name: "Method", Value: l.Method},
+			LayerField{Name: "URI", Value: l.URI},
+			LayerField{Name: "Version", Value: l.Version},
+		)
+	} else {
+		fields = append(fields,
+			LayerField{Name: "Version", Value: l.Version},
+			LayerField{Name: "Status", Value: strings.TrimSpace(fmt.Sprintf("%d %s", l.StatusCode, l.Reason))},
+		)
+	}
+	if len(l.Headers) != 0 {
+		f := LayerField{Name: "Headers"}
+		for _, h := range l.Headers {
+			f.Children = append(f.Children, LayerField{Name: h[0], Value: h[1]})
+		}
+		fields = append(fields, f)
+	}
+	if len(l.Body) != 0 {
+		fields = append(fields, LayerField{Name: "Body", Value: fmt.Sprintf("%d bytes", len(l.Body))})
+	}
+	return fields
+}
+
+func (l *HTTPLayer) Summary() string {
+	switch {
+	case l.Continuation != nil:
+		return "HTTP continuation"
+	case l.Request:
+		return fmt.Sprintf("HTTP %s %s %s", l.Method, l.URI, l.Version)
+	}
+	return strings.TrimSpace(fmt.Sprintf("HTTP %s %d %s", l.Version, l.StatusCode, l.Reason))
+}
+
+func (l *HTTPLayer) LayerPayload() []byte      { return nil }
+func (l *HTTPLayer) NextDecoder() LayerDecoder { return nil }
@@ -0,0 +1,662 @@
+package tcpip
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+func layerTooShort(name string, length int) error {
+	return fmt.Errorf("%s is too short : %d", name, length)
+}
+
+var etherTypeNames = map[uint16]string{
+	0x0800: "IPv4",
+	0x0806: "ARP",
+	0x86dd: "IPv6",
+	0x8100: "802.1Q",
+	0x88a8: "802.1ad",
+}
+
+func etherTypeString(t uint16) string {
+	if name, ok := etherTypeNames[t]; ok {
+		return fmt.Sprintf("%s (0x%04x)", name, t)
+	}
+	return fmt.Sprintf("0x%04x", t)
+}
+
+var ipProtocolNames = map[byte]string{
+	IPProtoICMP:   "ICMP",
+	IPProtoIGMP:   "IGMP",
+	IPProtoTCP:    "TCP",
+	IPProtoUDP:    "UDP",
+	IPProtoICMPv6: "ICMPv6",
+}
+
+func ipProtocolString(p byte) string {
+	if name, ok := ipProtocolNames[p]; ok {
+		return fmt.Sprintf("%s (%d)", name, p)
+	}
+	return fmt.Sprint(p)
+}
+
+// EthernetLayer はEthernetのヘッダ。VLANタグは次のVLANLayerになる
+type EthernetLayer struct {
+	DstMacAddr    net.HardwareAddr
+	SourceMacAddr net.HardwareAddr
+	EtherType     uint16
+	Payload       []byte
+}
+
+func DecodeEthernet(data []byte) (Layer, error) {
+	if len(data) < 14 {
+		return nil, layerTooShort("ethernet frame", len(data))
+	}
+	return &EthernetLayer{
+		DstMacAddr:    net.HardwareAddr(data[0:6]),
+		SourceMacAddr: net.HardwareAddr(data[6:12]),
+		EtherType:     binary.BigEndian.Uint16(data[12:14]),
+		Payload:       data[14:],
+	}, nil
+}
+
+func (l *EthernetLayer) LayerName() string { return "Ethernet" }
+
+func (l *EthernetLayer) Fields() []LayerField {
+	return []LayerField{
+		{Name: "Destination", Value: l.DstMacAddr.String()},
+		{Name: "Source", Value: l.SourceMacAddr.String()},
+		{Name: "Type", Value: etherTypeString(l.EtherType)},
+	}
+}
+
+func (l *EthernetLayer) LayerPayload() []byte { return l.Payload }
+
+func (l *EthernetLayer) NextDecoder() LayerDecoder {
+	return lookupDecoder(decoderEtherType, l.EtherType)
+}
+
+// VLANLayer は802.1Q/802.1adのタグ1つ分。TPIDは1つ外側の層のTypeに入っている
+type VLANLayer struct {
+	PCP       byte
+	DEI       bool
+	VID       uint16
+	EtherType uint16
+	Payload   []byte
+}
+
+func DecodeVLAN(data []byte) (Layer, error) {
+	if len(data) < 4 {
+		return nil, layerTooShort("vlan tag", len(data))
+	}
+	tag := VLANTag{TCI: data[0:2]}
+	return &VLANLayer{
+		PCP:       tag.PCP(),
+		DEI:       tag.DEI(),
+		VID:       tag.VID(),
+		EtherType: binary.BigEndian.Uint16(data[2:4]),
+		Payload:   data[4:],
+	}, nil
+}
+
+func (l *VLANLayer) LayerName() string { return "VLAN" }
+
+func (l *VLANLayer) Fields() []LayerField {
+	return []LayerField{
+		{Name: "Priority", Value: fmt.Sprint(l.PCP)},
+		{Name: "DEI", Value: fmt.Sprint(l.DEI)},
+		{Name: "ID", Value: fmt.Sprint(l.VID)},
+		{Name: "Type", Value: etherTypeString(l.EtherType)},
+	}
+}
+
+func (l *VLANLayer) Summary() string {
+	return fmt.Sprintf("vlan %d, p %d", l.VID, l.PCP)
+}
+
+func (l *VLANLayer) LayerPayload() []byte { return l.Payload }
+
+func (l *VLANLayer) NextDecoder() LayerDecoder {
+	return lookupDecoder(decoderEtherType, l.EtherType)
+}
+
+// ARPLayer はEthernetとIPv4のARP
+type ARPLayer struct {
+	Operation     uint16
+	SenderMacAddr net.HardwareAddr
+	SenderIPAddr  net.IP
+	TargetMacAddr net.HardwareAddr
+	TargetIPAddr  net.IP
+}
+
+func DecodeARP(data []byte) (Layer, error) {
+	if len(data) < 28 {
+		return nil, layerTooShort("arp", len(data))
+	}
+	if data[4] != 6 || data[5] != 4 {
+		return nil, fmt.Errorf("arp address size is not supported : %d, %d", data[4], data[5])
+	}
+	return &ARPLayer{
+		Operation:     binary.BigEndian.Uint16(data[6:8]),
+		SenderMacAddr: net.HardwareAddr(data[8:14]),
+		SenderIPAddr:  net.IP(data[14:18]),
+		TargetMacAddr: net.HardwareAddr(data[18:24]),
+		TargetIPAddr:  net.IP(data[24:28]),
+	}, nil
+}
+
+func (l *ARPLayer) LayerName() string { return "ARP" }
+
+func (l *ARPLayer) Fields() []LayerField {
+	op := fmt.Sprint(l.Operation)
+	switch l.Operation {
+	case 1:
+		op = "request (1)"
+	case 2:
+		op = "reply (2)"
+	}
+	return []LayerField{
+		{Name: "Operation", Value: op},
+		{Name: "Sender MAC", Value: l.SenderMacAddr.String()},
+		{Name: "Sender IP", Value: l.SenderIPAddr.String()},
+		{Name: "Target MAC", Value: l.TargetMacAddr.String()},
+		{Name: "Target IP", Value: l.TargetIPAddr.String()},
+	}
+}
+
+func (l *ARPLayer) Summary() string {
+	switch l.Operation {
+	case 1:
+		return fmt.Sprintf("ARP, Request who-has %s tell %s", l.TargetIPAddr, l.SenderIPAddr)
+	case 2:
+		return fmt.Sprintf("ARP, Reply %s is-at %s", l.SenderIPAddr, l.SenderMacAddr)
+	}
+	return fmt.Sprintf("ARP, Operation %d", l.Operation)
+}
+
+// Ethernetのパディングは捨てる
+func (l *ARPLayer) LayerPayload() []byte      { return nil }
+func (l *ARPLayer) NextDecoder() LayerDecoder { return nil }
+
+// IPv4Layer はIPv4のヘッダ。Payloadはヘッダの全長で切り詰める
+type IPv4Layer struct {
+	HeaderLength   int
+	TOS            byte
+	TotalLength    uint16
+	ID             uint16
+	Flags          byte
+	FragmentOffset uint16
+	TTL            byte
+	Protocol       byte
+	Checksum       uint16
+	SourceIPAddr   net.IP
+	DstIPAddr      net.IP
+	Options        []byte
+	Payload        []byte
+}
+
+func DecodeIPv4(data []byte) (Layer, error) {
+	if len(data) < 20 {
+		return nil, layerTooShort("ipv4 header", len(data))
+	}
+	if data[0]>>4 != 4 {
+		return nil, fmt.Errorf("ip version is not 4 : %d", data[0]>>4)
+	}
+	hlen := ipHeaderLength(data)
+	if hlen < 20 || hlen > len(data) {
+		return nil, fmt.Errorf("invalid ipv4 header length : %d", hlen)
+	}
+	total := int(binary.BigEndian.Uint16(data[2:4]))
+	if total < hlen {
+		return nil, fmt.Errorf("invalid ipv4 total length : %d", total)
+	}
+	// キャプチャで切り詰められていたらあるところまで
+	end := total
+	if end > len(data) {
+		end = len(data)
+	}
+	flags := binary.BigEndian.Uint16(data[6:8])
+	return &IPv4Layer{
+		HeaderLength:   hlen,
+		TOS:            data[1],
+		TotalLength:    uint16(total),
+		ID:             binary.BigEndian.Uint16(data[4:6]),
+		Flags:          byte(flags >> 13),
+		FragmentOffset: flags & 0x1fff,
+		TTL:            data[8],
+		Protocol:       data[9],
+		Checksum:       binary.BigEndian.Uint16(data[10:12]),
+		SourceIPAddr:   net.IP(data[12:16]),
+		DstIPAddr:      net.IP(data[16:20]),
+		Options:        data[20:hlen],
+		Payload:        data[hlen:end],
+	}, nil
+}
+
+func (l *IPv4Layer) LayerName() string { return "IPv4" }
+
+// Fragmented はフラグメントの一部ならtrue
+func (l *IPv4Layer) Fragmented() bool {
+	return l.Flags&0x01 != 0 || l.FragmentOffset != 0
+}
+
+func (l *IPv4Layer) Fields() []LayerField {
+	var flags []string
+	if l.Flags&0x02 != 0 {
+		flags = append(flags, "DF")
+	}
+	if l.Flags&0x01 != 0 {
+		flags = append(flags, "MF")
+	}
+	fields := []LayerField{
+		{Name: "Header Length", Value: fmt.Sprint(l.HeaderLength)},
+		{Name: "TOS", Value: fmt.Sprintf("0x%02x", l.TOS)},
+		{Name: "Total Length", Value: fmt.Sprint(l.TotalLength)},
+		{Name: "Identification", Value: fmt.Sprintf("0x%04x", l.ID)},
+		{Name: "Flags", Value: strings.Join(flags, ",")},
+		{Name: "Fragment Offset", Value: fmt.Sprint(l.FragmentOffset * 8)},
+		{Name: "TTL", Value: fmt.Sprint(l.TTL)},
+		{Name: "Protocol", Value: ipProtocolString(l.Protocol)},
+		{Name: "Checksum", Value: fmt.Sprintf("0x%04x", l.Checksum)},
+		{Name: "Source", Value: l.SourceIPAddr.String()},
+		{Name: "Destination", Value: l.DstIPAddr.String()},
+	}
+	if len(l.Options) != 0 {
+		fields = append(fields, LayerField{Name: "Options", Value: fmt.Sprintf("%x", l.Options)})
+	}
+	return fields
+}
+
+func (l *IPv4Layer) LayerPayload() []byte { return l.Payload }
+
+// フラグメントは組み立てないので、上の層はデコードしない
+func (l *IPv4Layer) NextDecoder() LayerDecoder {
+	if l.Fragmented() {
+		return nil
+	}
+	return lookupDecoder(decoderIPProtocol, uint16(l.Protocol))
+}
+
+// IPv6のExtension Header
+const (
+	ipv6HopByHop     = 0
+	ipv6Routing      = 43
+	ipv6Fragment     = 44
+	ipv6AuthHeader   = 51
+	ipv6DestOptions  = 60
+	ipv6NoNextHeader = 59
+)
+
+// IPv6Layer はIPv6のヘッダ。Extension Headerは読み飛ばしてProtocolに最後のNext Headerを入れる
+type IPv6Layer struct {
+	TrafficClass  byte
+	FlowLabel     uint32
+	PayloadLength uint16
+	NextHeader    byte
+	HopLimit      byte
+	SourceIPAddr  net.IP
+	DstIPAddr     net.IP
+	// 読み飛ばしたExtension Headerの種類
+	ExtensionHeaders []byte
+	Protocol         byte
+	// フラグメントの一部ならtrue
+	Fragmented bool
+	Payload    []byte
+}
+
+func DecodeIPv6(data []byte) (Layer, error) {
+	if len(data) < 40 {
+		return nil, layerTooShort("ipv6 header", len(data))
+	}
+	if data[0]>>4 != 6 {
+		return nil, fmt.Errorf("ip version is not 6 : %d", data[0]>>4)
+	}
+	vtf := binary.BigEndian.Uint32(data[0:4])
+	l := &IPv6Layer{
+		TrafficClass:  byte(vtf >> 20),
+		FlowLabel:     vtf & 0xfffff,
+		PayloadLength: binary.BigEndian.Uint16(data[4:6]),
+		NextHeader:    data[6],
+		HopLimit:      data[7],
+		SourceIPAddr:  net.IP(data[8:24]),
+		DstIPAddr:     net.IP(data[24:40]),
+	}
+	payload := data[40:]
+	if int(l.PayloadLength) < len(payload) {
+		payload = payload[:l.PayloadLength]
+	}
+	next := l.NextHeader
+	for {
+		var hlen int
+		switch next {
+		case ipv6HopByHop, ipv6Routing, ipv6DestOptions:
+			if len(payload) < 2 {
+				return nil, layerTooShort("ipv6 extension header", len(payload))
+			}
+			hlen = int(payload[1])*8 + 8
+		case ipv6Fragment:
+			if len(payload) < 8 {
+				return nil, layerTooShort("ipv6 fragment header", len(payload))
+			}
+			hlen = 8
+			// Fragment Offsetが0でないか、Mフラグがある
+			if binary.BigEndian.Uint16(payload[2:4]) != 0 {
+				l.Fragmented = true
+			}
+		case ipv6AuthHeader:
+			if len(payload) < 2 {
+				return nil, layerTooShort("ipv6 authentication header", len(payload))
+			}
+			hlen = (int(payload[1]) + 2) * 4
+		}
+		if hlen == 0 {
+			break
+		}
+		if hlen > len(payload) {
+			return nil, layerTooShort("ipv6 extension header", len(payload))
+		}
+		l.ExtensionHeaders = append(l.ExtensionHeaders, next)
+		next = payload[0]
+		payload = payload[hlen:]
+	}
+	l.Protocol = next
+	l.Payload = payload
+	return l, nil
+}
+
+func (l *IPv6Layer) LayerName() string { return "IPv6" }
+
+func (l *IPv6Layer) Fields() []LayerField {
+	fields := []LayerField{
+		{Name: "Traffic Class", Value: fmt.Sprintf("0x%02x", l.TrafficClass)},
+		{Name: "Flow Label", Value: fmt.Sprintf("0x%05x", l.FlowLabel)},
+		{Name: "Payload Length", Value: fmt.Sprint(l.PayloadLength)},
+		{Name: "Next Header", Value: ipProtocolString(l.NextHeader)},
+		{Name: "Hop Limit", Value: fmt.Sprint(l.HopLimit)},
+		{Name: "Source", Value: l.SourceIPAddr.String()},
+		{Name: "Destination", Value: l.DstIPAddr.String()},
+	}
+	if len(l.ExtensionHeaders) != 0 {
+		ext := LayerField{Name: "Extension Headers"}
+		for _, h := range l.ExtensionHeaders {
+			ext.Children = append(ext.Children, LayerField{Name: "Header", Value: fmt.Sprint(h)})
+		}
+		fields = append(fields, ext, LayerField{Name: "Protocol", Value: ipProtocolString(l.Protocol)})
+	}
+	return fields
+}
+
+func (l *IPv6Layer) LayerPayload() []byte { return l.Payload }
+
+func (l *IPv6Layer) NextDecoder() LayerDecoder {
+	if l.Fragmented || l.Protocol == ipv6NoNextHeader {
+		return nil
+	}
+	return lookupDecoder(decoderIPProtocol, uint16(l.Protocol))
+}
+
+// TCPLayer はTCPのヘッダ
+type TCPLayer struct {
+	SourcePort uint16
+	DestPort   uint16
+	Seq        uint32
+	Ack        uint32
+	// オプション込みのヘッダの長さ
+	HeaderLength int
+	Flags        byte
+	Window       uint16
+	Checksum     uint16
+	Urgent       uint16
+	Options      []byte
+	Payload      []byte
+}
+
+func DecodeTCP(data []byte) (Layer, error) {
+	if len(data) < 20 {
+		return nil, layerTooShort("tcp header", len(data))
+	}
+	hlen := int(data[12]>>4) * 4
+	if hlen < 20 || hlen > len(data) {
+		return nil, fmt.Errorf("invalid tcp header length : %d", hlen)
+	}
+	return &TCPLayer{
+		SourcePort:   binary.BigEndian.Uint16(data[0:2]),
+		DestPort:     binary.BigEndian.Uint16(data[2:4]),
+		Seq:          binary.BigEndian.Uint32(data[4:8]),
+		Ack:          binary.BigEndian.Uint32(data[8:12]),
+		HeaderLength: hlen,
+		Flags:        data[13],
+		Window:       binary.BigEndian.Uint16(data[14:16]),
+		Checksum:     binary.BigEndian.Uint16(data[16:18]),
+		Urgent:       binary.BigEndian.Uint16(data[18:20]),
+		Options:      data[20:hlen],
+		Payload:      data[hlen:],
+	}, nil
+}
+
+func (l *TCPLayer) LayerName() string { return "TCP" }
+
+// FlagString は"SYN,ACK"のようにフラグを並べる
+func (l *TCPLayer) FlagString() string {
+	names := []struct {
+		flag byte
+		name string
+	}{
+		{FIN, "FIN"}, {SYN, "SYN"}, {RST, "RST"}, {PSH, "PSH"},
+		{ACK, "ACK"}, {0x20, "URG"}, {0x40, "ECE"}, {0x80, "CWR"},
+	}
+	var flags []string
+	for _, n := range names {
+		if l.Flags&n.flag != 0 {
+			flags = append(flags, n.name)
+		}
+	}
+	return strings.Join(flags, ",")
+}
+
+// Summary のフラグはtcpdumpと同じ1文字の表記にする。ACKは"."
+func (l *TCPLayer) Summary() string {
+	var flags string
+	for _, f := range []struct {
+		flag byte
+		mark string
+	}{
+		{SYN, "S"}, {FIN, "F"}, {RST, "R"}, {PSH, "P"}, {0x20, "U"}, {0x40, "E"}, {0x80, "W"}, {ACK, "."},
+	} {
+		if l.Flags&f.flag != 0 {
+			flags += f.mark
+		}
+	}
+	return fmt.Sprintf("Flags [%s], seq %d, ack %d, win %d, length %d", flags, l.Seq, l.Ack, l.Window, len(l.Payload))
+}
+
+func (l *TCPLayer) Fields() []LayerField {
+	fields := []LayerField{
+		{Name: "Source Port", Value: fmt.Sprint(l.SourcePort)},
+		{Name: "Destination Port", Value: fmt.Sprint(l.DestPort)},
+		{Name: "Sequence Number", Value: fmt.Sprint(l.Seq)},
+		{Name: "Acknowledgment Number", Value: fmt.Sprint(l.Ack)},
+		{Name: "Header Length", Value: fmt.Sprint(l.HeaderLength)},
+		{Name: "Flags", Value: l.FlagString()},
+		{Name: "Window", Value: fmt.Sprint(l.Window)},
+		{Name: "Checksum", Value: fmt.Sprintf("0x%04x", l.Checksum)},
+		{Name: "Urgent Pointer", Value: fmt.Sprint(l.Urgent)},
+	}
+	if len(l.Options) != 0 {
+		fields = append(fields, LayerField{Name: "Options", Value: fmt.Sprintf("%x", l.Options)})
+	}
+	return fields
+}
+
+func (l *TCPLayer) LayerPayload() []byte { return l.Payload }
+
+func (l *TCPLayer) NextDecoder() LayerDecoder {
+	return portDecoder(decoderTCPPort, l.SourcePort, l.DestPort)
+}
+
+// UDPLayer はUDPのヘッダ
+type UDPLayer struct {
+	SourcePort uint16
+	DestPort   uint16
+	Length     uint16
+	Checksum   uint16
+	Payload    []byte
+}
+
+func DecodeUDP(data []byte) (Layer, error) {
+	if len(data) < 8 {
+		return nil, layerTooShort("udp header", len(data))
+	}
+	length := int(binary.BigEndian.Uint16(data[4:6]))
+	if length < 8 {
+		return nil, fmt.Errorf("invalid udp length : %d", length)
+	}
+	end := length
+	if end > len(data) {
+		end = len(data)
+	}
+	return &UDPLayer{
+		SourcePort: binary.BigEndian.Uint16(data[0:2]),
+		DestPort:   binary.BigEndian.Uint16(data[2:4]),
+		Length:     uint16(length),
+		Checksum:   binary.BigEndian.Uint16(data[6:8]),
+		Payload:    data[8:end],
+	}, nil
+}
+
+func (l *UDPLayer) LayerName() string { return "UDP" }
+
+func (l *UDPLayer) Fields() []LayerField {
+	return []LayerField{
+		{Name: "Source Port", Value: fmt.Sprint(l.SourcePort)},
+		{Name: "Destination Port", Value: fmt.Sprint(l.DestPort)},
+		{Name: "Length", Value: fmt.Sprint(l.Length)},
+		{Name: "Checksum", Value: fmt.Sprintf("0x%04x", l.Checksum)},
+	}
+}
+
+func (l *UDPLayer) Summary() string {
+	return fmt.Sprintf("UDP, length %d", len(l.Payload))
+}
+
+func (l *UDPLayer) LayerPayload() []byte { return l.Payload }
+
+func (l *UDPLayer) NextDecoder() LayerDecoder {
+	return portDecoder(decoderUDPPort, l.SourcePort, l.DestPort)
+}
+
+var icmpTypeNames = map[byte]string{
+	ICMPTypeEchoReply:              "Echo Reply",
+	ICMPTypeDestinationUnreachable: "Destination Unreachable",
+	ICMPTypeRedirect:               "Redirect",
+	ICMPTypeEchoRequest:            "Echo Request",
+	ICMPTypeTimeExceeded:           "Time Exceeded",
+	ICMPTypeParameterProblem:       "Parameter Problem",
+}
+
+var icmpv6TypeNames = map[byte]string{
+	1:   "Destination Unreachable",
+	2:   "Packet Too Big",
+	3:   "Time Exceeded",
+	4:   "Parameter Problem",
+	128: "Echo Request",
+	129: "Echo Reply",
+	133: "Router Solicitation",
+	134: "Router Advertisement",
+	135: "Neighbor Solicitation",
+	136: "Neighbor Advertisement",
+	137: "Redirect",
+}
+
+// ICMPLayer はICMPとICMPv6のヘッダ
+// Restはタイプごとに意味が変わる4byte(EchoならIdentifierとSequence Number)
+type ICMPLayer struct {
+	V6       bool
+	Type     byte
+	Code     byte
+	Checksum uint16
+	Rest     []byte
+	Payload  []byte
+}
+
+func DecodeICMP(data []byte) (Layer, error) {
+	return decodeICMP(data, false)
+}
+
+func DecodeICMPv6(data []byte) (Layer, error) {
+	return decodeICMP(data, true)
+}
+
+func decodeICMP(data []byte, v6 bool) (Layer, error) {
+	if len(data) < 8 {
+		return nil, layerTooShort("icmp header", len(data))
+	}
+	return &ICMPLayer{
+		V6:       v6,
+		Type:     data[0],
+		Code:     data[1],
+		Checksum: binary.BigEndian.Uint16(data[2:4]),
+		Rest:     data[4:8],
+		Payload:  data[8:],
+	}, nil
+}
+
+func (l *ICMPLayer) LayerName() string {
+	if l.V6 {
+		return "ICMPv6"
+	}
+	return "ICMP"
+}
+
+// IsEcho はEcho RequestかEcho Replyならtrue
+func (l *ICMPLayer) IsEcho() bool {
+	if l.V6 {
+		return l.Type == 128 || l.Type == 129
+	}
+	return l.Type == ICMPTypeEchoRequest || l.Type == ICMPTypeEchoReply
+}
+
+func (l *ICMPLayer) typeName() string {
+	names := icmpTypeNames
+	if l.V6 {
+		names = icmpv6TypeNames
+	}
+	if name, ok := names[l.Type]; ok {
+		return name
+	}
+	return ""
+}
+
+func (l *ICMPLayer) Summary() string {
+	s := fmt.Sprintf("%s type %d code %d", l.LayerName(), l.Type, l.Code)
+	if name := l.typeName(); name != "" {
+		s = fmt.Sprintf("%s %s", l.LayerName(), name)
+	}
+	if l.IsEcho() {
+		s += fmt.Sprintf(", id %d, seq %d", binary.BigEndian.Uint16(l.Rest[0:2]), binary.BigEndian.Uint16(l.Rest[2:4]))
+	}
+	return s + fmt.Sprintf(", length %d", len(l.Payload)+8)
+}
+
+func (l *ICMPLayer) Fields() []LayerField {
+	typ := fmt.Sprint(l.Type)
+	if name := l.typeName(); name != "" {
+		typ = fmt.Sprintf("%s (%d)", name, l.Type)
+	}
+	fields := []LayerField{
+		{Name: "Type", Value: typ},
+		{Name: "Code", Value: fmt.Sprint(l.Code)},
+		{Name: "Checksum", Value: fmt.Sprintf("0x%04x", l.Checksum)},
+	}
+	if l.IsEcho() {
+		fields = append(fields,
+			LayerField{Name: "Identifier", Value: fmt.Sprint(binary.BigEndian.Uint16(l.Rest[0:2]))},
+			LayerField{Name: "Sequence Number", Value: fmt.Sprint(binary.BigEndian.Uint16(l.Rest[2:4]))},
+		)
+	}
+	return fields
+}
+
+func (l *ICMPLayer) LayerPayload() []byte      { return l.Payload }
+func (l *ICMPLayer) NextDecoder() LayerDecoder { return nil }
@@ -1,9 +1,17 @@
 package tcpip
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"log"
-	"syscall"
+	"net"
+	"strings"
+)
+
+var (
+	ErrDNSMessageTooShort = errors.New("dns message is too short")
+	ErrDNSInvalidName     = errors.New("invalid dns name")
+	ErrDNSPointerLoop     = errors.New("too many dns compression pointers")
 )
 
 type DNS struct {
@@ -19,16 +27,14 @@ type DNS struct {
 }
 
 func NewDNSQuery(host string) DNS {
-	bytehost := []byte{0x03, 0x77, 0x77, 0x77, 0x04, 0x6a, 0x70, 0x72,
-		0x73, 0x02, 0x63, 0x6f, 0x02, 0x6a, 0x70, 0x00,
+	bytehost, err := encodeDNSName(host)
+	if err != nil {
+		bytehost = []byte{0x00}
 	}
-	//if len(bytehost)%2 != 0 {
-	//	bytehost = paddingZero(bytehost)
-	//}
 
 	return DNS{
-		// 適当な値をセット
-		TransactionID: []byte{0x00, 0x00},
+		// 返事と問い合わせを対応させるのでランダムにする
+		TransactionID: randomByte(2),
 		// https://atmarkit.itmedia.co.jp/ait/articles/1601/29/news014.html
 		// Flags 1byte: QR = 0, OPCode = 0000, AA = 0, TC = 0, RD = 1 → 0x01
 		// Flags 2byte: RA = 0, Z = 0, AD = 1, CD = 0, RCode = 0000   → 100000 = 32 = 0x20
@@ -45,66 +51,583 @@ func NewDNSQuery(host string) DNS {
 
 }
 
-func (*DNS) SendQuery(packet []byte) {
-	addr := syscall.SockaddrLinklayer{
-		Protocol: syscall.ETH_P_IP,
-		Ifindex:  1,
+// DNSQuestion は問い合わせる名前とタイプ
+type DNSQuestion struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// DNSResourceRecord はAnswer, Authority, Additionalに入るレコード
+type DNSResourceRecord struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	// Typeに応じてDNSA, DNSCNAMEなどが入る。知らないTypeならRDATAの[]byte
+	Data interface{}
+}
+
+type DNSA struct {
+	Addr net.IP
+}
+
+type DNSAAAA struct {
+	Addr net.IP
+}
+
+type DNSCNAME struct {
+	Target string
+}
+
+type DNSNS struct {
+	Host string
+}
+
+type DNSPTR struct {
+	Target string
+}
+
+type DNSMX struct {
+	Preference uint16
+	Exchange   string
+}
+
+type DNSTXT struct {
+	Texts []string
+}
+
+type DNSSRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+type DNSSOA struct {
+	MName   string
+	RName   string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+
+// DNSMessage はDNSのメッセージ全体
+// https://datatracker.ietf.org/doc/html/rfc1035#section-4
+type DNSMessage struct {
+	ID uint16
+	// QR, Opcode, AA, TC, RD, RA, Z, AD, CD, RCODE
+	Flags       uint16
+	Questions   []DNSQuestion
+	Answers     []DNSResourceRecord
+	Authorities []DNSResourceRecord
+	Additionals []DNSResourceRecord
+}
+
+// NewDNSQueryMessage はランダムなIDで再帰問い合わせのメッセージを作る
+func NewDNSQueryMessage(name string, qtype uint16) DNSMessage {
+	return DNSMessage{
+		ID:    binary.BigEndian.Uint16(randomByte(2)),
+		Flags: DNSFlagRD,
+		Questions: []DNSQuestion{{
+			Name:  name,
+			Type:  qtype,
+			Class: DNSClassINET,
+		}},
+	}
+}
+
+func (m DNSMessage) RCode() int {
+	return int(m.Flags & 0x000f)
+}
+
+func (m DNSMessage) Truncated() bool {
+	return m.Flags&DNSFlagTC != 0
+}
+
+func (m DNSMessage) IsResponse() bool {
+	return m.Flags&DNSFlagQR != 0
+}
+
+// Pack はメッセージをbyteにする。同じ名前は圧縮ポインタで参照する
+func (m DNSMessage) Pack() ([]byte, error) {
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:2], m.ID)
+	binary.BigEndian.PutUint16(b[2:4], m.Flags)
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(b[6:8], uint16(len(m.Answers)))
+	binary.BigEndian.PutUint16(b[8:10], uint16(len(m.Authorities)))
+	binary.BigEndian.PutUint16(b[10:12], uint16(len(m.Additionals)))
+
+	comp := make(map[string]int)
+	var err error
+	for _, q := range m.Questions {
+		if b, err = packDNSName(b, q.Name, comp); err != nil {
+			return nil, err
+		}
+		b = append(b, UintTo2byte(q.Type)...)
+		b = append(b, UintTo2byte(q.Class)...)
 	}
+	for _, section := range [][]DNSResourceRecord{m.Answers, m.Authorities, m.Additionals} {
+		for _, rr := range section {
+			if b, err = packDNSRecord(b, rr, comp); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b, nil
+}
 
-	sendfd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ALL)))
-	if err != nil {
-		log.Fatalf("create udp sendfd err : %v\n", err)
+// ParseDNSMessage はbyteのメッセージを読む
+func ParseDNSMessage(b []byte) (DNSMessage, error) {
+	var m DNSMessage
+	if len(b) < 12 {
+		return m, ErrDNSMessageTooShort
+	}
+	m.ID = binary.BigEndian.Uint16(b[0:2])
+	m.Flags = binary.BigEndian.Uint16(b[2:4])
+	qdcount := int(binary.BigEndian.Uint16(b[4:6]))
+	counts := []int{
+		int(binary.BigEndian.Uint16(b[6:8])),
+		int(binary.BigEndian.Uint16(b[8:10])),
+		int(binary.BigEndian.Uint16(b[10:12])),
 	}
 
-	err = syscall.Sendto(sendfd, packet, 0, &addr)
-	if err != nil {
-		log.Fatalf("Send to err : %v\n", err)
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		name, next, err := decodeDNSName(b, off)
+		if err != nil {
+			return m, err
+		}
+		if next+4 > len(b) {
+			return m, ErrDNSMessageTooShort
+		}
+		m.Questions = append(m.Questions, DNSQuestion{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[next : next+2]),
+			Class: binary.BigEndian.Uint16(b[next+2 : next+4]),
+		})
+		off = next + 4
 	}
-	fmt.Println("UDP packet send")
-	syscall.Close(sendfd)
+
+	sections := []*[]DNSResourceRecord{&m.Answers, &m.Authorities, &m.Additionals}
+	for i, section := range sections {
+		for j := 0; j < counts[i]; j++ {
+			rr, next, err := parseDNSRecord(b, off)
+			if err != nil {
+				return m, err
+			}
+			*section = append(*section, rr)
+			off = next
+		}
+	}
+	return m, nil
 }
 
-func sendDNS() {
-	//　ルータのMacアドレス
-	routermac := []byte{0x1c, 0x3b, 0xf3, 0x95, 0x6a, 0x2c}
+// encodeDNSName は名前をラベルの長さ+文字列の並びにする
+// www.example.com → 3www7example3com0
+func encodeDNSName(name string) ([]byte, error) {
+	return packDNSName(nil, name, nil)
+}
 
-	localif, err := getLocalIpAddr("wlp4s0")
+// packDNSName はbに名前を追加する。compがnilでなければ圧縮する
+func packDNSName(b []byte, name string, comp map[string]int) ([]byte, error) {
+	labels, err := splitDNSName(name)
 	if err != nil {
-		log.Fatalf("getLocalIpAddr err : %v", err)
+		return nil, fmt.Errorf("%w: %s", err, name)
+	}
+	if len(labels) == 0 {
+		return append(b, 0x00), nil
+	}
+	// 長さのバイトと最後の0を入れて255バイトまで
+	size := 1
+	for _, label := range labels {
+		size += 1 + len(label)
+	}
+	if size > 255 {
+		return nil, fmt.Errorf("%w: %s", ErrDNSInvalidName, name)
 	}
+	for i := range labels {
+		suffix := strings.ToLower(joinDNSLabels(labels[i:]))
+		if comp != nil {
+			// 前に出てきた名前ならポインタにする
+			if ptr, ok := comp[suffix]; ok {
+				return append(b, byte(0xc0|ptr>>8), byte(ptr)), nil
+			}
+			if len(b) < 0x4000 {
+				comp[suffix] = len(b)
+			}
+		}
+		label := labels[i]
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("%w: %s", ErrDNSInvalidName, name)
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0x00), nil
+}
 
-	ipheader := NewIPHeader(localif.LocalIpAddr, Iptobyte("192.168.0.254"), "UDP")
+// splitDNSName は名前をラベルに分けて、"\."と"\\"のエスケープを元に戻す
+// DNS-SDのインスタンス名のようにラベルの中に"."を含められる(RFC6763 4.3)
+func splitDNSName(name string) ([]string, error) {
+	var labels []string
+	var label []byte
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; c {
+		case '\\':
+			i++
+			if i == len(name) {
+				return nil, ErrDNSInvalidName
+			}
+			label = append(label, name[i])
+		case '.':
+			labels = append(labels, string(label))
+			label = label[:0]
+		default:
+			label = append(label, c)
+		}
+	}
+	// 最後の"."はルートなので無視する
+	if len(label) > 0 {
+		labels = append(labels, string(label))
+	}
+	if len(labels) == 1 && labels[0] == "" {
+		return nil, nil
+	}
+	return labels, nil
+}
 
-	//var udp UDPHeader
-	udpheader := NewUDPHeader(UintTo2byte(42279), UintTo2byte(53))
-	dnspacket := NewDNSQuery(".github.com")
-	udpdata := toByteArr(dnspacket)
+// escapeDNSLabel はラベルの中の"."と"\\"をエスケープする
+func escapeDNSLabel(label string) string {
+	if !strings.ContainsAny(label, ".\\") {
+		return label
+	}
+	var sb strings.Builder
+	for i := 0; i < len(label); i++ {
+		if label[i] == '.' || label[i] == '\\' {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(label[i])
+	}
+	return sb.String()
+}
 
-	fmt.Printf("dns packet : %s\n", printByteArr(udpdata))
+func joinDNSLabels(labels []string) string {
+	escaped := make([]string, len(labels))
+	for i, label := range labels {
+		escaped[i] = escapeDNSLabel(label)
+	}
+	return strings.Join(escaped, ".")
+}
 
-	ipheader.TotalPacketLength = UintTo2byte(uint16(20) + toByteLen(udpheader) + uint16(len(udpdata)))
-	udpheader.PacketLenth = UintTo2byte(toByteLen(udpheader) + uint16(len(udpdata)))
+// decodeDNSName はoffから名前を読んで、名前の次の位置を返す
+// 圧縮ポインタ(先頭2bitが11)はメッセージの中の前の位置を指している(RFC1035 4.1.4)
+func decodeDNSName(b []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	// ポインタがループしていても止まるようにする
+	for hops := 0; ; hops++ {
+		if off >= len(b) {
+			return "", 0, ErrDNSMessageTooShort
+		}
+		length := int(b[off])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			if len(labels) == 0 {
+				return ".", next, nil
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(b) {
+				return "", 0, ErrDNSMessageTooShort
+			}
+			if hops > 127 {
+				return "", 0, ErrDNSPointerLoop
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:off+2]) & 0x3fff)
+		case length&0xc0 != 0:
+			return "", 0, ErrDNSInvalidName
+		default:
+			if off+1+length > len(b) {
+				return "", 0, ErrDNSMessageTooShort
+			}
+			labels = append(labels, escapeDNSLabel(string(b[off+1:off+1+length])))
+			off += 1 + length
+		}
+	}
+}
 
-	// IPヘッダのチェックサムを計算する
-	ipsum := sumByteArr(toByteArr(ipheader))
-	ipheader.HeaderCheckSum = checksum(ipsum)
+func packDNSRecord(b []byte, rr DNSResourceRecord, comp map[string]int) ([]byte, error) {
+	var err error
+	if b, err = packDNSName(b, rr.Name, comp); err != nil {
+		return nil, err
+	}
+	b = append(b, UintTo2byte(rr.Type)...)
+	b = append(b, UintTo2byte(rr.Class)...)
+	b = append(b, UintTo4byte(rr.TTL)...)
+	// RDLENGTHはRDATAを書いてから埋める
+	lenOff := len(b)
+	b = append(b, 0x00, 0x00)
+	if b, err = packDNSRData(b, rr.Data, comp); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint16(b[lenOff:lenOff+2], uint16(len(b)-lenOff-2))
+	return b, nil
+}
 
-	dummyHeader := NewUDPDummyHeader(ipheader)
-	dummyHeader.Length = udpheader.PacketLenth
+func packDNSRData(b []byte, data interface{}, comp map[string]int) ([]byte, error) {
+	switch d := data.(type) {
+	case DNSA:
+		ip := d.Addr.To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid A record address : %v", d.Addr)
+		}
+		return append(b, ip...), nil
+	case DNSAAAA:
+		ip := d.Addr.To16()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid AAAA record address : %v", d.Addr)
+		}
+		return append(b, ip...), nil
+	case DNSCNAME:
+		return packDNSName(b, d.Target, comp)
+	case DNSNS:
+		return packDNSName(b, d.Host, comp)
+	case DNSPTR:
+		return packDNSName(b, d.Target, comp)
+	case DNSMX:
+		b = append(b, UintTo2byte(d.Preference)...)
+		return packDNSName(b, d.Exchange, comp)
+	case DNSTXT:
+		for _, txt := range d.Texts {
+			if len(txt) > 255 {
+				return nil, fmt.Errorf("txt string is too long : %d", len(txt))
+			}
+			b = append(b, byte(len(txt)))
+			b = append(b, txt...)
+		}
+		return b, nil
+	case DNSSRV:
+		b = append(b, UintTo2byte(d.Priority)...)
+		b = append(b, UintTo2byte(d.Weight)...)
+		b = append(b, UintTo2byte(d.Port)...)
+		// SRVのTargetは圧縮しない(RFC2782)
+		return packDNSName(b, d.Target, nil)
+	case DNSSOA:
+		var err error
+		if b, err = packDNSName(b, d.MName, comp); err != nil {
+			return nil, err
+		}
+		if b, err = packDNSName(b, d.RName, comp); err != nil {
+			return nil, err
+		}
+		for _, v := range []uint32{d.Serial, d.Refresh, d.Retry, d.Expire, d.Minimum} {
+			b = append(b, UintTo4byte(v)...)
+		}
+		return b, nil
+	case DNSOPT:
+		for _, opt := range d.Options {
+			b = append(b, UintTo2byte(opt.Code)...)
+			b = append(b, UintTo2byte(uint16(len(opt.Data)))...)
+			b = append(b, opt.Data...)
+		}
+		return b, nil
+	case []byte:
+		return append(b, d...), nil
+	case nil:
+		return b, nil
+	}
+	return nil, fmt.Errorf("unsupported dns record data : %T", data)
+}
+
+// parseDNSRecord はoffからレコードを1つ読んで、次のレコードの位置を返す
+func parseDNSRecord(b []byte, off int) (DNSResourceRecord, int, error) {
+	var rr DNSResourceRecord
+	name, off, err := decodeDNSName(b, off)
+	if err != nil {
+		return rr, 0, err
+	}
+	if off+10 > len(b) {
+		return rr, 0, ErrDNSMessageTooShort
+	}
+	rr.Name = name
+	rr.Type = binary.BigEndian.Uint16(b[off : off+2])
+	rr.Class = binary.BigEndian.Uint16(b[off+2 : off+4])
+	rr.TTL = binary.BigEndian.Uint32(b[off+4 : off+8])
+	length := int(binary.BigEndian.Uint16(b[off+8 : off+10]))
+	off += 10
+	if off+length > len(b) {
+		return rr, 0, ErrDNSMessageTooShort
+	}
+	rr.Data, err = parseDNSRData(b, off, length, rr.Type)
+	if err != nil {
+		return rr, 0, err
+	}
+	return rr, off + length, nil
+}
 
-	sum := sumByteArr(toByteArr(dummyHeader))
-	sum += sumByteArr(toByteArr(udpheader))
-	sum += sumByteArr(udpdata)
+// parseDNSRData はRDATAを読む。名前は圧縮されていることがあるのでメッセージ全体を渡す
+func parseDNSRData(b []byte, off, length int, rrtype uint16) (interface{}, error) {
+	rdata := b[off : off+length]
+	short := func(n int) error {
+		if length < n {
+			return ErrDNSMessageTooShort
+		}
+		return nil
+	}
+	switch rrtype {
+	case DNSTypeA:
+		if length != 4 {
+			return nil, fmt.Errorf("invalid A record length : %d", length)
+		}
+		return DNSA{Addr: net.IP(append([]byte{}, rdata...))}, nil
+	case DNSTypeAAAA:
+		if length != 16 {
+			return nil, fmt.Errorf("invalid AAAA record length : %d", length)
+		}
+		return DNSAAAA{Addr: net.IP(append([]byte{}, rdata...))}, nil
+	case DNSTypeCNAME, DNSTypeNS, DNSTypePTR:
+		name, _, err := decodeDNSName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		switch rrtype {
+		case DNSTypeCNAME:
+			return DNSCNAME{Target: name}, nil
+		case DNSTypeNS:
+			return DNSNS{Host: name}, nil
+		}
+		return DNSPTR{Target: name}, nil
+	case DNSTypeMX:
+		if err := short(3); err != nil {
+			return nil, err
+		}
+		name, _, err := decodeDNSName(b, off+2)
+		if err != nil {
+			return nil, err
+		}
+		return DNSMX{Preference: binary.BigEndian.Uint16(rdata[0:2]), Exchange: name}, nil
+	case DNSTypeTXT:
+		var txt DNSTXT
+		for i := 0; i < len(rdata); {
+			l := int(rdata[i])
+			if i+1+l > len(rdata) {
+				return nil, ErrDNSMessageTooShort
+			}
+			txt.Texts = append(txt.Texts, string(rdata[i+1:i+1+l]))
+			i += 1 + l
+		}
+		return txt, nil
+	case DNSTypeSRV:
+		if err := short(7); err != nil {
+			return nil, err
+		}
+		name, _, err := decodeDNSName(b, off+6)
+		if err != nil {
+			return nil, err
+		}
+		return DNSSRV{
+			Priority: binary.BigEndian.Uint16(rdata[0:2]),
+			Weight:   binary.BigEndian.Uint16(rdata[2:4]),
+			Port:     binary.BigEndian.Uint16(rdata[4:6]),
+			Target:   name,
+		}, nil
+	case DNSTypeSOA:
+		mname, next, err := decodeDNSName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		rname, next, err := decodeDNSName(b, next)
+		if err != nil {
+			return nil, err
+		}
+		if next+20 > off+length {
+			return nil, ErrDNSMessageTooShort
+		}
+		return DNSSOA{
+			MName:   mname,
+			RName:   rname,
+			Serial:  binary.BigEndian.Uint32(b[next : next+4]),
+			Refresh: binary.BigEndian.Uint32(b[next+4 : next+8]),
+			Retry:   binary.BigEndian.Uint32(b[next+8 : next+12]),
+			Expire:  binary.BigEndian.Uint32(b[next+12 : next+16]),
+			Minimum: binary.BigEndian.Uint32(b[next+16 : next+20]),
+		}, nil
+	case DNSTypeOPT:
+		var opt DNSOPT
+		for i := 0; i < len(rdata); {
+			if i+4 > len(rdata) {
+				return nil, ErrDNSMessageTooShort
+			}
+			l := int(binary.BigEndian.Uint16(rdata[i+2 : i+4]))
+			if i+4+l > len(rdata) {
+				return nil, ErrDNSMessageTooShort
+			}
+			opt.Options = append(opt.Options, DNSOption{
+				Code: binary.BigEndian.Uint16(rdata[i : i+2]),
+				Data: append([]byte{}, rdata[i+4:i+4+l]...),
+			})
+			i += 4 + l
+		}
+		return opt, nil
+	}
+	return append([]byte{}, rdata...), nil
+}
 
-	// UDPヘッダ+データのチェックサムを計算する
-	udpheader.Checksum = checksum(sum)
-	var packet []byte
-	packet = append(packet, toByteArr(NewEthernet(routermac, localif.LocalMacAddr, "IPv4"))...)
-	packet = append(packet, toByteArr(ipheader)...)
-	packet = append(packet, toByteArr(udpheader)...)
-	packet = append(packet, udpdata...)
+func DNSTypeString(t uint16) string {
+	if name, ok := dnsTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
 
-	go udpheader.recv(localif.LocalIpAddr)
+func DNSRCodeString(rcode int) string {
+	if name, ok := dnsRCodeNames[rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
 
-	udpheader.Send(packet)
+// String はdigのような1行の表記にする
+func (rr DNSResourceRecord) String() string {
+	if rr.Type == DNSTypeOPT {
+		return ednsFromRecord(rr).String()
+	}
+	var data string
+	switch d := rr.Data.(type) {
+	case DNSA:
+		data = d.Addr.String()
+	case DNSAAAA:
+		data = d.Addr.String()
+	case DNSCNAME:
+		data = d.Target + "."
+	case DNSNS:
+		data = d.Host + "."
+	case DNSPTR:
+		data = d.Target + "."
+	case DNSMX:
+		data = fmt.Sprintf("%d %s.", d.Preference, d.Exchange)
+	case DNSTXT:
+		var quoted []string
+		for _, txt := range d.Texts {
+			quoted = append(quoted, fmt.Sprintf("%q", txt))
+		}
+		data = strings.Join(quoted, " ")
+	case DNSSRV:
+		data = fmt.Sprintf("%d %d %d %s.", d.Priority, d.Weight, d.Port, d.Target)
+	case DNSSOA:
+		data = fmt.Sprintf("%s. %s. %d %d %d %d %d", d.MName, d.RName, d.Serial, d.Refresh, d.Retry, d.Expire, d.Minimum)
+	case []byte:
+		data = fmt.Sprintf("\\# %d %x", len(d), d)
+	}
+	return fmt.Sprintf("%s.\t%d\tIN\t%s\t%s", strings.TrimSuffix(rr.Name, "."), rr.TTL, DNSTypeString(rr.Type), data)
 }
@@ -0,0 +1,370 @@
+package tcpip
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSCacheStats はDNSCacheの統計
+type DNSCacheStats struct {
+	// キャッシュから返したもの
+	Hits uint64
+	// Hitsのうち、NXDOMAINやNODATAの否定応答だったもの
+	NegativeHits uint64
+	// サーバに問い合わせたもの
+	Misses uint64
+	// 同じ問い合わせをしている最中だったので、その返事を待ったもの
+	Coalesced uint64
+	// 期限が切れる前に裏で問い合わせ直したもの
+	Prefetches uint64
+	// 上限を超えたので捨てたもの
+	Evictions uint64
+	// 覚えている数
+	Entries int
+}
+
+type dnsCacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	// DNSSECのレコードも欲しいかどうかで返事が変わる
+	do bool
+}
+
+type dnsCacheEntry struct {
+	resp   DNSMessage
+	server string
+	stored time.Time
+	expire time.Time
+	ttl    time.Duration
+	// NXDOMAINかNODATA
+	negative    bool
+	hits        int
+	prefetching bool
+}
+
+// dnsCall はサーバに問い合わせている最中のもの
+type dnsCall struct {
+	done   chan struct{}
+	resp   DNSMessage
+	server string
+	err    error
+}
+
+// DNSCache は問い合わせの返事をTTLの間覚えておく
+// NXDOMAINとNODATAはSOAレコードのTTLとMINIMUMの小さい方の間覚えておく(RFC2308)
+type DNSCache struct {
+	mu       sync.Mutex
+	entries  map[dnsCacheKey]*dnsCacheEntry
+	inflight map[dnsCacheKey]*dnsCall
+	stats    DNSCacheStats
+
+	// 覚えておく数の上限。超えたら期限が一番近いものから捨てる
+	MaxEntries int
+	// TTLをこの範囲に収める
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// 否定応答を覚えておく時間の上限
+	MaxNegativeTTL time.Duration
+	// 残りのTTLが元のTTLのこの割合を切ってから引かれたら、期限が切れる前に裏で問い合わせ直す
+	// 0ならprefetchしない
+	PrefetchRatio float64
+	// PrefetchHits回以上引かれた名前だけをprefetchする
+	PrefetchHits int
+}
+
+func NewDNSCache() *DNSCache {
+	return &DNSCache{
+		entries:        make(map[dnsCacheKey]*dnsCacheEntry),
+		inflight:       make(map[dnsCacheKey]*dnsCall),
+		MaxEntries:     4096,
+		MaxTTL:         24 * time.Hour,
+		MaxNegativeTTL: 3 * time.Hour,
+		PrefetchRatio:  0.1,
+		PrefetchHits:   2,
+	}
+}
+
+// newDNSCacheKey はキャッシュできる問い合わせならキーを返す
+// Client Subnetを付けた問い合わせはクライアントごとに返事が変わるのでキャッシュしない
+func newDNSCacheKey(query DNSMessage) (dnsCacheKey, bool) {
+	if len(query.Questions) != 1 {
+		return dnsCacheKey{}, false
+	}
+	q := query.Questions[0]
+	key := dnsCacheKey{
+		name:   strings.ToLower(strings.TrimSuffix(q.Name, ".")),
+		qtype:  q.Type,
+		qclass: q.Class,
+	}
+	if e, ok := query.EDNS(); ok {
+		if _, ok := e.Option(DNSOptionClientSubnet); ok {
+			return dnsCacheKey{}, false
+		}
+		key.do = e.DO
+	}
+	return key, true
+}
+
+// exchange はキャッシュにあればそれを返し、なければfetchで問い合わせて覚える
+// 同じ問い合わせをしている最中ならその返事を待つ
+// prefetchがtrueなら、呼び出した側で裏でrefreshする
+func (c *DNSCache) exchange(ctx context.Context, key dnsCacheKey, id uint16, fetch func() (DNSMessage, string, error)) (resp DNSMessage, server string, prefetch bool, err error) {
+	c.mu.Lock()
+	if entry, ok := c.lookup(key); ok {
+		c.stats.Hits++
+		if entry.negative {
+			c.stats.NegativeHits++
+		}
+		entry.hits++
+		prefetch = c.needPrefetch(entry)
+		if prefetch {
+			entry.prefetching = true
+			c.stats.Prefetches++
+		}
+		resp = entry.message(id)
+		server = entry.server
+		c.mu.Unlock()
+		return resp, server, prefetch, nil
+	}
+	if call, ok := c.inflight[key]; ok {
+		c.stats.Coalesced++
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return DNSMessage{}, "", false, ctx.Err()
+		}
+		if call.err != nil {
+			return DNSMessage{}, "", false, call.err
+		}
+		resp = call.resp
+		resp.ID = id
+		return resp, call.server, false, nil
+	}
+	c.stats.Misses++
+	// 同じ問い合わせが後から来たら待たせるように、ロックを離す前に登録する
+	call := c.startCall(key)
+	c.mu.Unlock()
+
+	resp, server, err = c.do(key, call, fetch)
+	return resp, server, false, err
+}
+
+// refresh はキャッシュにあってもfetchで問い合わせ直して覚える
+func (c *DNSCache) refresh(key dnsCacheKey, fetch func() (DNSMessage, string, error)) {
+	c.mu.Lock()
+	var call *dnsCall
+	if _, busy := c.inflight[key]; !busy {
+		call = c.startCall(key)
+	}
+	c.mu.Unlock()
+	if call != nil {
+		c.do(key, call, fetch)
+	}
+	c.mu.Lock()
+	if entry, ok := c.entries[key]; ok {
+		entry.prefetching = false
+	}
+	c.mu.Unlock()
+}
+
+// startCall は問い合わせている最中として登録する。c.muを持って呼ぶ
+func (c *DNSCache) startCall(key dnsCacheKey) *dnsCall {
+	call := &dnsCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	return call
+}
+
+// do はstartCallで登録したcallの問い合わせをして、返事を覚えて待っているものに知らせる
+func (c *DNSCache) do(key dnsCacheKey, call *dnsCall, fetch func() (DNSMessage, string, error)) (DNSMessage, string, error) {
+	call.resp, call.server, call.err = fetch()
+
+	c.mu.Lock()
+	if call.err == nil {
+		c.store(key, call.resp, call.server)
+	}
+	delete(c.inflight, key)
+	c.mu.Unlock()
+	close(call.done)
+
+	return call.resp, call.server, call.err
+}
+
+// lookup は期限が切れていないエントリを返す。c.muを持って呼ぶ
+func (c *DNSCache) lookup(key dnsCacheKey) (*dnsCacheEntry, bool) {
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !time.Now().Before(entry.expire) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry, true
+}
+
+func (c *DNSCache) needPrefetch(entry *dnsCacheEntry) bool {
+	if c.PrefetchRatio <= 0 || entry.negative || entry.prefetching || entry.hits < c.PrefetchHits {
+		return false
+	}
+	remain := time.Until(entry.expire)
+	return remain < time.Duration(float64(entry.ttl)*c.PrefetchRatio)
+}
+
+// store は返事をTTLの間覚える。c.muを持って呼ぶ
+func (c *DNSCache) store(key dnsCacheKey, resp DNSMessage, server string) {
+	// 切り詰められた返事は全部のレコードが入っていないので覚えない
+	if resp.Truncated() {
+		return
+	}
+	ttl, negative, ok := dnsCacheTTL(resp, key)
+	if !ok {
+		return
+	}
+	if negative {
+		if ttl > c.MaxNegativeTTL {
+			ttl = c.MaxNegativeTTL
+		}
+	} else {
+		if ttl < c.MinTTL {
+			ttl = c.MinTTL
+		}
+		if c.MaxTTL > 0 && ttl > c.MaxTTL {
+			ttl = c.MaxTTL
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	if _, ok := c.entries[key]; !ok && c.MaxEntries > 0 && len(c.entries) >= c.MaxEntries {
+		c.evict()
+	}
+	now := time.Now()
+	c.entries[key] = &dnsCacheEntry{
+		resp:     resp,
+		server:   server,
+		stored:   now,
+		expire:   now.Add(ttl),
+		ttl:      ttl,
+		negative: negative,
+	}
+}
+
+// evict は期限が切れたものを捨て、それでも上限なら期限が一番近いものを捨てる
+func (c *DNSCache) evict() {
+	now := time.Now()
+	var oldest dnsCacheKey
+	var oldestExpire time.Time
+	for key, entry := range c.entries {
+		if !now.Before(entry.expire) {
+			delete(c.entries, key)
+			continue
+		}
+		if oldestExpire.IsZero() || entry.expire.Before(oldestExpire) {
+			oldest, oldestExpire = key, entry.expire
+		}
+	}
+	if len(c.entries) >= c.MaxEntries && !oldestExpire.IsZero() {
+		delete(c.entries, oldest)
+		c.stats.Evictions++
+	}
+}
+
+// dnsCacheTTL は返事を覚えておく時間を返す
+// 否定応答はAuthorityのSOAレコードのTTLとMINIMUMの小さい方(RFC2308 5)
+// SOAレコードのない否定応答は覚えない
+func dnsCacheTTL(resp DNSMessage, key dnsCacheKey) (ttl time.Duration, negative bool, ok bool) {
+	minTTL := uint32(0xffffffff)
+	for _, rr := range resp.Answers {
+		if rr.TTL < minTTL {
+			minTTL = rr.TTL
+		}
+	}
+
+	negative = resp.RCode() == DNSRCodeNameError || len(answersFor(resp, key.name, key.qtype)) == 0
+	if !negative {
+		for _, rr := range resp.Authorities {
+			if rr.TTL < minTTL {
+				minTTL = rr.TTL
+			}
+		}
+		return time.Duration(minTTL) * time.Second, false, true
+	}
+
+	for _, rr := range resp.Authorities {
+		if soa, isSOA := rr.Data.(DNSSOA); isSOA {
+			negTTL := rr.TTL
+			if soa.Minimum < negTTL {
+				negTTL = soa.Minimum
+			}
+			if negTTL < minTTL {
+				minTTL = negTTL
+			}
+			return time.Duration(minTTL) * time.Second, true, true
+		}
+	}
+	return 0, true, false
+}
+
+// message は覚えてからの時間だけTTLを減らした返事を返す
+func (e *dnsCacheEntry) message(id uint16) DNSMessage {
+	elapsed := uint32(time.Since(e.stored) / time.Second)
+	resp := e.resp
+	resp.ID = id
+	resp.Answers = agedDNSRecords(e.resp.Answers, elapsed)
+	resp.Authorities = agedDNSRecords(e.resp.Authorities, elapsed)
+	resp.Additionals = agedDNSRecords(e.resp.Additionals, elapsed)
+	return resp
+}
+
+func agedDNSRecords(records []DNSResourceRecord, elapsed uint32) []DNSResourceRecord {
+	if records == nil {
+		return nil
+	}
+	aged := make([]DNSResourceRecord, len(records))
+	copy(aged, records)
+	for i := range aged {
+		// OPTレコードのTTLは時間ではない
+		if aged[i].Type == DNSTypeOPT {
+			continue
+		}
+		if aged[i].TTL > elapsed {
+			aged[i].TTL -= elapsed
+		} else {
+			aged[i].TTL = 0
+		}
+	}
+	return aged
+}
+
+// Stats は統計を返す
+func (c *DNSCache) Stats() DNSCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	return stats
+}
+
+// Flush は覚えている返事を全て捨てる
+func (c *DNSCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[dnsCacheKey]*dnsCacheEntry)
+}
+
+// FlushName はnameの返事をタイプに関係なく捨てる
+func (c *DNSCache) FlushName(name string) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		if key.name == name {
+			delete(c.entries, key)
+		}
+	}
+}
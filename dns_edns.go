@@ -0,0 +1,230 @@
+package tcpip
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// EDNS(0)
+// https://datatracker.ietf.org/doc/html/rfc6891
+
+// OPTレコードのTTLに入っているDOビット(RFC3225)
+const dnsEDNSFlagDO = 0x8000
+
+// DNSOption はOPTレコードのRDATAに入るオプション
+type DNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// DNSOPT はOPTレコードのRDATA
+type DNSOPT struct {
+	Options []DNSOption
+}
+
+// DNSEDNS はOPTレコードのCLASSとTTLに詰め込まれている情報とオプション
+type DNSEDNS struct {
+	// 受け取れるUDPのペイロードの最大長(CLASSに入る)
+	UDPSize uint16
+	// 拡張RCODEの上位8bit
+	ExtendedRCode uint8
+	Version       uint8
+	// DNSSECのレコードも欲しいときに立てる
+	DO      bool
+	Options []DNSOption
+}
+
+// record はAdditionalに入れるOPTレコードにする
+func (e DNSEDNS) record() DNSResourceRecord {
+	ttl := uint32(e.ExtendedRCode)<<24 | uint32(e.Version)<<16
+	if e.DO {
+		ttl |= dnsEDNSFlagDO
+	}
+	return DNSResourceRecord{
+		Name:  ".",
+		Type:  DNSTypeOPT,
+		Class: e.UDPSize,
+		TTL:   ttl,
+		Data:  DNSOPT{Options: e.Options},
+	}
+}
+
+func ednsFromRecord(rr DNSResourceRecord) DNSEDNS {
+	e := DNSEDNS{
+		UDPSize:       rr.Class,
+		ExtendedRCode: uint8(rr.TTL >> 24),
+		Version:       uint8(rr.TTL >> 16),
+		DO:            rr.TTL&dnsEDNSFlagDO != 0,
+	}
+	if opt, ok := rr.Data.(DNSOPT); ok {
+		e.Options = opt.Options
+	}
+	return e
+}
+
+// Option はcodeのオプションを探す
+func (e DNSEDNS) Option(code uint16) (DNSOption, bool) {
+	for _, opt := range e.Options {
+		if opt.Code == code {
+			return opt, true
+		}
+	}
+	return DNSOption{}, false
+}
+
+// String はdigのOPT PSEUDOSECTIONのような表記にする
+func (e DNSEDNS) String() string {
+	var flags string
+	if e.DO {
+		flags = " do"
+	}
+	str := fmt.Sprintf("; EDNS: version: %d, flags:%s; udp: %d", e.Version, flags, e.UDPSize)
+	for _, opt := range e.Options {
+		if opt.Code == DNSOptionClientSubnet {
+			if subnet, err := ParseDNSClientSubnet(opt); err == nil {
+				str += "\n; CLIENT-SUBNET: " + subnet.String()
+				continue
+			}
+		}
+		if opt.Code == DNSOptionPadding {
+			str += fmt.Sprintf("\n; PADDING: %d bytes", len(opt.Data))
+			continue
+		}
+		str += fmt.Sprintf("\n; OPT=%d: %x", opt.Code, opt.Data)
+	}
+	return str
+}
+
+// SetEDNS はOPTレコードをAdditionalに入れる。前に入っていたOPTレコードは置き換える
+func (m *DNSMessage) SetEDNS(e DNSEDNS) {
+	m.RemoveEDNS()
+	m.Additionals = append(m.Additionals, e.record())
+}
+
+// RemoveEDNS はOPTレコードを取り除く
+func (m *DNSMessage) RemoveEDNS() {
+	var additionals []DNSResourceRecord
+	for _, rr := range m.Additionals {
+		if rr.Type != DNSTypeOPT {
+			additionals = append(additionals, rr)
+		}
+	}
+	m.Additionals = additionals
+}
+
+// EDNS はOPTレコードが入っていればその中身を返す
+func (m DNSMessage) EDNS() (DNSEDNS, bool) {
+	for _, rr := range m.Additionals {
+		if rr.Type == DNSTypeOPT {
+			return ednsFromRecord(rr), true
+		}
+	}
+	return DNSEDNS{}, false
+}
+
+// ExtendedRCode はOPTレコードの上位8bitと合わせた12bitのRCODEを返す
+func (m DNSMessage) ExtendedRCode() int {
+	rcode := m.RCode()
+	if e, ok := m.EDNS(); ok {
+		rcode |= int(e.ExtendedRCode) << 4
+	}
+	return rcode
+}
+
+// Pad はメッセージの長さがblockの倍数になるようにPaddingオプション(RFC7830)を付ける
+// 暗号化しても長さから問い合わせた名前を推測されないようにする。推奨値は問い合わせなら128(RFC8467)
+// OPTレコードがなければ何もしない
+func (m *DNSMessage) Pad(block int) error {
+	e, ok := m.EDNS()
+	if !ok || block <= 0 {
+		return nil
+	}
+	var options []DNSOption
+	for _, opt := range e.Options {
+		if opt.Code != DNSOptionPadding {
+			options = append(options, opt)
+		}
+	}
+	e.Options = options
+	m.SetEDNS(e)
+
+	packed, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	// オプションのCodeとLengthの4byteも長さに入る
+	length := (block - (len(packed)+4)%block) % block
+	e.Options = append(e.Options, DNSOption{Code: DNSOptionPadding, Data: make([]byte, length)})
+	m.SetEDNS(e)
+	return nil
+}
+
+// DNSClientSubnet はEDNS Client Subnetオプション(RFC7871)
+// 問い合わせたクライアントのネットワークを権威サーバに伝える
+type DNSClientSubnet struct {
+	// 1ならIPv4, 2ならIPv6
+	Family uint16
+	// 問い合わせで伝えるアドレスの長さ
+	SourcePrefix uint8
+	// 返事がどの長さのネットワークに向けたものか
+	ScopePrefix uint8
+	Addr        net.IP
+}
+
+// NewDNSClientSubnet はaddrの先頭prefixビットを伝えるオプションを作る
+func NewDNSClientSubnet(addr net.IP, prefix int) DNSClientSubnet {
+	if ip := addr.To4(); ip != nil {
+		return DNSClientSubnet{Family: 1, SourcePrefix: uint8(prefix), Addr: ip.Mask(net.CIDRMask(prefix, 32))}
+	}
+	return DNSClientSubnet{Family: 2, SourcePrefix: uint8(prefix), Addr: addr.To16().Mask(net.CIDRMask(prefix, 128))}
+}
+
+// Option はOPTレコードに入れるオプションにする
+// アドレスはSourcePrefixのビットが入る分だけ送る
+func (s DNSClientSubnet) Option() DNSOption {
+	ip := s.Addr.To4()
+	if s.Family == 2 {
+		ip = s.Addr.To16()
+	}
+	n := (int(s.SourcePrefix) + 7) / 8
+	if n > len(ip) {
+		n = len(ip)
+	}
+	data := make([]byte, 4, 4+n)
+	binary.BigEndian.PutUint16(data[0:2], s.Family)
+	data[2] = s.SourcePrefix
+	data[3] = s.ScopePrefix
+	data = append(data, ip[:n]...)
+	return DNSOption{Code: DNSOptionClientSubnet, Data: data}
+}
+
+func ParseDNSClientSubnet(opt DNSOption) (DNSClientSubnet, error) {
+	if opt.Code != DNSOptionClientSubnet || len(opt.Data) < 4 {
+		return DNSClientSubnet{}, fmt.Errorf("invalid client subnet option : %x", opt.Data)
+	}
+	s := DNSClientSubnet{
+		Family:       binary.BigEndian.Uint16(opt.Data[0:2]),
+		SourcePrefix: opt.Data[2],
+		ScopePrefix:  opt.Data[3],
+	}
+	var ip net.IP
+	switch s.Family {
+	case 1:
+		ip = make(net.IP, 4)
+	case 2:
+		ip = make(net.IP, 16)
+	default:
+		return DNSClientSubnet{}, fmt.Errorf("unknown client subnet family : %d", s.Family)
+	}
+	if len(opt.Data)-4 > len(ip) {
+		return DNSClientSubnet{}, fmt.Errorf("invalid client subnet option : %x", opt.Data)
+	}
+	copy(ip, opt.Data[4:])
+	s.Addr = ip
+	return s, nil
+}
+
+func (s DNSClientSubnet) String() string {
+	return fmt.Sprintf("%s/%d/%d", s.Addr, s.SourcePrefix, s.ScopePrefix)
+}
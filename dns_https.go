@@ -0,0 +1,181 @@
+package tcpip
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// DNS over HTTPSのメディアタイプ
+const dnsMessageContentType = "application/dns-message"
+
+// DNSHTTPSTransport はHTTP/2のPOSTで問い合わせる(RFC8484, DNS over HTTPS)
+// TLS1.3のALPNでh2を選び、1回の問い合わせごとにコネクションを張る
+// StackがnilならカーネルのTCPソケットを使う
+type DNSHTTPSTransport struct {
+	Stack *Stack
+	// リクエストを送るパス。空なら"/dns-query"
+	Path string
+	// :authorityで送り、証明書を確かめる名前。空ならサーバのIPアドレスを使う
+	ServerName string
+	// nilならOSにインストールされているルート証明書を使う
+	RootCAs            *x509.CertPool
+	InsecureSkipVerify bool
+}
+
+func (t *DNSHTTPSTransport) Exchange(ctx context.Context, server string, query []byte) ([]byte, error) {
+	addr := withDNSPort(server, "443")
+	conn, err := dialDNSStream(ctx, t.Stack, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer watchContext(ctx, conn)()
+
+	config := dnsTLSConfig(addr, t.ServerName, t.RootCAs, t.InsecureSkipVerify, []string{"h2"})
+	tlsconn := TLS13Client(conn, config)
+	defer tlsconn.Close()
+
+	resp, err := t.exchange(tlsconn, addr, config.ServerName, query)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return resp, err
+}
+
+func (t *DNSHTTPSTransport) exchange(conn *TLS13Conn, addr, serverName string, query []byte) ([]byte, error) {
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+	if conn.NegotiatedProtocol() != "h2" {
+		return nil, errors.New("server does not support http2")
+	}
+
+	authority := serverName
+	if _, port, _ := net.SplitHostPort(addr); port != "443" {
+		authority = net.JoinHostPort(serverName, port)
+	}
+	path := t.Path
+	if path == "" {
+		path = "/dns-query"
+	}
+	// 4.1. The HTTP Request
+	// RFC8484ではIDを0にすることを勧めているが、IDで返事を確かめられるようにそのまま送る
+	headers := []Http2Header{
+		{Name: "", Value: "POST"},
+		{Name: "", Value: "https"},
+		{Name: ":authority", Value: authority},
+		{Name: ":path", Value: path},
+		{Name: "accept", Value: dnsMessageContentType},
+		{Name: "content-type", Value: dnsMessageContentType},
+		{Name: "content-length", Value: strconv.Itoa(len(query))},
+	}
+
+	packet := CreateFirstFrametoServer()
+	packet = append(packet, CreateRequestFrames(1, headers, query)...)
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+	return readDNSHTTPSResponse(conn)
+}
+
+// readDNSHTTPSResponse はストリーム1の返事を読んでボディを返す
+// サーバからのSETTINGSとPINGには応える
+func readDNSHTTPSResponse(conn io.ReadWriter) ([]byte, error) {
+	var block, body []byte
+	status := ""
+	endStream := false
+	for {
+		frame, err := ReadHttp2Frame(conn)
+		if err != nil {
+			return nil, err
+		}
+		streamID := binary.BigEndian.Uint32(frame.StreamIdentifier)
+		flags := frame.Flags[0]
+
+		switch frame.Type[0] {
+		case FrameTypeSettings:
+			if flags&Http2FlagAck != 0 {
+				continue
+			}
+			ack := toByteArr(Http2Frame{
+				Length:           UintTo3byte(0),
+				Type:             []byte{FrameTypeSettings},
+				Flags:            []byte{Http2FlagAck},
+				StreamIdentifier: UintTo4byte(0),
+			})
+			if _, err := conn.Write(ack); err != nil {
+				return nil, err
+			}
+			continue
+		case FrameTypePing:
+			if flags&Http2FlagAck != 0 {
+				continue
+			}
+			frame.Flags = []byte{Http2FlagAck}
+			if _, err := conn.Write(toByteArr(frame)); err != nil {
+				return nil, err
+			}
+			continue
+		case FrameTypeGoaway:
+			return nil, fmt.Errorf("http2 goaway : %x", frame.Value)
+		}
+		if streamID != 1 {
+			continue
+		}
+
+		switch frame.Type[0] {
+		case FrameTypeRstStream:
+			return nil, fmt.Errorf("http2 stream reset : %x", frame.Value)
+		case FrameTypeHeaders, FrameTypeContinuation:
+			payload, err := http2FramePayload(frame)
+			if err != nil {
+				return nil, err
+			}
+			block = append(block, payload...)
+			// END_STREAMはHEADERSに付いていて、CONTINUATIONが続くことがある
+			if frame.Type[0] == FrameTypeHeaders && flags&Http2FlagEndStream != 0 {
+				endStream = true
+			}
+			if flags&Http2FlagEndHeaders == 0 {
+				continue
+			}
+			for _, h := range DecodeHttp2Header(block) {
+				if h.Name == ":status" && status == "" {
+					status = h.Value
+				}
+			}
+			block = nil
+			// 1xxは途中経過なので、本当の返事のヘッダを待つ
+			if len(status) == 3 && status[0] == '1' {
+				status = ""
+				continue
+			}
+			if status != "200" {
+				return nil, fmt.Errorf("dns over https status : %s", status)
+			}
+		case FrameTypeData:
+			payload, err := http2FramePayload(frame)
+			if err != nil {
+				return nil, err
+			}
+			if len(body)+len(payload) > 0xffff {
+				return nil, errors.New("dns over https response is too long")
+			}
+			body = append(body, payload...)
+			if flags&Http2FlagEndStream != 0 {
+				endStream = true
+			}
+		}
+		if endStream {
+			if status == "" {
+				return nil, errors.New("dns over https response has no status")
+			}
+			return body, nil
+		}
+	}
+}
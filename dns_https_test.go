@@ -0,0 +1,84 @@
+package tcpip
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDNSHTTPSTransport(t *testing.T) {
+	client, server := newDNSTestStacks(t)
+	cert, pool := newDNSTestCertificate(t)
+
+	ln, err := server.ListenTCP(&net.TCPAddr{Port: 443})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dns-query", func(w http.ResponseWriter, req *http.Request) {
+		// RFC8484 4.1 POSTでapplication/dns-messageを送る
+		if req.Method != http.MethodPost || req.ProtoMajor != 2 ||
+			req.Header.Get("Content-Type") != dnsMessageContentType {
+			t.Errorf("unexpected request : %s %s %s", req.Proto, req.Method, req.Header.Get("Content-Type"))
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if req.Host != dnsTestServerName {
+			t.Errorf(":authority = %q, want %q", req.Host, dnsTestServerName)
+		}
+		query, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", dnsMessageContentType)
+		w.Write(dnsTestAnswer(t, query, net.IP{192, 0, 2, 2}))
+	})
+	srv := &http.Server{
+		Handler:   mux,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS13},
+	}
+	defer srv.Close()
+	go srv.ServeTLS(ln, "", "")
+
+	r := NewDNSHTTPSResolver(client, dnsTestServerName, "10.0.0.2")
+	r.Transport.(*DNSHTTPSTransport).RootCAs = pool
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	hosts, err := r.LookupHost(ctx, "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 || hosts[0] != "192.0.2.2" {
+		t.Fatalf("LookupHost = %v, want [192.0.2.2]", hosts)
+	}
+}
+
+func TestDNSHTTPSTransportErrorStatus(t *testing.T) {
+	client, server := newDNSTestStacks(t)
+	cert, pool := newDNSTestCertificate(t)
+
+	ln, err := server.ListenTCP(&net.TCPAddr{Port: 443})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler:   http.NotFoundHandler(),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS13},
+	}
+	defer srv.Close()
+	go srv.ServeTLS(ln, "", "")
+
+	// 200以外のステータスは返事として使わない
+	transport := &DNSHTTPSTransport{Stack: client, ServerName: dnsTestServerName, RootCAs: pool}
+	query, _ := NewDNSQueryMessage("www.example.com", DNSTypeA).Pack()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := transport.Exchange(ctx, "10.0.0.2", query); err == nil {
+		t.Fatal("Exchange succeeded with a 404 response")
+	}
+}
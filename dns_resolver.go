@@ -0,0 +1,557 @@
+package tcpip
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSError は名前解決に失敗したときのエラー
+type DNSError struct {
+	Name   string
+	Server string
+	// 返事のRCODE。返事が来なかったときは-1
+	RCode int
+	Err   error
+}
+
+func (e *DNSError) Error() string {
+	if e.RCode >= 0 {
+		return fmt.Sprintf("lookup %s on %s: %s", e.Name, e.Server, DNSRCodeString(e.RCode))
+	}
+	return fmt.Sprintf("lookup %s on %s: %v", e.Name, e.Server, e.Err)
+}
+
+func (e *DNSError) Unwrap() error {
+	return e.Err
+}
+
+// IsNotFound は名前が存在しないか、そのタイプのレコードがないときにtrue
+func (e *DNSError) IsNotFound() bool {
+	return e.RCode == DNSRCodeNameError || errors.Is(e.Err, ErrDNSNoRecord)
+}
+
+var ErrDNSNoRecord = errors.New("no such record")
+
+// DNSTransport はDNSのメッセージを1つサーバに送って返事を受け取る
+// UDP, TCP, TLS, HTTPSなどで実装する
+type DNSTransport interface {
+	Exchange(ctx context.Context, server string, query []byte) ([]byte, error)
+}
+
+// DNSUDPTransport はUDPで問い合わせる
+// StackがnilならカーネルのUDPソケットを使う
+type DNSUDPTransport struct {
+	Stack *Stack
+	// 受け取れる返事の最大長
+	UDPSize int
+}
+
+func (t *DNSUDPTransport) Exchange(ctx context.Context, server string, query []byte) ([]byte, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", withDNSPort(server, "53"))
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	if t.Stack != nil {
+		conn, err = t.Stack.DialUDP(nil, raddr)
+	} else {
+		conn, err = net.DialUDP("udp4", nil, raddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer watchContext(ctx, conn)()
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	size := t.UDPSize
+	if size == 0 {
+		size = 512
+	}
+	for {
+		buf := make([]byte, size)
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		// IDが違う返事は偽物かもしれないので捨てて待ち続ける
+		if n < 12 || buf[0] != query[0] || buf[1] != query[1] {
+			continue
+		}
+		return buf[:n], nil
+	}
+}
+
+// DNSTCPTransport はTCPで問い合わせる(RFC7766)
+// メッセージの前に2byteの長さを付けて送り、返事も同じように読む
+// StackがnilならカーネルのTCPソケットを使う
+type DNSTCPTransport struct {
+	Stack *Stack
+}
+
+func (t *DNSTCPTransport) Exchange(ctx context.Context, server string, query []byte) ([]byte, error) {
+	if len(query) > 0xffff {
+		return nil, fmt.Errorf("dns message is too long : %d", len(query))
+	}
+	conn, err := dialDNSStream(ctx, t.Stack, withDNSPort(server, "53"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer watchContext(ctx, conn)()
+
+	resp, err := exchangeDNSStream(conn, query)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return resp, err
+}
+
+// dialDNSStream はstackの上でTCPのコネクションを張る。stackがnilならカーネルのソケットを使う
+func dialDNSStream(ctx context.Context, stack *Stack, addr string) (net.Conn, error) {
+	raddr, err := net.ResolveTCPAddr("tcp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	if stack != nil {
+		conn, err := stack.DialTCP(ctx, nil, raddr)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp4", raddr.String())
+}
+
+// exchangeDNSStream は2byteの長さを付けたメッセージを1つ送って、返事を1つ読む
+// TCPとTLSで使う
+func exchangeDNSStream(conn io.ReadWriter, query []byte) ([]byte, error) {
+	msg := append(UintTo2byte(uint16(len(query))), query...)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	for {
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(length))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return nil, err
+		}
+		// IDが違う返事は読み飛ばす
+		if len(resp) < 12 || resp[0] != query[0] || resp[1] != query[1] {
+			continue
+		}
+		return resp, nil
+	}
+}
+
+// watchContext はctxがキャンセルされたらconnの読み書きをやめさせる
+// 返した関数を呼ぶと見張るのをやめる
+func watchContext(ctx context.Context, conn net.Conn) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// withDNSPort はポートが書かれていなければデフォルトのポートを付ける
+func withDNSPort(server, port string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(server, port)
+}
+
+// EDNS(0)で伝えるUDPの最大長(DNS Flag Day 2020の推奨値)
+const dnsEDNSUDPSize = 1232
+
+// DNSResolver はDNSサーバに再帰問い合わせをするスタブリゾルバ
+type DNSResolver struct {
+	// "8.8.8.8"や"192.168.0.1:53"のようなサーバのアドレス
+	// 問い合わせを始めた後に変えるときはSetServersを使う
+	Servers   []string
+	Transport DNSTransport
+	// 返事のTCビットが立っていたらこちらで問い合わせ直す。nilなら切り詰められた返事をそのまま使う
+	TCPTransport DNSTransport
+	// nilでなければLookupの問い合わせにOPTレコードを付ける
+	EDNS *DNSEDNS
+	// 0でなければOPTレコードの付いた問い合わせの長さをこの倍数に揃える
+	Padding int
+	// 1回の問い合わせで返事を待つ時間
+	Timeout time.Duration
+	// 全てのサーバに問い合わせるのを何周するか
+	Attempts int
+	// nilでなければ返事をTTLの間覚えておき、同じ問い合わせにはサーバに問い合わせずに返す
+	Cache *DNSCache
+
+	// Serversを守る
+	mu sync.Mutex
+}
+
+// NewDNSResolver はstackの上でUDPを使って問い合わせるリゾルバを作る
+// EDNS(0)で1232byteまでのUDPの返事を受け取り、切り詰められていたらTCPで問い合わせ直す
+// stackがnilならカーネルのソケットを使う
+func NewDNSResolver(stack *Stack, servers ...string) *DNSResolver {
+	return &DNSResolver{
+		Servers:      servers,
+		Transport:    &DNSUDPTransport{Stack: stack, UDPSize: dnsEDNSUDPSize},
+		TCPTransport: &DNSTCPTransport{Stack: stack},
+		EDNS:         &DNSEDNS{UDPSize: dnsEDNSUDPSize},
+		Timeout:      2 * time.Second,
+		Attempts:     2,
+	}
+}
+
+// NewDNSTLSResolver はstackの上でTLS(DoT)を使って問い合わせるリゾルバを作る
+// serverNameでサーバの証明書を確かめ、空ならサーバのIPアドレスで確かめる
+// 問い合わせの長さはPaddingで128byteの倍数に揃える
+func NewDNSTLSResolver(stack *Stack, serverName string, servers ...string) *DNSResolver {
+	r := NewDNSResolver(stack, servers...)
+	r.Transport = &DNSTLSTransport{Stack: stack, ServerName: serverName}
+	// TLSなら返事が切り詰められることはない
+	r.TCPTransport = nil
+	r.Padding = 128
+	// ハンドシェイクの分だけ時間がかかる
+	r.Timeout = 5 * time.Second
+	return r
+}
+
+// NewDNSHTTPSResolver はstackの上でHTTPS(DoH)を使って問い合わせるリゾルバを作る
+func NewDNSHTTPSResolver(stack *Stack, serverName string, servers ...string) *DNSResolver {
+	r := NewDNSTLSResolver(stack, serverName, servers...)
+	r.Transport = &DNSHTTPSTransport{Stack: stack, ServerName: serverName}
+	return r
+}
+
+// SetServers は問い合わせるサーバを入れ替える
+// 問い合わせの途中でも使える
+func (r *DNSResolver) SetServers(servers []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Servers = servers
+}
+
+// servers は今のServersを返す
+func (r *DNSResolver) servers() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Servers
+}
+
+// NewQuery はリゾルバの設定に合わせて問い合わせのメッセージを作る
+func (r *DNSResolver) NewQuery(name string, qtype uint16) DNSMessage {
+	query := NewDNSQueryMessage(name, qtype)
+	if r.EDNS != nil {
+		query.SetEDNS(*r.EDNS)
+	}
+	return query
+}
+
+// Exchange はメッセージをサーバに送って返事を返す
+// タイムアウトやSERVFAIL, REFUSEDなら次のサーバに問い合わせる
+func (r *DNSResolver) Exchange(ctx context.Context, query DNSMessage) (DNSMessage, error) {
+	resp, _, err := r.exchangeAny(ctx, query)
+	return resp, err
+}
+
+// exchangeAny は返事をしたサーバも返す
+// Cacheがあれば先にそちらを見る
+func (r *DNSResolver) exchangeAny(ctx context.Context, query DNSMessage) (DNSMessage, string, error) {
+	key, ok := newDNSCacheKey(query)
+	if r.Cache == nil || !ok {
+		return r.exchangeServers(ctx, query)
+	}
+	resp, server, prefetch, err := r.Cache.exchange(ctx, key, query.ID, func() (DNSMessage, string, error) {
+		return r.exchangeServers(ctx, query)
+	})
+	if prefetch {
+		go r.prefetch(key, query)
+	}
+	return resp, server, err
+}
+
+// prefetch は期限が切れる前に問い合わせ直してCacheを新しくする
+func (r *DNSResolver) prefetch(key dnsCacheKey, query DNSMessage) {
+	timeout := r.Timeout * time.Duration(r.Attempts*len(r.servers()))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// 元の問い合わせとは別のIDで送る
+	query.ID = binary.BigEndian.Uint16(randomByte(2))
+	r.Cache.refresh(key, func() (DNSMessage, string, error) {
+		return r.exchangeServers(ctx, query)
+	})
+}
+
+// exchangeServers はサーバに順番に問い合わせる
+func (r *DNSResolver) exchangeServers(ctx context.Context, query DNSMessage) (DNSMessage, string, error) {
+	var name string
+	if len(query.Questions) != 0 {
+		name = query.Questions[0].Name
+	}
+	servers := r.servers()
+	if len(servers) == 0 {
+		return DNSMessage{}, "", &DNSError{Name: name, RCode: -1, Err: errors.New("no dns servers")}
+	}
+	if r.Padding > 0 {
+		if err := query.Pad(r.Padding); err != nil {
+			return DNSMessage{}, "", err
+		}
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return DNSMessage{}, "", err
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < r.Attempts; attempt++ {
+		for _, server := range servers {
+			resp, err := r.exchange(ctx, server, query, packed)
+			if err == nil {
+				return resp, server, nil
+			}
+			lastErr = err
+			if ctx.Err() != nil {
+				return DNSMessage{}, "", &DNSError{Name: name, Server: server, RCode: -1, Err: ctx.Err()}
+			}
+		}
+	}
+	return DNSMessage{}, "", lastErr
+}
+
+func (r *DNSResolver) exchange(ctx context.Context, server string, query DNSMessage, packed []byte) (DNSMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	resp, err := r.exchangeOver(ctx, r.Transport, server, query, packed)
+	if err != nil {
+		return DNSMessage{}, err
+	}
+	// 古いサーバはOPTレコードを知らずにFORMERRを返すので、OPTレコードなしで問い合わせ直す(RFC6891 7)
+	if _, ok := query.EDNS(); ok && resp.RCode() == DNSRCodeFormatError {
+		if _, ok := resp.EDNS(); !ok {
+			query.RemoveEDNS()
+			if packed, err = query.Pack(); err != nil {
+				return DNSMessage{}, err
+			}
+			if resp, err = r.exchangeOver(ctx, r.Transport, server, query, packed); err != nil {
+				return DNSMessage{}, err
+			}
+		}
+	}
+	// UDPに入りきらずに切り詰められていたらTCPで問い合わせ直す
+	if resp.Truncated() && r.TCPTransport != nil {
+		if resp, err = r.exchangeOver(ctx, r.TCPTransport, server, query, packed); err != nil {
+			return DNSMessage{}, err
+		}
+	}
+	switch rcode := resp.ExtendedRCode(); rcode {
+	case DNSRCodeSuccess, DNSRCodeNameError:
+		return resp, nil
+	default:
+		return DNSMessage{}, &DNSError{Name: query.Questions[0].Name, Server: server, RCode: rcode}
+	}
+}
+
+// exchangeOver はtransportで問い合わせて、問い合わせに対応した返事か確かめる
+func (r *DNSResolver) exchangeOver(ctx context.Context, transport DNSTransport, server string, query DNSMessage, packed []byte) (DNSMessage, error) {
+	name := query.Questions[0].Name
+	b, err := transport.Exchange(ctx, server, packed)
+	if err != nil {
+		return DNSMessage{}, &DNSError{Name: name, Server: server, RCode: -1, Err: err}
+	}
+	resp, err := ParseDNSMessage(b)
+	if err != nil {
+		return DNSMessage{}, &DNSError{Name: name, Server: server, RCode: -1, Err: err}
+	}
+	if resp.ID != query.ID || !resp.IsResponse() || !sameDNSQuestion(query, resp) {
+		return DNSMessage{}, &DNSError{Name: name, Server: server, RCode: -1, Err: errors.New("mismatched dns response")}
+	}
+	return resp, nil
+}
+
+func sameDNSQuestion(query, resp DNSMessage) bool {
+	if len(resp.Questions) != 1 {
+		return false
+	}
+	q, a := query.Questions[0], resp.Questions[0]
+	return q.Type == a.Type && q.Class == a.Class &&
+		strings.EqualFold(strings.TrimSuffix(q.Name, "."), strings.TrimSuffix(a.Name, "."))
+}
+
+// Lookup はnameのqtypeのレコードを返す
+// CNAMEが返ってきたらその先の名前のレコードを返す
+func (r *DNSResolver) Lookup(ctx context.Context, name string, qtype uint16) ([]DNSResourceRecord, error) {
+	resp, server, err := r.exchangeAny(ctx, r.NewQuery(name, qtype))
+	if err != nil {
+		return nil, err
+	}
+	if resp.RCode() == DNSRCodeNameError {
+		return nil, &DNSError{Name: name, Server: server, RCode: DNSRCodeNameError}
+	}
+	records := answersFor(resp, name, qtype)
+	if len(records) == 0 {
+		return nil, &DNSError{Name: name, Server: server, RCode: -1, Err: ErrDNSNoRecord}
+	}
+	return records, nil
+}
+
+// answersFor はAnswerセクションからCNAMEをたどってqtypeのレコードを集める
+func answersFor(resp DNSMessage, name string, qtype uint16) []DNSResourceRecord {
+	target := strings.TrimSuffix(name, ".")
+	var records []DNSResourceRecord
+	// CNAMEが何段か続いていても追いかける
+	for hops := 0; hops < 8; hops++ {
+		var next string
+		for _, rr := range resp.Answers {
+			if !strings.EqualFold(rr.Name, target) {
+				continue
+			}
+			if rr.Type == qtype || qtype == DNSTypeANY {
+				records = append(records, rr)
+			} else if cname, ok := rr.Data.(DNSCNAME); ok {
+				next = cname.Target
+			}
+		}
+		if len(records) != 0 || next == "" {
+			return records
+		}
+		target = next
+	}
+	return records
+}
+
+// LookupHost はホスト名のIPアドレスを文字列で返す(IPv4が先)
+// TCPIP.DestIPにそのまま入れられる
+func (r *DNSResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{host}, nil
+	}
+	var addrs []string
+	var firstErr error
+	for _, qtype := range []uint16{DNSTypeA, DNSTypeAAAA} {
+		records, err := r.Lookup(ctx, host, qtype)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, rr := range records {
+			switch d := rr.Data.(type) {
+			case DNSA:
+				addrs = append(addrs, d.Addr.String())
+			case DNSAAAA:
+				addrs = append(addrs, d.Addr.String())
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, firstErr
+	}
+	return addrs, nil
+}
+
+// LookupIPv4 はホスト名のIPv4アドレスを返す
+func (r *DNSResolver) LookupIPv4(ctx context.Context, host string) ([][]byte, error) {
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		return [][]byte{ip}, nil
+	}
+	records, err := r.Lookup(ctx, host, DNSTypeA)
+	if err != nil {
+		return nil, err
+	}
+	var addrs [][]byte
+	for _, rr := range records {
+		if a, ok := rr.Data.(DNSA); ok {
+			addrs = append(addrs, []byte(a.Addr.To4()))
+		}
+	}
+	return addrs, nil
+}
+
+// LookupAddr はIPv4アドレスの逆引きをする
+func (r *DNSResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	ip := net.ParseIP(addr).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IPv4 address : %s", addr)
+	}
+	name := fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip[3], ip[2], ip[1], ip[0])
+	records, err := r.Lookup(ctx, name, DNSTypePTR)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, rr := range records {
+		names = append(names, rr.Data.(DNSPTR).Target)
+	}
+	return names, nil
+}
+
+// DefaultDNSCache はDefaultDNSResolverで作ったリゾルバが共有するキャッシュ
+var DefaultDNSCache = NewDNSCache()
+
+// DefaultDNSResolver は/etc/resolv.confのnameserverにカーネルのUDPソケットで問い合わせるリゾルバを作る
+// 返事はDefaultDNSCacheに覚えておく
+func DefaultDNSResolver() *DNSResolver {
+	r := NewDNSResolver(nil, resolvConfServers("/etc/resolv.conf")...)
+	r.Cache = DefaultDNSCache
+	return r
+}
+
+func resolvConfServers(path string) []string {
+	servers := []string{}
+	b, err := os.ReadFile(path)
+	if err == nil {
+		for _, line := range strings.Split(string(b), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]).To4() != nil {
+				servers = append(servers, fields[1])
+			}
+		}
+	}
+	if len(servers) == 0 {
+		servers = append(servers, "8.8.8.8")
+	}
+	return servers
+}
+
+// LookupHost はDefaultDNSResolverでホスト名を引いて、IPv4アドレスの文字列を返す
+// TCPIP{DestIP: addrs[0]}のようにTCPのクライアントで使う
+func LookupHost(host string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	addrs, err := DefaultDNSResolver().LookupIPv4(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []string
+	for _, addr := range addrs {
+		hosts = append(hosts, net.IP(addr).String())
+	}
+	return hosts, nil
+}
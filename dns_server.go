@@ -0,0 +1,564 @@
+package tcpip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TCPのコネクションで次の問い合わせを待つ時間(RFC7766 6.2.3)
+const dnsServerTCPIdleTimeout = 10 * time.Second
+
+// dnsZoneData はDNSZoneのレコードを名前ごとにまとめたもの
+type dnsZoneData struct {
+	origin string
+	soa    DNSResourceRecord
+	// 小文字にした名前ごとのレコード
+	rrsets map[string][]DNSResourceRecord
+	// レコードがなくても、下にレコードのある名前(empty non-terminal)は存在する
+	nodes map[string]bool
+}
+
+func newDNSZoneData(zone *DNSZone) (*dnsZoneData, error) {
+	origin := strings.ToLower(strings.TrimSuffix(zone.Origin, "."))
+	if origin == "" {
+		return nil, errors.New("zone has no origin")
+	}
+	z := &dnsZoneData{
+		origin: origin,
+		rrsets: make(map[string][]DNSResourceRecord),
+		nodes:  map[string]bool{origin: true},
+	}
+	hasSOA := false
+	for _, rr := range zone.Records {
+		name := strings.TrimSuffix(rr.Name, ".")
+		if name == "" || name == "@" {
+			name = zone.Origin
+		}
+		rr.Name = strings.TrimSuffix(name, ".")
+		if rr.Class == 0 {
+			rr.Class = DNSClassINET
+		}
+		key := strings.ToLower(rr.Name)
+		if !dnsNameWithin(key, origin) {
+			return nil, fmt.Errorf("%s is out of zone %s", rr.Name, origin)
+		}
+		if rr.Type == DNSTypeSOA {
+			if key != origin {
+				return nil, fmt.Errorf("SOA record must be at the zone apex : %s", rr.Name)
+			}
+			if hasSOA {
+				return nil, fmt.Errorf("zone %s has multiple SOA records", origin)
+			}
+			hasSOA = true
+			z.soa = rr
+		}
+		z.rrsets[key] = append(z.rrsets[key], rr)
+		for n := key; n != origin; n = dnsParentName(n) {
+			z.nodes[n] = true
+		}
+	}
+	// CNAMEのある名前には他のレコードを置けない(RFC1034 3.6.2)
+	for name, rrs := range z.rrsets {
+		for _, rr := range rrs {
+			if rr.Type == DNSTypeCNAME && len(rrs) > 1 {
+				return nil, fmt.Errorf("CNAME and other data at %s", name)
+			}
+		}
+	}
+	if !hasSOA {
+		z.soa = DNSResourceRecord{
+			Name:  zone.Origin,
+			Type:  DNSTypeSOA,
+			Class: DNSClassINET,
+			TTL:   3600,
+			Data: DNSSOA{
+				MName:   "ns." + origin,
+				RName:   "hostmaster." + origin,
+				Serial:  1,
+				Refresh: 3600,
+				Retry:   600,
+				Expire:  86400,
+				Minimum: 60,
+			},
+		}
+		z.rrsets[origin] = append(z.rrsets[origin], z.soa)
+	}
+	return z, nil
+}
+
+// dnsNameWithin はnameがzoneかその下の名前ならtrue
+func dnsNameWithin(name, zone string) bool {
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+func dnsParentName(name string) string {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+// negativeSOA は否定応答のAuthorityに入れるSOAレコード
+// TTLはSOAレコードのTTLとMINIMUMの小さい方にする(RFC2308 3)
+// MINIMUMが読めないSOAならレコードのTTLのまま使う
+func (z *dnsZoneData) negativeSOA() DNSResourceRecord {
+	soa := z.soa
+	var data DNSSOA
+	switch d := soa.Data.(type) {
+	case DNSSOA:
+		data = d
+	case *DNSSOA:
+		if d == nil {
+			return soa
+		}
+		data = *d
+	default:
+		return soa
+	}
+	if data.Minimum < soa.TTL {
+		soa.TTL = data.Minimum
+	}
+	return soa
+}
+
+// DNSServer はゾーンのレコードに権威を持って答えるDNSサーバ
+// 再帰問い合わせはしないので、知らないゾーンの問い合わせにはREFUSEDを返す
+type DNSServer struct {
+	mu    sync.RWMutex
+	zones map[string]*dnsZoneData
+	// EDNS(0)で伝えるUDPの最大長
+	UDPSize int
+
+	packetConn net.PacketConn
+	listener   net.Listener
+	conns      map[net.Conn]struct{}
+	closed     bool
+}
+
+func NewDNSServer(zones ...*DNSZone) (*DNSServer, error) {
+	s := &DNSServer{
+		zones:   make(map[string]*dnsZoneData),
+		UDPSize: dnsEDNSUDPSize,
+		conns:   make(map[net.Conn]struct{}),
+	}
+	for _, zone := range zones {
+		if err := s.AddZone(zone); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// AddZone はゾーンを追加する。同じOriginのゾーンがあれば置き換える
+// 追加したあとにzone.Recordsを変えたときは、もう一度AddZoneする
+func (s *DNSServer) AddZone(zone *DNSZone) error {
+	z, err := newDNSZoneData(zone)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.zones[z.origin] = z
+	return nil
+}
+
+func (s *DNSServer) RemoveZone(origin string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.zones, strings.ToLower(strings.TrimSuffix(origin, ".")))
+}
+
+// findZone はnameを含む一番長いOriginのゾーンを探す
+func (s *DNSServer) findZone(name string) *dnsZoneData {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for n := name; n != ""; n = dnsParentName(n) {
+		if z, ok := s.zones[n]; ok {
+			return z
+		}
+	}
+	return nil
+}
+
+// Answer は問い合わせへの返事を作る
+func (s *DNSServer) Answer(query DNSMessage) DNSMessage {
+	// Opcode, RD, CDはそのまま返す
+	resp := DNSMessage{
+		ID:        query.ID,
+		Flags:     DNSFlagQR | query.Flags&(dnsFlagOpcode|DNSFlagRD|DNSFlagCD),
+		Questions: query.Questions,
+	}
+	e, hasEDNS := query.EDNS()
+	rcode := DNSRCodeSuccess
+	switch {
+	case query.Flags&dnsFlagOpcode != 0:
+		// 標準の問い合わせ(QUERY)以外は知らない
+		rcode = DNSRCodeNotImplemented
+	case len(query.Questions) != 1:
+		rcode = DNSRCodeFormatError
+	case hasEDNS && e.Version != 0:
+		rcode = DNSRCodeBadVersion
+	default:
+		q := query.Questions[0]
+		zone := s.findZone(strings.ToLower(strings.TrimSuffix(q.Name, ".")))
+		if zone == nil || (q.Class != DNSClassINET && q.Class != DNSClassANY) {
+			rcode = DNSRCodeRefused
+			break
+		}
+		rcode = zone.answer(&resp, q)
+	}
+
+	// 12bitのRCODEの上位8bitはOPTレコードに入れる
+	resp.Flags |= uint16(rcode & 0x0f)
+	if hasEDNS {
+		resp.SetEDNS(DNSEDNS{UDPSize: uint16(s.UDPSize), DO: e.DO, ExtendedRCode: uint8(rcode >> 4)})
+	}
+	return resp
+}
+
+// answer はRFC1034 4.3.2のアルゴリズムでゾーンから答える
+func (z *dnsZoneData) answer(resp *DNSMessage, q DNSQuestion) int {
+	name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	owner := strings.TrimSuffix(q.Name, ".")
+	resp.Flags |= DNSFlagAA
+
+	// CNAMEをたどってゾーンの中の名前を探す
+	for hops := 0; hops < 8; hops++ {
+		if z.referral(resp, name) {
+			return DNSRCodeSuccess
+		}
+		rrs, exists := z.lookup(name, owner)
+		if !exists {
+			resp.Authorities = append(resp.Authorities, z.negativeSOA())
+			return DNSRCodeNameError
+		}
+
+		var matched []DNSResourceRecord
+		var cname *DNSResourceRecord
+		for i, rr := range rrs {
+			if rr.Type == q.Type || q.Type == DNSTypeANY {
+				matched = append(matched, rr)
+			} else if rr.Type == DNSTypeCNAME {
+				cname = &rrs[i]
+			}
+		}
+		if len(matched) != 0 {
+			resp.Answers = append(resp.Answers, matched...)
+			z.addAdditionals(resp, matched)
+			return DNSRCodeSuccess
+		}
+		if cname == nil {
+			// 名前はあるがそのタイプのレコードがない(NODATA)
+			resp.Authorities = append(resp.Authorities, z.negativeSOA())
+			return DNSRCodeSuccess
+		}
+		resp.Answers = append(resp.Answers, *cname)
+		// 中身の読めないCNAMEはたどらない
+		data, ok := cname.Data.(DNSCNAME)
+		if !ok {
+			return DNSRCodeSuccess
+		}
+		target := data.Target
+		name = strings.ToLower(strings.TrimSuffix(target, "."))
+		owner = strings.TrimSuffix(target, ".")
+		// ゾーンの外ならリゾルバにたどってもらう
+		if !dnsNameWithin(name, z.origin) {
+			return DNSRCodeSuccess
+		}
+	}
+	return DNSRCodeServerFailure
+}
+
+// lookup はnameのレコードを返す。なければワイルドカードから作る(RFC4592)
+// nameが存在しなければexistsはfalse
+func (z *dnsZoneData) lookup(name, owner string) (rrs []DNSResourceRecord, exists bool) {
+	if z.nodes[name] {
+		return z.rrsets[name], true
+	}
+	// 存在する一番近い祖先(closest encloser)の"*"を探す
+	encloser := dnsParentName(name)
+	for encloser != "" && !z.nodes[encloser] {
+		encloser = dnsParentName(encloser)
+	}
+	wildcard, ok := z.rrsets["*."+encloser]
+	if !ok {
+		return nil, false
+	}
+	for _, rr := range wildcard {
+		rr.Name = owner
+		rrs = append(rrs, rr)
+	}
+	return rrs, true
+}
+
+// referral はnameがゾーンの頂点より下のNSレコードで委任されていたら、委任先を教える
+func (z *dnsZoneData) referral(resp *DNSMessage, name string) bool {
+	var cut string
+	for n := name; n != z.origin && n != ""; n = dnsParentName(n) {
+		for _, rr := range z.rrsets[n] {
+			if rr.Type == DNSTypeNS {
+				cut = n
+			}
+		}
+	}
+	if cut == "" {
+		return false
+	}
+	resp.Flags &^= DNSFlagAA
+	var ns []DNSResourceRecord
+	for _, rr := range z.rrsets[cut] {
+		if rr.Type == DNSTypeNS {
+			ns = append(ns, rr)
+		}
+	}
+	resp.Authorities = append(resp.Authorities, ns...)
+	// グルーのアドレスを付ける
+	z.addAdditionals(resp, ns)
+	return true
+}
+
+// addAdditionals はNS, MX, SRVの先の名前がゾーンの中にあれば、そのアドレスをAdditionalに入れる
+func (z *dnsZoneData) addAdditionals(resp *DNSMessage, records []DNSResourceRecord) {
+	seen := make(map[string]bool)
+	for _, rr := range records {
+		var target string
+		switch d := rr.Data.(type) {
+		case DNSNS:
+			target = d.Host
+		case DNSMX:
+			target = d.Exchange
+		case DNSSRV:
+			target = d.Target
+		default:
+			continue
+		}
+		target = strings.ToLower(strings.TrimSuffix(target, "."))
+		if seen[target] || !dnsNameWithin(target, z.origin) {
+			continue
+		}
+		seen[target] = true
+		for _, addr := range z.rrsets[target] {
+			if addr.Type == DNSTypeA || addr.Type == DNSTypeAAAA {
+				resp.Additionals = append(resp.Additionals, addr)
+			}
+		}
+	}
+}
+
+// ServeUDP はconnで問い合わせを受け取って答える。connを閉じると戻る
+func (s *DNSServer) ServeUDP(conn net.PacketConn) error {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if s.isClosed() || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		query, ok := parseDNSQuery(buf[:n])
+		if !ok {
+			continue
+		}
+		resp := s.Answer(query)
+		b, err := packDNSResponse(resp, udpResponseSize(query, s.UDPSize))
+		if err != nil {
+			continue
+		}
+		conn.WriteTo(b, addr)
+	}
+}
+
+// ServeTCP はlnで受け付けたコネクションで、2byteの長さを付けた問い合わせに答える
+// lnを閉じると戻る
+func (s *DNSServer) ServeTCP(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.isClosed() || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.serveTCPConn(conn)
+	}
+}
+
+func (s *DNSServer) serveTCPConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	for {
+		conn.SetReadDeadline(time.Now().Add(dnsServerTCPIdleTimeout))
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return
+		}
+		b := make([]byte, binary.BigEndian.Uint16(length))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return
+		}
+		query, ok := parseDNSQuery(b)
+		if !ok {
+			continue
+		}
+		resp, err := packDNSResponse(s.Answer(query), 0xffff)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(append(UintTo2byte(uint16(len(resp))), resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// parseDNSQuery は問い合わせを読む。ヘッダしか読めなければFORMERRを返すために質問なしで返す
+// 返事は無視する
+func parseDNSQuery(b []byte) (DNSMessage, bool) {
+	query, err := ParseDNSMessage(b)
+	if err != nil {
+		if len(b) < 12 {
+			return DNSMessage{}, false
+		}
+		query = DNSMessage{
+			ID:    binary.BigEndian.Uint16(b[0:2]),
+			Flags: binary.BigEndian.Uint16(b[2:4]),
+		}
+	}
+	if query.IsResponse() {
+		return DNSMessage{}, false
+	}
+	return query, true
+}
+
+// udpResponseSize はUDPで返せる返事の最大長
+// OPTレコードがなければ512byte(RFC1035 4.2.1)
+func udpResponseSize(query DNSMessage, max int) int {
+	size := 512
+	if e, ok := query.EDNS(); ok && int(e.UDPSize) > size {
+		size = int(e.UDPSize)
+	}
+	if max > 512 && size > max {
+		size = max
+	}
+	return size
+}
+
+// packDNSResponse は返事がsizeに収まらなければ、TCビットを立ててレコードを取り除く
+func packDNSResponse(resp DNSMessage, size int) ([]byte, error) {
+	b, err := resp.Pack()
+	if err != nil || len(b) <= size {
+		return b, err
+	}
+	resp.Flags |= DNSFlagTC
+	resp.Answers = nil
+	resp.Authorities = nil
+	var additionals []DNSResourceRecord
+	for _, rr := range resp.Additionals {
+		if rr.Type == DNSTypeOPT {
+			additionals = append(additionals, rr)
+		}
+	}
+	resp.Additionals = additionals
+	return resp.Pack()
+}
+
+// Start はstackのaddrでUDPとTCPを待ち受けて答え始める。stackがnilならカーネルのソケットを使う
+// ポートが0ならUDPで選ばれたポートをTCPでも使う
+func (s *DNSServer) Start(stack *Stack, addr string) error {
+	uaddr, err := net.ResolveUDPAddr("udp4", withDNSPort(addr, "53"))
+	if err != nil {
+		return err
+	}
+	var pc net.PacketConn
+	if stack != nil {
+		conn, err := stack.ListenUDP(uaddr)
+		if err != nil {
+			return err
+		}
+		pc = conn
+	} else {
+		conn, err := net.ListenUDP("udp4", uaddr)
+		if err != nil {
+			return err
+		}
+		pc = conn
+	}
+	taddr := &net.TCPAddr{IP: uaddr.IP, Port: pc.LocalAddr().(*net.UDPAddr).Port}
+	var ln net.Listener
+	if stack != nil {
+		l, err := stack.ListenTCP(taddr)
+		if err != nil {
+			pc.Close()
+			return err
+		}
+		ln = l
+	} else {
+		l, err := net.ListenTCP("tcp4", taddr)
+		if err != nil {
+			pc.Close()
+			return err
+		}
+		ln = l
+	}
+
+	s.mu.Lock()
+	s.packetConn = pc
+	s.listener = ln
+	s.closed = false
+	s.mu.Unlock()
+
+	go s.ServeUDP(pc)
+	go s.ServeTCP(ln)
+	return nil
+}
+
+// Addr はStartで待ち受けているアドレスを返す
+func (s *DNSServer) Addr() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.packetConn == nil {
+		return ""
+	}
+	return s.packetConn.LocalAddr().String()
+}
+
+func (s *DNSServer) isClosed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.closed
+}
+
+// Close はStartで待ち受けたソケットとTCPのコネクションを閉じる
+func (s *DNSServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.packetConn != nil {
+		s.packetConn.Close()
+	}
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package tcpip
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+)
+
+// DNSTLSTransport はTLS1.3で暗号化して問い合わせる(RFC7858, DNS over TLS)
+// TLSの中ではTCPと同じように2byteの長さを付けて送る
+// StackがnilならカーネルのTCPソケットを使う
+type DNSTLSTransport struct {
+	Stack *Stack
+	// 証明書を確かめる名前。空ならサーバのIPアドレスで確かめる
+	ServerName string
+	// nilならOSにインストールされているルート証明書を使う
+	RootCAs            *x509.CertPool
+	InsecureSkipVerify bool
+}
+
+func (t *DNSTLSTransport) Exchange(ctx context.Context, server string, query []byte) ([]byte, error) {
+	if len(query) > 0xffff {
+		return nil, fmt.Errorf("dns message is too long : %d", len(query))
+	}
+	addr := withDNSPort(server, "853")
+	conn, err := dialDNSStream(ctx, t.Stack, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer watchContext(ctx, conn)()
+
+	tlsconn := TLS13Client(conn, dnsTLSConfig(addr, t.ServerName, t.RootCAs, t.InsecureSkipVerify, nil))
+	defer tlsconn.Close()
+
+	resp, err := exchangeDNSStream(tlsconn, query)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return resp, err
+}
+
+// dnsTLSConfig はserverNameが空ならサーバのアドレスを証明書を確かめる名前にする
+func dnsTLSConfig(addr, serverName string, roots *x509.CertPool, insecure bool, protos []string) *TLS13Config {
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(addr)
+	}
+	return &TLS13Config{
+		ServerName:         serverName,
+		RootCAs:            roots,
+		InsecureSkipVerify: insecure,
+		NextProtos:         protos,
+	}
+}
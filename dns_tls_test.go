@@ -0,0 +1,170 @@
+package tcpip
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// dnsTestServerName は代わりのサーバの証明書に入れる名前
+const dnsTestServerName = "dns.test"
+
+// newDNSTestStacks は10.0.0.1のクライアントと10.0.0.2のサーバのStackをつなげる
+func newDNSTestStacks(t *testing.T) (*Stack, *Stack) {
+	a, b := NewChannelLinkPair(1500)
+	client, server := NewStack(), NewStack()
+	client.AddInterface(&NetInterface{Name: "eth0", MacAddr: []byte{0x02, 0, 0, 0, 0, 0x01}, IpAddr: []byte{10, 0, 0, 1}, Netmask: []byte{255, 255, 255, 0}, Link: a})
+	server.AddInterface(&NetInterface{Name: "eth0", MacAddr: []byte{0x02, 0, 0, 0, 0, 0x02}, IpAddr: []byte{10, 0, 0, 2}, Netmask: []byte{255, 255, 255, 0}, Link: b})
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// newDNSTestCertificate はdnsTestServerNameの自己署名証明書と、それを信頼するCertPoolを作る
+func newDNSTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: dnsTestServerName},
+		DNSNames:              []string{dnsTestServerName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+// dnsTestAnswer は問い合わせにaddrのAレコードを1つ入れて返す
+func dnsTestAnswer(t *testing.T, query []byte, addr net.IP) []byte {
+	msg, err := ParseDNSMessage(query)
+	if err != nil || len(msg.Questions) != 1 {
+		t.Errorf("invalid query : %v", err)
+		return nil
+	}
+	resp := DNSMessage{
+		ID:        msg.ID,
+		Flags:     DNSFlagQR | DNSFlagRD | DNSFlagRA,
+		Questions: msg.Questions,
+		Answers: []DNSResourceRecord{{
+			Name:  msg.Questions[0].Name,
+			Type:  DNSTypeA,
+			Class: DNSClassINET,
+			TTL:   60,
+			Data:  DNSA{Addr: addr},
+		}},
+	}
+	b, err := resp.Pack()
+	if err != nil {
+		t.Error(err)
+	}
+	return b
+}
+
+func TestDNSTLSTransport(t *testing.T) {
+	client, server := newDNSTestStacks(t)
+	cert, pool := newDNSTestCertificate(t)
+
+	ln, err := server.ListenTCP(&net.TCPAddr{Port: 853})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsln := tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS13})
+	defer tlsln.Close()
+	go func() {
+		for {
+			conn, err := tlsln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// RFC7858 3.3 TCPと同じ2byteの長さを付けたメッセージ
+				for {
+					length := make([]byte, 2)
+					if _, err := io.ReadFull(conn, length); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(length))
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+					resp := dnsTestAnswer(t, query, net.IP{192, 0, 2, 1})
+					conn.Write(append(UintTo2byte(uint16(len(resp))), resp...))
+				}
+			}()
+		}
+	}()
+
+	r := NewDNSTLSResolver(client, dnsTestServerName, "10.0.0.2")
+	r.Transport.(*DNSTLSTransport).RootCAs = pool
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	hosts, err := r.LookupHost(ctx, "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 || hosts[0] != "192.0.2.1" {
+		t.Fatalf("LookupHost = %v, want [192.0.2.1]", hosts)
+	}
+}
+
+func TestDNSTLSTransportUnknownAuthority(t *testing.T) {
+	client, server := newDNSTestStacks(t)
+	cert, _ := newDNSTestCertificate(t)
+
+	ln, err := server.ListenTCP(&net.TCPAddr{Port: 853})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsln := tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS13})
+	defer tlsln.Close()
+	go func() {
+		for {
+			conn, err := tlsln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+
+	// 信頼していない証明書ならハンドシェイクで失敗する
+	transport := &DNSTLSTransport{Stack: client, ServerName: dnsTestServerName, RootCAs: x509.NewCertPool()}
+	query, _ := NewDNSQueryMessage("www.example.com", DNSTypeA).Pack()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := transport.Exchange(ctx, "10.0.0.2", query); err == nil {
+		t.Fatal("Exchange succeeded with an untrusted certificate")
+	}
+}
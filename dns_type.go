@@ -0,0 +1,74 @@
+package tcpip
+
+// https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml
+const (
+	DNSTypeA     = 1
+	DNSTypeNS    = 2
+	DNSTypeCNAME = 5
+	DNSTypeSOA   = 6
+	DNSTypePTR   = 12
+	DNSTypeMX    = 15
+	DNSTypeTXT   = 16
+	DNSTypeAAAA  = 28
+	DNSTypeSRV   = 33
+	DNSTypeOPT   = 41
+	DNSTypeANY   = 255
+
+	DNSClassINET = 1
+	DNSClassANY  = 255
+)
+
+// ヘッダのFlags(RFC1035 4.1.1, RFC4035 3.2)
+const (
+	DNSFlagQR = 0x8000
+	DNSFlagAA = 0x0400
+	DNSFlagTC = 0x0200
+	DNSFlagRD = 0x0100
+	DNSFlagRA = 0x0080
+	DNSFlagAD = 0x0020
+	DNSFlagCD = 0x0010
+
+	dnsFlagOpcode = 0x7800
+)
+
+// EDNS(0)のオプションコード(RFC6891, RFC7871)
+const (
+	DNSOptionClientSubnet = 8
+	DNSOptionPadding      = 12
+)
+
+// RCODE
+const (
+	DNSRCodeSuccess        = 0
+	DNSRCodeFormatError    = 1
+	DNSRCodeServerFailure  = 2
+	DNSRCodeNameError      = 3
+	DNSRCodeNotImplemented = 4
+	DNSRCodeRefused        = 5
+	// OPTレコードの拡張RCODEを使うもの
+	DNSRCodeBadVersion = 16
+)
+
+var dnsTypeNames = map[uint16]string{
+	DNSTypeA:     "A",
+	DNSTypeNS:    "NS",
+	DNSTypeCNAME: "CNAME",
+	DNSTypeSOA:   "SOA",
+	DNSTypePTR:   "PTR",
+	DNSTypeMX:    "MX",
+	DNSTypeTXT:   "TXT",
+	DNSTypeAAAA:  "AAAA",
+	DNSTypeSRV:   "SRV",
+	DNSTypeOPT:   "OPT",
+	DNSTypeANY:   "ANY",
+}
+
+var dnsRCodeNames = map[int]string{
+	DNSRCodeSuccess:        "NOERROR",
+	DNSRCodeFormatError:    "FORMERR",
+	DNSRCodeServerFailure:  "SERVFAIL",
+	DNSRCodeNameError:      "NXDOMAIN",
+	DNSRCodeNotImplemented: "NOTIMP",
+	DNSRCodeRefused:        "REFUSED",
+	DNSRCodeBadVersion:     "BADVERS",
+}
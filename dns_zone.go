@@ -0,0 +1,360 @@
+package tcpip
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DNSZone はDNSServerが権威を持って答えるゾーン
+// Goの構造体で書くか、ParseDNSZoneでゾーンファイルから読む
+type DNSZone struct {
+	// ゾーンの頂点の名前。"example.com"のように最後の"."は付けない
+	Origin string
+	// ゾーンのレコード。Nameは"www.example.com"のような絶対名で、"@"や空ならOriginになる
+	// SOAレコードがなければDNSServerがデフォルトのものを作る
+	Records []DNSResourceRecord
+}
+
+// Add はレコードを足す
+func (z *DNSZone) Add(records ...DNSResourceRecord) {
+	z.Records = append(z.Records, records...)
+}
+
+// LoadDNSZoneFile はゾーンファイルを読む
+// originは$ORIGINがないときの頂点の名前
+func LoadDNSZoneFile(path, origin string) (*DNSZone, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseDNSZone(f, origin)
+}
+
+// ParseDNSZone はRFC1035 5のマスターファイル形式のゾーンを読む
+// $ORIGIN, $TTL, "@", 相対名, 省略した名前やTTLやクラス, 括弧で複数行に分けたレコードに対応する
+// https://datatracker.ietf.org/doc/html/rfc1035#section-5
+func ParseDNSZone(r io.Reader, origin string) (*DNSZone, error) {
+	p := &dnsZoneParser{
+		origin:  strings.ToLower(strings.TrimSuffix(origin, ".")),
+		lastTTL: 3600,
+	}
+	zone := &DNSZone{Origin: p.origin}
+
+	scanner := bufio.NewScanner(r)
+	var tokens []dnsZoneToken
+	depth := 0
+	lineno := 0
+	start := 0
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Text()
+		lineTokens, opened, err := tokenizeDNSZoneLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("zone line %d: %w", lineno, err)
+		}
+		if depth == 0 {
+			start = lineno
+			// 行頭が空白なら、名前は前のレコードと同じ
+			if len(lineTokens) != 0 && (line[0] == ' ' || line[0] == '\t') {
+				tokens = append(tokens, dnsZoneToken{text: "", blank: true})
+			}
+		}
+		tokens = append(tokens, lineTokens...)
+		depth += opened
+		if depth < 0 {
+			return nil, fmt.Errorf("zone line %d: unbalanced parenthesis", lineno)
+		}
+		if depth > 0 {
+			continue
+		}
+		if len(tokens) != 0 {
+			rr, ok, err := p.parseEntry(tokens)
+			if err != nil {
+				return nil, fmt.Errorf("zone line %d: %w", start, err)
+			}
+			if ok {
+				zone.Records = append(zone.Records, rr)
+			}
+		}
+		tokens = nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("zone line %d: unbalanced parenthesis", start)
+	}
+	if zone.Origin == "" {
+		zone.Origin = p.origin
+	}
+	return zone, nil
+}
+
+type dnsZoneToken struct {
+	text string
+	// 行頭の空白
+	blank bool
+}
+
+type dnsZoneParser struct {
+	origin string
+	// TTLを省略したときは$TTLを使い、$TTLがなければひとつ前のレコードのTTLを使う(RFC2308 4)
+	ttl       uint32
+	hasTTL    bool
+	lastTTL   uint32
+	lastOwner string
+}
+
+// tokenizeDNSZoneLine は1行を空白で区切る。;から後はコメント
+// 括弧は取り除いて、開いた数から閉じた数を引いたものを返す
+func tokenizeDNSZoneLine(line string) ([]dnsZoneToken, int, error) {
+	var tokens []dnsZoneToken
+	opened := 0
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == ';':
+			return tokens, opened, nil
+		case c == '(':
+			opened++
+			i++
+		case c == ')':
+			opened--
+			i++
+		case c == '"':
+			var sb strings.Builder
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				sb.WriteByte(line[i])
+			}
+			if i >= len(line) {
+				return nil, 0, fmt.Errorf("unterminated string")
+			}
+			i++
+			tokens = append(tokens, dnsZoneToken{text: sb.String()})
+		default:
+			j := i
+			for j < len(line) && !strings.ContainsRune(" \t\r;()\"", rune(line[j])) {
+				j++
+			}
+			tokens = append(tokens, dnsZoneToken{text: line[i:j]})
+			i = j
+		}
+	}
+	return tokens, opened, nil
+}
+
+// parseEntry は1つのレコードか$で始まる制御エントリを読む
+func (p *dnsZoneParser) parseEntry(tokens []dnsZoneToken) (DNSResourceRecord, bool, error) {
+	var rr DNSResourceRecord
+	switch strings.ToUpper(tokens[0].text) {
+	case "$ORIGIN":
+		if len(tokens) != 2 {
+			return rr, false, fmt.Errorf("invalid $ORIGIN")
+		}
+		p.origin = strings.ToLower(p.absName(tokens[1].text))
+		return rr, false, nil
+	case "$TTL":
+		if len(tokens) != 2 {
+			return rr, false, fmt.Errorf("invalid $TTL")
+		}
+		ttl, err := parseDNSZoneTTL(tokens[1].text)
+		if err != nil {
+			return rr, false, err
+		}
+		p.ttl = ttl
+		p.hasTTL = true
+		return rr, false, nil
+	case "$INCLUDE", "$GENERATE":
+		return rr, false, fmt.Errorf("%s is not supported", tokens[0].text)
+	}
+
+	if tokens[0].blank {
+		if p.lastOwner == "" {
+			return rr, false, fmt.Errorf("no owner name")
+		}
+		rr.Name = p.lastOwner
+	} else {
+		rr.Name = p.absName(tokens[0].text)
+		p.lastOwner = rr.Name
+	}
+	tokens = tokens[1:]
+
+	// TTLとクラスはどちらが先でもよく、省略できる
+	rr.TTL = p.lastTTL
+	if p.hasTTL {
+		rr.TTL = p.ttl
+	}
+	rr.Class = DNSClassINET
+	for len(tokens) > 0 {
+		text := strings.ToUpper(tokens[0].text)
+		if text == "IN" {
+			tokens = tokens[1:]
+			continue
+		}
+		if text == "CH" || text == "HS" || text == "CS" {
+			return rr, false, fmt.Errorf("class %s is not supported", text)
+		}
+		if ttl, err := parseDNSZoneTTL(text); err == nil {
+			rr.TTL = ttl
+			tokens = tokens[1:]
+			continue
+		}
+		break
+	}
+	if len(tokens) == 0 {
+		return rr, false, fmt.Errorf("no record type")
+	}
+	rrtype, ok := dnsTypeFromString(tokens[0].text)
+	if !ok {
+		return rr, false, fmt.Errorf("unknown record type %s", tokens[0].text)
+	}
+	rr.Type = rrtype
+	data, err := p.parseRData(rrtype, tokens[1:])
+	if err != nil {
+		return rr, false, fmt.Errorf("%s %s: %w", rr.Name, tokens[0].text, err)
+	}
+	rr.Data = data
+	p.lastTTL = rr.TTL
+	return rr, true, nil
+}
+
+func (p *dnsZoneParser) parseRData(rrtype uint16, tokens []dnsZoneToken) (interface{}, error) {
+	want := map[uint16]int{
+		DNSTypeA: 1, DNSTypeAAAA: 1, DNSTypeCNAME: 1, DNSTypeNS: 1, DNSTypePTR: 1,
+		DNSTypeMX: 2, DNSTypeSRV: 4, DNSTypeSOA: 7,
+	}
+	if n, ok := want[rrtype]; ok && len(tokens) != n {
+		return nil, fmt.Errorf("want %d fields but got %d", n, len(tokens))
+	}
+	texts := make([]string, len(tokens))
+	for i, t := range tokens {
+		texts[i] = t.text
+	}
+
+	switch rrtype {
+	case DNSTypeA:
+		ip := net.ParseIP(texts[0]).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %s", texts[0])
+		}
+		return DNSA{Addr: ip}, nil
+	case DNSTypeAAAA:
+		ip := net.ParseIP(texts[0])
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 address %s", texts[0])
+		}
+		return DNSAAAA{Addr: ip}, nil
+	case DNSTypeCNAME:
+		return DNSCNAME{Target: p.absName(texts[0])}, nil
+	case DNSTypeNS:
+		return DNSNS{Host: p.absName(texts[0])}, nil
+	case DNSTypePTR:
+		return DNSPTR{Target: p.absName(texts[0])}, nil
+	case DNSTypeMX:
+		pref, err := strconv.ParseUint(texts[0], 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		return DNSMX{Preference: uint16(pref), Exchange: p.absName(texts[1])}, nil
+	case DNSTypeTXT:
+		if len(texts) == 0 {
+			return nil, fmt.Errorf("no text")
+		}
+		return DNSTXT{Texts: texts}, nil
+	case DNSTypeSRV:
+		var nums [3]uint16
+		for i := range nums {
+			n, err := strconv.ParseUint(texts[i], 10, 16)
+			if err != nil {
+				return nil, err
+			}
+			nums[i] = uint16(n)
+		}
+		return DNSSRV{Priority: nums[0], Weight: nums[1], Port: nums[2], Target: p.absName(texts[3])}, nil
+	case DNSTypeSOA:
+		soa := DNSSOA{MName: p.absName(texts[0]), RName: p.absName(texts[1])}
+		serial, err := strconv.ParseUint(texts[2], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		soa.Serial = uint32(serial)
+		for i, field := range []*uint32{&soa.Refresh, &soa.Retry, &soa.Expire, &soa.Minimum} {
+			if *field, err = parseDNSZoneTTL(texts[3+i]); err != nil {
+				return nil, err
+			}
+		}
+		return soa, nil
+	}
+	return nil, fmt.Errorf("unsupported record type")
+}
+
+// absName は相対名にOriginを付けて、最後の"."のない絶対名にする
+func (p *dnsZoneParser) absName(name string) string {
+	switch {
+	case name == "@":
+		return p.origin
+	case name == ".":
+		return "."
+	case strings.HasSuffix(name, "."):
+		return strings.TrimSuffix(name, ".")
+	case p.origin == "":
+		return name
+	}
+	return name + "." + p.origin
+}
+
+// parseDNSZoneTTL は秒数か、"1h30m"のように単位(s, m, h, d, w)の付いた時間を読む
+func parseDNSZoneTTL(s string) (uint32, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty ttl")
+	}
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(n), nil
+	}
+	units := map[byte]uint64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}
+	var total, num uint64
+	digits := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= '0' && c <= '9' {
+			num = num*10 + uint64(c-'0')
+			digits = true
+			continue
+		}
+		unit, ok := units[c|0x20]
+		if !ok || !digits {
+			return 0, fmt.Errorf("invalid ttl %s", s)
+		}
+		total += num * unit
+		num, digits = 0, false
+	}
+	if digits {
+		return 0, fmt.Errorf("invalid ttl %s", s)
+	}
+	if total > 0xffffffff {
+		return 0, fmt.Errorf("ttl is too large %s", s)
+	}
+	return uint32(total), nil
+}
+
+func dnsTypeFromString(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	for t, name := range dnsTypeNames {
+		if name == s && t != DNSTypeOPT && t != DNSTypeANY {
+			return t, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,257 @@
+package tcpip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// サービスの種類を列挙するための名前(RFC6763 9)
+const dnssdServicesName = "_services._dns-sd._udp"
+
+// DNSSDService はDNS-SD(RFC6763)で知らせるサービスの1つ
+// "My Printer._ipp._tcp.local"のPTR, SRV, TXTレコードになる
+type DNSSDService struct {
+	// "My Printer"のようなインスタンスの名前。"."は入れられない
+	Instance string
+	// "_ipp._tcp"のようなサービスの種類
+	Service string
+	// 空なら"local"
+	Domain string
+	// サービスを動かしているホスト。RegisterServiceで空ならRegisterHostで登録した名前を使う
+	Host string
+	Port uint16
+	// "key=value"のような文字列
+	Text []string
+	// Browse, Resolveで見つけたホストのアドレス
+	Addrs []net.IP
+}
+
+func (s *DNSSDService) domain() string {
+	if s.Domain == "" {
+		return "local"
+	}
+	return strings.Trim(s.Domain, ".")
+}
+
+// ServiceName は"_ipp._tcp.local"のようなPTRレコードを引く名前を返す
+func (s *DNSSDService) ServiceName() string {
+	return strings.Trim(s.Service, ".") + "." + s.domain()
+}
+
+// InstanceName は"My Printer._ipp._tcp.local"のようなSRVレコードとTXTレコードの名前を返す
+// インスタンスの名前の中の"."は"\."にエスケープする
+func (s *DNSSDService) InstanceName() string {
+	return escapeDNSLabel(s.Instance) + "." + s.ServiceName()
+}
+
+// uniqueRecords はprobeして自分だけが使うSRVとTXTのレコードを返す
+func (s *DNSSDService) uniqueRecords() []DNSResourceRecord {
+	text := s.Text
+	// 空のTXTレコードは長さ0の文字列を1つ入れる(RFC6763 6.1)
+	if len(text) == 0 {
+		text = []string{""}
+	}
+	return []DNSResourceRecord{
+		{Name: s.InstanceName(), Type: DNSTypeSRV, Class: DNSClassINET, TTL: mdnsHostTTL,
+			Data: DNSSRV{Port: s.Port, Target: s.Host}},
+		{Name: s.InstanceName(), Type: DNSTypeTXT, Class: DNSClassINET, TTL: mdnsOtherTTL,
+			Data: DNSTXT{Texts: text}},
+	}
+}
+
+// sharedRecords は他のホストも同じ名前で答えるPTRレコードを返す
+func (s *DNSSDService) sharedRecords() []DNSResourceRecord {
+	return []DNSResourceRecord{
+		{Name: s.ServiceName(), Type: DNSTypePTR, Class: DNSClassINET, TTL: mdnsOtherTTL,
+			Data: DNSPTR{Target: s.InstanceName()}},
+		{Name: dnssdServicesName + "." + s.domain(), Type: DNSTypePTR, Class: DNSClassINET, TTL: mdnsOtherTTL,
+			Data: DNSPTR{Target: s.ServiceName()}},
+	}
+}
+
+// RegisterService はサービスをprobeしてから知らせる
+// 同じインスタンスの名前を他のホストが使っていれば"My Printer (2)"のように番号を付けて、svc.Instanceを書き換える
+func (m *MDNS) RegisterService(ctx context.Context, svc *DNSSDService) error {
+	if svc.Instance == "" || len(svc.Instance) > 63 {
+		return fmt.Errorf("invalid dns-sd instance name : %q", svc.Instance)
+	}
+	if !strings.HasPrefix(svc.Service, "_") {
+		return fmt.Errorf("invalid dns-sd service type : %q", svc.Service)
+	}
+	if svc.Host == "" {
+		svc.Host = m.HostName()
+		if svc.Host == "" {
+			return errors.New("dns-sd service has no host : call RegisterHost first")
+		}
+	}
+
+	base := svc.Instance
+	for i := 2; ; i++ {
+		err := m.probe(ctx, svc.uniqueRecords())
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrMDNSConflict) || i > 16 {
+			return err
+		}
+		svc.Instance = fmt.Sprintf("%s (%d)", base, i)
+	}
+
+	var records []mdnsRecord
+	for _, rr := range svc.uniqueRecords() {
+		records = append(records, mdnsRecord{rr: rr, unique: true})
+	}
+	m.mu.Lock()
+	for _, rr := range svc.sharedRecords() {
+		// 同じ種類のサービスが先に登録されていれば、サービスの種類のPTRは答えている
+		if !m.isOwnRecord(rr) {
+			records = append(records, mdnsRecord{rr: rr})
+		}
+	}
+	m.services = append(m.services, svc)
+	m.mu.Unlock()
+	m.publish(records)
+	return nil
+}
+
+// UnregisterService はサービスのgoodbyeを送って答えるのをやめる
+func (m *MDNS) UnregisterService(svc *DNSSDService) {
+	records := svc.uniqueRecords()
+	shared := svc.sharedRecords()
+	records = append(records, shared[0])
+
+	m.mu.Lock()
+	sameType := false
+	for i, other := range m.services {
+		if other == svc {
+			m.services = append(m.services[:i], m.services[i+1:]...)
+			break
+		}
+	}
+	for _, other := range m.services {
+		if strings.EqualFold(other.ServiceName(), svc.ServiceName()) {
+			sameType = true
+		}
+	}
+	m.mu.Unlock()
+	// 同じ種類のサービスが残っていれば、サービスの種類のPTRは答え続ける
+	if !sameType {
+		records = append(records, shared[1])
+	}
+	m.unpublish(records)
+}
+
+// Browse はservice("_ipp._tcp"など)のインスタンスを探し、見つけたものをResolveしてチャネルに送る
+// ctxが終わるまで1秒, 2秒, 4秒...と間隔を空けながら問い合わせ続け、終わったらチャネルを閉じる
+func (m *MDNS) Browse(ctx context.Context, service string) (<-chan *DNSSDService, error) {
+	service = strings.Trim(service, ".")
+	if !strings.HasPrefix(service, "_") {
+		return nil, fmt.Errorf("invalid dns-sd service type : %q", service)
+	}
+	if !strings.HasSuffix(strings.ToLower(service), ".local") {
+		service += ".local"
+	}
+
+	found := make(chan *DNSSDService)
+	go func() {
+		var wg sync.WaitGroup
+		defer func() {
+			wg.Wait()
+			close(found)
+		}()
+		seen := make(map[string]bool)
+		interval := time.Second
+		var next <-chan time.Time
+		for {
+			m.mu.Lock()
+			ptrs := m.cached(service, DNSTypePTR)
+			updated := m.updated
+			m.mu.Unlock()
+			for _, rr := range ptrs {
+				ptr, ok := rr.Data.(DNSPTR)
+				if !ok || seen[mdnsName(ptr.Target)] {
+					continue
+				}
+				seen[mdnsName(ptr.Target)] = true
+				wg.Add(1)
+				go func(name string) {
+					defer wg.Done()
+					svc, err := m.Resolve(ctx, name)
+					if err != nil {
+						return
+					}
+					select {
+					case found <- svc:
+					case <-ctx.Done():
+					}
+				}(ptr.Target)
+			}
+
+			if next == nil {
+				// 知っているインスタンスは問い合わせに付けて、もう一度答えないようにしてもらう
+				m.Query(service, DNSTypePTR)
+				next = time.After(interval)
+				if interval < mdnsMaxQueryInterval {
+					interval *= 2
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-m.closed:
+				return
+			case <-updated:
+			case <-next:
+				next = nil
+			}
+		}
+	}()
+	return found, nil
+}
+
+// Resolve は"My Printer._ipp._tcp.local"のようなインスタンスのSRV, TXT, アドレスを引く
+func (m *MDNS) Resolve(ctx context.Context, instance string) (*DNSSDService, error) {
+	// インスタンスの名前には"\."でエスケープした"."が入っていることがある
+	labels, err := splitDNSName(instance)
+	if err != nil || len(labels) < 4 {
+		return nil, fmt.Errorf("invalid dns-sd instance name : %q", instance)
+	}
+	svc := &DNSSDService{
+		Instance: labels[0],
+		Service:  joinDNSLabels(labels[1:3]),
+		Domain:   joinDNSLabels(labels[3:]),
+	}
+
+	srvs, err := m.Lookup(ctx, instance, DNSTypeSRV)
+	if err != nil {
+		return nil, err
+	}
+	srv := srvs[0].Data.(DNSSRV)
+	svc.Host, svc.Port = srv.Target, srv.Port
+
+	txts, err := m.Lookup(ctx, instance, DNSTypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range txts[0].Data.(DNSTXT).Texts {
+		if t != "" {
+			svc.Text = append(svc.Text, t)
+		}
+	}
+
+	addrs, err := m.Lookup(ctx, svc.Host, DNSTypeA)
+	if err != nil {
+		return nil, err
+	}
+	for _, rr := range addrs {
+		if a, ok := rr.Data.(DNSA); ok {
+			svc.Addrs = append(svc.Addrs, a.Addr)
+		}
+	}
+	return svc, nil
+}
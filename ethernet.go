@@ -1,21 +1,74 @@
 package tcpip
 
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
 var IPv4 = []byte{0x08, 0x00}
 var ARP = []byte{0x08, 0x06}
 
+// VLANタグのTPID
+var VLAN8021Q = []byte{0x81, 0x00}
+var VLAN8021AD = []byte{0x88, 0xa8}
+
 type EthernetFrame struct {
 	DstMacAddr    []byte
 	SourceMacAddr []byte
-	Type          []byte
+	// 802.1Q/802.1adのタグ(4byteずつ、外側から順番)。タグなしならnil
+	VLANTags []byte
+	Type     []byte
+}
+
+// https://www.infraexpert.com/study/ethernet10.html
+// VLANTag は802.1Qのタグ1つ分
+type VLANTag struct {
+	TPID []byte
+	// PCP(3bit) + DEI(1bit) + VID(12bit)
+	TCI []byte
+}
+
+func NewVLANTag(tpid []byte, pcp byte, dei bool, vid uint16) VLANTag {
+	tci := uint16(pcp&0x07)<<13 | vid&0x0fff
+	if dei {
+		tci |= 0x1000
+	}
+	return VLANTag{
+		TPID: tpid,
+		TCI:  UintTo2byte(tci),
+	}
+}
+
+// PCP は優先度(0-7)
+func (t VLANTag) PCP() byte {
+	return t.TCI[0] >> 5
+}
+
+// DEI は輻輳時に捨ててもいいかのフラグ
+func (t VLANTag) DEI() bool {
+	return t.TCI[0]&0x10 != 0
+}
+
+func (t VLANTag) VID() uint16 {
+	return binary.BigEndian.Uint16(t.TCI) & 0x0fff
 }
 
-func NewEthernet(dstMacAddr, sourceMacAddr []byte, ethType string) EthernetFrame {
+func isVLANTPID(b []byte) bool {
+	return bytes.Equal(b, VLAN8021Q) || bytes.Equal(b, VLAN8021AD)
+}
+
+func NewEthernet(dstMacAddr, sourceMacAddr []byte, ethType string, tags ...VLANTag) EthernetFrame {
 	ethernet := EthernetFrame{
 		//宛先のMac Addressをセット
 		DstMacAddr: dstMacAddr,
 		//PCのMac Addressをセット
 		SourceMacAddr: sourceMacAddr,
 	}
+	// VLANタグは外側から順番に入れる
+	for _, tag := range tags {
+		ethernet.VLANTags = append(ethernet.VLANTags, toByteArr(tag)...)
+	}
 	// https://www.infraexpert.com/study/ethernet4.html
 	switch ethType {
 	case "IPv4":
@@ -27,3 +80,43 @@ func NewEthernet(dstMacAddr, sourceMacAddr []byte, ethType string) EthernetFrame
 	}
 	return ethernet
 }
+
+// Tags はVLANタグを外側から順番に返す
+func (e EthernetFrame) Tags() []VLANTag {
+	var tags []VLANTag
+	for i := 0; i+4 <= len(e.VLANTags); i += 4 {
+		tags = append(tags, VLANTag{
+			TPID: e.VLANTags[i : i+2],
+			TCI:  e.VLANTags[i+2 : i+4],
+		})
+	}
+	return tags
+}
+
+// HeaderLength はVLANタグを含めたEthernetヘッダの長さ
+func (e EthernetFrame) HeaderLength() int {
+	return 14 + len(e.VLANTags)
+}
+
+// parseEthernet はVLANタグを読み飛ばしてEthernetヘッダをパースする
+func parseEthernet(frame []byte) (EthernetFrame, error) {
+	if len(frame) < 14 {
+		return EthernetFrame{}, fmt.Errorf("ethernet frame is too short : %d", len(frame))
+	}
+	eth := EthernetFrame{
+		DstMacAddr:    frame[0:6],
+		SourceMacAddr: frame[6:12],
+	}
+	offset := 12
+	for isVLANTPID(frame[offset : offset+2]) {
+		if len(frame) < offset+6 {
+			return EthernetFrame{}, fmt.Errorf("ethernet VLAN tag is truncated")
+		}
+		offset += 4
+	}
+	if offset > 12 {
+		eth.VLANTags = frame[12:offset]
+	}
+	eth.Type = frame[offset : offset+2]
+	return eth, nil
+}
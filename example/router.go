@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"tcpip"
+)
+
+func main() {
+	// eth0, eth1は各自の環境に変えてください
+	// カーネルにも転送させないように sysctl -w net.ipv4.ip_forward=0 にしておく
+	stack := tcpip.NewStack()
+	for _, name := range []string{"eth0", "eth1"} {
+		ifc, err := tcpip.NewNetInterface(name)
+		if err != nil {
+			log.Fatalf("NewNetInterface err : %v", err)
+		}
+		stack.AddInterface(ifc)
+	}
+	// デフォルトルートは各自の環境に変えてください
+	stack.Routes.Add(tcpip.Route{
+		Dest:    tcpip.Iptobyte("0.0.0.0"),
+		Netmask: tcpip.Iptobyte("0.0.0.0"),
+		Gateway: tcpip.Iptobyte("192.168.0.1"),
+		Ifname:  "eth0",
+	})
+	stack.Forwarding = true
+
+	for _, r := range stack.Routes.Routes() {
+		fmt.Printf("route %s/%s via %s dev %s\n", net.IP(r.Dest), net.IP(r.Netmask), net.IP(r.Gateway), r.Ifname)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	<-sig
+	stack.Close()
+}
@@ -0,0 +1,385 @@
+package tcpip
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PacketFilter はtcpdumpに似た式でDecodedPacketを選ぶ
+//
+//	[src|dst] host ADDR       IPv4/IPv6の送信元か宛先、ARPの送信元か対象のアドレス
+//	[src|dst] net ADDR/LEN    アドレスがネットワークに入っている
+//	[src|dst] port N          TCPかUDPのポート
+//	tcp, udp, icmp, icmp6, igmp, ip, ip6, arp
+//	tcpflags syn,ack          指定したTCPのフラグがすべて立っている
+//	vlan [ID]                 VLANタグがある(IDが一致する)
+//
+// and(&&), or(||), not(!)と括弧で組み合わせられる。空の式はすべてのパケットに一致する
+type PacketFilter struct {
+	expr string
+	root filterNode
+}
+
+type filterNode interface {
+	match(p *DecodedPacket) bool
+}
+
+type filterAnd struct{ left, right filterNode }
+type filterOr struct{ left, right filterNode }
+type filterNot struct{ x filterNode }
+
+func (n filterAnd) match(p *DecodedPacket) bool { return n.left.match(p) && n.right.match(p) }
+func (n filterOr) match(p *DecodedPacket) bool  { return n.left.match(p) || n.right.match(p) }
+func (n filterNot) match(p *DecodedPacket) bool { return !n.x.match(p) }
+
+// 送信元と宛先のどちらを見るか
+const (
+	filterDirAny = iota
+	filterDirSrc
+	filterDirDst
+)
+
+type filterHost struct {
+	dir  int
+	addr *net.IPNet
+}
+
+type filterPort struct {
+	dir  int
+	port uint16
+}
+
+// filterProto はIPのプロトコル番号かip, ip6, arpの層があるかを見る
+type filterProto struct {
+	name     string
+	protocol byte
+}
+
+type filterTCPFlags struct {
+	flags byte
+}
+
+// vidが-1ならIDは見ない
+type filterVLAN struct {
+	vid int
+}
+
+var filterProtocols = map[string]byte{
+	"tcp":   IPProtoTCP,
+	"udp":   IPProtoUDP,
+	"icmp":  IPProtoICMP,
+	"icmp6": IPProtoICMPv6,
+	"igmp":  IPProtoIGMP,
+}
+
+var filterTCPFlagNames = map[string]byte{
+	"fin": FIN,
+	"syn": SYN,
+	"rst": RST,
+	"psh": PSH,
+	"ack": ACK,
+	"urg": 0x20,
+	"ece": 0x40,
+	"cwr": 0x80,
+}
+
+// ParsePacketFilter は式をパースする
+func ParsePacketFilter(expr string) (*PacketFilter, error) {
+	f := &PacketFilter{expr: strings.TrimSpace(expr)}
+	tokens := tokenizeFilter(f.expr)
+	if len(tokens) == 0 {
+		return f, nil
+	}
+	p := &filterParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("filter: unexpected %q", p.tokens[p.pos])
+	}
+	f.root = root
+	return f, nil
+}
+
+func (f *PacketFilter) String() string {
+	return f.expr
+}
+
+// Match はパケットが式に一致すればtrue
+func (f *PacketFilter) Match(p *DecodedPacket) bool {
+	if f.root == nil {
+		return true
+	}
+	return f.root.match(p)
+}
+
+// tokenizeFilter は空白で区切り、括弧と!は1つのトークンにする
+func tokenizeFilter(expr string) []string {
+	var tokens []string
+	var cur strings.Builder
+	flush := func() {
+		if cur.Len() != 0 {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+		}
+	}
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			flush()
+		case c == '(' || c == ')':
+			flush()
+			tokens = append(tokens, string(c))
+		case c == '!' && (i+1 == len(expr) || expr[i+1] != '='):
+			flush()
+			tokens = append(tokens, "!")
+		case (c == '&' || c == '|') && i+1 < len(expr) && expr[i+1] == c:
+			flush()
+			tokens = append(tokens, expr[i:i+2])
+			i++
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	flush()
+	return tokens
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", fmt.Errorf("filter: unexpected end of expression")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" || p.peek() == "||" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = filterOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" || p.peek() == "&&" {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = filterAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (filterNode, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.pos++
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{x}, nil
+	case "(":
+		p.pos++
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok, err := p.next(); err != nil || tok != ")" {
+			return nil, fmt.Errorf("filter: missing )")
+		}
+		return x, nil
+	}
+	return p.parsePrimitive()
+}
+
+func (p *filterParser) parsePrimitive() (filterNode, error) {
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	dir := filterDirAny
+	switch tok {
+	case "src":
+		dir = filterDirSrc
+	case "dst":
+		dir = filterDirDst
+	}
+	if dir != filterDirAny {
+		if tok, err = p.next(); err != nil {
+			return nil, err
+		}
+		if tok != "host" && tok != "net" && tok != "port" {
+			return nil, fmt.Errorf("filter: %q after src/dst", tok)
+		}
+	}
+
+	switch tok {
+	case "host":
+		arg, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(arg)
+		if ip == nil {
+			return nil, fmt.Errorf("filter: invalid host address %q", arg)
+		}
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return filterHost{dir: dir, addr: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}}, nil
+	case "net":
+		arg, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		_, ipnet, err := net.ParseCIDR(arg)
+		if err != nil {
+			return nil, fmt.Errorf("filter: invalid network %q", arg)
+		}
+		return filterHost{dir: dir, addr: ipnet}, nil
+	case "port":
+		arg, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.ParseUint(arg, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("filter: invalid port %q", arg)
+		}
+		return filterPort{dir: dir, port: uint16(port)}, nil
+	case "ip", "ip6", "arp":
+		return filterProto{name: tok}, nil
+	case "tcpflags":
+		arg, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		var flags byte
+		for _, name := range strings.Split(arg, ",") {
+			flag, ok := filterTCPFlagNames[strings.ToLower(name)]
+			if !ok {
+				return nil, fmt.Errorf("filter: unknown tcp flag %q", name)
+			}
+			flags |= flag
+		}
+		return filterTCPFlags{flags: flags}, nil
+	case "vlan":
+		if vid, err := strconv.ParseUint(p.peek(), 10, 12); err == nil {
+			p.pos++
+			return filterVLAN{vid: int(vid)}, nil
+		}
+		return filterVLAN{vid: -1}, nil
+	}
+	if protocol, ok := filterProtocols[tok]; ok {
+		return filterProto{name: tok, protocol: protocol}, nil
+	}
+	return nil, fmt.Errorf("filter: unknown primitive %q", tok)
+}
+
+// packetAddrs はIPかARPの送信元と宛先のアドレスを返す
+func packetAddrs(p *DecodedPacket) (src, dst net.IP) {
+	for _, l := range p.Layers {
+		switch l := l.(type) {
+		case *IPv4Layer:
+			return l.SourceIPAddr, l.DstIPAddr
+		case *IPv6Layer:
+			return l.SourceIPAddr, l.DstIPAddr
+		case *ARPLayer:
+			return l.SenderIPAddr, l.TargetIPAddr
+		}
+	}
+	return nil, nil
+}
+
+// packetPorts はTCPかUDPのポートを返す
+func packetPorts(p *DecodedPacket) (src, dst uint16, ok bool) {
+	for _, l := range p.Layers {
+		switch l := l.(type) {
+		case *TCPLayer:
+			return l.SourcePort, l.DestPort, true
+		case *UDPLayer:
+			return l.SourcePort, l.DestPort, true
+		}
+	}
+	return 0, 0, false
+}
+
+func (n filterHost) match(p *DecodedPacket) bool {
+	src, dst := packetAddrs(p)
+	if src == nil {
+		return false
+	}
+	return (n.dir != filterDirDst && n.addr.Contains(src)) || (n.dir != filterDirSrc && n.addr.Contains(dst))
+}
+
+func (n filterPort) match(p *DecodedPacket) bool {
+	src, dst, ok := packetPorts(p)
+	if !ok {
+		return false
+	}
+	return (n.dir != filterDirDst && src == n.port) || (n.dir != filterDirSrc && dst == n.port)
+}
+
+func (n filterProto) match(p *DecodedPacket) bool {
+	switch n.name {
+	case "ip":
+		return p.Layer("IPv4") != nil
+	case "ip6":
+		return p.Layer("IPv6") != nil
+	case "arp":
+		return p.Layer("ARP") != nil
+	}
+	// フラグメントも含めるのでIPヘッダのプロトコル番号を見る
+	for _, l := range p.Layers {
+		switch l := l.(type) {
+		case *IPv4Layer:
+			return l.Protocol == n.protocol
+		case *IPv6Layer:
+			return l.Protocol == n.protocol
+		}
+	}
+	return false
+}
+
+func (n filterTCPFlags) match(p *DecodedPacket) bool {
+	tcp, ok := p.Layer("TCP").(*TCPLayer)
+	return ok && tcp.Flags&n.flags == n.flags
+}
+
+func (n filterVLAN) match(p *DecodedPacket) bool {
+	vlan, ok := p.Layer("VLAN").(*VLANLayer)
+	return ok && (n.vid < 0 || int(vlan.VID) == n.vid)
+}
@@ -0,0 +1,222 @@
+package tcpip
+
+import (
+	"errors"
+
+	"golang.org/x/net/bpf"
+)
+
+var ErrFilterNotCompilable = errors.New("filter cannot be compiled to bpf")
+
+// カーネルに渡すときに切り取らずに全部受け取る長さ
+const bpfSnapLen = 262144
+
+// BPF は式をカーネルで動かすclassic BPFにする
+// 見るのはVLANタグのない(カーネルが外した)IPv4だけで、それ以外のフレームは全部通す
+// 通したフレームはMatchでもう一度選ぶので、カーネルでは多めに通してもよい
+func (f *PacketFilter) BPF() ([]bpf.Instruction, error) {
+	if f.root == nil {
+		return nil, nil
+	}
+	a := &bpfAsm{}
+	body, accept, drop := a.newLabel(), a.newLabel(), a.newLabel()
+	a.emit(bpf.LoadAbsolute{Off: 12, Size: 2})
+	a.jump(bpf.JumpEqual, 0x0800, body, accept)
+	a.mark(body)
+	if err := a.gen(f.root, accept, drop); err != nil {
+		return nil, err
+	}
+	a.mark(accept)
+	a.emit(bpf.RetConstant{Val: bpfSnapLen})
+	a.mark(drop)
+	a.emit(bpf.RetConstant{Val: 0})
+	return a.assemble()
+}
+
+// bpfJump はラベルに飛ぶ条件分岐。assembleでJumpIfにする
+type bpfJump struct {
+	cond bpf.JumpTest
+	val  uint32
+	t, f int
+}
+
+// bpfGoto はラベルに飛ぶ無条件の分岐
+type bpfGoto struct {
+	to int
+}
+
+// bpfAsm はラベルを使って前向きの分岐を書き、最後に相対位置に直す
+type bpfAsm struct {
+	ins    []interface{}
+	labels []int
+}
+
+func (a *bpfAsm) newLabel() int {
+	a.labels = append(a.labels, -1)
+	return len(a.labels) - 1
+}
+
+func (a *bpfAsm) mark(label int) {
+	a.labels[label] = len(a.ins)
+}
+
+func (a *bpfAsm) emit(ins ...bpf.Instruction) {
+	for _, i := range ins {
+		a.ins = append(a.ins, i)
+	}
+}
+
+func (a *bpfAsm) jump(cond bpf.JumpTest, val uint32, t, f int) {
+	a.ins = append(a.ins, bpfJump{cond: cond, val: val, t: t, f: f})
+}
+
+func (a *bpfAsm) jumpTo(label int) {
+	a.ins = append(a.ins, bpfGoto{to: label})
+}
+
+func (a *bpfAsm) assemble() ([]bpf.Instruction, error) {
+	prog := make([]bpf.Instruction, len(a.ins))
+	for i, ins := range a.ins {
+		switch ins := ins.(type) {
+		case bpfJump:
+			t, f := a.labels[ins.t]-i-1, a.labels[ins.f]-i-1
+			if t < 0 || f < 0 || t > 255 || f > 255 {
+				return nil, ErrFilterNotCompilable
+			}
+			prog[i] = bpf.JumpIf{Cond: ins.cond, Val: ins.val, SkipTrue: uint8(t), SkipFalse: uint8(f)}
+		case bpfGoto:
+			prog[i] = bpf.Jump{Skip: uint32(a.labels[ins.to] - i - 1)}
+		case bpf.Instruction:
+			prog[i] = ins
+		}
+	}
+	return prog, nil
+}
+
+// gen はnodeが真ならt、偽ならfに飛ぶコードを書く
+func (a *bpfAsm) gen(node filterNode, t, f int) error {
+	switch n := node.(type) {
+	case filterAnd:
+		mid := a.newLabel()
+		if err := a.gen(n.left, mid, f); err != nil {
+			return err
+		}
+		a.mark(mid)
+		return a.gen(n.right, t, f)
+	case filterOr:
+		mid := a.newLabel()
+		if err := a.gen(n.left, t, mid); err != nil {
+			return err
+		}
+		a.mark(mid)
+		return a.gen(n.right, t, f)
+	case filterNot:
+		return a.gen(n.x, f, t)
+	case filterHost:
+		return a.genHost(n, t, f)
+	case filterPort:
+		a.genTransport(f)
+		if n.dir != filterDirDst {
+			next := f
+			if n.dir == filterDirAny {
+				next = a.newLabel()
+			}
+			a.emit(bpf.LoadIndirect{Off: 14, Size: 2})
+			a.jump(bpf.JumpEqual, uint32(n.port), t, next)
+			if n.dir == filterDirAny {
+				a.mark(next)
+			}
+		}
+		if n.dir != filterDirSrc {
+			a.emit(bpf.LoadIndirect{Off: 16, Size: 2})
+			a.jump(bpf.JumpEqual, uint32(n.port), t, f)
+		}
+		return nil
+	case filterProto:
+		switch n.name {
+		case "ip":
+			a.jumpTo(t)
+		case "ip6", "arp":
+			a.jumpTo(f)
+		default:
+			a.emit(bpf.LoadAbsolute{Off: 23, Size: 1})
+			a.jump(bpf.JumpEqual, uint32(n.protocol), t, f)
+		}
+		return nil
+	case filterTCPFlags:
+		proto := a.newLabel()
+		a.emit(bpf.LoadAbsolute{Off: 23, Size: 1})
+		a.jump(bpf.JumpEqual, IPProtoTCP, proto, f)
+		a.mark(proto)
+		a.genTransport(f)
+		a.emit(
+			bpf.LoadIndirect{Off: 14 + 13, Size: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: uint32(n.flags)},
+		)
+		a.jump(bpf.JumpEqual, uint32(n.flags), t, f)
+		return nil
+	case filterVLAN:
+		// カーネルが外したタグはskbに残っている
+		a.emit(bpf.LoadExtension{Num: bpf.ExtVLANTagPresent})
+		if n.vid < 0 {
+			a.jump(bpf.JumpNotEqual, 0, t, f)
+			return nil
+		}
+		present := a.newLabel()
+		a.jump(bpf.JumpNotEqual, 0, present, f)
+		a.mark(present)
+		a.emit(
+			bpf.LoadExtension{Num: bpf.ExtVLANTag},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0x0fff},
+		)
+		a.jump(bpf.JumpEqual, uint32(n.vid), t, f)
+		return nil
+	}
+	return ErrFilterNotCompilable
+}
+
+func (a *bpfAsm) genHost(n filterHost, t, f int) error {
+	ip := n.addr.IP.To4()
+	if ip == nil || len(n.addr.Mask) != 4 {
+		// IPv6のアドレスはIPv4のパケットには一致しない
+		a.jumpTo(f)
+		return nil
+	}
+	addr := uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+	mask := uint32(n.addr.Mask[0])<<24 | uint32(n.addr.Mask[1])<<16 | uint32(n.addr.Mask[2])<<8 | uint32(n.addr.Mask[3])
+	cmp := func(off uint32, t, f int) {
+		a.emit(bpf.LoadAbsolute{Off: off, Size: 4})
+		if mask != 0xffffffff {
+			a.emit(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: mask})
+		}
+		a.jump(bpf.JumpEqual, addr&mask, t, f)
+	}
+	switch n.dir {
+	case filterDirSrc:
+		cmp(26, t, f)
+	case filterDirDst:
+		cmp(30, t, f)
+	default:
+		next := a.newLabel()
+		cmp(26, t, next)
+		a.mark(next)
+		cmp(30, t, f)
+	}
+	return nil
+}
+
+// genTransport はTCPかUDPの先頭のフラグメントでなければfに飛び、
+// XレジスタにIPヘッダの長さを入れる
+// デコーダはフラグメントの上の層を読まないので、MFが立っているものも除く
+func (a *bpfAsm) genTransport(f int) {
+	udp, frag, first := a.newLabel(), a.newLabel(), a.newLabel()
+	a.emit(bpf.LoadAbsolute{Off: 23, Size: 1})
+	a.jump(bpf.JumpEqual, IPProtoTCP, frag, udp)
+	a.mark(udp)
+	a.jump(bpf.JumpEqual, IPProtoUDP, frag, f)
+	a.mark(frag)
+	a.emit(bpf.LoadAbsolute{Off: 20, Size: 2})
+	a.jump(bpf.JumpBitsSet, 0x3fff, f, first)
+	a.mark(first)
+	a.emit(bpf.LoadMemShift{Off: 14})
+}
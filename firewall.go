@@ -0,0 +1,370 @@
+package tcpip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrFirewallRule = errors.New("invalid firewall rule")
+	// 送ろうとしたパケットがOUTPUTかPOSTROUTINGで落とされた
+	ErrPacketFiltered = errors.New("packet filtered by firewall")
+)
+
+// FirewallHook はパケットのルールを評価する場所
+// https://wiki.nftables.org/wiki-nftables/index.php/Netfilter_hooks
+type FirewallHook int
+
+const (
+	// 受け取ったすべてのパケット。NATで宛先を書き換える前
+	HookPrerouting FirewallHook = iota
+	// 自分宛てのパケット
+	HookInput
+	// 転送するパケット。宛先は書き換えた後で、送信元は書き換える前
+	HookForward
+	// 自分が送るパケット
+	HookOutput
+	// 送り出すすべてのパケット。NATで送信元を書き換える前
+	HookPostrouting
+	firewallHooks
+)
+
+var firewallHookNames = [...]string{"PREROUTING", "INPUT", "FORWARD", "OUTPUT", "POSTROUTING"}
+
+func (h FirewallHook) String() string {
+	if h < 0 || h >= firewallHooks {
+		return fmt.Sprintf("hook(%d)", int(h))
+	}
+	return firewallHookNames[h]
+}
+
+// FirewallVerdict はルールに一致したパケットをどうするか
+type FirewallVerdict int
+
+const (
+	VerdictAccept FirewallVerdict = iota
+	VerdictDrop
+	// 捨てて、送信元にICMPエラーかTCPのRSTを返す
+	VerdictReject
+	// ログに書いて、次のルールに進む
+	VerdictLog
+)
+
+var firewallVerdictNames = map[FirewallVerdict]string{
+	VerdictAccept: "ACCEPT",
+	VerdictDrop:   "DROP",
+	VerdictReject: "REJECT",
+	VerdictLog:    "LOG",
+}
+
+func (v FirewallVerdict) String() string {
+	return firewallVerdictNames[v]
+}
+
+// FirewallReject はRejectで返すもの
+type FirewallReject int
+
+const (
+	RejectPortUnreachable FirewallReject = iota
+	RejectHostUnreachable
+	RejectNetUnreachable
+	RejectAdminProhibited
+	// TCPならRSTを返す。TCP以外はPort Unreachableにする
+	RejectTCPReset
+)
+
+var firewallRejectCodes = map[FirewallReject]byte{
+	RejectPortUnreachable: ICMPCodePortUnreachable,
+	RejectHostUnreachable: ICMPCodeHostUnreachable,
+	RejectNetUnreachable:  ICMPCodeNetUnreachable,
+	RejectAdminProhibited: ICMPCodeAdminProhibited,
+	RejectTCPReset:        ICMPCodePortUnreachable,
+}
+
+// FirewallRule はパケットに一致する条件とVerdict
+// 空の条件はすべてに一致する
+type FirewallRule struct {
+	Protocol byte
+	Source   *net.IPNet
+	Dest     *net.IPNet
+	// TCPとUDPのポート。指定するとTCPとUDPの先頭のフラグメントにしか一致しない
+	SourcePort uint16
+	DestPort   uint16
+	// INPUTとPREROUTINGにはOutInterface、OUTPUTにはInInterfaceがない
+	InInterface  string
+	OutInterface string
+	// TCPFlagsMaskのビットのうちTCPFlagsだけが立っているものに一致する
+	// iptablesの--tcp-flags RST RSTならTCPFlagsMaskもTCPFlagsもRST
+	TCPFlags     byte
+	TCPFlagsMask byte
+	// CTStateNew|CTStateEstablishedのように、どれかの状態に一致する
+	State ConnTrackState
+
+	Verdict    FirewallVerdict
+	RejectWith FirewallReject
+	// VerdictLogのログの先頭に付ける
+	LogPrefix string
+}
+
+// Firewall はフックごとに順番にルールを評価する
+// 最初に一致したAccept, Drop, Rejectで決まり、どれにも一致しなければフックのポリシーに従う
+type Firewall struct {
+	// VerdictLogで使う。nilならlog.Printf
+	Logf func(format string, v ...interface{})
+
+	mu       sync.RWMutex
+	rules    [firewallHooks][]FirewallRule
+	policies [firewallHooks]FirewallVerdict
+}
+
+// NewFirewall はルールがなく、すべてのフックのポリシーがAcceptのファイアウォールを作る
+func NewFirewall() *Firewall {
+	return &Firewall{}
+}
+
+func validFirewallRule(hook FirewallHook, rule FirewallRule) error {
+	if hook < 0 || hook >= firewallHooks {
+		return ErrFirewallRule
+	}
+	if _, ok := firewallVerdictNames[rule.Verdict]; !ok {
+		return ErrFirewallRule
+	}
+	// iptablesと同じく、返事を送るのはINPUT, FORWARD, OUTPUTだけ
+	if rule.Verdict == VerdictReject && (hook == HookPrerouting || hook == HookPostrouting) {
+		return ErrFirewallRule
+	}
+	if (rule.SourcePort != 0 || rule.DestPort != 0) && rule.Protocol != 0 &&
+		rule.Protocol != IPProtoTCP && rule.Protocol != IPProtoUDP {
+		return ErrFirewallRule
+	}
+	if rule.TCPFlagsMask != 0 && rule.Protocol != 0 && rule.Protocol != IPProtoTCP {
+		return ErrFirewallRule
+	}
+	return nil
+}
+
+// AppendRule はフックの最後にルールを追加する
+func (f *Firewall) AppendRule(hook FirewallHook, rule FirewallRule) error {
+	if err := validFirewallRule(hook, rule); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules[hook] = append(f.rules[hook], rule)
+	return nil
+}
+
+// InsertRule はフックのindex番目にルールを入れる
+func (f *Firewall) InsertRule(hook FirewallHook, index int, rule FirewallRule) error {
+	if err := validFirewallRule(hook, rule); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rules := f.rules[hook]
+	if index < 0 || index > len(rules) {
+		return ErrFirewallRule
+	}
+	rules = append(rules, FirewallRule{})
+	copy(rules[index+1:], rules[index:])
+	rules[index] = rule
+	f.rules[hook] = rules
+	return nil
+}
+
+// DeleteRule はフックのindex番目のルールを消す
+func (f *Firewall) DeleteRule(hook FirewallHook, index int) error {
+	if hook < 0 || hook >= firewallHooks {
+		return ErrFirewallRule
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rules := f.rules[hook]
+	if index < 0 || index >= len(rules) {
+		return ErrFirewallRule
+	}
+	f.rules[hook] = append(rules[:index:index], rules[index+1:]...)
+	return nil
+}
+
+// Rules はフックのルールのコピーを返す
+func (f *Firewall) Rules(hook FirewallHook) []FirewallRule {
+	if hook < 0 || hook >= firewallHooks {
+		return nil
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return append([]FirewallRule{}, f.rules[hook]...)
+}
+
+// Flush はフックのルールを全部消す。ポリシーは残る
+func (f *Firewall) Flush(hook FirewallHook) {
+	if hook < 0 || hook >= firewallHooks {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules[hook] = nil
+}
+
+// SetPolicy はどのルールにも一致しなかったパケットをどうするか決める。AcceptかDropだけ
+func (f *Firewall) SetPolicy(hook FirewallHook, verdict FirewallVerdict) error {
+	if hook < 0 || hook >= firewallHooks || (verdict != VerdictAccept && verdict != VerdictDrop) {
+		return ErrFirewallRule
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.policies[hook] = verdict
+	return nil
+}
+
+// Policy はフックのポリシーを返す
+func (f *Firewall) Policy(hook FirewallHook) FirewallVerdict {
+	if hook < 0 || hook >= firewallHooks {
+		return VerdictAccept
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.policies[hook]
+}
+
+// evaluate はルールを順番に見て、決まったVerdictと一致したルールを返す
+// ポリシーで決まったときのルールはnil
+func (f *Firewall) evaluate(hook FirewallHook, in, out string, packet []byte, state ConnTrackState) (FirewallVerdict, *FirewallRule) {
+	f.mu.RLock()
+	rules := f.rules[hook]
+	policy := f.policies[hook]
+	f.mu.RUnlock()
+
+	for i := range rules {
+		r := &rules[i]
+		if !r.match(in, out, packet, state) {
+			continue
+		}
+		if r.Verdict == VerdictLog {
+			f.log(hook, r, in, out, packet)
+			continue
+		}
+		return r.Verdict, r
+	}
+	return policy, nil
+}
+
+func (r *FirewallRule) match(in, out string, packet []byte, state ConnTrackState) bool {
+	if r.InInterface != "" && r.InInterface != in {
+		return false
+	}
+	if r.OutInterface != "" && r.OutInterface != out {
+		return false
+	}
+	if r.State != 0 && r.State&state == 0 {
+		return false
+	}
+	proto := packet[9]
+	if r.Protocol != 0 && r.Protocol != proto {
+		return false
+	}
+	if r.Source != nil && !r.Source.Contains(packet[12:16]) {
+		return false
+	}
+	if r.Dest != nil && !r.Dest.Contains(packet[16:20]) {
+		return false
+	}
+	if r.SourcePort == 0 && r.DestPort == 0 && r.TCPFlagsMask == 0 {
+		return true
+	}
+
+	// ここから先はトランスポート層のヘッダを見る
+	hlen := ipHeaderLength(packet)
+	if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 || len(packet) < hlen+4 {
+		return false
+	}
+	if proto != IPProtoTCP && proto != IPProtoUDP {
+		return false
+	}
+	if r.SourcePort != 0 && r.SourcePort != binary.BigEndian.Uint16(packet[hlen:]) {
+		return false
+	}
+	if r.DestPort != 0 && r.DestPort != binary.BigEndian.Uint16(packet[hlen+2:]) {
+		return false
+	}
+	if r.TCPFlagsMask != 0 {
+		if proto != IPProtoTCP || len(packet) < hlen+14 {
+			return false
+		}
+		return packet[hlen+13]&r.TCPFlagsMask == r.TCPFlags
+	}
+	return true
+}
+
+// log はiptablesのLOGと同じく、インターフェイスとパケットの要約を書く
+func (f *Firewall) log(hook FirewallHook, r *FirewallRule, in, out string, packet []byte) {
+	logf := f.Logf
+	if logf == nil {
+		logf = log.Printf
+	}
+	summary := DecodePacket(packet, DecodeIPv4).Summary()
+	logf("%s%s IN=%s OUT=%s %s", r.LogPrefix, hook, in, out, strings.TrimSpace(summary))
+}
+
+func ifname(ifc *NetInterface) string {
+	if ifc == nil {
+		return ""
+	}
+	return ifc.Name
+}
+
+// filter はフックのルールを評価して、パケットを先に進めてよければtrueを返す
+// Rejectなら受け取ったパケットの送信元にICMPエラーかRSTを返す
+// 返事はNATで書き換える前のパケットに対して作る
+func (s *Stack) filter(hook FirewallHook, in, out *NetInterface, packet []byte, ref *connRef) bool {
+	if s.Firewall == nil {
+		return true
+	}
+	state := CTStateUntracked
+	original := packet
+	if ref != nil {
+		state, original = ref.state, ref.original
+	}
+	verdict, rule := s.Firewall.evaluate(hook, ifname(in), ifname(out), packet, state)
+	switch verdict {
+	case VerdictAccept:
+		return true
+	case VerdictReject:
+		s.reject(in, original, rule.RejectWith)
+	}
+	return false
+}
+
+// reject は捨てたパケットの送信元に返事をする
+// 自分が送ろうとしたパケット(inがnil)には何も返さず、送信の関数がエラーを返す
+func (s *Stack) reject(in *NetInterface, packet []byte, with FirewallReject) {
+	if in == nil {
+		return
+	}
+	hlen := ipHeaderLength(packet)
+	if with == RejectTCPReset && packet[9] == IPProtoTCP && len(packet) >= hlen+20 &&
+		binary.BigEndian.Uint16(packet[6:8])&0x1fff == 0 {
+		ip := parseIP(packet[0:20])
+		tcp := packet[hlen:]
+		thlen := int(tcp[12]>>4) * 4
+		if thlen < 20 || thlen > len(tcp) {
+			return
+		}
+		seg := tcpSegment{
+			seq:   binary.BigEndian.Uint32(tcp[4:8]),
+			ack:   binary.BigEndian.Uint32(tcp[8:12]),
+			flags: tcp[13],
+			data:  tcp[thlen:],
+		}
+		s.sendTCPReset(ip.DstIPAddr, binary.BigEndian.Uint16(tcp[2:4]),
+			ip.SourceIPAddr, binary.BigEndian.Uint16(tcp[0:2]), seg)
+		return
+	}
+	s.sendICMPError(in, packet, ICMPTypeDestinationUnreachable, firewallRejectCodes[with], nil)
+}
@@ -0,0 +1,134 @@
+package tcpip
+
+import (
+	"encoding/binary"
+)
+
+// forward は自分宛てでないIPパケットを次のルータかホストに送る
+// https://datatracker.ietf.org/doc/html/rfc1812#section-5.2
+// refはパケットの接続。ICMPエラーにはNATで書き換える前のパケットを引用する
+func (s *Stack) forward(in *NetInterface, packet []byte, ref *connRef) {
+	ip := parseIP(packet[0:20])
+	quote := packet
+	if ref != nil {
+		quote = ref.original
+	}
+
+	// ブロードキャストやマルチキャスト、不正な送信元のパケットは転送しない
+	if isBroadcastAddr(ip.DstIPAddr, nil) || isMulticastAddr(ip.DstIPAddr) || isMartianSource(ip.SourceIPAddr) {
+		return
+	}
+
+	// TTLが尽きるならTime Exceededを返す
+	if ip.TTL[0] <= 1 {
+		s.sendICMPError(in, quote, ICMPTypeTimeExceeded, 0x00, nil)
+		return
+	}
+
+	out, nexthop, err := s.lookupRoute(ip.DstIPAddr)
+	if err != nil {
+		s.sendICMPError(in, quote, ICMPTypeDestinationUnreachable, ICMPCodeNetUnreachable, nil)
+		return
+	}
+
+	// TTLを1減らして、チェックサムは差分だけ更新する
+	fwd := make([]byte, len(packet))
+	copy(fwd, packet)
+	oldWord := binary.BigEndian.Uint16(fwd[8:10])
+	fwd[8]--
+	copy(fwd[10:12], updateChecksum(fwd[10:12], oldWord, binary.BigEndian.Uint16(fwd[8:10])))
+
+	if !s.filter(HookForward, in, out, fwd, ref) || !s.filter(HookPostrouting, in, out, fwd, ref) {
+		return
+	}
+	if s.NAT != nil {
+		outAddr, _ := s.interfaceAddr(out)
+		if !s.NAT.postrouting(s.ConnTrack, out, outAddr, fwd, ref) {
+			return
+		}
+	}
+	if !s.ConnTrack.confirm(ref) {
+		return
+	}
+
+	if s.ClampMSS {
+		clampTCPMSS(fwd, s.pathMTU(out, ip.DstIPAddr))
+	}
+
+	fragments, err := fragmentIPv4(fwd, out.MTU())
+	if err == ErrFragmentNeeded {
+		// 次のホップのMTUを教える(RFC1191)
+		s.sendICMPError(in, quote, ICMPTypeDestinationUnreachable, ICMPCodeFragmentationNeeded,
+			[]byte{0x00, 0x00, byte(out.MTU() >> 8), byte(out.MTU())})
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	unreachable := func() {
+		s.sendICMPError(in, quote, ICMPTypeDestinationUnreachable, ICMPCodeHostUnreachable, nil)
+	}
+	for i, frag := range fragments {
+		// Host Unreachableは最初のフラグメントのときだけ返す
+		if i != 0 {
+			unreachable = nil
+		}
+		s.writeIPv4(out, nexthop, frag, unreachable)
+	}
+}
+
+func isMulticastAddr(ip []byte) bool {
+	return len(ip) == 4 && ip[0]&0xf0 == 0xe0
+}
+
+// 0.0.0.0/8, 127.0.0.0/8, マルチキャスト, ブロードキャストは送信元にならない
+func isMartianSource(ip []byte) bool {
+	return ip[0] == 0 || ip[0] == 127 || isMulticastAddr(ip) || isBroadcastAddr(ip, nil)
+}
+
+// sendICMPError は受け取ったパケットの送信元にICMPエラーを返す
+// ICMPエラーへのエラーや2番目以降のフラグメントへのエラーは返さない(RFC1812 4.3.2.7)
+func (s *Stack) sendICMPError(in *NetInterface, original []byte, icmpType, code byte, rest []byte) {
+	ip := parseIP(original[0:20])
+	if isMartianSource(ip.SourceIPAddr) || isMulticastAddr(ip.DstIPAddr) || s.isLocalBroadcast(ip.DstIPAddr) {
+		return
+	}
+	if binary.BigEndian.Uint16(ip.Flags)&0x1fff != 0 {
+		return
+	}
+	hlen := ipHeaderLength(original)
+	if ip.Protocol[0] == IPProtoICMP && len(original) > hlen && isICMPErrorType(original[hlen]) {
+		return
+	}
+	if rest == nil {
+		rest = []byte{0x00, 0x00, 0x00, 0x00}
+	}
+	icmp := NewICMPError(icmpType, code, rest, original)
+
+	src, _ := s.interfaceAddr(in)
+	header := NewIPHeader(src, ip.SourceIPAddr, "ICMP")
+	s.SendIPv4(header, toByteArr(icmp))
+}
+
+func (s *Stack) isLocalBroadcast(ip []byte) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, ifc := range s.interfaces {
+		if isBroadcastAddr(ip, ifc.Netmask) {
+			return true
+		}
+	}
+	return false
+}
+
+func isICMPErrorType(icmpType byte) bool {
+	switch icmpType {
+	case ICMPTypeEchoReply, ICMPTypeEchoRequest:
+		return false
+	// Timestamp, Information, Address Mask, Router Advertisement/Solicitation
+	case 13, 14, 15, 16, 17, 18, 9, 10:
+		return false
+	}
+	return true
+}
@@ -151,6 +151,7 @@ func HuffmanDecode(hpackBytes []byte) string {
 
 	var decstr string
 	for {
+		remain := len(binstr)
 		for _, v := range bitLength {
 			// 残り文字数より多いbitはskipする
 			if len(binstr) < v {
@@ -168,6 +169,9 @@ func HuffmanDecode(hpackBytes []byte) string {
 		} else if !strings.Contains(binstr, "0") {
 			// 残りの文字が全部１なら全部Paddingだからbreak
 			break
+		} else if len(binstr) == remain {
+			// テーブルにない符号なのでこれ以上読めない
+			break
 		}
 	}
 	return decstr
@@ -186,56 +190,110 @@ func DecodeHttp2Header(headerByte []byte) []Http2Header {
 
 	var http2Header []Http2Header
 
-	for i := 0; i < len(headerByte); i++ {
-		binstr := fmt.Sprintf("%08b", headerByte[i])
-		//fmt.Printf("i is %d, binstr is %s\n", i, binstr)
-		if strings.HasPrefix(binstr, "1") {
+	for i := 0; i < len(headerByte); {
+		b := headerByte[i]
+		switch {
+		case b&0x80 != 0:
 			// インデックスヘッダフィールド表現(1で始まる)
-			// 残り7bitを10進数にする
-			d, _ := strconv.ParseInt(binstr[1:], 2, 8)
-			http2Header = append(http2Header, StaticHttp2Table[d-1])
-		} else if strings.HasPrefix(binstr, "01") {
-			var header Http2Header
-			// インデックス更新を伴うリテラルヘッダフィールド（01で始まる）
-			// Httpヘッダ名をIndex番号で取得
-			d, _ := strconv.ParseInt(binstr[2:], 2, 8)
-			header.Name = StaticHttp2Table[d-1].Name
-
-			//　Valueの値を2進数にする
-			binstr = fmt.Sprintf("%08b", headerByte[i+1])
-			if binstr[0:1] == "1" {
-				d, _ := strconv.ParseInt(binstr[1:], 2, 8)
-				header.Value = HuffmanDecode(headerByte[i+2 : i+2+int(d)])
+			index, n := decodeHpackInteger(headerByte[i:], 7)
+			if n == 0 {
+				return http2Header
+			}
+			i += n
+			if header, ok := staticHttp2Header(index); ok {
 				http2Header = append(http2Header, header)
-				// 次のヘッダが始まる位置にiを進めるためにインクリメント
-				i = i + 1 + int(d)
 			}
-		} else if binstr == "00000000" {
+		case b&0xe0 == 0x20:
+			// 動的テーブルサイズ更新(001で始まる)
+			_, n := decodeHpackInteger(headerByte[i:], 5)
+			if n == 0 {
+				return http2Header
+			}
+			i += n
+		default:
+			// インデックス更新を伴うリテラルヘッダフィールド（01で始まる）はIndexが6bit
+			// インデックス更新を伴わない(0000), インデックスしない(0001)ものは4bit
+			prefix := 4
+			if b&0xc0 == 0x40 {
+				prefix = 6
+			}
+			index, n := decodeHpackInteger(headerByte[i:], prefix)
+			if n == 0 {
+				return http2Header
+			}
+			i += n
 
-			binstr = fmt.Sprintf("%08b", headerByte[i+1])
-			if binstr[0:1] == "1" {
+			var header Http2Header
+			if index == 0 {
 				// Name Stringを処理する
-				d, _ := strconv.ParseInt(binstr[1:], 2, 8)
-				nameString := HuffmanDecode(headerByte[i+2 : i+2+int(d)])
-				// Name Valueを処理する
-				i = i + 2 + int(d)
-				binstr = fmt.Sprintf("%08b", headerByte[i])
-				d, _ = strconv.ParseInt(binstr[1:], 2, 8)
-				nameValue := HuffmanDecode(headerByte[i+1 : i+1+int(d)])
+				name, n := decodeHpackString(headerByte[i:])
+				if n == 0 {
+					return http2Header
+				}
+				header.Name = name
+				i += n
+			} else {
+				// 動的テーブルは持っていないので、静的テーブルにないものは名前が空になる
+				static, _ := staticHttp2Header(index)
+				header.Name = static.Name
+			}
+			// Name Valueを処理する
+			value, n := decodeHpackString(headerByte[i:])
+			if n == 0 {
+				return http2Header
+			}
+			header.Value = value
+			i += n
+			http2Header = append(http2Header, header)
+		}
+	}
 
-				// 次のヘッダが始まる位置にiを進めるためにインクリメント
-				i += int(d)
+	return http2Header
+}
 
-				http2Header = append(http2Header, Http2Header{
-					Name:  nameString,
-					Value: nameValue,
-				})
+func staticHttp2Header(index int) (Http2Header, bool) {
+	if index < 1 || index > len(StaticHttp2Table) {
+		return Http2Header{}, false
+	}
+	return StaticHttp2Table[index-1], true
+}
 
-			}
+// 5.1. Integer Representation
+// 読んだ値と使ったbyte数を返す。途中で切れていたら0byteを返す
+func decodeHpackInteger(b []byte, prefix int) (int, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	max := 1<<prefix - 1
+	value := int(b[0]) & max
+	if value < max {
+		return value, 1
+	}
+	shift := 0
+	for i := 1; i < len(b) && i < 5; i++ {
+		value += int(b[i]&0x7f) << shift
+		shift += 7
+		if b[i]&0x80 == 0 {
+			return value, i + 1
 		}
 	}
+	return 0, 0
+}
 
-	return http2Header
+// 5.2. String Literal Representation
+// 先頭のbitが1ならハフマン符号化されている
+func decodeHpackString(b []byte) (string, int) {
+	if len(b) == 0 {
+		return "", 0
+	}
+	length, n := decodeHpackInteger(b, 7)
+	if n == 0 || len(b) < n+length {
+		return "", 0
+	}
+	if b[0]&0x80 != 0 {
+		return HuffmanDecode(b[n : n+length]), n + length
+	}
+	return string(b[n : n+length]), n + length
 }
 
 func getHttp2HeaderIndexByValue(value string) (index int) {
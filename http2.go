@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"strconv"
 )
 
@@ -30,6 +31,18 @@ const (
 	SettingsMaxHeaderListSize
 )
 
+// フレームのFlags
+const (
+	Http2FlagEndStream  = 0x01
+	Http2FlagAck        = 0x01
+	Http2FlagEndHeaders = 0x04
+	Http2FlagPadded     = 0x08
+	Http2FlagPriority   = 0x20
+)
+
+// SETTINGSで変えなければフレームの長さはこれまで
+const http2DefaultMaxFrameSize = 16384
+
 type Http2Header struct {
 	Name  string
 	Value string
@@ -216,6 +229,93 @@ func CreateHeaderFrame() []byte {
 	return toByteArr(headerFrame)
 }
 
+// CreateRequestFrames はstreamIDのストリームでリクエストを送るHEADERSとDATAのフレームを作る
+// Nameが空のヘッダはCreateHttp2Headerと同じように値で静的テーブルを引く
+// bodyが空ならHEADERSでストリームを終える
+func CreateRequestFrames(streamID uint32, headers []Http2Header, body []byte) []byte {
+	var block []byte
+	for _, h := range headers {
+		block = append(block, CreateHttp2Header(h.Name, h.Value)...)
+	}
+
+	flags := byte(Http2FlagEndHeaders)
+	if len(body) == 0 {
+		flags |= Http2FlagEndStream
+	}
+	packet := toByteArr(Http2Frame{
+		Length:           UintTo3byte(uint32(len(block))),
+		Type:             []byte{FrameTypeHeaders},
+		Flags:            []byte{flags},
+		StreamIdentifier: UintTo4byte(streamID),
+		Value:            block,
+	})
+
+	// 1つのDATAフレームに入りきらなければ分ける
+	for len(body) > 0 {
+		chunk := body
+		if len(chunk) > http2DefaultMaxFrameSize {
+			chunk = chunk[:http2DefaultMaxFrameSize]
+		}
+		body = body[len(chunk):]
+		flags = 0x00
+		if len(body) == 0 {
+			flags = Http2FlagEndStream
+		}
+		packet = append(packet, toByteArr(Http2Frame{
+			Length:           UintTo3byte(uint32(len(chunk))),
+			Type:             []byte{FrameTypeData},
+			Flags:            []byte{flags},
+			StreamIdentifier: UintTo4byte(streamID),
+			Value:            chunk,
+		})...)
+	}
+
+	return packet
+}
+
+// ReadHttp2Frame はフレームを1つ読む
+func ReadHttp2Frame(r io.Reader) (Http2Frame, error) {
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Http2Frame{}, err
+	}
+	length := sum3BytetoLength(header[0:3])
+	if length > http2DefaultMaxFrameSize {
+		return Http2Frame{}, fmt.Errorf("http2 frame is too large : %d", length)
+	}
+	value := make([]byte, length)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return Http2Frame{}, err
+	}
+	// 最上位の1bitは予約されている
+	header[5] &= 0x7f
+	return Http2Frame{
+		Length:           header[0:3],
+		Type:             header[3:4],
+		Flags:            header[4:5],
+		StreamIdentifier: header[5:9],
+		Value:            value,
+	}, nil
+}
+
+// http2FramePayload はPADDEDとPRIORITYのフィールドを取り除いたフレームの中身を返す
+func http2FramePayload(frame Http2Frame) ([]byte, error) {
+	value := frame.Value
+	if frame.Flags[0]&Http2FlagPadded != 0 {
+		if len(value) < 1 || len(value) < 1+int(value[0]) {
+			return nil, fmt.Errorf("invalid http2 padding")
+		}
+		value = value[1 : len(value)-int(value[0])]
+	}
+	if frame.Type[0] == FrameTypeHeaders && frame.Flags[0]&Http2FlagPriority != 0 {
+		if len(value) < 5 {
+			return nil, fmt.Errorf("invalid http2 priority")
+		}
+		value = value[5:]
+	}
+	return value, nil
+}
+
 func getServerSettings(packet []byte) (frames []SettingsFrame) {
 
 	for i := 0; i < len(packet); i++ {
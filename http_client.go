@@ -0,0 +1,724 @@
+package tcpip
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrHTTPMalformedResponse = errors.New("malformed http response")
+	ErrHTTPUnsupportedScheme = errors.New("unsupported url scheme")
+)
+
+// HTTPClient はTCPの上でHTTP/1.1のリクエストを送る
+// 同じホストへのコネクションは返事のボディを読み終わったらプールに戻して使い回す(keep-alive)
+// http.RoundTripperなので、http.ClientのTransportにすればリダイレクトやCookieも扱える
+type HTTPClient struct {
+	// nilならカーネルのTCPソケットを使う
+	Stack *Stack
+	// ホスト名を引く。nilならOSのリゾルバを使う
+	Resolver *DNSResolver
+	// リクエストを送ってからボディを読み終わるまでの時間。0なら無制限
+	Timeout time.Duration
+	// ホストごとに残しておく使っていないコネクションの数。0なら2
+	MaxIdleConnsPerHost int
+	// 使っていないコネクションを閉じるまでの時間。0なら90秒
+	IdleConnTimeout time.Duration
+	// User-Agentヘッダがなければ付ける
+	UserAgent string
+
+	mu   sync.Mutex
+	idle map[string][]*httpPersistConn
+}
+
+func NewHTTPClient(stack *Stack) *HTTPClient {
+	return &HTTPClient{
+		Stack:     stack,
+		UserAgent: "go-tcpip",
+	}
+}
+
+// httpPersistConn はプールに入れるコネクション
+type httpPersistConn struct {
+	key    string
+	conn   net.Conn
+	br     *bufio.Reader
+	bw     *bufio.Writer
+	idleAt time.Time
+	// 一度でもリクエストを送ったか。使い回したコネクションはサーバが閉じていることがある
+	reused bool
+}
+
+func (c *HTTPClient) Get(url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+func (c *HTTPClient) Head(url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+func (c *HTTPClient) Post(url, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return c.Do(req)
+}
+
+// Do はリクエストを送って返事のヘッダまで読む。リダイレクトはしない
+// 返事のBodyは読み終わるか閉じるまでコネクションを使っているので、必ずCloseする
+func (c *HTTPClient) Do(req *http.Request) (*http.Response, error) {
+	return c.RoundTrip(req)
+}
+
+// RoundTrip は使っていないコネクションがあれば使い、なければ新しく張る
+// 使い回したコネクションがすでに閉じられていたら、もう一度送れるリクエストは新しいコネクションで送り直す
+func (c *HTTPClient) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL == nil {
+		return nil, errors.New("http: nil request url")
+	}
+	if req.URL.Scheme != "http" {
+		return nil, fmt.Errorf("%w : %s", ErrHTTPUnsupportedScheme, req.URL.Scheme)
+	}
+	ctx := req.Context()
+	cancel := func() {}
+	if c.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+	}
+	host, port := req.URL.Hostname(), req.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	key := net.JoinHostPort(host, port)
+
+	for {
+		pc := c.getIdle(key)
+		if pc == nil {
+			conn, err := c.dial(ctx, host, port)
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			pc = &httpPersistConn{key: key, conn: conn, br: bufio.NewReader(conn), bw: bufio.NewWriter(conn)}
+		}
+		resp, err := c.roundTrip(ctx, cancel, pc, req)
+		if err == nil {
+			return resp, nil
+		}
+		retry := pc.reused && httpRetryable(req, err)
+		pc.conn.Close()
+		if !retry {
+			cancel()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// httpRetryable は送り直してもよいか決める
+// サーバが閉じたばかりのコネクションに送ってしまったときだけで、ボディは作り直せるものに限る
+func httpRetryable(req *http.Request, err error) bool {
+	closed := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+	if !closed {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	// べき等でなくても、Idempotency-Keyが付いていれば送り直せる
+	_, ok := req.Header["Idempotency-Key"]
+	return ok
+}
+
+func (c *HTTPClient) roundTrip(ctx context.Context, cancel func(), pc *httpPersistConn, req *http.Request) (*http.Response, error) {
+	stop := watchContext(ctx, pc.conn)
+	if err := writeHTTPRequest(pc.bw, req, c.UserAgent); err != nil {
+		stop()
+		return nil, err
+	}
+	resp, err := readHTTPResponse(pc.br, req)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	pc.reused = true
+
+	keepAlive := !resp.Close && !req.Close
+	done := func(ok bool) {
+		stop()
+		cancel()
+		if ok && keepAlive {
+			c.putIdle(pc)
+		} else {
+			pc.conn.Close()
+		}
+	}
+	// net/httpと同じく、101ならボディをio.ReadWriteCloserにして新しいプロトコルで話せるようにする
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = &httpSwitchedBody{br: pc.br, conn: pc.conn, done: done}
+		return resp, nil
+	}
+	if resp.Body == http.NoBody {
+		done(true)
+		return resp, nil
+	}
+	resp.Body = &httpResponseBody{r: resp.Body, done: done}
+	return resp, nil
+}
+
+// dial はホストのアドレスを順番に試してつながったコネクションを返す
+func (c *HTTPClient) dial(ctx context.Context, host, port string) (net.Conn, error) {
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	if ip := net.ParseIP(host); ip != nil {
+		addrs = []string{ip.String()}
+	} else if c.Resolver != nil {
+		ips, err := c.Resolver.LookupIPv4(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, net.IP(ip).String())
+		}
+	} else {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, ip.String())
+		}
+	}
+
+	var lastErr error = ErrNoRoute
+	for _, addr := range addrs {
+		raddr := &net.TCPAddr{IP: net.ParseIP(addr).To4(), Port: p}
+		var conn net.Conn
+		var err error
+		if c.Stack != nil {
+			conn, err = c.Stack.DialTCP(ctx, nil, raddr)
+		} else {
+			var d net.Dialer
+			conn, err = d.DialContext(ctx, "tcp4", raddr.String())
+		}
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+func (c *HTTPClient) getIdle(key string) *httpPersistConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timeout := c.IdleConnTimeout
+	if timeout == 0 {
+		timeout = 90 * time.Second
+	}
+	conns := c.idle[key]
+	for len(conns) != 0 {
+		pc := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		c.idle[key] = conns
+		if time.Since(pc.idleAt) < timeout {
+			return pc
+		}
+		pc.conn.Close()
+	}
+	return nil
+}
+
+func (c *HTTPClient) putIdle(pc *httpPersistConn) {
+	pc.conn.SetDeadline(time.Time{})
+	pc.idleAt = time.Now()
+	max := c.MaxIdleConnsPerHost
+	if max == 0 {
+		max = 2
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.idle == nil {
+		c.idle = make(map[string][]*httpPersistConn)
+	}
+	conns := append(c.idle[pc.key], pc)
+	// 古いものから閉じる
+	for len(conns) > max {
+		conns[0].conn.Close()
+		conns = conns[1:]
+	}
+	c.idle[pc.key] = conns
+}
+
+// CloseIdleConnections はプールにあるコネクションを全部閉じる
+func (c *HTTPClient) CloseIdleConnections() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, conns := range c.idle {
+		for _, pc := range conns {
+			pc.conn.Close()
+		}
+		delete(c.idle, key)
+	}
+}
+
+// writeHTTPRequest はリクエストライン、ヘッダ、ボディを書く
+// 長さのわからないボディはchunkedで送る
+// https://datatracker.ietf.org/doc/html/rfc9112#section-3
+func writeHTTPRequest(w *bufio.Writer, req *http.Request, userAgent string) error {
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	uri := req.URL.RequestURI()
+	if method == http.MethodConnect {
+		uri = host
+	}
+	fmt.Fprintf(w, "%s %s HTTP/1.1\r\n", method, uri)
+	fmt.Fprintf(w, "Host: %s\r\n", host)
+
+	header := req.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	if header.Get("User-Agent") == "" && userAgent != "" {
+		header.Set("User-Agent", userAgent)
+	}
+	if req.Close {
+		header.Set("Connection", "close")
+	}
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	chunked := false
+	switch {
+	case hasBody && req.ContentLength > 0:
+		header.Set("Content-Length", strconv.FormatInt(req.ContentLength, 10))
+	case hasBody:
+		chunked = true
+		header.Set("Transfer-Encoding", "chunked")
+	case method == http.MethodPost || method == http.MethodPut || method == http.MethodPatch:
+		header.Set("Content-Length", "0")
+	}
+	// 同じリクエストが同じバイト列になるように並べる
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		if k != "Host" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range header[k] {
+			// 改行を入れられるとヘッダを増やされるので、空白にする
+			v = strings.NewReplacer("\r", " ", "\n", " ").Replace(v)
+			fmt.Fprintf(w, "%s: %s\r\n", k, v)
+		}
+	}
+	w.WriteString("\r\n")
+
+	if hasBody {
+		defer req.Body.Close()
+		var err error
+		if chunked {
+			err = writeHTTPChunked(w, req.Body)
+		} else {
+			var n int64
+			n, err = io.Copy(w, req.Body)
+			if err == nil && n != req.ContentLength {
+				err = fmt.Errorf("http: request body length %d, want %d", n, req.ContentLength)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// writeHTTPChunked はボディをchunkedにして書く。トレイラーは送らない
+func writeHTTPChunked(w *bufio.Writer, body io.Reader) error {
+	buf := make([]byte, 8192)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(w, "%x\r\n", n)
+			w.Write(buf[:n])
+			w.WriteString("\r\n")
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.WriteString("0\r\n\r\n")
+	return err
+}
+
+// readHTTPResponse はステータスラインとヘッダを読んで、ボディを読むReaderを付ける
+// 100 Continueのような途中の返事は読み飛ばす
+// https://datatracker.ietf.org/doc/html/rfc9112#section-6.3
+func readHTTPResponse(br *bufio.Reader, req *http.Request) (*http.Response, error) {
+	for {
+		resp, err := readHTTPResponseHeader(br)
+		if err != nil {
+			return nil, err
+		}
+		resp.Request = req
+		if resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+			continue
+		}
+		// プロトコルが切り替わったコネクションは使い回せない
+		// ボディはroundTripでコネクションを読み書きするものにする
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			resp.Close = true
+		}
+
+		resp.ContentLength = -1
+		resp.Body = http.NoBody
+		if req.Method == http.MethodHead || resp.StatusCode < 200 ||
+			resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+			resp.ContentLength = 0
+			if req.Method == http.MethodHead {
+				resp.ContentLength = httpContentLength(resp.Header)
+			}
+			return resp, nil
+		}
+
+		te := strings.ToLower(strings.TrimSpace(resp.Header.Get("Transfer-Encoding")))
+		switch {
+		case te != "":
+			// chunkedは最後でなければならない。それ以外は閉じるまで読む
+			if strings.HasSuffix(te, "chunked") {
+				resp.TransferEncoding = []string{"chunked"}
+				resp.Header.Del("Content-Length")
+				resp.Trailer = make(http.Header)
+				resp.Body = io.NopCloser(&httpChunkedReader{br: br, trailer: resp.Trailer})
+			} else {
+				resp.Close = true
+				resp.Body = io.NopCloser(br)
+			}
+		case resp.Header.Get("Content-Length") != "":
+			n := httpContentLength(resp.Header)
+			if n < 0 {
+				return nil, ErrHTTPMalformedResponse
+			}
+			resp.ContentLength = n
+			if n > 0 {
+				resp.Body = io.NopCloser(&httpLengthReader{r: br, n: n})
+			}
+		default:
+			// 長さがわからないので、サーバが閉じるまでがボディ
+			resp.Close = true
+			resp.Body = io.NopCloser(br)
+		}
+		return resp, nil
+	}
+}
+
+func httpContentLength(header http.Header) int64 {
+	v := strings.TrimSpace(header.Get("Content-Length"))
+	if v == "" {
+		return -1
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// readHTTPResponseHeader はステータスラインとヘッダを読む
+func readHTTPResponseHeader(br *bufio.Reader) (*http.Response, error) {
+	line, err := readHTTPLine(br)
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	// HTTP/1.1 200 OK
+	proto, status, ok := cutHTTPField(line)
+	if !ok {
+		return nil, ErrHTTPMalformedResponse
+	}
+	major, minor, ok := http.ParseHTTPVersion(proto)
+	if !ok || len(status) < 3 {
+		return nil, ErrHTTPMalformedResponse
+	}
+	code, err := strconv.Atoi(status[:3])
+	if err != nil || code < 100 || (len(status) > 3 && status[3] != ' ') {
+		return nil, ErrHTTPMalformedResponse
+	}
+	resp := &http.Response{
+		Status:     strings.TrimSpace(status),
+		StatusCode: code,
+		Proto:      proto,
+		ProtoMajor: major,
+		ProtoMinor: minor,
+	}
+	if resp.Header, err = readHTTPHeader(br); err != nil {
+		return nil, err
+	}
+
+	// HTTP/1.0はKeep-Aliveと言われたときだけ使い回す
+	conn := strings.ToLower(resp.Header.Get("Connection"))
+	if major == 1 && minor == 0 {
+		resp.Close = !strings.Contains(conn, "keep-alive")
+	} else {
+		resp.Close = strings.Contains(conn, "close")
+	}
+	return resp, nil
+}
+
+func cutHTTPField(line string) (string, string, bool) {
+	i := strings.IndexByte(line, ' ')
+	if i < 0 {
+		return "", "", false
+	}
+	return line[:i], line[i+1:], true
+}
+
+// readHTTPHeader は空行までのヘッダを読む。トレイラーでも使う
+func readHTTPHeader(br *bufio.Reader) (http.Header, error) {
+	header := make(http.Header)
+	var last string
+	for {
+		line, err := readHTTPLine(br)
+		if err != nil {
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if line == "" {
+			return header, nil
+		}
+		// 空白で始まる行は前のヘッダの続き(obs-fold)
+		if line[0] == ' ' || line[0] == '\t' {
+			if last == "" {
+				return nil, ErrHTTPMalformedResponse
+			}
+			values := header[last]
+			values[len(values)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 || strings.ContainsAny(line[:i], " \t") {
+			return nil, ErrHTTPMalformedResponse
+		}
+		last = http.CanonicalHeaderKey(line[:i])
+		header.Add(last, strings.TrimSpace(line[i+1:]))
+	}
+}
+
+// readHTTPLine はCRLF(かLF)までの1行を読む
+func readHTTPLine(br *bufio.Reader) (string, error) {
+	line, err := br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", fmt.Errorf("%w : line too long", ErrHTTPMalformedResponse)
+	}
+	if err != nil {
+		if err == io.EOF && len(line) != 0 {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return string(bytes.TrimRight(line, "\r\n")), nil
+}
+
+// httpLengthReader はContent-Lengthの分だけ読む。足りなければErrUnexpectedEOF
+type httpLengthReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *httpLengthReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if err == io.EOF && l.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && l.n == 0 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// httpChunkedReader はchunkedのボディを読む。最後のチャンクの後のトレイラーはtrailerに入れる
+// https://datatracker.ietf.org/doc/html/rfc9112#section-7.1
+type httpChunkedReader struct {
+	br      *bufio.Reader
+	trailer http.Header
+	// 今のチャンクの残り
+	n   int64
+	err error
+}
+
+func (r *httpChunkedReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.n == 0 {
+		if err := r.beginChunk(); err != nil {
+			r.err = err
+			return 0, err
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.br.Read(p)
+	r.n -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && r.n == 0 {
+		// チャンクの後ろのCRLF
+		var line string
+		if line, err = readHTTPLine(r.br); err == nil && line != "" {
+			err = ErrHTTPMalformedResponse
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// beginChunk はチャンクの長さの行を読む。長さ0なら最後のチャンクなのでトレイラーを読む
+func (r *httpChunkedReader) beginChunk() error {
+	line, err := readHTTPLine(r.br)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	// チャンク拡張(;name=value)は無視する
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	size, err := strconv.ParseUint(strings.TrimSpace(line), 16, 63)
+	if err != nil {
+		return ErrHTTPMalformedResponse
+	}
+	if size == 0 {
+		trailer, err := readHTTPHeader(r.br)
+		if err != nil {
+			return err
+		}
+		for k, v := range trailer {
+			r.trailer[k] = v
+		}
+		r.err = io.EOF
+		return nil
+	}
+	r.n = int64(size)
+	return nil
+}
+
+// httpResponseBody は読み終わったらコネクションをプールに戻す
+// 途中で閉じたら残りを読まずにコネクションも閉じる
+type httpResponseBody struct {
+	r    io.Reader
+	done func(ok bool)
+	once sync.Once
+}
+
+func (b *httpResponseBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		b.once.Do(func() { b.done(true) })
+	} else if err != nil {
+		b.once.Do(func() { b.done(false) })
+	}
+	return n, err
+}
+
+func (b *httpResponseBody) Close() error {
+	b.once.Do(func() { b.done(false) })
+	return nil
+}
+
+// httpSwitchedBody は101 Switching Protocolsの後のコネクション
+// 読むときはヘッダの後ろまで読んだbufio.Readerから続きを読み、書くときはコネクションにそのまま書く
+type httpSwitchedBody struct {
+	br   *bufio.Reader
+	conn net.Conn
+	done func(ok bool)
+	once sync.Once
+}
+
+func (b *httpSwitchedBody) Read(p []byte) (int, error) {
+	return b.br.Read(p)
+}
+
+func (b *httpSwitchedBody) Write(p []byte) (int, error) {
+	return b.conn.Write(p)
+}
+
+// Close はコネクションを閉じる。プールには戻さない
+func (b *httpSwitchedBody) Close() error {
+	b.once.Do(func() { b.done(false) })
+	return nil
+}
@@ -0,0 +1,246 @@
+package tcpip
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadHTTPResponse(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		raw        string
+		wantStatus int
+		wantBody   string
+		wantLength int64
+		wantClose  bool
+		wantErr    error
+	}{
+		{
+			name:       "content-length",
+			raw:        "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhelloextra",
+			wantStatus: 200,
+			wantBody:   "hello",
+			wantLength: 5,
+		},
+		{
+			name:       "chunked",
+			raw:        "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6;ext=1\r\n world\r\n0\r\nX-Sum: 1\r\n\r\n",
+			wantStatus: 200,
+			wantBody:   "hello world",
+			wantLength: -1,
+		},
+		{
+			name:       "skip 100 continue",
+			raw:        "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok",
+			wantStatus: 201,
+			wantBody:   "ok",
+			wantLength: 2,
+		},
+		{
+			name:       "head has no body",
+			method:     http.MethodHead,
+			raw:        "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n",
+			wantStatus: 200,
+			wantLength: 10,
+		},
+		{
+			name:       "no content",
+			raw:        "HTTP/1.1 204 No Content\r\n\r\n",
+			wantStatus: 204,
+		},
+		{
+			name:       "read until close",
+			raw:        "HTTP/1.1 200 OK\r\n\r\nall of it",
+			wantStatus: 200,
+			wantBody:   "all of it",
+			wantLength: -1,
+			wantClose:  true,
+		},
+		{
+			name:       "http/1.0 closes",
+			raw:        "HTTP/1.0 200 OK\r\nContent-Length: 1\r\n\r\nx",
+			wantStatus: 200,
+			wantBody:   "x",
+			wantLength: 1,
+			wantClose:  true,
+		},
+		{
+			name:       "switching protocols",
+			raw:        "HTTP/1.1 101 Switching Protocols\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\n",
+			wantStatus: 101,
+			wantClose:  true,
+		},
+		{
+			name:    "bad content-length",
+			raw:     "HTTP/1.1 200 OK\r\nContent-Length: -1\r\n\r\n",
+			wantErr: ErrHTTPMalformedResponse,
+		},
+		{
+			name:    "bad status line",
+			raw:     "HTTP/1.1 2xx OK\r\n\r\n",
+			wantErr: ErrHTTPMalformedResponse,
+		},
+		{
+			name:    "truncated header",
+			raw:     "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n",
+			wantErr: io.ErrUnexpectedEOF,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req, _ := http.NewRequest(method, "http://example.com/", nil)
+			resp, err := readHTTPResponse(bufio.NewReader(strings.NewReader(tt.raw)), req)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus || string(body) != tt.wantBody ||
+				resp.ContentLength != tt.wantLength || resp.Close != tt.wantClose {
+				t.Fatalf("got status %d body %q length %d close %v, want %d %q %d %v",
+					resp.StatusCode, body, resp.ContentLength, resp.Close,
+					tt.wantStatus, tt.wantBody, tt.wantLength, tt.wantClose)
+			}
+		})
+	}
+}
+
+func TestHTTPChunkedReader(t *testing.T) {
+	tests := []struct {
+		name        string
+		raw         string
+		wantBody    string
+		wantTrailer http.Header
+		wantErr     error
+	}{
+		{
+			name:     "chunks",
+			raw:      "3\r\nabc\r\na\r\n0123456789\r\n0\r\n\r\n",
+			wantBody: "abc0123456789",
+		},
+		{
+			name:     "extension and lf only",
+			raw:      "4;name=value\nabcd\n0\n\n",
+			wantBody: "abcd",
+		},
+		{
+			name:        "trailer",
+			raw:         "2\r\nhi\r\n0\r\nExpires: never\r\nX-Sum: 42\r\n\r\n",
+			wantBody:    "hi",
+			wantTrailer: http.Header{"Expires": {"never"}, "X-Sum": {"42"}},
+		},
+		{
+			name:    "bad size",
+			raw:     "zz\r\nabc\r\n0\r\n\r\n",
+			wantErr: ErrHTTPMalformedResponse,
+		},
+		{
+			name:    "missing crlf after chunk",
+			raw:     "3\r\nabcdef\r\n0\r\n\r\n",
+			wantErr: ErrHTTPMalformedResponse,
+		},
+		{
+			name:    "truncated chunk",
+			raw:     "8\r\nabc",
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "no last chunk",
+			raw:     "3\r\nabc\r\n",
+			wantErr: io.ErrUnexpectedEOF,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trailer := make(http.Header)
+			r := &httpChunkedReader{br: bufio.NewReader(strings.NewReader(tt.raw)), trailer: trailer}
+			body, err := io.ReadAll(r)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != tt.wantBody {
+				t.Fatalf("body = %q, want %q", body, tt.wantBody)
+			}
+			for k, v := range tt.wantTrailer {
+				if got := trailer.Get(k); got != v[0] {
+					t.Fatalf("trailer %s = %q, want %q", k, got, v[0])
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPClientSwitchingProtocols(t *testing.T) {
+	client, server := newDNSTestStacks(t)
+	ln, err := server.ListenTCP(&net.TCPAddr{Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		if _, err := http.ReadRequest(br); err != nil {
+			return
+		}
+		// 切り替えたあとは受け取ったものをそのまま返す
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		io.Copy(conn, br)
+	}()
+
+	c := &HTTPClient{Stack: client, Timeout: 10 * time.Second}
+	req, _ := http.NewRequest(http.MethodGet, "http://10.0.0.2/", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "echo")
+	resp, err := c.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+	rw, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		t.Fatalf("body %T is not an io.ReadWriteCloser", resp.Body)
+	}
+	defer rw.Close()
+	if _, err := io.WriteString(rw, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(rw, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("echo = %q, want ping", buf)
+	}
+}
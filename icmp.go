@@ -1,8 +1,11 @@
 package tcpip
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"log"
+	"net"
 	"syscall"
 )
 
@@ -17,23 +20,27 @@ type ICMP struct {
 
 func NewICMP() ICMP {
 	// https://www.infraexpert.com/study/tcpip4.html
+	// ping request
+	return NewICMPEcho(ICMPTypeEchoRequest, 0x0010, 0x0001, []byte{0x01, 0x02})
+}
+
+// NewICMPEcho はEcho RequestかEcho Replyを作る
+func NewICMPEcho(icmpType byte, id, seq uint16, data []byte) ICMP {
 	icmp := ICMP{
-		// ping request
-		Type:           []byte{0x08},
+		Type:           []byte{icmpType},
 		Code:           []byte{0x00},
 		CheckSum:       []byte{0x00, 0x00},
-		Identification: []byte{0x00, 0x10},
-		SequenceNumber: []byte{0x00, 0x01},
-		Data:           []byte{0x01, 0x02},
+		Identification: UintTo2byte(id),
+		SequenceNumber: UintTo2byte(seq),
+		Data:           data,
 	}
-
-	icmpsum := sumByteArr(toByteArr(icmp))
-	icmp.CheckSum = checksum(icmpsum)
+	icmp.CheckSum = icmpChecksum(icmp)
 
 	return icmp
 }
 
-func (*ICMP) Send(ifindex int, packet []byte) ICMP {
+// Send はICMPパケットを送って、同じIdentificationのEcho Replyが返ってくるのを待つ
+func (icmp *ICMP) Send(ifindex int, packet []byte) ICMP {
 	addr := syscall.SockaddrLinklayer{
 		Protocol: syscall.ETH_P_IP,
 		Ifindex:  ifindex,
@@ -52,14 +59,25 @@ func (*ICMP) Send(ifindex int, packet []byte) ICMP {
 
 	for {
 		recvBuf := make([]byte, 1500)
-		_, _, err := syscall.Recvfrom(sendfd, recvBuf, 0)
+		n, _, err := syscall.Recvfrom(sendfd, recvBuf, 0)
 		if err != nil {
 			log.Fatalf("read err : %v", err)
 		}
-		// IPヘッダのProtocolがICMPであることをチェック
-		if recvBuf[23] == 0x01 {
-			// Ethernetが14byte, IPヘッダが20byteなので34byte目からがICMPパケット
-			return parseICMP(recvBuf[34:])
+		// EthernetのTypeがIPv4で、IPヘッダのProtocolがICMPであることをチェック
+		if n < 34 || recvBuf[12] != 0x08 || recvBuf[13] != 0x00 || recvBuf[23] != IPProtoICMP {
+			continue
+		}
+		// Ethernetが14byte, その後ろのIPヘッダの長さを飛ばしたところからがICMPパケット
+		// IPオプションで長くなったヘッダの後ろにICMPヘッダの8byteがなければ読まない
+		hlen := ipHeaderLength(recvBuf[14:])
+		if hlen < 20 || n < 14+hlen+8 {
+			continue
+		}
+		reply := parseICMP(recvBuf[14+hlen : n])
+		// 自分が送ったRequestへのReplyかチェック
+		if reply.Type[0] == ICMPTypeEchoReply && bytes.Equal(reply.Identification, icmp.Identification) &&
+			bytes.Equal(reply.SequenceNumber, icmp.SequenceNumber) {
+			return reply
 		}
 	}
 }
@@ -74,3 +92,357 @@ func parseICMP(packet []byte) ICMP {
 		Data:           packet[8:],
 	}
 }
+
+// https://www.infraexpert.com/study/tcpip4.html
+const (
+	ICMPTypeEchoReply              = 0x00
+	ICMPTypeDestinationUnreachable = 0x03
+	ICMPTypeRedirect               = 0x05
+	ICMPTypeEchoRequest            = 0x08
+	ICMPTypeTimeExceeded           = 0x0b
+	ICMPTypeParameterProblem       = 0x0c
+)
+
+// Destination Unreachableのコード
+const (
+	ICMPCodeNetUnreachable      = 0x00
+	ICMPCodeHostUnreachable     = 0x01
+	ICMPCodeProtocolUnreachable = 0x02
+	ICMPCodePortUnreachable     = 0x03
+	ICMPCodeFragmentationNeeded = 0x04
+	ICMPCodeAdminProhibited     = 0x0d
+)
+
+// Time Exceededのコード
+const (
+	ICMPCodeTTLExceeded        = 0x00
+	ICMPCodeReassemblyExceeded = 0x01
+)
+
+// エラーメッセージに含める元のデータグラムの最大長
+// ICMPのパケット全体が576byteを超えないようにする(RFC1812 4.3.2.3)
+const icmpErrorMaxQuote = 576 - 20 - 8
+
+// データが奇数長でもいいようにチェックサムを計算する
+func icmpChecksum(icmp ICMP) []byte {
+	icmp.CheckSum = []byte{0x00, 0x00}
+	b := toByteArr(icmp)
+	if len(b)%2 != 0 {
+		b = paddingZero(b)
+	}
+	return checksum(sumByteArr(b))
+}
+
+// NewICMPError は元のIPパケットを引用したICMPエラーメッセージを作る
+// restはTypeごとに意味が変わる4byte(Fragmentation NeededならMTUが入る)
+func NewICMPError(icmpType, code byte, rest []byte, original []byte) ICMP {
+	quote := original
+	if len(quote) > icmpErrorMaxQuote {
+		quote = quote[:icmpErrorMaxQuote]
+	}
+	icmp := ICMP{
+		Type:           []byte{icmpType},
+		Code:           []byte{code},
+		CheckSum:       []byte{0x00, 0x00},
+		Identification: []byte{rest[0], rest[1]},
+		SequenceNumber: []byte{rest[2], rest[3]},
+		Data:           append([]byte{}, quote...),
+	}
+	icmp.CheckSum = icmpChecksum(icmp)
+	return icmp
+}
+
+// ICMPQuote はICMPエラーに引用された元のIPパケット
+type ICMPQuote struct {
+	IPHeader IPHeader
+	// IPヘッダの後ろのデータ(少なくとも8byte)
+	Data []byte
+}
+
+// 元のパケットがTCPかUDPなら送信元と宛先のポート番号を返す
+func (q ICMPQuote) Ports() (sourcePort, destPort uint16, ok bool) {
+	switch q.IPHeader.Protocol[0] {
+	case IPProtoTCP, IPProtoUDP:
+		if len(q.Data) < 4 {
+			return 0, 0, false
+		}
+		return binary.BigEndian.Uint16(q.Data[0:2]), binary.BigEndian.Uint16(q.Data[2:4]), true
+	}
+	return 0, 0, false
+}
+
+// 元のパケットがICMP Echoなら、そのICMPを返す
+func (q ICMPQuote) Echo() (ICMP, bool) {
+	if q.IPHeader.Protocol[0] != IPProtoICMP || len(q.Data) < 8 {
+		return ICMP{}, false
+	}
+	return parseICMP(q.Data), true
+}
+
+type ICMPEcho struct {
+	ICMP
+}
+
+type ICMPDestinationUnreachable struct {
+	ICMP
+	// Fragmentation Neededのときの次のホップのMTU(RFC1191)
+	NextHopMTU []byte
+	Original   ICMPQuote
+}
+
+type ICMPTimeExceeded struct {
+	ICMP
+	Original ICMPQuote
+}
+
+type ICMPRedirect struct {
+	ICMP
+	// こっちに送ってくださいというルータのアドレス
+	Gateway  []byte
+	Original ICMPQuote
+}
+
+type ICMPParameterProblem struct {
+	ICMP
+	// 元のIPヘッダのおかしいところのオフセット
+	Pointer  []byte
+	Original ICMPQuote
+}
+
+func parseICMPQuote(data []byte) (ICMPQuote, error) {
+	if len(data) < 20 || data[0]>>4 != 4 || ipHeaderLength(data) < 20 || len(data) < ipHeaderLength(data) {
+		return ICMPQuote{}, fmt.Errorf("invalid ICMP quoted datagram")
+	}
+	hlen := ipHeaderLength(data)
+	return ICMPQuote{
+		IPHeader: parseIP(data[0:20]),
+		Data:     data[hlen:],
+	}, nil
+}
+
+// ParseICMPMessage はICMPパケットをTypeごとの構造体にする
+// Echo Request/ReplyはICMPEcho、エラーは元のIPパケットも解析した構造体を返す
+func ParseICMPMessage(packet []byte) (interface{}, error) {
+	if len(packet) < 8 {
+		return nil, fmt.Errorf("ICMP packet is too short : %d", len(packet))
+	}
+	b := packet
+	if len(b)%2 != 0 {
+		b = paddingZero(append([]byte{}, b...))
+	}
+	if binary.BigEndian.Uint16(checksum(sumByteArr(b))) != 0 {
+		return nil, fmt.Errorf("ICMP checksum error")
+	}
+
+	icmp := parseICMP(packet)
+	switch icmp.Type[0] {
+	case ICMPTypeEchoRequest, ICMPTypeEchoReply:
+		return ICMPEcho{ICMP: icmp}, nil
+	}
+
+	original, err := parseICMPQuote(icmp.Data)
+	if err != nil {
+		return nil, err
+	}
+	switch icmp.Type[0] {
+	case ICMPTypeDestinationUnreachable:
+		return ICMPDestinationUnreachable{ICMP: icmp, NextHopMTU: icmp.SequenceNumber, Original: original}, nil
+	case ICMPTypeTimeExceeded:
+		return ICMPTimeExceeded{ICMP: icmp, Original: original}, nil
+	case ICMPTypeRedirect:
+		return ICMPRedirect{ICMP: icmp, Gateway: packet[4:8], Original: original}, nil
+	case ICMPTypeParameterProblem:
+		return ICMPParameterProblem{ICMP: icmp, Pointer: packet[4:5], Original: original}, nil
+	}
+	return nil, fmt.Errorf("unsupported ICMP type : %d", icmp.Type[0])
+}
+
+// ICMPError はTCPやUDPのエンドポイントに届けるICMPエラー
+type ICMPError struct {
+	// エラーを送ってきたルータかホストのアドレス
+	From []byte
+	Type byte
+	Code byte
+	// ICMPDestinationUnreachableなどParseICMPMessageが返す構造体
+	Message interface{}
+}
+
+func (e *ICMPError) Error() string {
+	var reason string
+	switch e.Type {
+	case ICMPTypeDestinationUnreachable:
+		switch e.Code {
+		case ICMPCodeNetUnreachable:
+			reason = "network unreachable"
+		case ICMPCodeHostUnreachable:
+			reason = "host unreachable"
+		case ICMPCodeProtocolUnreachable:
+			reason = "protocol unreachable"
+		case ICMPCodePortUnreachable:
+			reason = "connection refused"
+		case ICMPCodeFragmentationNeeded:
+			reason = "fragmentation needed"
+		case ICMPCodeAdminProhibited:
+			reason = "administratively prohibited"
+		default:
+			reason = "destination unreachable"
+		}
+	case ICMPTypeTimeExceeded:
+		reason = "time exceeded"
+	case ICMPTypeRedirect:
+		reason = "redirect"
+	case ICMPTypeParameterProblem:
+		reason = "parameter problem"
+	default:
+		reason = "unknown error"
+	}
+	return fmt.Sprintf("icmp %s from %s (type %d, code %d)", reason, net.IP(e.From), e.Type, e.Code)
+}
+
+// ICMPHandler はStackが受け取ったICMPメッセージを受け取る
+// messageはParseICMPMessageが返す構造体
+type ICMPHandler func(ifc *NetInterface, header IPHeader, message interface{})
+
+type icmpEndpoint struct {
+	protocol byte
+	port     uint16
+}
+
+// RegisterICMPHandler はICMPを届ける相手を登録する
+// protocolがTCPかUDPならportは自分側のポート番号、ICMPならEchoのIdentificationで、
+// 元のパケットがそれに一致するエラーと、Identificationが一致するEcho Replyが届く
+func (s *Stack) RegisterICMPHandler(protocol byte, port uint16, handler ICMPHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.icmpHandlers[icmpEndpoint{protocol: protocol, port: port}] = handler
+}
+
+func (s *Stack) UnregisterICMPHandler(protocol byte, port uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.icmpHandlers, icmpEndpoint{protocol: protocol, port: port})
+}
+
+func (s *Stack) lookupICMPHandler(protocol byte, port uint16) (ICMPHandler, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	handler, ok := s.icmpHandlers[icmpEndpoint{protocol: protocol, port: port}]
+	return handler, ok
+}
+
+// icmpProbeHandler は自分で送ったプローブへのICMPならtrueを返す
+type icmpProbeHandler func(ifc *NetInterface, header IPHeader, message interface{}) bool
+
+// registerICMPProbe はtracerouteのようにソケットを使わずに送ったプローブへのICMPを受け取る
+// ソケットのハンドラとは別に登録するので、同じポートのソケットがあっても上書きしない
+// プローブのものでなかったICMPはソケットのハンドラに届ける
+func (s *Stack) registerICMPProbe(protocol byte, port uint16, handler icmpProbeHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.icmpProbes[icmpEndpoint{protocol: protocol, port: port}] = handler
+}
+
+func (s *Stack) unregisterICMPProbe(protocol byte, port uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.icmpProbes, icmpEndpoint{protocol: protocol, port: port})
+}
+
+// deliverICMP はプローブ、ソケットのハンドラの順にICMPを届ける
+func (s *Stack) deliverICMP(ifc *NetInterface, ip IPHeader, protocol byte, port uint16, message interface{}) {
+	s.mu.RLock()
+	probe := s.icmpProbes[icmpEndpoint{protocol: protocol, port: port}]
+	s.mu.RUnlock()
+	if probe != nil && probe(ifc, ip, message) {
+		return
+	}
+	if handler, ok := s.lookupICMPHandler(protocol, port); ok {
+		handler(ifc, ip, message)
+	}
+}
+
+// handleICMP は自分宛てのICMPを処理する
+func (s *Stack) handleICMP(ifc *NetInterface, packet []byte) {
+	ip := parseIP(packet[0:20])
+	message, err := ParseICMPMessage(packet[ipHeaderLength(packet):])
+	if err != nil {
+		return
+	}
+
+	var original ICMPQuote
+	switch m := message.(type) {
+	case ICMPEcho:
+		if m.Type[0] == ICMPTypeEchoRequest {
+			s.replyEcho(ifc, ip, m)
+			return
+		}
+		s.deliverICMP(ifc, ip, IPProtoICMP, binary.BigEndian.Uint16(m.Identification), message)
+		return
+	case ICMPDestinationUnreachable:
+		original = m.Original
+		if m.Code[0] == ICMPCodeFragmentationNeeded {
+			s.handleFragmentationNeeded(m)
+		}
+	case ICMPTimeExceeded:
+		original = m.Original
+	case ICMPRedirect:
+		original = m.Original
+		s.handleRedirect(ifc, ip, m)
+	case ICMPParameterProblem:
+		original = m.Original
+	}
+
+	// 元のパケットを送ったエンドポイントにエラーを届ける
+	var port uint16
+	if src, _, ok := original.Ports(); ok {
+		port = src
+	} else if echo, ok := original.Echo(); ok {
+		port = binary.BigEndian.Uint16(echo.Identification)
+	} else {
+		return
+	}
+	s.deliverICMP(ifc, ip, original.IPHeader.Protocol[0], port, message)
+}
+
+// replyEcho はEcho RequestにEcho Replyを返す
+func (s *Stack) replyEcho(ifc *NetInterface, ip IPHeader, request ICMPEcho) {
+	if s.IgnoreEcho {
+		return
+	}
+	// ブロードキャストやマルチキャスト宛てのpingには返さない(Linuxのicmp_echo_ignore_broadcastsの初期値と同じ)
+	// 返すとしても、その宛先は送信元にできない
+	if s.isLocalBroadcast(ip.DstIPAddr) || isMulticastAddr(ip.DstIPAddr) {
+		return
+	}
+	reply := NewICMPEcho(ICMPTypeEchoReply, binary.BigEndian.Uint16(request.Identification),
+		binary.BigEndian.Uint16(request.SequenceNumber), request.Data)
+	header := NewIPHeader(ip.DstIPAddr, ip.SourceIPAddr, "ICMP")
+	s.SendIPv4(header, toByteArr(reply))
+}
+
+// handleRedirect はルータでなければRedirectに従ってホストルートを追加する
+func (s *Stack) handleRedirect(ifc *NetInterface, ip IPHeader, redirect ICMPRedirect) {
+	if s.Forwarding {
+		return
+	}
+	// 今使っているゲートウェイからのRedirectで、新しいゲートウェイが同じネットワークにいるときだけ従う
+	dst := redirect.Original.IPHeader.DstIPAddr
+	_, nexthop, err := s.lookupRoute(dst)
+	if err != nil || !bytes.Equal(nexthop, ip.SourceIPAddr) {
+		return
+	}
+	// アドレスがまだないインターフェイスでは比べられない
+	addr, netmask := s.interfaceAddr(ifc)
+	if addr == nil || netmask == nil {
+		return
+	}
+	if !bytes.Equal(maskedAddr(redirect.Gateway, netmask), maskedAddr(addr, netmask)) {
+		return
+	}
+	s.Routes.Add(Route{
+		Dest:    append([]byte{}, dst...),
+		Netmask: []byte{0xff, 0xff, 0xff, 0xff},
+		Gateway: append([]byte{}, redirect.Gateway...),
+		Ifname:  ifc.Name,
+	})
+}
@@ -0,0 +1,558 @@
+package tcpip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// IGMPのメッセージの種類(RFC2236, RFC3376)
+const (
+	IGMPTypeMembershipQuery    = 0x11
+	IGMPTypeV1MembershipReport = 0x12
+	IGMPTypeV2MembershipReport = 0x16
+	IGMPTypeV2LeaveGroup       = 0x17
+	IGMPTypeV3MembershipReport = 0x22
+)
+
+// IGMPv3のGroup Recordの種類(RFC3376 4.2.12)
+const (
+	IGMPModeIsInclude   = 1
+	IGMPModeIsExclude   = 2
+	IGMPChangeToInclude = 3
+	IGMPChangeToExclude = 4
+	IGMPAllowNewSources = 5
+	IGMPBlockOldSources = 6
+)
+
+const (
+	igmpRobustness = 2
+	// 参加や離脱を知らせるReportを送り直すまでの時間の上限
+	igmpV2UnsolicitedReportInterval = 10 * time.Second
+	igmpV3UnsolicitedReportInterval = time.Second
+	// 古いバージョンのQueryを受け取ってから、そのバージョンで話し続ける時間(RFC3376 8.12)
+	igmpOlderVersionQuerierTimeout = igmpRobustness*125*time.Second + 10*time.Second
+	// IGMPv1のQueryにはMax Resp Timeがないので10秒とする(RFC2236 4)
+	igmpV1MaxRespTime = 10 * time.Second
+)
+
+var (
+	allRoutersGroup    = []byte{224, 0, 0, 2}
+	igmpv3RoutersGroup = []byte{224, 0, 0, 22}
+	// ルータに中身を見てもらうためのRouter Alertオプション(RFC2113)
+	ipOptionRouterAlert = []byte{0x94, 0x04, 0x00, 0x00}
+)
+
+var ErrInvalidIGMP = errors.New("invalid igmp message")
+
+// IGMP はIGMPv1, v2のメッセージとIGMPv3のQuery
+// https://datatracker.ietf.org/doc/html/rfc3376#section-4.1
+type IGMP struct {
+	Type []byte
+	// IGMPv2以降のQueryなら返事を送るまでの最大の時間(100ms単位)
+	MaxRespCode []byte
+	CheckSum    []byte
+	GroupAddr   []byte
+	// ここから後ろはIGMPv3のQueryだけ。Resv(4bit) + S(1bit) + QRV(3bit)
+	Flags []byte
+	// Querier's Query Interval Code
+	QQIC            []byte
+	NumberOfSources []byte
+	Sources         []byte
+}
+
+// IGMPv3Report はIGMPv3のMembership Report
+// https://datatracker.ietf.org/doc/html/rfc3376#section-4.2
+type IGMPv3Report struct {
+	Type                 []byte
+	Reserved             []byte
+	CheckSum             []byte
+	Reserved2            []byte
+	NumberOfGroupRecords []byte
+	GroupRecords         []byte
+}
+
+// IGMPGroupRecord はIGMPv3のReportに入れるグループごとの状態
+type IGMPGroupRecord struct {
+	Type    byte
+	Group   net.IP
+	Sources []net.IP
+}
+
+// NewIGMPv2Message はIGMPv2のReportかLeave Groupを作る
+func NewIGMPv2Message(igmpType byte, group []byte) IGMP {
+	igmp := IGMP{
+		Type:        []byte{igmpType},
+		MaxRespCode: []byte{0x00},
+		CheckSum:    []byte{0x00, 0x00},
+		GroupAddr:   group,
+	}
+	igmp.CheckSum = checksum(sumByteArr(toByteArr(igmp)))
+	return igmp
+}
+
+// NewIGMPv3Report はグループの状態を入れたReportを作る
+func NewIGMPv3Report(records []IGMPGroupRecord) IGMPv3Report {
+	var b []byte
+	for _, r := range records {
+		// Record Type, Aux Data Len, Number of Sources, Multicast Address, Source Address...
+		b = append(b, r.Type, 0x00)
+		b = append(b, UintTo2byte(uint16(len(r.Sources)))...)
+		b = append(b, r.Group.To4()...)
+		for _, src := range r.Sources {
+			b = append(b, src.To4()...)
+		}
+	}
+	report := IGMPv3Report{
+		Type:                 []byte{IGMPTypeV3MembershipReport},
+		Reserved:             []byte{0x00},
+		CheckSum:             []byte{0x00, 0x00},
+		Reserved2:            []byte{0x00, 0x00},
+		NumberOfGroupRecords: UintTo2byte(uint16(len(records))),
+		GroupRecords:         b,
+	}
+	report.CheckSum = checksum(sumByteArr(toByteArr(report)))
+	return report
+}
+
+// ParseIGMP はQuery, v1, v2のメッセージを読む
+func ParseIGMP(b []byte) (IGMP, error) {
+	if len(b) < 8 {
+		return IGMP{}, ErrInvalidIGMP
+	}
+	igmp := IGMP{
+		Type:        b[0:1],
+		MaxRespCode: b[1:2],
+		CheckSum:    b[2:4],
+		GroupAddr:   b[4:8],
+	}
+	// 12byte以上のQueryはIGMPv3(RFC3376 7.1)
+	if b[0] == IGMPTypeMembershipQuery && len(b) >= 12 {
+		n := int(binary.BigEndian.Uint16(b[10:12]))
+		if len(b) < 12+n*4 {
+			return IGMP{}, ErrInvalidIGMP
+		}
+		igmp.Flags = b[8:9]
+		igmp.QQIC = b[9:10]
+		igmp.NumberOfSources = b[10:12]
+		igmp.Sources = b[12 : 12+n*4]
+	}
+	return igmp, nil
+}
+
+// ParseIGMPv3Report はReportのGroup Recordを読む
+func ParseIGMPv3Report(b []byte) ([]IGMPGroupRecord, error) {
+	if len(b) < 8 || b[0] != IGMPTypeV3MembershipReport {
+		return nil, ErrInvalidIGMP
+	}
+	n := int(binary.BigEndian.Uint16(b[6:8]))
+	var records []IGMPGroupRecord
+	off := 8
+	for i := 0; i < n; i++ {
+		if len(b) < off+8 {
+			return nil, ErrInvalidIGMP
+		}
+		auxLen := int(b[off+1]) * 4
+		nsrc := int(binary.BigEndian.Uint16(b[off+2 : off+4]))
+		end := off + 8 + nsrc*4 + auxLen
+		if len(b) < end {
+			return nil, ErrInvalidIGMP
+		}
+		r := IGMPGroupRecord{Type: b[off], Group: net.IP(b[off+4 : off+8])}
+		for j := 0; j < nsrc; j++ {
+			p := off + 8 + j*4
+			r.Sources = append(r.Sources, net.IP(b[p:p+4]))
+		}
+		records = append(records, r)
+		off = end
+	}
+	return records, nil
+}
+
+// Version はQueryのバージョンを返す(RFC3376 7.1)
+func (q IGMP) Version() int {
+	switch {
+	case q.Flags != nil:
+		return 3
+	case q.MaxRespCode[0] == 0:
+		return 1
+	}
+	return 2
+}
+
+// MaxRespTime はQueryに返事を送るまでの最大の時間
+// IGMPv3で128以上なら指数と仮数で表す(RFC3376 4.1.1)
+func (q IGMP) MaxRespTime() time.Duration {
+	code := int(q.MaxRespCode[0])
+	switch {
+	case q.Version() == 1:
+		return igmpV1MaxRespTime
+	case q.Version() == 3 && code >= 128:
+		mant := code & 0x0f
+		exp := (code >> 4) & 0x07
+		code = (mant | 0x10) << (exp + 3)
+	}
+	return time.Duration(code) * 100 * time.Millisecond
+}
+
+func (q IGMP) SourceAddrs() [][]byte {
+	var sources [][]byte
+	for i := 0; i+4 <= len(q.Sources); i += 4 {
+		sources = append(sources, q.Sources[i:i+4])
+	}
+	return sources
+}
+
+// igmpState はインターフェイスごとのIGMPの状態
+type igmpState struct {
+	// 古いバージョンのQueryを受け取ったときのバージョンと、それに合わせる期限
+	compatVersion int
+	compatUntil   time.Time
+	// Queryへの返事を送るのを待っているグループ
+	pending map[[4]byte]*igmpPendingReport
+	// IGMPv3の一般的なQueryへの返事を待っているタイマー
+	general *time.Timer
+}
+
+type igmpPendingReport struct {
+	timer *time.Timer
+	// IGMPv3のGroup-and-Source-Specific Queryで聞かれた送信元。nilならグループ全体
+	sources [][]byte
+}
+
+// igmpStateLocked はifnameのIGMPの状態を返す。s.muを持って呼ぶ
+func (s *Stack) igmpStateLocked(ifname string) *igmpState {
+	st, ok := s.igmp[ifname]
+	if !ok {
+		st = &igmpState{pending: make(map[[4]byte]*igmpPendingReport)}
+		s.igmp[ifname] = st
+	}
+	return st
+}
+
+// igmpVersionLocked はifnameで今使うIGMPのバージョンを返す。s.muを持って呼ぶ
+func (s *Stack) igmpVersionLocked(ifname string) int {
+	version := s.IGMPVersion
+	if version == 0 || version > 3 {
+		version = 3
+	}
+	st := s.igmpStateLocked(ifname)
+	if st.compatVersion != 0 && st.compatVersion < version && time.Now().Before(st.compatUntil) {
+		version = st.compatVersion
+	}
+	return version
+}
+
+// filterLocked はグループのフィルタモードと送信元を返す。s.muを持って呼ぶ
+func (s *Stack) filterLocked(ifname string, group []byte) (byte, [][]byte) {
+	return s.groups[multicastGroupKey{ifname: ifname, group: toIPv4Key(group)}].filter()
+}
+
+// igmpStateChanged はグループの状態が変わったことをReportで知らせる(RFC3376 5.1)
+// 知らせ損ねないように、少し待ってからもう一度送る
+func (s *Stack) igmpStateChanged(ifname string, group []byte, oldMode byte, oldSources [][]byte, newMode byte, newSources [][]byte) {
+	// 224.0.0.1はいつも入っているので知らせない
+	if bytes.Equal(group, allHostsGroup) {
+		return
+	}
+	s.mu.Lock()
+	version := s.igmpVersionLocked(ifname)
+	left := newMode == IGMPModeIsInclude && len(newSources) == 0
+	if left {
+		// 抜けたグループのQueryへの返事は送らない
+		st := s.igmpStateLocked(ifname)
+		if p, ok := st.pending[toIPv4Key(group)]; ok {
+			p.timer.Stop()
+			delete(st.pending, toIPv4Key(group))
+		}
+	}
+	s.mu.Unlock()
+
+	send := func() bool {
+		if version == 3 {
+			records := igmpv3ChangeRecords(group, oldMode, oldSources, newMode, newSources)
+			if len(records) == 0 {
+				return false
+			}
+			s.sendIGMPv3Report(ifname, records)
+			return true
+		}
+		joined := oldMode == IGMPModeIsInclude && len(oldSources) == 0 && !left
+		switch {
+		case joined && version == 1:
+			s.sendIGMP(ifname, group, toByteArr(NewIGMPv2Message(IGMPTypeV1MembershipReport, group)))
+		case joined:
+			s.sendIGMP(ifname, group, toByteArr(NewIGMPv2Message(IGMPTypeV2MembershipReport, group)))
+		case left && version == 2:
+			// Leave GroupはIGMPv2から。送るのは1回だけ
+			s.sendIGMP(ifname, allRoutersGroup, toByteArr(NewIGMPv2Message(IGMPTypeV2LeaveGroup, group)))
+			return false
+		default:
+			return false
+		}
+		return true
+	}
+	if !send() {
+		return
+	}
+
+	interval := igmpV3UnsolicitedReportInterval
+	if version < 3 {
+		interval = igmpV2UnsolicitedReportInterval
+	}
+	var retransmit func(n int)
+	retransmit = func(n int) {
+		time.AfterFunc(randomDuration(interval), func() {
+			// 間に状態が変わっていれば、そちらで送り直すので送らない
+			s.mu.RLock()
+			mode, sources := s.filterLocked(ifname, group)
+			s.mu.RUnlock()
+			if mode != newMode || !equalAddrList(sources, newSources) {
+				return
+			}
+			send()
+			if n > 1 {
+				retransmit(n - 1)
+			}
+		})
+	}
+	retransmit(igmpRobustness - 1)
+}
+
+// igmpv3ChangeRecords は状態の変化を表すGroup Recordを作る(RFC3376 5.1の表)
+func igmpv3ChangeRecords(group []byte, oldMode byte, oldSources [][]byte, newMode byte, newSources [][]byte) []IGMPGroupRecord {
+	var records []IGMPGroupRecord
+	add := func(recordType byte, sources [][]byte, always bool) {
+		if len(sources) == 0 && !always {
+			return
+		}
+		r := IGMPGroupRecord{Type: recordType, Group: net.IP(group)}
+		for _, src := range sources {
+			r.Sources = append(r.Sources, net.IP(src))
+		}
+		records = append(records, r)
+	}
+	switch {
+	case oldMode == IGMPModeIsInclude && newMode == IGMPModeIsInclude:
+		add(IGMPAllowNewSources, subtractAddrList(newSources, oldSources), false)
+		add(IGMPBlockOldSources, subtractAddrList(oldSources, newSources), false)
+	case oldMode == IGMPModeIsExclude && newMode == IGMPModeIsExclude:
+		add(IGMPAllowNewSources, subtractAddrList(oldSources, newSources), false)
+		add(IGMPBlockOldSources, subtractAddrList(newSources, oldSources), false)
+	case newMode == IGMPModeIsExclude:
+		add(IGMPChangeToExclude, newSources, true)
+	default:
+		add(IGMPChangeToInclude, newSources, true)
+	}
+	return records
+}
+
+func subtractAddrList(a, b [][]byte) [][]byte {
+	var diff [][]byte
+	for _, x := range a {
+		found := false
+		for _, y := range b {
+			if bytes.Equal(x, y) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			diff = append(diff, x)
+		}
+	}
+	return diff
+}
+
+func equalAddrList(a, b [][]byte) bool {
+	return len(a) == len(b) && len(subtractAddrList(a, b)) == 0
+}
+
+// sendIGMP はTTL 1, Router Alertオプション付きでIGMPを送る
+func (s *Stack) sendIGMP(ifname string, dst, payload []byte) error {
+	ifc := s.Interface(ifname)
+	if ifc == nil {
+		return ErrNoRoute
+	}
+	// アドレスがまだなければ0.0.0.0から送る
+	src, _ := s.interfaceAddr(ifc)
+	if src == nil {
+		src = []byte{0x00, 0x00, 0x00, 0x00}
+	}
+	header := NewIPHeader(src, dst, "IGMP")
+	header.TTL = []byte{0x01}
+	// Internetwork Control(RFC3376 4)
+	header.ServiceType = []byte{0xc0}
+	header.Options = ipOptionRouterAlert
+	// ゲートウェイではなく同じリンクのグループにそのまま送る
+	return s.sendIPv4(ifc, dst, header, payload)
+}
+
+func (s *Stack) sendIGMPv3Report(ifname string, records []IGMPGroupRecord) error {
+	// MTUに収まるようにGroup Recordを分けて送る
+	max := s.Interface(ifname).MTU() - 24 - 8
+	for len(records) != 0 {
+		n, size := 0, 0
+		for n < len(records) {
+			rsize := 8 + 4*len(records[n].Sources)
+			if n > 0 && size+rsize > max {
+				break
+			}
+			size += rsize
+			n++
+		}
+		if err := s.sendIGMP(ifname, igmpv3RoutersGroup, toByteArr(NewIGMPv3Report(records[:n]))); err != nil {
+			return err
+		}
+		records = records[n:]
+	}
+	return nil
+}
+
+// handleIGMP はQueryに答え、他のホストのReportを見たら自分のReportを止める
+func (s *Stack) handleIGMP(ifc *NetInterface, packet []byte) {
+	b := packet[ipHeaderLength(packet):]
+	if len(b) < 8 || len(b)%2 != 0 || !bytes.Equal(checksum(sumByteArr(b)), []byte{0x00, 0x00}) {
+		return
+	}
+	igmp, err := ParseIGMP(b)
+	if err != nil {
+		return
+	}
+	switch igmp.Type[0] {
+	case IGMPTypeMembershipQuery:
+		s.handleIGMPQuery(ifc, igmp)
+	case IGMPTypeV1MembershipReport, IGMPTypeV2MembershipReport:
+		// 同じグループのReportを他のホストが送ったので、自分は送らなくていい(RFC2236 3)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.igmpVersionLocked(ifc.Name) == 3 {
+			return
+		}
+		st := s.igmpStateLocked(ifc.Name)
+		if p, ok := st.pending[toIPv4Key(igmp.GroupAddr)]; ok {
+			p.timer.Stop()
+			delete(st.pending, toIPv4Key(igmp.GroupAddr))
+		}
+	}
+}
+
+// handleIGMPQuery はMax Resp Timeまでのランダムな時間だけ待ってから、入っているグループを知らせる
+func (s *Stack) handleIGMPQuery(ifc *NetInterface, q IGMP) {
+	ifname := ifc.Name
+	delay := randomDuration(q.MaxRespTime())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.igmpStateLocked(ifname)
+	if v := q.Version(); v < 3 {
+		st.compatVersion = v
+		st.compatUntil = time.Now().Add(igmpOlderVersionQuerierTimeout)
+	}
+	version := s.igmpVersionLocked(ifname)
+	general := isUnspecifiedAddr(q.GroupAddr)
+
+	// IGMPv3の一般的なQueryには全てのグループを1つのReportで答える
+	if version == 3 && general {
+		if st.general == nil {
+			st.general = time.AfterFunc(delay, func() { s.igmpRespondGeneral(ifname) })
+		}
+		return
+	}
+
+	var groups [][4]byte
+	if general {
+		for key := range s.groups {
+			if key.ifname == ifname {
+				groups = append(groups, key.group)
+			}
+		}
+	} else if _, ok := s.groups[multicastGroupKey{ifname: ifname, group: toIPv4Key(q.GroupAddr)}]; ok {
+		groups = append(groups, toIPv4Key(q.GroupAddr))
+	}
+	var sources [][]byte
+	if version == 3 {
+		for _, src := range q.SourceAddrs() {
+			sources = append(sources, append([]byte{}, src...))
+		}
+	}
+	for _, group := range groups {
+		if p, ok := st.pending[group]; ok {
+			// 待っている間にグループ全体を聞かれたら、グループ全体を答える
+			if sources == nil {
+				p.sources = nil
+			} else if p.sources != nil {
+				p.sources = append(p.sources, subtractAddrList(sources, p.sources)...)
+			}
+			continue
+		}
+		group := group
+		st.pending[group] = &igmpPendingReport{
+			sources: sources,
+			timer:   time.AfterFunc(delay, func() { s.igmpRespond(ifname, group) }),
+		}
+	}
+}
+
+// igmpRespond はQueryで聞かれたグループの今の状態を送る
+func (s *Stack) igmpRespond(ifname string, group [4]byte) {
+	s.mu.Lock()
+	st := s.igmpStateLocked(ifname)
+	p, ok := st.pending[group]
+	delete(st.pending, group)
+	version := s.igmpVersionLocked(ifname)
+	mode, sources := s.filterLocked(ifname, group[:])
+	s.mu.Unlock()
+	if !ok || (mode == IGMPModeIsInclude && len(sources) == 0) {
+		return
+	}
+
+	switch version {
+	case 1:
+		s.sendIGMP(ifname, group[:], toByteArr(NewIGMPv2Message(IGMPTypeV1MembershipReport, group[:])))
+	case 2:
+		s.sendIGMP(ifname, group[:], toByteArr(NewIGMPv2Message(IGMPTypeV2MembershipReport, group[:])))
+	default:
+		record := IGMPGroupRecord{Type: mode, Group: net.IP(group[:])}
+		if p.sources != nil {
+			// 聞かれた送信元のうち受け取るものだけを答える(RFC3376 5.2)
+			record.Type = IGMPModeIsInclude
+			if mode == IGMPModeIsInclude {
+				sources = subtractAddrList(p.sources, subtractAddrList(p.sources, sources))
+			} else {
+				sources = subtractAddrList(p.sources, sources)
+			}
+			if len(sources) == 0 {
+				return
+			}
+		}
+		for _, src := range sources {
+			record.Sources = append(record.Sources, net.IP(src))
+		}
+		s.sendIGMPv3Report(ifname, []IGMPGroupRecord{record})
+	}
+}
+
+// igmpRespondGeneral は入っている全てのグループの今の状態を送る
+func (s *Stack) igmpRespondGeneral(ifname string) {
+	s.mu.Lock()
+	s.igmpStateLocked(ifname).general = nil
+	var records []IGMPGroupRecord
+	for key, m := range s.groups {
+		if key.ifname != ifname || bytes.Equal(key.group[:], allHostsGroup) {
+			continue
+		}
+		mode, sources := m.filter()
+		record := IGMPGroupRecord{Type: mode, Group: net.IP(append([]byte{}, key.group[:]...))}
+		for _, src := range sources {
+			record.Sources = append(record.Sources, net.IP(src))
+		}
+		records = append(records, record)
+	}
+	s.mu.Unlock()
+	if len(records) != 0 {
+		s.sendIGMPv3Report(ifname, records)
+	}
+}
@@ -1,5 +1,21 @@
 package tcpip
 
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	IPProtoICMP = 0x01
+	IPProtoIGMP = 0x02
+	IPProtoTCP  = 0x06
+	IPProtoUDP  = 0x11
+	// IPv6のNext Header
+	IPProtoICMPv6 = 0x3a
+)
+
+var ErrFragmentNeeded = errors.New("packet is larger than MTU and DF bit is set")
+
 // https://www.infraexpert.com/study/tcpip1.html
 type IPHeader struct {
 	VersionAndHeaderLength []byte
@@ -12,6 +28,8 @@ type IPHeader struct {
 	HeaderCheckSum         []byte
 	SourceIPAddr           []byte
 	DstIPAddr              []byte
+	// オプション。4byteの倍数にしておく
+	Options []byte
 }
 
 func NewIPHeader(sourceIp, dstIp []byte, protocol string) IPHeader {
@@ -29,13 +47,137 @@ func NewIPHeader(sourceIp, dstIp []byte, protocol string) IPHeader {
 	}
 
 	switch protocol {
-	case "IP":
-		ip.Protocol = []byte{0x01}
+	case "IP", "ICMP":
+		ip.Protocol = []byte{IPProtoICMP}
 	case "UDP":
-		ip.Protocol = []byte{0x11}
+		ip.Protocol = []byte{IPProtoUDP}
 	case "TCP":
-		ip.Protocol = []byte{0x06}
+		ip.Protocol = []byte{IPProtoTCP}
+	case "IGMP":
+		ip.Protocol = []byte{IPProtoIGMP}
 	}
 
 	return ip
 }
+
+// IPヘッダの長さ(オプション込み)
+func ipHeaderLength(packet []byte) int {
+	return int(packet[0]&0x0f) * 4
+}
+
+// ヘッダのチェックサムを計算し直してIPパケットのbyteにする
+func newIPv4Packet(header IPHeader, payload []byte) []byte {
+	if len(header.Options) != 0 {
+		header.VersionAndHeaderLength = []byte{0x40 | byte(toByteLen(header)/4)}
+	}
+	header.TotalPacketLength = UintTo2byte(toByteLen(header) + uint16(len(payload)))
+	header.HeaderCheckSum = []byte{0x00, 0x00}
+	header.HeaderCheckSum = checksum(sumByteArr(toByteArr(header)))
+
+	var packet []byte
+	packet = append(packet, toByteArr(header)...)
+	packet = append(packet, payload...)
+	return packet
+}
+
+// 受け取ったIPv4パケットのヘッダが正しいかチェックする
+func validIPv4Packet(packet []byte) bool {
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return false
+	}
+	hlen := ipHeaderLength(packet)
+	if hlen < 20 || len(packet) < hlen {
+		return false
+	}
+	total := int(binary.BigEndian.Uint16(packet[2:4]))
+	if total < hlen || len(packet) < total {
+		return false
+	}
+	// ヘッダ全体のチェックサムを足して0xffffになれば正しい
+	return binary.BigEndian.Uint16(checksum(sumByteArr(packet[:hlen]))) == 0
+}
+
+// 後ろのフラグメントにもコピーするオプションだけ残す
+func copiedIPOptions(options []byte) []byte {
+	var copied []byte
+	for i := 0; i < len(options); {
+		switch options[i] {
+		// End of Option List
+		case 0x00:
+			i = len(options)
+			continue
+		// No Operation
+		case 0x01:
+			i++
+			continue
+		}
+		if i+1 >= len(options) || options[i+1] < 2 {
+			break
+		}
+		olen := int(options[i+1])
+		if i+olen > len(options) {
+			break
+		}
+		// 先頭のbitがcopiedフラグ
+		if options[i]&0x80 != 0 {
+			copied = append(copied, options[i:i+olen]...)
+		}
+		i += olen
+	}
+	// ヘッダ長は4byte単位なのでEnd of Option Listで埋める
+	for len(copied)%4 != 0 {
+		copied = append(copied, 0x00)
+	}
+	return copied
+}
+
+// fragmentIPv4 はIPパケットをMTUに収まるように分割する
+// DFビットが立っているときはErrFragmentNeededを返す
+func fragmentIPv4(packet []byte, mtu int) ([][]byte, error) {
+	total := int(binary.BigEndian.Uint16(packet[2:4]))
+	if total <= mtu {
+		return [][]byte{packet[:total]}, nil
+	}
+	flags := binary.BigEndian.Uint16(packet[6:8])
+	if flags&0x4000 != 0 {
+		return nil, ErrFragmentNeeded
+	}
+
+	hlen := ipHeaderLength(packet)
+	header := packet[:hlen]
+	payload := packet[hlen:total]
+	// 元々フラグメントだった場合はそのオフセットとMFビットを引き継ぐ
+	baseOffset := int(flags&0x1fff) * 8
+	lastMF := flags & 0x2000
+
+	var fragments [][]byte
+	for offset := 0; offset < len(payload); {
+		fragHeader := header
+		if offset != 0 {
+			fragHeader = append(append([]byte{}, header[:20]...), copiedIPOptions(header[20:])...)
+			fragHeader[0] = 0x40 | byte(len(fragHeader)/4)
+		}
+		// フラグメントのデータ長は8byteの倍数にする
+		size := (mtu - len(fragHeader)) &^ 7
+		if size <= 0 {
+			return nil, ErrFragmentNeeded
+		}
+		mf := uint16(0x2000)
+		if offset+size >= len(payload) {
+			size = len(payload) - offset
+			mf = lastMF
+		}
+
+		frag := make([]byte, len(fragHeader)+size)
+		copy(frag, fragHeader)
+		copy(frag[len(fragHeader):], payload[offset:offset+size])
+		binary.BigEndian.PutUint16(frag[2:4], uint16(len(frag)))
+		binary.BigEndian.PutUint16(frag[6:8], mf|uint16((baseOffset+offset)/8))
+		frag[10], frag[11] = 0x00, 0x00
+		copy(frag[10:12], checksum(sumByteArr(frag[:len(fragHeader)])))
+
+		fragments = append(fragments, frag)
+		offset += size
+	}
+	return fragments, nil
+}
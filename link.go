@@ -0,0 +1,225 @@
+package tcpip
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/bpf"
+)
+
+var ErrLinkClosed = errors.New("link endpoint is closed")
+
+// LinkEndpoint はEthernetフレームを送受信するリンク層の口
+// AF_PACKETのソケットでもメモリ上のパイプでも同じように扱えるようにする
+type LinkEndpoint interface {
+	// Ethernetヘッダを含むフレームを1つ送る
+	WriteFrame(frame []byte) error
+	// Ethernetヘッダを含むフレームを1つ受け取る
+	ReadFrame() ([]byte, error)
+	// IPパケットとして送れる最大長
+	MTU() int
+	Close() error
+}
+
+// RawLinkEndpoint はAF_PACKETのソケットでNICとフレームをやり取りする
+type RawLinkEndpoint struct {
+	fd      int
+	ifindex int
+	mtu     int
+	// trueなら自分が送ったフレームも受け取る。キャプチャ用
+	IncludeOutgoing bool
+}
+
+func NewRawLinkEndpoint(ifname string) (*RawLinkEndpoint, error) {
+	nif, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ALL)))
+	if err != nil {
+		return nil, err
+	}
+	// 指定したインターフェイスのフレームだけ受け取る
+	err = syscall.Bind(fd, &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ALL),
+		Ifindex:  nif.Index,
+	})
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	// カーネルが外してしまうVLANタグを受け取れるようにする
+	err = syscall.SetsockoptInt(fd, syscall.SOL_PACKET, packetAuxdata, 1)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &RawLinkEndpoint{fd: fd, ifindex: nif.Index, mtu: nif.MTU}, nil
+}
+
+func (l *RawLinkEndpoint) WriteFrame(frame []byte) error {
+	return syscall.Sendto(l.fd, frame, 0, &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ALL),
+		Ifindex:  l.ifindex,
+	})
+}
+
+func (l *RawLinkEndpoint) ReadFrame() ([]byte, error) {
+	for {
+		recvBuf := make([]byte, 65536)
+		oob := make([]byte, 64)
+		n, oobn, _, from, err := syscall.Recvmsg(l.fd, recvBuf, oob, 0)
+		if err != nil {
+			return nil, err
+		}
+		// 自分が送ったフレームも見えてしまうので捨てる
+		if ll, ok := from.(*syscall.SockaddrLinklayer); ok && ll.Pkttype == syscall.PACKET_OUTGOING && !l.IncludeOutgoing {
+			continue
+		}
+		return restoreVLANTag(recvBuf[:n], oob[:oobn]), nil
+	}
+}
+
+// Linuxのtpacket_auxdata
+const (
+	packetAuxdata          = 8
+	tpStatusVlanValid      = 0x10
+	tpStatusVlanTpidValid  = 0x40
+	tpacketAuxdataLength   = 20
+	tpacketAuxdataVlanTCI  = 16
+	tpacketAuxdataVlanTPID = 18
+)
+
+// restoreVLANTag はカーネルが外したVLANタグをフレームに戻す
+func restoreVLANTag(frame, oob []byte) []byte {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil || len(frame) < 12 {
+		return frame
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level != syscall.SOL_PACKET || msg.Header.Type != packetAuxdata || len(msg.Data) < tpacketAuxdataLength {
+			continue
+		}
+		status := binary.LittleEndian.Uint32(msg.Data[0:4])
+		if status&tpStatusVlanValid == 0 {
+			return frame
+		}
+		tpid := VLAN8021Q
+		if status&tpStatusVlanTpidValid != 0 {
+			tpid = UintTo2byte(binary.LittleEndian.Uint16(msg.Data[tpacketAuxdataVlanTPID:]))
+		}
+		tci := UintTo2byte(binary.LittleEndian.Uint16(msg.Data[tpacketAuxdataVlanTCI:]))
+
+		var tagged []byte
+		tagged = append(tagged, frame[0:12]...)
+		tagged = append(tagged, tpid...)
+		tagged = append(tagged, tci...)
+		tagged = append(tagged, frame[12:]...)
+		return tagged
+	}
+	return frame
+}
+
+// AttachFilter はclassic BPFのプログラムをソケットに付けて、カーネルでフレームを選ぶ
+// nilなら外す
+func (l *RawLinkEndpoint) AttachFilter(prog []bpf.Instruction) error {
+	if prog == nil {
+		return syscall.DetachLsf(l.fd)
+	}
+	raw, err := bpf.Assemble(prog)
+	if err != nil {
+		return err
+	}
+	filter := make([]syscall.SockFilter, len(raw))
+	for i, ins := range raw {
+		filter[i] = syscall.SockFilter{Code: ins.Op, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	return syscall.AttachLsf(l.fd, filter)
+}
+
+// Linuxのpacket_mreq
+type packetMreq struct {
+	ifindex int32
+	mrType  uint16
+	alen    uint16
+	address [8]byte
+}
+
+// SetPromiscuous はNICをプロミスキャスモードにする
+// ソケットを閉じれば元に戻る
+func (l *RawLinkEndpoint) SetPromiscuous(on bool) error {
+	mreq := packetMreq{ifindex: int32(l.ifindex), mrType: syscall.PACKET_MR_PROMISC}
+	opt := syscall.PACKET_ADD_MEMBERSHIP
+	if !on {
+		opt = syscall.PACKET_DROP_MEMBERSHIP
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(l.fd), syscall.SOL_PACKET, uintptr(opt),
+		uintptr(unsafe.Pointer(&mreq)), unsafe.Sizeof(mreq), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (l *RawLinkEndpoint) MTU() int {
+	return l.mtu
+}
+
+func (l *RawLinkEndpoint) Close() error {
+	return syscall.Close(l.fd)
+}
+
+// ChannelLinkEndpoint はメモリ上でフレームをやり取りするテスト用のリンク
+type ChannelLinkEndpoint struct {
+	mtu    int
+	in     chan []byte
+	peer   *ChannelLinkEndpoint
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewChannelLinkPair は互いに繋がったリンクを2つ返す
+// 片方にWriteFrameしたフレームがもう片方のReadFrameで読める
+func NewChannelLinkPair(mtu int) (*ChannelLinkEndpoint, *ChannelLinkEndpoint) {
+	a := &ChannelLinkEndpoint{mtu: mtu, in: make(chan []byte, 256), closed: make(chan struct{})}
+	b := &ChannelLinkEndpoint{mtu: mtu, in: make(chan []byte, 256), closed: make(chan struct{})}
+	a.peer = b
+	b.peer = a
+	return a, b
+}
+
+func (l *ChannelLinkEndpoint) WriteFrame(frame []byte) error {
+	b := make([]byte, len(frame))
+	copy(b, frame)
+	select {
+	case <-l.closed:
+		return ErrLinkClosed
+	case <-l.peer.closed:
+		// 相手がいなければ線が抜けているのと同じなので捨てる
+		return nil
+	case l.peer.in <- b:
+		return nil
+	}
+}
+
+func (l *ChannelLinkEndpoint) ReadFrame() ([]byte, error) {
+	select {
+	case <-l.closed:
+		return nil, ErrLinkClosed
+	case frame := <-l.in:
+		return frame, nil
+	}
+}
+
+func (l *ChannelLinkEndpoint) MTU() int {
+	return l.mtu
+}
+
+func (l *ChannelLinkEndpoint) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
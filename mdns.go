@@ -0,0 +1,817 @@
+package tcpip
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// mDNS(RFC6762)
+const (
+	mdnsPort = 5353
+	// Classの最上位bit。質問ならユニキャストで返事が欲しい(QU)、レコードなら古いものを置き換える(cache-flush)
+	mdnsClassUnicast    = 0x8000
+	mdnsClassCacheFlush = 0x8000
+	// ホスト名に関わるレコードとそれ以外のTTL(RFC6762 10)
+	mdnsHostTTL  = 120
+	mdnsOtherTTL = 4500
+	// ポートが5353でない問い合わせへの返事のTTLの上限(RFC6762 6.7)
+	mdnsLegacyTTL = 10
+	// probeを送る間隔と回数(RFC6762 8.1)
+	mdnsProbeInterval = 250 * time.Millisecond
+	mdnsProbeCount    = 3
+	// 続けて問い合わせるときの間隔の上限(RFC6762 5.2)
+	mdnsMaxQueryInterval = time.Hour
+)
+
+var mdnsGroup = []byte{224, 0, 0, 251}
+
+var ErrMDNSConflict = errors.New("mdns name is already in use")
+
+// MDNS はリンク上のホストとDNSサーバなしで名前を引き合う(RFC6762, Multicast DNS)
+// 自分のレコードを問い合わせに答え、他のホストの返事はキャッシュしておく
+type MDNS struct {
+	conn net.PacketConn
+	// 自分のIPv4アドレス
+	addr net.IP
+
+	mu sync.Mutex
+	// 自分が答えるレコード
+	records []mdnsRecord
+	// probeしている名前(小文字)
+	probes map[string]*mdnsProbe
+	// 他のホストから受け取ったレコード。名前(小文字)ごと
+	cache map[string][]mdnsCacheEntry
+	// キャッシュが変わったら閉じて作り直す
+	updated  chan struct{}
+	hostname string
+	services []*DNSSDService
+
+	closed chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+}
+
+// mdnsRecord は自分が答えるレコード
+type mdnsRecord struct {
+	rr DNSResourceRecord
+	// 他のホストが同じ名前を使っていないかprobeで確かめたもの。cache-flushビットを立てて送る
+	unique bool
+}
+
+type mdnsCacheEntry struct {
+	rr     DNSResourceRecord
+	expire time.Time
+	ttl    time.Duration
+}
+
+// mdnsProbe はprobeしている名前で使いたいレコード
+type mdnsProbe struct {
+	records []DNSResourceRecord
+	// 同じ名前で違うレコードを返したホストがいた
+	conflict bool
+	// 同時にprobeしていたホストとの比べ合いで負けた(RFC6762 8.2)
+	lost   bool
+	signal chan struct{}
+}
+
+// NewMDNS はifnameのインターフェイスで224.0.0.251:5353に入ってmDNSを送受信する
+// stackがnilならカーネルのソケットを使う
+func NewMDNS(stack *Stack, ifname string) (*MDNS, error) {
+	var conn net.PacketConn
+	var addr net.IP
+	if stack != nil {
+		ifc := stack.Interface(ifname)
+		if ifc != nil {
+			addr, _ = stack.interfaceAddr(ifc)
+		}
+		if addr == nil {
+			return nil, fmt.Errorf("no ipv4 interface : %s", ifname)
+		}
+		// インターフェイスごとにMDNSを作れるように、ポートを共有してこのインターフェイスに届いたものだけを受け取る
+		c, err := stack.listenUDP(&net.UDPAddr{Port: mdnsPort}, true, ifname)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.JoinGroup(ifname, mdnsGroup); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.MulticastInterface = ifname
+		// 同じリンクからのものか確かめられるようにTTLは255で送る(RFC6762 11)
+		c.MulticastTTL = 255
+		conn = c
+	} else {
+		nif, err := net.InterfaceByName(ifname)
+		if err != nil {
+			return nil, err
+		}
+		addr, err = interfaceIPv4Addr(nif)
+		if err != nil {
+			return nil, err
+		}
+		c, err := net.ListenMulticastUDP("udp4", nif, &net.UDPAddr{IP: mdnsGroup, Port: mdnsPort})
+		if err != nil {
+			return nil, err
+		}
+		if err := setMulticastTTL(c, 255); err != nil {
+			c.Close()
+			return nil, err
+		}
+		conn = c
+	}
+
+	m := &MDNS{
+		conn:    conn,
+		addr:    addr,
+		probes:  make(map[string]*mdnsProbe),
+		cache:   make(map[string][]mdnsCacheEntry),
+		updated: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	m.wg.Add(1)
+	go m.readLoop()
+	return m, nil
+}
+
+func interfaceIPv4Addr(nif *net.Interface) (net.IP, error) {
+	addrs, err := nif.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.To4(), nil
+		}
+	}
+	return nil, fmt.Errorf("no ipv4 address : %s", nif.Name)
+}
+
+func setMulticastTTL(c *net.UDPConn, ttl int) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, ttl)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// Close は自分のレコードのgoodbye(TTL 0)を送ってソケットを閉じる
+func (m *MDNS) Close() error {
+	var err error
+	m.once.Do(func() {
+		m.mu.Lock()
+		records := m.records
+		m.records = nil
+		m.mu.Unlock()
+		m.goodbye(records)
+		close(m.closed)
+		err = m.conn.Close()
+		m.wg.Wait()
+	})
+	return err
+}
+
+func (m *MDNS) readLoop() {
+	defer m.wg.Done()
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := m.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		addr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		msg, err := ParseDNSMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		if msg.IsResponse() {
+			m.handleResponse(msg, addr)
+		} else {
+			m.handleQuery(msg, addr)
+		}
+	}
+}
+
+// send はメッセージを送る。toがnilならグループに送る
+func (m *MDNS) send(msg DNSMessage, to *net.UDPAddr) error {
+	b, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	if to == nil {
+		to = &net.UDPAddr{IP: net.IP(mdnsGroup), Port: mdnsPort}
+	}
+	_, err = m.conn.WriteTo(b, to)
+	return err
+}
+
+// sameMDNSRecord は名前、タイプ、クラス、RDATAが同じならtrue。TTLとcache-flushビットは比べない
+func sameMDNSRecord(a, b DNSResourceRecord) bool {
+	return strings.EqualFold(strings.TrimSuffix(a.Name, "."), strings.TrimSuffix(b.Name, ".")) &&
+		a.Type == b.Type && a.Class&^mdnsClassCacheFlush == b.Class&^mdnsClassCacheFlush &&
+		bytes.Equal(mdnsRData(a), mdnsRData(b))
+}
+
+// mdnsRData は圧縮しないRDATAを返す
+func mdnsRData(rr DNSResourceRecord) []byte {
+	b, err := packDNSRData(nil, rr.Data, nil)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func mdnsName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// handleResponse は他のホストの返事をキャッシュし、自分が使っている名前とぶつかっていないか確かめる
+func (m *MDNS) handleResponse(msg DNSMessage, from *net.UDPAddr) {
+	// 5353以外から来た返事は信用しない(RFC6762 6)
+	if from.Port != mdnsPort || msg.RCode() != DNSRCodeSuccess {
+		return
+	}
+	records := append(append([]DNSResourceRecord{}, msg.Answers...), msg.Additionals...)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var conflicts []mdnsRecord
+	changed := false
+	now := time.Now()
+	for _, rr := range records {
+		if rr.Type == DNSTypeOPT {
+			continue
+		}
+		name := mdnsName(rr.Name)
+		if p, ok := m.probes[name]; ok && !mdnsContains(p.records, rr) {
+			p.conflict = true
+			p.notify()
+		}
+		if m.isOwnRecord(rr) {
+			continue
+		}
+		// probeし終わった名前に違うレコードが来たら、答えるのをやめてprobeし直す(RFC6762 9)
+		kept := m.records[:0]
+		for _, own := range m.records {
+			if own.unique && mdnsName(own.rr.Name) == name && own.rr.Type == rr.Type {
+				conflicts = append(conflicts, own)
+				continue
+			}
+			kept = append(kept, own)
+		}
+		m.records = kept
+
+		entries := m.cache[name]
+		// cache-flushビットが立っていれば、同じ名前とタイプの古いレコードは1秒後に消す(RFC6762 10.2)
+		if rr.Class&mdnsClassCacheFlush != 0 {
+			for i := range entries {
+				e := &entries[i]
+				if e.rr.Type == rr.Type && !sameMDNSRecord(e.rr, rr) && e.expire.After(now.Add(time.Second)) {
+					e.expire = now.Add(time.Second)
+				}
+			}
+		}
+		ttl := time.Duration(rr.TTL) * time.Second
+		expire := now.Add(ttl)
+		// TTLが0ならgoodbyeなので1秒後に消す(RFC6762 10.1)
+		if rr.TTL == 0 {
+			expire = now.Add(time.Second)
+		}
+		rr.Class &^= mdnsClassCacheFlush
+		found := false
+		for i := range entries {
+			if sameMDNSRecord(entries[i].rr, rr) {
+				entries[i] = mdnsCacheEntry{rr: rr, expire: expire, ttl: ttl}
+				found = true
+				break
+			}
+		}
+		if !found {
+			entries = append(entries, mdnsCacheEntry{rr: rr, expire: expire, ttl: ttl})
+		}
+		m.cache[name] = entries
+		changed = true
+	}
+	if changed {
+		close(m.updated)
+		m.updated = make(chan struct{})
+	}
+	if len(conflicts) != 0 {
+		m.wg.Add(1)
+		go m.reprobe(conflicts)
+	}
+}
+
+// reprobe はぶつかったレコードをprobeし直して、誰も使っていなければまた答える
+// 使われていればそのレコードは答えないままにする
+func (m *MDNS) reprobe(records []mdnsRecord) {
+	defer m.wg.Done()
+	byName := make(map[string][]mdnsRecord)
+	for _, r := range records {
+		name := mdnsName(r.rr.Name)
+		byName[name] = append(byName[name], r)
+	}
+	for _, group := range byName {
+		var rrs []DNSResourceRecord
+		for _, r := range group {
+			rrs = append(rrs, r.rr)
+		}
+		if err := m.probe(context.Background(), rrs); err == nil {
+			m.publish(group)
+		}
+	}
+}
+
+func mdnsContains(records []DNSResourceRecord, rr DNSResourceRecord) bool {
+	for _, r := range records {
+		if sameMDNSRecord(r, rr) {
+			return true
+		}
+	}
+	return false
+}
+
+// isOwnRecord は自分が答えているレコードならtrue。m.muを持って呼ぶ
+func (m *MDNS) isOwnRecord(rr DNSResourceRecord) bool {
+	for _, own := range m.records {
+		if sameMDNSRecord(own.rr, rr) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleQuery は自分のレコードへの問い合わせに答える
+func (m *MDNS) handleQuery(msg DNSMessage, from *net.UDPAddr) {
+	if msg.Flags&dnsFlagOpcode != 0 || msg.RCode() != DNSRCodeSuccess {
+		return
+	}
+	m.checkSimultaneousProbe(msg)
+
+	// 5353以外から来た問い合わせは普通のDNSのリゾルバからのもの(RFC6762 6.7)
+	legacy := from.Port != mdnsPort
+	unicast := legacy
+	var answers, additionals []DNSResourceRecord
+	shared := false
+	for _, q := range msg.Questions {
+		if q.Class&mdnsClassUnicast != 0 {
+			unicast = true
+		}
+		for _, own := range m.answersFor(q) {
+			// 相手が知っているレコードは、TTLが半分以上残っていれば答えない(RFC6762 7.1)
+			if knownAnswer(msg.Answers, own.rr) {
+				continue
+			}
+			if !own.unique {
+				shared = true
+			}
+			answers = appendMDNSRecord(answers, own.rr, own.unique)
+		}
+	}
+	if len(answers) == 0 {
+		return
+	}
+	for _, own := range m.additionalsFor(answers) {
+		if !mdnsContains(answers, own.rr) {
+			additionals = appendMDNSRecord(additionals, own.rr, own.unique)
+		}
+	}
+
+	resp := DNSMessage{Flags: DNSFlagQR | DNSFlagAA, Answers: answers, Additionals: additionals}
+	var to *net.UDPAddr
+	if unicast {
+		to = from
+	}
+	if legacy {
+		// 普通のDNSの返事と同じように、IDと質問を返してcache-flushビットは立てない
+		resp.ID = msg.ID
+		resp.Questions = msg.Questions
+		for _, section := range [][]DNSResourceRecord{resp.Answers, resp.Additionals} {
+			for i := range section {
+				section[i].Class &^= mdnsClassCacheFlush
+				if section[i].TTL > mdnsLegacyTTL {
+					section[i].TTL = mdnsLegacyTTL
+				}
+			}
+		}
+		m.send(resp, to)
+		return
+	}
+	// 何台も同時に答えるかもしれない共有のレコードは20〜120ms待ってから送る(RFC6762 6)
+	if shared && !unicast {
+		delay := 20*time.Millisecond + randomDuration(100*time.Millisecond)
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			select {
+			case <-time.After(delay):
+				m.send(resp, to)
+			case <-m.closed:
+			}
+		}()
+		return
+	}
+	m.send(resp, to)
+}
+
+func appendMDNSRecord(records []DNSResourceRecord, rr DNSResourceRecord, unique bool) []DNSResourceRecord {
+	if unique {
+		rr.Class |= mdnsClassCacheFlush
+	}
+	return append(records, rr)
+}
+
+func knownAnswer(known []DNSResourceRecord, rr DNSResourceRecord) bool {
+	for _, k := range known {
+		if sameMDNSRecord(k, rr) && k.TTL >= rr.TTL/2 {
+			return true
+		}
+	}
+	return false
+}
+
+// answersFor は質問に答える自分のレコードを返す
+func (m *MDNS) answersFor(q DNSQuestion) []mdnsRecord {
+	name := mdnsName(q.Name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var records []mdnsRecord
+	for _, own := range m.records {
+		if mdnsName(own.rr.Name) == name && (q.Type == own.rr.Type || q.Type == DNSTypeANY) {
+			records = append(records, own)
+		}
+	}
+	return records
+}
+
+// additionalsFor はPTRの先のSRVとTXT、SRVの先のアドレスを返す(RFC6763 12)
+func (m *MDNS) additionalsFor(answers []DNSResourceRecord) []mdnsRecord {
+	var names []string
+	for _, rr := range answers {
+		switch d := rr.Data.(type) {
+		case DNSPTR:
+			names = append(names, mdnsName(d.Target))
+		case DNSSRV:
+			names = append(names, mdnsName(d.Target))
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var records []mdnsRecord
+	for i := 0; i < len(names); i++ {
+		for _, own := range m.records {
+			if mdnsName(own.rr.Name) != names[i] {
+				continue
+			}
+			switch d := own.rr.Data.(type) {
+			case DNSSRV:
+				records = append(records, own)
+				names = append(names, mdnsName(d.Target))
+			case DNSTXT, DNSA, DNSAAAA:
+				records = append(records, own)
+			}
+		}
+	}
+	return records
+}
+
+// checkSimultaneousProbe は同じ名前を同時にprobeしているホストがいたら、Authorityのレコードを比べる
+// 辞書順で小さい方が負けてprobeをやり直す(RFC6762 8.2)
+func (m *MDNS) checkSimultaneousProbe(msg DNSMessage) {
+	if len(msg.Authorities) == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, q := range msg.Questions {
+		p, ok := m.probes[mdnsName(q.Name)]
+		if !ok {
+			continue
+		}
+		var theirs []DNSResourceRecord
+		for _, rr := range msg.Authorities {
+			if mdnsName(rr.Name) == mdnsName(q.Name) {
+				theirs = append(theirs, rr)
+			}
+		}
+		if len(theirs) != 0 && compareMDNSRecords(p.records, theirs) < 0 {
+			p.lost = true
+			p.notify()
+		}
+	}
+}
+
+// compareMDNSRecords はクラス、タイプ、RDATAの順に並べたレコードを先頭から比べる
+// 同じなら0、aが小さければ負の値を返す
+func compareMDNSRecords(a, b []DNSResourceRecord) int {
+	sortMDNS := func(records []DNSResourceRecord) []DNSResourceRecord {
+		sorted := append([]DNSResourceRecord{}, records...)
+		sort.Slice(sorted, func(i, j int) bool {
+			return compareMDNSRecord(sorted[i], sorted[j]) < 0
+		})
+		return sorted
+	}
+	a, b = sortMDNS(a), sortMDNS(b)
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareMDNSRecord(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+func compareMDNSRecord(a, b DNSResourceRecord) int {
+	if ca, cb := a.Class&^mdnsClassCacheFlush, b.Class&^mdnsClassCacheFlush; ca != cb {
+		return int(ca) - int(cb)
+	}
+	if a.Type != b.Type {
+		return int(a.Type) - int(b.Type)
+	}
+	return bytes.Compare(mdnsRData(a), mdnsRData(b))
+}
+
+func (p *mdnsProbe) notify() {
+	select {
+	case p.signal <- struct{}{}:
+	default:
+	}
+}
+
+// probe はrecordsの名前を他のホストが使っていないか確かめる(RFC6762 8.1)
+// recordsは全て同じ名前。使われていればErrMDNSConflictを返す
+func (m *MDNS) probe(ctx context.Context, records []DNSResourceRecord) error {
+	name := mdnsName(records[0].Name)
+	p := &mdnsProbe{records: records, signal: make(chan struct{}, 1)}
+	m.mu.Lock()
+	if _, ok := m.probes[name]; ok {
+		m.mu.Unlock()
+		return fmt.Errorf("%w : %s", ErrMDNSConflict, name)
+	}
+	for _, own := range m.records {
+		if own.unique && mdnsName(own.rr.Name) == name {
+			m.mu.Unlock()
+			return fmt.Errorf("%w : %s", ErrMDNSConflict, name)
+		}
+	}
+	m.probes[name] = p
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.probes, name)
+		m.mu.Unlock()
+	}()
+
+	query := DNSMessage{
+		Questions:   []DNSQuestion{{Name: records[0].Name, Type: DNSTypeANY, Class: DNSClassINET | mdnsClassUnicast}},
+		Authorities: records,
+	}
+	// 最初は0〜250ms待ってから送る
+	wait := randomDuration(mdnsProbeInterval)
+	for sent := 0; sent <= mdnsProbeCount; {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-m.closed:
+			return net.ErrClosed
+		case <-p.signal:
+		case <-time.After(wait):
+		}
+
+		m.mu.Lock()
+		conflict, lost := p.conflict, p.lost
+		p.lost = false
+		m.mu.Unlock()
+		if conflict {
+			return fmt.Errorf("%w : %s", ErrMDNSConflict, name)
+		}
+		if lost {
+			// 負けたら1秒待ってからやり直す
+			sent, wait = 0, time.Second
+			continue
+		}
+		if sent == mdnsProbeCount {
+			return nil
+		}
+		if err := m.send(query, nil); err != nil {
+			return err
+		}
+		sent++
+		wait = mdnsProbeInterval
+	}
+	return nil
+}
+
+// publish はレコードを答えるようにして、1秒空けて2回知らせる(RFC6762 8.3)
+func (m *MDNS) publish(records []mdnsRecord) {
+	var rrs []DNSResourceRecord
+	m.mu.Lock()
+	for _, r := range records {
+		m.records = append(m.records, r)
+		rrs = appendMDNSRecord(rrs, r.rr, r.unique)
+	}
+	m.mu.Unlock()
+
+	m.announce(rrs)
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		select {
+		case <-time.After(time.Second):
+			m.announce(rrs)
+		case <-m.closed:
+		}
+	}()
+}
+
+func (m *MDNS) announce(records []DNSResourceRecord) {
+	m.send(DNSMessage{Flags: DNSFlagQR | DNSFlagAA, Answers: records}, nil)
+}
+
+// unpublish は答えるのをやめてgoodbyeを送る
+func (m *MDNS) unpublish(records []DNSResourceRecord) {
+	m.mu.Lock()
+	var removed []mdnsRecord
+	kept := m.records[:0]
+	for _, own := range m.records {
+		if mdnsContains(records, own.rr) {
+			removed = append(removed, own)
+			continue
+		}
+		kept = append(kept, own)
+	}
+	m.records = kept
+	m.mu.Unlock()
+	m.goodbye(removed)
+}
+
+func (m *MDNS) goodbye(records []mdnsRecord) {
+	if len(records) == 0 {
+		return
+	}
+	var rrs []DNSResourceRecord
+	for _, r := range records {
+		rr := r.rr
+		rr.TTL = 0
+		rrs = append(rrs, rr)
+	}
+	m.announce(rrs)
+}
+
+// RegisterHost はname.localのAレコードを自分のアドレスで答えるようにする
+// 他のホストが使っていれば"name-2"のように番号を付けて探し、登録した名前を返す
+func (m *MDNS) RegisterHost(ctx context.Context, name string) (string, error) {
+	base := strings.TrimSuffix(strings.TrimSuffix(name, "."), ".local")
+	for i := 1; ; i++ {
+		host := base + ".local"
+		if i > 1 {
+			host = fmt.Sprintf("%s-%d.local", base, i)
+		}
+		rr := DNSResourceRecord{Name: host, Type: DNSTypeA, Class: DNSClassINET, TTL: mdnsHostTTL, Data: DNSA{Addr: m.addr}}
+		err := m.probe(ctx, []DNSResourceRecord{rr})
+		if errors.Is(err, ErrMDNSConflict) && i < 16 {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		m.publish([]mdnsRecord{{rr: rr, unique: true}})
+		m.mu.Lock()
+		m.hostname = host
+		m.mu.Unlock()
+		return host, nil
+	}
+}
+
+// HostName はRegisterHostで登録した名前を返す
+func (m *MDNS) HostName() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.hostname
+}
+
+// cached は期限の切れていないキャッシュのレコードを返す。m.muを持って呼ぶ
+func (m *MDNS) cached(name string, qtype uint16) []DNSResourceRecord {
+	name = mdnsName(name)
+	now := time.Now()
+	var records []DNSResourceRecord
+	var alive []mdnsCacheEntry
+	for _, e := range m.cache[name] {
+		if !now.Before(e.expire) {
+			continue
+		}
+		alive = append(alive, e)
+		// goodbyeを受け取ったレコードは消すまでの1秒の間も返さない
+		if e.rr.TTL == 0 {
+			continue
+		}
+		if e.rr.Type == qtype || qtype == DNSTypeANY {
+			rr := e.rr
+			rr.TTL = uint32(time.Until(e.expire) / time.Second)
+			records = append(records, rr)
+		}
+	}
+	if len(alive) == 0 {
+		delete(m.cache, name)
+	} else {
+		m.cache[name] = alive
+	}
+	return records
+}
+
+// knownAnswers は問い合わせに付けるキャッシュのレコードを返す
+// TTLが半分以上残っているものだけ付ける(RFC6762 7.1)
+func (m *MDNS) knownAnswers(name string, qtype uint16) []DNSResourceRecord {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var known []DNSResourceRecord
+	for _, e := range m.cache[mdnsName(name)] {
+		if (e.rr.Type == qtype || qtype == DNSTypeANY) && e.rr.TTL != 0 && time.Until(e.expire) > e.ttl/2 {
+			rr := e.rr
+			rr.TTL = uint32(time.Until(e.expire) / time.Second)
+			known = append(known, rr)
+		}
+	}
+	return known
+}
+
+// Query はname, qtypeの問い合わせをグループに送る
+func (m *MDNS) Query(name string, qtype uint16) error {
+	return m.send(DNSMessage{
+		Questions: []DNSQuestion{{Name: name, Type: qtype, Class: DNSClassINET}},
+		Answers:   m.knownAnswers(name, qtype),
+	}, nil)
+}
+
+// Lookup はキャッシュにあればそれを返し、なければ返事が来るまで1秒, 2秒, 4秒...の間隔で問い合わせる
+func (m *MDNS) Lookup(ctx context.Context, name string, qtype uint16) ([]DNSResourceRecord, error) {
+	interval := time.Second
+	var next <-chan time.Time
+	for {
+		m.mu.Lock()
+		records := m.cached(name, qtype)
+		updated := m.updated
+		m.mu.Unlock()
+		if len(records) != 0 {
+			return records, nil
+		}
+		if next == nil {
+			if err := m.Query(name, qtype); err != nil {
+				return nil, err
+			}
+			next = time.After(interval)
+			if interval < mdnsMaxQueryInterval {
+				interval *= 2
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, &DNSError{Name: name, Server: "mdns", RCode: -1, Err: ctx.Err()}
+		case <-m.closed:
+			return nil, net.ErrClosed
+		case <-updated:
+		case <-next:
+			next = nil
+		}
+	}
+}
+
+// LookupHost はhost.localのIPv4アドレスを引く
+func (m *MDNS) LookupHost(ctx context.Context, host string) ([]string, error) {
+	records, err := m.Lookup(ctx, host, DNSTypeA)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, rr := range records {
+		if a, ok := rr.Data.(DNSA); ok {
+			addrs = append(addrs, a.Addr.String())
+		}
+	}
+	return addrs, nil
+}
+
+// randomDuration は0からmaxまでのランダムな時間を返す
+func randomDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(binary.BigEndian.Uint64(randomByte(8)) % uint64(max))
+}
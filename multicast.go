@@ -0,0 +1,335 @@
+package tcpip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"syscall"
+)
+
+// 全てのホストが入っているグループ(RFC1112)
+var allHostsGroup = []byte{224, 0, 0, 1}
+
+var ErrNotMulticast = errors.New("not a multicast address")
+
+type multicastGroupKey struct {
+	ifname string
+	group  [4]byte
+}
+
+// multicastMembership はグループへの参加の状態
+// RFC3376 3.2のフィルタモードと送信元のリストにまとめられる
+type multicastMembership struct {
+	// JoinGroupした回数。1以上なら全ての送信元から受け取る(EXCLUDE {})
+	any int
+	// JoinSourceGroupした送信元と回数。anyが0ならこの送信元からだけ受け取る(INCLUDE)
+	sources map[[4]byte]int
+}
+
+func (m *multicastMembership) empty() bool {
+	return m == nil || (m.any == 0 && len(m.sources) == 0)
+}
+
+func (m *multicastMembership) accepts(src []byte) bool {
+	if m.empty() {
+		return false
+	}
+	return m.any != 0 || m.sources[toIPv4Key(src)] != 0
+}
+
+// filter はフィルタモード(IGMPModeIsIncludeかIGMPModeIsExclude)と送信元のリストを返す
+// 参加していなければINCLUDE {}
+func (m *multicastMembership) filter() (byte, [][]byte) {
+	if m.empty() {
+		return IGMPModeIsInclude, nil
+	}
+	if m.any != 0 {
+		return IGMPModeIsExclude, nil
+	}
+	var sources [][]byte
+	for src := range m.sources {
+		sources = append(sources, append([]byte{}, src[:]...))
+	}
+	sort.Slice(sources, func(i, j int) bool { return bytes.Compare(sources[i], sources[j]) < 0 })
+	return IGMPModeIsInclude, sources
+}
+
+// join はsourceがnilならJoinGroup、そうでなければJoinSourceGroupした分を数える
+func (m *multicastMembership) join(source []byte) {
+	if source == nil {
+		m.any++
+		return
+	}
+	if m.sources == nil {
+		m.sources = make(map[[4]byte]int)
+	}
+	m.sources[toIPv4Key(source)]++
+}
+
+func (m *multicastMembership) leave(source []byte) bool {
+	if source == nil {
+		if m.any == 0 {
+			return false
+		}
+		m.any--
+		return true
+	}
+	key := toIPv4Key(source)
+	if m.sources[key] == 0 {
+		return false
+	}
+	m.sources[key]--
+	if m.sources[key] == 0 {
+		delete(m.sources, key)
+	}
+	return true
+}
+
+// multicastMacAddr はグループアドレスの下位23bitを01:00:5e:00:00:00に入れたMACアドレスを返す(RFC1112 6.4)
+func multicastMacAddr(group []byte) []byte {
+	return []byte{0x01, 0x00, 0x5e, group[1] & 0x7f, group[2], group[3]}
+}
+
+func isMulticastMacAddr(mac []byte) bool {
+	return mac[0]&0x01 != 0 && !bytes.Equal(mac, broadcastMacAddr)
+}
+
+// JoinGroup はifnameのインターフェイスで全ての送信元からのgroup宛てのパケットを受け取るようにする
+// 初めて参加したときはIGMPのReportを送る
+// 同じグループに何回も入ったときは、同じ回数LeaveGroupするまで抜けない
+func (s *Stack) JoinGroup(ifname string, group net.IP) error {
+	return s.changeMembership(ifname, group, nil, true)
+}
+
+// LeaveGroup はJoinGroupしたグループから抜ける
+func (s *Stack) LeaveGroup(ifname string, group net.IP) error {
+	return s.changeMembership(ifname, group, nil, false)
+}
+
+// JoinSourceGroup はsourceから送られたgroup宛てのパケットだけを受け取るようにする(IGMPv3, INCLUDEモード)
+// JoinGroupもしていれば全ての送信元から受け取る
+func (s *Stack) JoinSourceGroup(ifname string, group, source net.IP) error {
+	src := source.To4()
+	if src == nil || isMulticastAddr(src) {
+		return fmt.Errorf("invalid multicast source : %s", source)
+	}
+	return s.changeMembership(ifname, group, src, true)
+}
+
+// LeaveSourceGroup はJoinSourceGroupした送信元から受け取るのをやめる
+func (s *Stack) LeaveSourceGroup(ifname string, group, source net.IP) error {
+	src := source.To4()
+	if src == nil {
+		return fmt.Errorf("invalid multicast source : %s", source)
+	}
+	return s.changeMembership(ifname, group, src, false)
+}
+
+func (s *Stack) changeMembership(ifname string, group net.IP, source []byte, join bool) error {
+	key, err := s.multicastGroupKey(ifname, group)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	m, ok := s.groups[key]
+	if !ok {
+		m = &multicastMembership{}
+	}
+	oldMode, oldSources := m.filter()
+	if join {
+		m.join(source)
+	} else if !m.leave(source) {
+		s.mu.Unlock()
+		return syscall.EADDRNOTAVAIL
+	}
+	newMode, newSources := m.filter()
+	if m.empty() {
+		delete(s.groups, key)
+	} else {
+		s.groups[key] = m
+	}
+	s.mu.Unlock()
+
+	s.igmpStateChanged(ifname, key.group[:], oldMode, oldSources, newMode, newSources)
+	return nil
+}
+
+func (s *Stack) multicastGroupKey(ifname string, group net.IP) (multicastGroupKey, error) {
+	ip := group.To4()
+	if ip == nil || !isMulticastAddr(ip) {
+		return multicastGroupKey{}, fmt.Errorf("%w : %s", ErrNotMulticast, group)
+	}
+	if s.Interface(ifname) == nil {
+		return multicastGroupKey{}, fmt.Errorf("no such interface : %s", ifname)
+	}
+	return multicastGroupKey{ifname: ifname, group: toIPv4Key(ip)}, nil
+}
+
+// Groups はifnameのインターフェイスが入っているグループを返す
+func (s *Stack) Groups(ifname string) []net.IP {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var groups []net.IP
+	for key := range s.groups {
+		if key.ifname == ifname {
+			groups = append(groups, net.IP(append([]byte{}, key.group[:]...)))
+		}
+	}
+	return groups
+}
+
+// isJoinedGroup はifcがsrcからのgroup宛てを受け取るならtrue。224.0.0.1にはいつも入っている
+func (s *Stack) isJoinedGroup(ifc *NetInterface, group, src []byte) bool {
+	if bytes.Equal(group, allHostsGroup) {
+		return true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.groups[multicastGroupKey{ifname: ifc.Name, group: toIPv4Key(group)}].accepts(src)
+}
+
+// acceptMulticastMac はifcが入っているグループのマルチキャストMACアドレスならtrue
+// 23bitしか使わないので違うグループのフレームも通すが、IPの宛先でもう一度確かめる
+func (s *Stack) acceptMulticastMac(ifc *NetInterface, mac []byte) bool {
+	if bytes.Equal(mac, multicastMacAddr(allHostsGroup)) {
+		return true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for key := range s.groups {
+		if key.ifname == ifc.Name && bytes.Equal(mac, multicastMacAddr(key.group[:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// JoinGroup はifnameのインターフェイスでgroupに入る。Closeすると抜ける
+// ソケットのポートに届いたマルチキャストを受け取るには、0.0.0.0かグループのアドレスにバインドしておく
+func (c *UDPConn) JoinGroup(ifname string, group net.IP) error {
+	return c.changeMembership("join", ifname, group, nil, true)
+}
+
+// LeaveGroup はJoinGroupしたグループから抜ける
+func (c *UDPConn) LeaveGroup(ifname string, group net.IP) error {
+	return c.changeMembership("leave", ifname, group, nil, false)
+}
+
+// JoinSourceGroup はsourceから送られたgroup宛てだけを受け取るようにする
+func (c *UDPConn) JoinSourceGroup(ifname string, group, source net.IP) error {
+	return c.changeMembership("join", ifname, group, source, true)
+}
+
+// LeaveSourceGroup はJoinSourceGroupした送信元から受け取るのをやめる
+func (c *UDPConn) LeaveSourceGroup(ifname string, group, source net.IP) error {
+	return c.changeMembership("leave", ifname, group, source, false)
+}
+
+func (c *UDPConn) changeMembership(op, ifname string, group, source net.IP, join bool) error {
+	ip := group.To4()
+	if ip == nil || !isMulticastAddr(ip) {
+		return &net.OpError{Op: op, Net: "udp", Source: c.LocalAddr(), Err: ErrNotMulticast}
+	}
+	var src []byte
+	if source != nil {
+		if src = source.To4(); src == nil {
+			return &net.OpError{Op: op, Net: "udp", Source: c.LocalAddr(), Err: syscall.EINVAL}
+		}
+	}
+	key := multicastGroupKey{ifname: ifname, group: toIPv4Key(ip)}
+
+	// 先にソケットの状態を変えて、抜けるときに入っていなければStackには伝えない
+	c.mu.Lock()
+	if c.groups == nil {
+		c.groups = make(map[multicastGroupKey]*multicastMembership)
+	}
+	m, ok := c.groups[key]
+	if !ok {
+		m = &multicastMembership{}
+		c.groups[key] = m
+	}
+	if join {
+		m.join(src)
+	} else if !m.leave(src) {
+		c.mu.Unlock()
+		return &net.OpError{Op: op, Net: "udp", Source: c.LocalAddr(), Err: syscall.EADDRNOTAVAIL}
+	}
+	if m.empty() {
+		delete(c.groups, key)
+	}
+	c.mu.Unlock()
+
+	var err error
+	switch {
+	case join && src == nil:
+		err = c.stack.JoinGroup(ifname, ip)
+	case join:
+		err = c.stack.JoinSourceGroup(ifname, ip, src)
+	case src == nil:
+		err = c.stack.LeaveGroup(ifname, ip)
+	default:
+		err = c.stack.LeaveSourceGroup(ifname, ip, src)
+	}
+	if err != nil {
+		if join {
+			c.mu.Lock()
+			if m.leave(src) && m.empty() {
+				delete(c.groups, key)
+			}
+			c.mu.Unlock()
+		}
+		return &net.OpError{Op: op, Net: "udp", Source: c.LocalAddr(), Err: err}
+	}
+	return nil
+}
+
+// acceptsMulticast はソケットがsrcからのgroup宛てを受け取るならtrue
+// ソケットがそのグループに入っていなければ、インターフェイスで受け取ったものは全て渡す(LinuxのIP_MULTICAST_ALL)
+func (c *UDPConn) acceptsMulticast(ifname string, group, src []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, ok := c.groups[multicastGroupKey{ifname: ifname, group: toIPv4Key(group)}]
+	if !ok {
+		return true
+	}
+	return m.accepts(src)
+}
+
+// leaveAllGroups はCloseのときに入っているグループから全て抜ける
+func (c *UDPConn) leaveAllGroups() {
+	c.mu.Lock()
+	groups := c.groups
+	c.groups = nil
+	c.mu.Unlock()
+	for key, m := range groups {
+		group := net.IP(key.group[:])
+		for i := 0; i < m.any; i++ {
+			c.stack.LeaveGroup(key.ifname, group)
+		}
+		for src, n := range m.sources {
+			for i := 0; i < n; i++ {
+				c.stack.LeaveSourceGroup(key.ifname, group, net.IP(src[:]))
+			}
+		}
+	}
+}
+
+// multicastRoute はマルチキャストを送るインターフェイスを決める
+// MulticastInterfaceがあればそこから、なければルーティングテーブルに従って送る
+func (c *UDPConn) multicastRoute(dst []byte) (*NetInterface, []byte, error) {
+	c.mu.Lock()
+	ifname := c.MulticastInterface
+	c.mu.Unlock()
+	if ifname == "" {
+		// ゲートウェイのあるルートでも、マルチキャストは同じリンクにそのまま送る
+		ifc, _, err := c.stack.lookupRoute(dst)
+		return ifc, dst, err
+	}
+	ifc := c.stack.Interface(ifname)
+	if ifc == nil {
+		return nil, nil, fmt.Errorf("no such interface : %s", ifname)
+	}
+	return ifc, dst, nil
+}
@@ -0,0 +1,337 @@
+package tcpip
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrNATRule = errors.New("invalid nat rule")
+
+// NATType はアドレスを書き換えるルールの種類
+type NATType int
+
+const (
+	// 送信元をToAddrに変える(SNAT)
+	NATSource NATType = iota
+	// 送信元を出ていくインターフェイスのアドレスに変える
+	NATMasquerade
+	// 宛先をToAddrとToPortに変える(DNAT, ポートフォワード)
+	NATDestination
+)
+
+// NATRule は新しい接続の最初のパケットに当てはめるルール
+// 空の条件はすべてに一致する。上から順番に見て、最初に一致したものを使う
+type NATRule struct {
+	Type     NATType
+	Protocol byte
+	Source   *net.IPNet
+	Dest     *net.IPNet
+	// DNATで見る宛先ポート
+	DestPort uint16
+	// DNATは受け取ったインターフェイス、SNATとマスカレードは出ていくインターフェイスを見る
+	InInterface  string
+	OutInterface string
+
+	ToAddr net.IP
+	// DNATの変換先のポート。0ならポートは変えない
+	ToPort uint16
+	// SNATとマスカレードで使うポートの範囲。0なら1024から65535
+	PortMin, PortMax uint16
+}
+
+func (r *NATRule) match(in, out string, t ConnTuple) bool {
+	if r.Protocol != 0 && r.Protocol != t.Protocol {
+		return false
+	}
+	if r.Source != nil && !r.Source.Contains(t.SourceAddr[:]) {
+		return false
+	}
+	if r.Dest != nil && !r.Dest.Contains(t.DestAddr[:]) {
+		return false
+	}
+	if r.Type == NATDestination {
+		if r.InInterface != "" && r.InInterface != in {
+			return false
+		}
+		// ICMPのEchoにはポートがない
+		return r.DestPort == 0 || (t.Protocol != IPProtoICMP && r.DestPort == t.DestPort)
+	}
+	return r.OutInterface == "" || r.OutInterface == out
+}
+
+// NAT はアドレス変換のルール
+// Stack.NATに設定すると、Stack.ConnTrackで追跡している接続の転送するパケットを書き換える
+// ルータ自身が送受信するパケットは書き換えない
+type NAT struct {
+	mu    sync.RWMutex
+	rules []NATRule
+}
+
+func NewNAT() *NAT {
+	return &NAT{}
+}
+
+// AddRule はルールを最後に追加する
+func (n *NAT) AddRule(rule NATRule) error {
+	switch rule.Type {
+	case NATSource, NATDestination:
+		if rule.ToAddr.To4() == nil {
+			return ErrNATRule
+		}
+	case NATMasquerade:
+	default:
+		return ErrNATRule
+	}
+	if rule.PortMin == 0 && rule.PortMax == 0 {
+		rule.PortMin, rule.PortMax = 1024, 65535
+	}
+	if rule.PortMin > rule.PortMax {
+		return ErrNATRule
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.rules = append(n.rules, rule)
+	return nil
+}
+
+// AddMasquerade はifnameから出ていくパケットの送信元をそのインターフェイスのアドレスにする
+func (n *NAT) AddMasquerade(ifname string) error {
+	return n.AddRule(NATRule{Type: NATMasquerade, OutInterface: ifname})
+}
+
+// AddPortForward はifnameに届いたprotocolのport宛てをtoAddrのtoPortに転送する
+func (n *NAT) AddPortForward(ifname string, protocol byte, port uint16, toAddr net.IP, toPort uint16) error {
+	return n.AddRule(NATRule{
+		Type:        NATDestination,
+		Protocol:    protocol,
+		DestPort:    port,
+		InInterface: ifname,
+		ToAddr:      toAddr,
+		ToPort:      toPort,
+	})
+}
+
+// Rules はルールのコピーを返す
+func (n *NAT) Rules() []NATRule {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return append([]NATRule{}, n.rules...)
+}
+
+// translated はその方向のパケットが変換した後に持つタプル
+func (c *trackedConn) translated(reply bool) ConnTuple {
+	if reply {
+		return c.orig.Inverse()
+	}
+	return c.reply.Inverse()
+}
+
+// prerouting は届いたパケットの宛先を書き換える。自分宛てかどうかを決める前に呼ぶ
+// 追跡している接続の返事は元の送信元に戻し、新しい接続にはDNATのルールを当てはめる
+// 書き換えるときはコピーを返す
+func (n *NAT) prerouting(ct *ConnTrack, in *NetInterface, packet []byte, ref *connRef) []byte {
+	if ref == nil || ref.conn == nil {
+		return packet
+	}
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	c := ref.conn
+	if ref.related {
+		return translateICMPError(packet, c, ref.reply)
+	}
+	if ref.isNew {
+		n.mu.RLock()
+		for _, r := range n.rules {
+			if r.Type != NATDestination || !r.match(in.Name, "", c.orig) {
+				continue
+			}
+			copy(c.reply.SourceAddr[:], r.ToAddr.To4())
+			if r.ToPort != 0 && c.orig.Protocol != IPProtoICMP {
+				c.reply.SourcePort = r.ToPort
+			}
+			break
+		}
+		n.mu.RUnlock()
+	}
+	target := c.translated(ref.reply)
+	if target.DestAddr == ref.tuple().DestAddr && target.DestPort == ref.tuple().DestPort {
+		return packet
+	}
+	out := make([]byte, len(packet))
+	copy(out, packet)
+	natRewrite(out, false, target.DestAddr, target.DestPort)
+	return out
+}
+
+// postrouting は転送先が決まったパケットの送信元を書き換える
+// 新しい接続ならSNATかマスカレードのルールを当てはめて、返事のタプルが重ならないポートを選ぶ
+// マスカレードではoutのアドレスoutAddrに書き換える。ポートが足りないときはfalseを返す
+func (n *NAT) postrouting(ct *ConnTrack, out *NetInterface, outAddr, packet []byte, ref *connRef) bool {
+	if ref == nil || ref.conn == nil || ref.related {
+		return true
+	}
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	c := ref.conn
+	if ref.isNew {
+		n.mu.RLock()
+		defer n.mu.RUnlock()
+		for _, r := range n.rules {
+			if r.Type == NATDestination || !r.match("", out.Name, c.translated(false)) {
+				continue
+			}
+			var addr [4]byte
+			if r.Type == NATMasquerade {
+				copy(addr[:], outAddr)
+			} else {
+				copy(addr[:], r.ToAddr.To4())
+			}
+			if !allocateNATPort(ct, c, addr, r.PortMin, r.PortMax) {
+				return false
+			}
+			break
+		}
+	}
+	target := c.translated(ref.reply)
+	natRewrite(packet, true, target.SourceAddr, target.SourcePort)
+	return true
+}
+
+// tuple は変換前のパケットのタプル
+func (ref *connRef) tuple() ConnTuple {
+	if ref.reply {
+		return ref.conn.reply
+	}
+	return ref.conn.orig
+}
+
+// allocateNATPort は返事のタプルが他の接続と重ならない送信元のポートを選ぶ
+// 元のポートが空いていて範囲内ならそのまま使う
+func allocateNATPort(ct *ConnTrack, c *trackedConn, addr [4]byte, min, max uint16) bool {
+	now := time.Now()
+	t := c.reply
+	t.DestAddr = addr
+	try := func(port uint16) bool {
+		t.DestPort = port
+		if t.Protocol == IPProtoICMP {
+			t.SourcePort = port
+		}
+		if other, _ := ct.lookup(t, now); other != nil {
+			return false
+		}
+		c.reply = t
+		return true
+	}
+	if port := c.orig.SourcePort; port >= min && port <= max && try(port) {
+		return true
+	}
+	size := int(max) - int(min) + 1
+	start := rand.Intn(size)
+	for i := 0; i < size; i++ {
+		if try(min + uint16((start+i)%size)) {
+			return true
+		}
+	}
+	return false
+}
+
+// translateICMPError は接続へのICMPエラーを元の送信元に届くように書き換える
+// 引用されているのは変換した後の逆向きのパケットなので、それを変換前に戻す
+func translateICMPError(packet []byte, c *trackedConn, reply bool) []byte {
+	quoted := c.reply
+	arriving := c.orig
+	if reply {
+		quoted, arriving = c.orig, c.reply
+	}
+	target := c.translated(reply)
+
+	hlen := ipHeaderLength(packet)
+	out := make([]byte, len(packet))
+	copy(out, packet)
+	inner := out[hlen+8:]
+	natRewrite(inner, true, quoted.SourceAddr, quoted.SourcePort)
+	natRewrite(inner, false, quoted.DestAddr, quoted.DestPort)
+
+	// 途中のルータではなく相手のホスト自身が返したエラーなら、送信元も書き換える
+	if [4]byte{out[12], out[13], out[14], out[15]} == arriving.SourceAddr {
+		natSetAddr(out, 12, target.SourceAddr, out[10:12])
+	}
+	natSetAddr(out, 16, target.DestAddr, out[10:12])
+
+	// 引用の中身が変わったので、ICMPのチェックサムは計算し直す
+	icmp := out[hlen:]
+	icmp[2], icmp[3] = 0, 0
+	b := icmp
+	if len(b)%2 != 0 {
+		b = paddingZero(b)
+	}
+	copy(icmp[2:4], checksum(sumByteArr(b)))
+	return out
+}
+
+// natSetWord はpacket[off:off+2]をvに書き換え、sumsのチェックサムを差分で直す
+func natSetWord(packet []byte, off int, v uint16, sums ...[]byte) {
+	old := binary.BigEndian.Uint16(packet[off:])
+	if old == v {
+		return
+	}
+	binary.BigEndian.PutUint16(packet[off:], v)
+	for _, sum := range sums {
+		if sum != nil {
+			copy(sum, updateChecksum(sum, old, v))
+		}
+	}
+}
+
+func natSetAddr(packet []byte, off int, addr [4]byte, sums ...[]byte) {
+	natSetWord(packet, off, binary.BigEndian.Uint16(addr[0:2]), sums...)
+	natSetWord(packet, off+2, binary.BigEndian.Uint16(addr[2:4]), sums...)
+}
+
+// natRewrite は送信元(srcがtrue)か宛先のアドレスとポートを書き換える
+// TCPとUDPのチェックサムは疑似ヘッダのアドレスの分も直す。ICMPのEchoはIdentifierを書き換える
+// ICMPエラーに引用されたパケットは途中で切れていることがあるので、ない部分は触らない
+func natRewrite(packet []byte, src bool, addr [4]byte, port uint16) {
+	hlen := ipHeaderLength(packet)
+	ipSum := packet[10:12]
+	addrOff, portOff := 16, hlen+2
+	if src {
+		addrOff, portOff = 12, hlen
+	}
+	// 2番目以降のフラグメントにはTCPやUDPのヘッダがないので、アドレスだけ書き換える
+	// チェックサムは最初のフラグメントで疑似ヘッダの分まで直してある
+	if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+		natSetAddr(packet, addrOff, addr, ipSum)
+		return
+	}
+	var l4Sum []byte
+	switch packet[9] {
+	case IPProtoTCP:
+		if len(packet) >= hlen+18 {
+			l4Sum = packet[hlen+16 : hlen+18]
+		}
+	case IPProtoUDP:
+		// 0はチェックサムなし
+		if len(packet) >= hlen+8 && binary.BigEndian.Uint16(packet[hlen+6:]) != 0 {
+			l4Sum = packet[hlen+6 : hlen+8]
+		}
+	case IPProtoICMP:
+		natSetAddr(packet, addrOff, addr, ipSum)
+		if len(packet) >= hlen+8 {
+			natSetWord(packet, hlen+4, port, packet[hlen+2:hlen+4])
+		}
+		return
+	}
+	natSetAddr(packet, addrOff, addr, ipSum, l4Sum)
+	if len(packet) >= portOff+2 {
+		natSetWord(packet, portOff, port, l4Sum)
+	}
+	// UDPでは計算した結果の0は0xffffで送る
+	if packet[9] == IPProtoUDP && l4Sum != nil && l4Sum[0] == 0 && l4Sum[1] == 0 {
+		l4Sum[0], l4Sum[1] = 0xff, 0xff
+	}
+}
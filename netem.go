@@ -0,0 +1,511 @@
+package tcpip
+
+import (
+	"container/heap"
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var ErrNetemConfig = errors.New("invalid netem config")
+
+// NetemDistribution は遅延のばらつきの分布
+type NetemDistribution int
+
+const (
+	// Delay±Jitterの一様分布
+	DistributionUniform NetemDistribution = iota
+	// Jitterを標準偏差にした正規分布
+	DistributionNormal
+	// 遅い方に長く裾を引くパレート分布
+	DistributionPareto
+	// 正規分布とパレート分布を3:1で混ぜたもの
+	DistributionParetoNormal
+)
+
+// GilbertElliott はバーストロスのモデル
+// Goodの状態とBadの状態を行き来して、それぞれの状態のロス率で捨てる
+// Simple GilbertモデルならLossGood=0, LossBad=1にする
+type GilbertElliott struct {
+	// GoodからBadに移る確率
+	P float64
+	// BadからGoodに戻る確率
+	R float64
+	// それぞれの状態でのロス率
+	LossGood float64
+	LossBad  float64
+}
+
+// NetemConfig はリンクに加える障害。ゼロ値なら何もしない
+// 確率はすべて0から1
+type NetemConfig struct {
+	Delay  time.Duration
+	Jitter time.Duration
+	// Jitterの分布
+	Distribution NetemDistribution
+	// 直前の遅延のばらつきとの相関(0から1)
+	DelayCorrelation float64
+
+	// ランダムに捨てる割合
+	Loss float64
+	// nilでなければLossの代わりにこのモデルで捨てる
+	GilbertElliott *GilbertElliott
+	// もう1つ同じフレームを送る割合
+	Duplicate float64
+	// Ethernetヘッダより後ろの1bitを反転させる割合
+	Corrupt float64
+	// 遅延させずにすぐ送って、前のフレームを追い越させる割合(Delayが必要)
+	Reorder float64
+
+	// 帯域(bit/s)。0なら制限しない
+	Rate int64
+	// トークンバケツの大きさ(byte)。0なら1フレーム分
+	Burst int
+	// 送るのを待っていられるフレームの数。超えたら捨てる。0なら1000
+	Limit int
+}
+
+func (c NetemConfig) valid() bool {
+	for _, p := range []float64{c.DelayCorrelation, c.Loss, c.Duplicate, c.Corrupt, c.Reorder} {
+		if p < 0 || p > 1 {
+			return false
+		}
+	}
+	if ge := c.GilbertElliott; ge != nil {
+		for _, p := range []float64{ge.P, ge.R, ge.LossGood, ge.LossBad} {
+			if p < 0 || p > 1 {
+				return false
+			}
+		}
+	}
+	return c.Delay >= 0 && c.Jitter >= 0 && c.Rate >= 0 && c.Burst >= 0 && c.Limit >= 0 &&
+		c.Distribution >= DistributionUniform && c.Distribution <= DistributionParetoNormal
+}
+
+func (c NetemConfig) isZero() bool {
+	return c.Delay == 0 && c.Jitter == 0 && c.Loss == 0 && c.GilbertElliott == nil &&
+		c.Duplicate == 0 && c.Corrupt == 0 && c.Reorder == 0 && c.Rate == 0
+}
+
+// NetemStats はそれぞれの方向で数えたフレームの数
+type NetemStats struct {
+	// 相手に渡したフレーム。複製したものも含む
+	Delivered  int
+	Lost       int
+	Duplicated int
+	Corrupted  int
+	Reordered  int
+	// Limitを超えて捨てた
+	Overflow int
+	// 下のリンクに渡そうとしてエラーになった
+	Errors int
+}
+
+// NetemLinkEndpoint はLinuxのnetemのようにリンクに遅延やロスを加える
+// 送る方向(Egress)と受け取る方向(Ingress)に別々の設定ができ、送受信しながら変えられる
+type NetemLinkEndpoint struct {
+	link    LinkEndpoint
+	egress  *netemQueue
+	ingress *netemQueue
+	in      chan []byte
+
+	closed chan struct{}
+	once   sync.Once
+	// 下のリンクから読めなくなったときのエラー
+	readErr  error
+	readDone chan struct{}
+}
+
+// NewNetemLinkEndpoint はlinkを包む。SetEgressかSetIngressするまでは何もしない
+func NewNetemLinkEndpoint(link LinkEndpoint) *NetemLinkEndpoint {
+	l := &NetemLinkEndpoint{
+		link:     link,
+		in:       make(chan []byte, 256),
+		closed:   make(chan struct{}),
+		readDone: make(chan struct{}),
+	}
+	l.egress = newNetemQueue(l.closed, link.WriteFrame)
+	l.ingress = newNetemQueue(l.closed, func(frame []byte) error {
+		select {
+		case l.in <- frame:
+			return nil
+		case <-l.closed:
+			return ErrLinkClosed
+		}
+	})
+	go l.egress.run()
+	go l.ingress.run()
+	go l.readLoop()
+	return l
+}
+
+func (l *NetemLinkEndpoint) readLoop() {
+	defer close(l.readDone)
+	for {
+		frame, err := l.link.ReadFrame()
+		if err != nil {
+			l.readErr = err
+			return
+		}
+		l.ingress.enqueue(frame)
+	}
+}
+
+// SetEgress は送るフレームに加える障害を変える
+func (l *NetemLinkEndpoint) SetEgress(cfg NetemConfig) error {
+	return l.egress.setConfig(cfg)
+}
+
+// SetIngress は受け取るフレームに加える障害を変える
+func (l *NetemLinkEndpoint) SetIngress(cfg NetemConfig) error {
+	return l.ingress.setConfig(cfg)
+}
+
+func (l *NetemLinkEndpoint) EgressStats() NetemStats {
+	return l.egress.statistics()
+}
+
+func (l *NetemLinkEndpoint) IngressStats() NetemStats {
+	return l.ingress.statistics()
+}
+
+// Seed は乱数の種を決める。テストで同じ順番にロスさせたいときに使う
+func (l *NetemLinkEndpoint) Seed(seed int64) {
+	l.egress.seed(seed)
+	l.ingress.seed(seed + 1)
+}
+
+func (l *NetemLinkEndpoint) WriteFrame(frame []byte) error {
+	select {
+	case <-l.closed:
+		return ErrLinkClosed
+	default:
+	}
+	b := make([]byte, len(frame))
+	copy(b, frame)
+	return l.egress.enqueue(b)
+}
+
+func (l *NetemLinkEndpoint) ReadFrame() ([]byte, error) {
+	select {
+	case frame := <-l.in:
+		return frame, nil
+	case <-l.closed:
+		return nil, ErrLinkClosed
+	case <-l.readDone:
+		// 遅らせているフレームがあれば先に返す
+		select {
+		case frame := <-l.in:
+			return frame, nil
+		default:
+			return nil, l.readErr
+		}
+	}
+}
+
+func (l *NetemLinkEndpoint) MTU() int {
+	return l.link.MTU()
+}
+
+// Close は遅らせているフレームを捨てて下のリンクを閉じる
+func (l *NetemLinkEndpoint) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return l.link.Close()
+}
+
+// netemFrame は送る時刻を待っているフレーム
+type netemFrame struct {
+	at    time.Time
+	seq   uint64
+	frame []byte
+}
+
+// netemHeap は送る時刻が早い順、同じなら入れた順に並べる
+type netemHeap []netemFrame
+
+func (h netemHeap) Len() int { return len(h) }
+func (h netemHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+func (h netemHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *netemHeap) Push(x interface{}) { *h = append(*h, x.(netemFrame)) }
+func (h *netemHeap) Pop() interface{} {
+	old := *h
+	f := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return f
+}
+
+// netemQueue は片方向の障害。遅延の時刻を待つヒープと、帯域を待つFIFOの2段になっている
+type netemQueue struct {
+	deliver func([]byte) error
+	closed  chan struct{}
+	wake    chan struct{}
+
+	mu      sync.Mutex
+	cfg     NetemConfig
+	rnd     *rand.Rand
+	stats   NetemStats
+	delayed netemHeap
+	fifo    [][]byte
+	seq     uint64
+	// Gilbert-ElliottでBadの状態か
+	bad bool
+	// 直前の遅延のばらつき(Jitterを1とした値)
+	lastJitter float64
+	// トークンバケツ
+	tokens   float64
+	refilled time.Time
+	// 最後に遅延させたフレームの送る時刻。Reorderで追い越したかを数える
+	lastAt time.Time
+	// 取り出して下のリンクに渡している途中のフレームの数
+	delivering int
+}
+
+func newNetemQueue(closed chan struct{}, deliver func([]byte) error) *netemQueue {
+	return &netemQueue{
+		deliver: deliver,
+		closed:  closed,
+		wake:    make(chan struct{}, 1),
+		rnd:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (q *netemQueue) setConfig(cfg NetemConfig) error {
+	if !cfg.valid() {
+		return ErrNetemConfig
+	}
+	if cfg.GilbertElliott != nil {
+		ge := *cfg.GilbertElliott
+		cfg.GilbertElliott = &ge
+	}
+	q.mu.Lock()
+	q.cfg = cfg
+	if cfg.GilbertElliott == nil {
+		q.bad = false
+	}
+	q.mu.Unlock()
+	q.notify()
+	return nil
+}
+
+func (q *netemQueue) statistics() NetemStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.stats
+}
+
+func (q *netemQueue) seed(seed int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rnd = rand.New(rand.NewSource(seed))
+}
+
+func (q *netemQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// enqueue はフレームに障害を加えて待ち行列に入れる
+// 何も設定されていなくて待っているフレームも渡している途中のフレームもなければ、そのまま渡す
+func (q *netemQueue) enqueue(frame []byte) error {
+	q.mu.Lock()
+	cfg := q.cfg
+	if cfg.isZero() && len(q.delayed) == 0 && len(q.fifo) == 0 && q.delivering == 0 {
+		q.delivering++
+		q.mu.Unlock()
+		err := q.deliver(frame)
+		q.delivered(err)
+		return err
+	}
+	defer q.notify()
+	defer q.mu.Unlock()
+
+	if q.lose() {
+		q.stats.Lost++
+		return nil
+	}
+	copies := 1
+	if cfg.Duplicate > 0 && q.rnd.Float64() < cfg.Duplicate {
+		copies = 2
+		q.stats.Duplicated++
+	}
+	limit := cfg.Limit
+	if limit == 0 {
+		limit = 1000
+	}
+	now := time.Now()
+	for i := 0; i < copies; i++ {
+		if len(q.delayed)+len(q.fifo) >= limit {
+			q.stats.Overflow++
+			continue
+		}
+		f := frame
+		if i == 1 {
+			f = append([]byte{}, frame...)
+		}
+		if cfg.Corrupt > 0 && len(f) > 14 && q.rnd.Float64() < cfg.Corrupt {
+			if i == 0 && copies == 2 {
+				f = append([]byte{}, frame...)
+			}
+			bit := 14*8 + q.rnd.Intn((len(f)-14)*8)
+			f[bit/8] ^= 1 << uint(bit%8)
+			q.stats.Corrupted++
+		}
+		at := now
+		if cfg.Reorder > 0 && q.rnd.Float64() < cfg.Reorder {
+			if at.Before(q.lastAt) {
+				q.stats.Reordered++
+			}
+		} else {
+			at = now.Add(q.delay())
+			q.lastAt = at
+		}
+		q.seq++
+		heap.Push(&q.delayed, netemFrame{at: at, seq: q.seq, frame: f})
+	}
+	return nil
+}
+
+// lose はフレームを捨てるか決める
+func (q *netemQueue) lose() bool {
+	ge := q.cfg.GilbertElliott
+	if ge == nil {
+		return q.cfg.Loss > 0 && q.rnd.Float64() < q.cfg.Loss
+	}
+	if q.bad {
+		if q.rnd.Float64() < ge.R {
+			q.bad = false
+		}
+	} else if q.rnd.Float64() < ge.P {
+		q.bad = true
+	}
+	loss := ge.LossGood
+	if q.bad {
+		loss = ge.LossBad
+	}
+	return loss > 0 && q.rnd.Float64() < loss
+}
+
+// delay はDelayに分布に従ったばらつきを足す。負にはしない
+func (q *netemQueue) delay() time.Duration {
+	cfg := q.cfg
+	if cfg.Jitter == 0 {
+		return cfg.Delay
+	}
+	var j float64
+	switch cfg.Distribution {
+	case DistributionUniform:
+		j = q.rnd.Float64()*2 - 1
+	case DistributionNormal:
+		j = q.rnd.NormFloat64()
+	case DistributionPareto:
+		j = q.pareto()
+	case DistributionParetoNormal:
+		j = (3*q.rnd.NormFloat64() + q.pareto()) / 4
+	}
+	j = cfg.DelayCorrelation*q.lastJitter + (1-cfg.DelayCorrelation)*j
+	q.lastJitter = j
+	d := cfg.Delay + time.Duration(j*float64(cfg.Jitter))
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// pareto は形状母数3のパレート分布を平均0、標準偏差1にしたもの
+func (q *netemQueue) pareto() float64 {
+	const alpha = 3.0
+	mean := alpha / (alpha - 1)
+	stddev := math.Sqrt(alpha/(alpha-2)) / (alpha - 1)
+	x := math.Pow(1-q.rnd.Float64(), -1/alpha)
+	return (x - mean) / stddev
+}
+
+// run は時刻になったフレームをFIFOに移し、トークンがあれば渡す
+func (q *netemQueue) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		frame, wait := q.next(time.Now())
+		if frame != nil {
+			q.delivered(q.deliver(frame))
+			continue
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-q.closed:
+			return
+		case <-q.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// next は今渡せるフレームを返す。なければ次に見直すまでの時間を返す
+func (q *netemQueue) next(now time.Time) ([]byte, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.delayed) != 0 && !q.delayed[0].at.After(now) {
+		q.fifo = append(q.fifo, heap.Pop(&q.delayed).(netemFrame).frame)
+	}
+	wait := time.Hour
+	if len(q.delayed) != 0 {
+		wait = q.delayed[0].at.Sub(now)
+	}
+	if len(q.fifo) == 0 {
+		return nil, wait
+	}
+
+	frame := q.fifo[0]
+	if q.cfg.Rate > 0 {
+		bytesPerSec := float64(q.cfg.Rate) / 8
+		burst := float64(q.cfg.Burst)
+		if burst < float64(len(frame)) {
+			burst = float64(len(frame))
+		}
+		q.tokens += now.Sub(q.refilled).Seconds() * bytesPerSec
+		if q.tokens > burst {
+			q.tokens = burst
+		}
+		q.refilled = now
+		if q.tokens < float64(len(frame)) {
+			need := time.Duration((float64(len(frame)) - q.tokens) / bytesPerSec * float64(time.Second))
+			if need < wait {
+				wait = need
+			}
+			return nil, wait
+		}
+		q.tokens -= float64(len(frame))
+	}
+	q.fifo[0] = nil
+	q.fifo = q.fifo[1:]
+	// 渡し終わるまでは後から来たフレームがそのまま渡されて追い越さないようにする
+	q.delivering++
+	return frame, 0
+}
+
+// delivered は下のリンクに渡し終わったフレームを数える
+func (q *netemQueue) delivered(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.delivering--
+	if err != nil {
+		q.stats.Errors++
+		return
+	}
+	q.stats.Delivered++
+}
@@ -7,11 +7,8 @@ type RawPacket struct {
 }
 
 func parseEth(packet []byte) EthernetFrame {
-	return EthernetFrame{
-		DstMacAddr:    packet[0:6],
-		SourceMacAddr: packet[6:12],
-		Type:          packet[13:],
-	}
+	eth, _ := parseEthernet(packet)
+	return eth
 }
 
 func parseIP(packet []byte) IPHeader {
@@ -49,9 +46,11 @@ func parseTCP(packet []byte) TCPHeader {
 }
 
 func parsePacket(packet []byte) RawPacket {
-	eth := parseEth(packet[0:14])
-	ip := parseIP(packet[14:34])
-	tcp := parseTCP(packet[34:])
+	eth := parseEth(packet)
+	// VLANタグとIPオプションの分だけずらす
+	packet = packet[eth.HeaderLength():]
+	ip := parseIP(packet[0:20])
+	tcp := parseTCP(packet[ipHeaderLength(packet):])
 
 	return RawPacket{
 		ethPacket: eth,
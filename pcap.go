@@ -0,0 +1,505 @@
+package tcpip
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// LINKTYPE_ETHERNET
+const PcapLinkTypeEthernet = 1
+
+// pcapngのブロックの種類
+// https://datatracker.ietf.org/doc/html/draft-ietf-opsawg-pcapng
+const (
+	pcapngSectionHeader   = 0x0a0d0d0a
+	pcapngInterfaceDesc   = 0x00000001
+	pcapngSimplePacket    = 0x00000003
+	pcapngEnhancedPacket  = 0x00000006
+	pcapngByteOrderMagic  = 0x1a2b3c4d
+	pcapngOptEnd          = 0
+	pcapngOptShbUserAppl  = 4
+	pcapngOptIfName       = 2
+	pcapngOptIfTsresol    = 9
+	pcapngOptEpbFlags     = 2
+	pcapngDefaultSnapLen  = 262144
+	pcapMagicMicroseconds = 0xa1b2c3d4
+	pcapMagicNanoseconds  = 0xa1b23c4d
+)
+
+// パケットの向き(epb_flagsの下位2bit)
+const (
+	PcapDirectionUnknown  = 0
+	PcapDirectionInbound  = 1
+	PcapDirectionOutbound = 2
+)
+
+var ErrInvalidPcap = errors.New("invalid pcap file")
+
+// PcapngWriter はWiresharkで開けるpcapngのファイルを書く
+// 複数のgoroutineから同時に書いてもいい
+type PcapngWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	ifaces int
+}
+
+// NewPcapngWriter はSection Header Blockを書いてWriterを作る
+func NewPcapngWriter(w io.Writer) (*PcapngWriter, error) {
+	pw := &PcapngWriter{w: w}
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:4], pcapngByteOrderMagic)
+	// バージョン1.0
+	binary.LittleEndian.PutUint16(body[4:6], 1)
+	binary.LittleEndian.PutUint16(body[6:8], 0)
+	// セクションの長さは分からないので-1
+	binary.LittleEndian.PutUint64(body[8:16], math.MaxUint64)
+	body = append(body, pcapngOptions([]pcapngOption{{pcapngOptShbUserAppl, []byte("go-tcpip")}})...)
+	if err := pw.writeBlock(pcapngSectionHeader, body); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// AddInterface はInterface Description Blockを書いて、WritePacketで使うインターフェイスの番号を返す
+// タイムスタンプはナノ秒で書く
+func (w *PcapngWriter) AddInterface(name string, linkType uint16) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:2], linkType)
+	binary.LittleEndian.PutUint32(body[4:8], pcapngDefaultSnapLen)
+	body = append(body, pcapngOptions([]pcapngOption{
+		{pcapngOptIfName, []byte(name)},
+		{pcapngOptIfTsresol, []byte{9}},
+	})...)
+	if err := w.writeBlockLocked(pcapngInterfaceDesc, body); err != nil {
+		return 0, err
+	}
+	w.ifaces++
+	return w.ifaces - 1, nil
+}
+
+// WritePacket はEnhanced Packet Blockを1つ書く
+// directionはPcapDirectionInboundかPcapDirectionOutbound
+func (w *PcapngWriter) WritePacket(ifid int, ts time.Time, data []byte, direction int) error {
+	body := make([]byte, 20)
+	ns := uint64(ts.UnixNano())
+	binary.LittleEndian.PutUint32(body[0:4], uint32(ifid))
+	binary.LittleEndian.PutUint32(body[4:8], uint32(ns>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(ns))
+	binary.LittleEndian.PutUint32(body[12:16], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:20], uint32(len(data)))
+	body = append(body, data...)
+	body = append(body, make([]byte, pad4(len(data)))...)
+	if direction != PcapDirectionUnknown {
+		flags := make([]byte, 4)
+		binary.LittleEndian.PutUint32(flags, uint32(direction))
+		body = append(body, pcapngOptions([]pcapngOption{{pcapngOptEpbFlags, flags}})...)
+	}
+	return w.writeBlock(pcapngEnhancedPacket, body)
+}
+
+func (w *PcapngWriter) writeBlock(blockType uint32, body []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writeBlockLocked(blockType, body)
+}
+
+// writeBlockLocked はブロックの種類と長さで本体を挟んで書く
+func (w *PcapngWriter) writeBlockLocked(blockType uint32, body []byte) error {
+	length := uint32(12 + len(body))
+	b := make([]byte, 8, length)
+	binary.LittleEndian.PutUint32(b[0:4], blockType)
+	binary.LittleEndian.PutUint32(b[4:8], length)
+	b = append(b, body...)
+	b = append(b, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(b[length-4:], length)
+	_, err := w.w.Write(b)
+	return err
+}
+
+type pcapngOption struct {
+	code  uint16
+	value []byte
+}
+
+// pcapngOptions はオプションを4byteに揃えて並べ、最後にopt_endofoptを付ける
+func pcapngOptions(opts []pcapngOption) []byte {
+	var b []byte
+	for _, opt := range opts {
+		h := make([]byte, 4)
+		binary.LittleEndian.PutUint16(h[0:2], opt.code)
+		binary.LittleEndian.PutUint16(h[2:4], uint16(len(opt.value)))
+		b = append(b, h...)
+		b = append(b, opt.value...)
+		b = append(b, make([]byte, pad4(len(opt.value)))...)
+	}
+	return append(b, 0, 0, 0, 0)
+}
+
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
+
+// PcapPacket はファイルから読んだパケット
+type PcapPacket struct {
+	Timestamp time.Time
+	// pcapngのインターフェイスの番号と名前。pcapなら0と空
+	InterfaceID   int
+	InterfaceName string
+	LinkType      uint16
+	Data          []byte
+	// キャプチャする前の長さ。snaplenで切られていればlen(Data)より長い
+	OriginalLength int
+	Direction      int
+}
+
+type pcapngInterface struct {
+	name     string
+	linkType uint16
+	// 1秒あたりのタイムスタンプの単位の数
+	unitsPerSecond uint64
+}
+
+// PcapReader はpcapとpcapngのファイルを読む。どちらかは先頭のマジックナンバーで見分ける
+type PcapReader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	ng    bool
+	// pcapのとき
+	linkType       uint16
+	unitsPerSecond uint64
+	// pcapngのとき。Section Header Blockが来るたびに作り直す
+	ifaces []pcapngInterface
+}
+
+func NewPcapReader(r io.Reader) (*PcapReader, error) {
+	pr := &PcapReader{r: bufio.NewReader(r)}
+	magic, err := pr.r.Peek(4)
+	if err != nil {
+		return nil, ErrInvalidPcap
+	}
+	if binary.LittleEndian.Uint32(magic) == pcapngSectionHeader {
+		pr.ng = true
+		return pr, nil
+	}
+
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(pr.r, header); err != nil {
+		return nil, ErrInvalidPcap
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(header[0:4]) {
+		case pcapMagicMicroseconds:
+			pr.order, pr.unitsPerSecond = order, 1000000
+		case pcapMagicNanoseconds:
+			pr.order, pr.unitsPerSecond = order, 1000000000
+		}
+	}
+	if pr.order == nil {
+		return nil, ErrInvalidPcap
+	}
+	pr.linkType = uint16(pr.order.Uint32(header[20:24]))
+	return pr, nil
+}
+
+// Next は次のパケットを返す。読み終わったらio.EOF
+func (r *PcapReader) Next() (PcapPacket, error) {
+	if r.ng {
+		return r.nextBlock()
+	}
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return PcapPacket{}, ErrInvalidPcap
+		}
+		return PcapPacket{}, err
+	}
+	capLen := r.order.Uint32(header[8:12])
+	if capLen > pcapngDefaultSnapLen {
+		return PcapPacket{}, ErrInvalidPcap
+	}
+	data := make([]byte, capLen)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return PcapPacket{}, ErrInvalidPcap
+	}
+	sec, frac := uint64(r.order.Uint32(header[0:4])), uint64(r.order.Uint32(header[4:8]))
+	return PcapPacket{
+		Timestamp:      time.Unix(int64(sec), int64(frac*1000000000/r.unitsPerSecond)),
+		LinkType:       r.linkType,
+		Data:           data,
+		OriginalLength: int(r.order.Uint32(header[12:16])),
+	}, nil
+}
+
+// nextBlock はパケットのブロックが出てくるまでブロックを読む
+// 知らないブロックは飛ばす
+func (r *PcapReader) nextBlock() (PcapPacket, error) {
+	for {
+		head := make([]byte, 8)
+		if _, err := io.ReadFull(r.r, head); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return PcapPacket{}, ErrInvalidPcap
+			}
+			return PcapPacket{}, err
+		}
+		// Section Header Blockはバイトオーダーが分かる前に読む
+		if binary.LittleEndian.Uint32(head[0:4]) == pcapngSectionHeader {
+			magic, err := r.r.Peek(4)
+			if err != nil {
+				return PcapPacket{}, ErrInvalidPcap
+			}
+			switch uint32(pcapngByteOrderMagic) {
+			case binary.LittleEndian.Uint32(magic):
+				r.order = binary.LittleEndian
+			case binary.BigEndian.Uint32(magic):
+				r.order = binary.BigEndian
+			default:
+				return PcapPacket{}, ErrInvalidPcap
+			}
+			r.ifaces = nil
+		}
+		if r.order == nil {
+			return PcapPacket{}, ErrInvalidPcap
+		}
+		length := r.order.Uint32(head[4:8])
+		if length < 12 || length%4 != 0 || length > 16*1024*1024 {
+			return PcapPacket{}, ErrInvalidPcap
+		}
+		body := make([]byte, length-8)
+		if _, err := io.ReadFull(r.r, body); err != nil {
+			return PcapPacket{}, ErrInvalidPcap
+		}
+		body = body[:len(body)-4]
+
+		switch r.order.Uint32(head[0:4]) {
+		case pcapngInterfaceDesc:
+			if len(body) < 8 {
+				return PcapPacket{}, ErrInvalidPcap
+			}
+			iface := pcapngInterface{linkType: r.order.Uint16(body[0:2]), unitsPerSecond: 1000000}
+			for _, opt := range r.parseOptions(body[8:]) {
+				switch opt.code {
+				case pcapngOptIfName:
+					iface.name = string(opt.value)
+				case pcapngOptIfTsresol:
+					if len(opt.value) == 1 {
+						units, ok := tsresolUnits(opt.value[0])
+						if !ok {
+							return PcapPacket{}, ErrInvalidPcap
+						}
+						iface.unitsPerSecond = units
+					}
+				}
+			}
+			r.ifaces = append(r.ifaces, iface)
+		case pcapngEnhancedPacket:
+			return r.parseEnhancedPacket(body)
+		case pcapngSimplePacket:
+			if len(body) < 4 || len(r.ifaces) == 0 {
+				return PcapPacket{}, ErrInvalidPcap
+			}
+			origLen := int(r.order.Uint32(body[0:4]))
+			data := body[4:]
+			if len(data) > origLen {
+				data = data[:origLen]
+			}
+			return PcapPacket{
+				InterfaceName:  r.ifaces[0].name,
+				LinkType:       r.ifaces[0].linkType,
+				Data:           data,
+				OriginalLength: origLen,
+			}, nil
+		}
+	}
+}
+
+func (r *PcapReader) parseEnhancedPacket(body []byte) (PcapPacket, error) {
+	if len(body) < 20 {
+		return PcapPacket{}, ErrInvalidPcap
+	}
+	ifid := int(r.order.Uint32(body[0:4]))
+	if ifid >= len(r.ifaces) {
+		return PcapPacket{}, fmt.Errorf("%w: unknown interface %d", ErrInvalidPcap, ifid)
+	}
+	iface := r.ifaces[ifid]
+	ts := uint64(r.order.Uint32(body[4:8]))<<32 | uint64(r.order.Uint32(body[8:12]))
+	capLen := int(r.order.Uint32(body[12:16]))
+	if 20+capLen > len(body) {
+		return PcapPacket{}, ErrInvalidPcap
+	}
+	p := PcapPacket{
+		Timestamp:      pcapTimestamp(ts, iface.unitsPerSecond),
+		InterfaceID:    ifid,
+		InterfaceName:  iface.name,
+		LinkType:       iface.linkType,
+		Data:           body[20 : 20+capLen],
+		OriginalLength: int(r.order.Uint32(body[16:20])),
+	}
+	for _, opt := range r.parseOptions(body[20+capLen+pad4(capLen):]) {
+		if opt.code == pcapngOptEpbFlags && len(opt.value) == 4 {
+			p.Direction = int(r.order.Uint32(opt.value) & 0x03)
+		}
+	}
+	return p, nil
+}
+
+func (r *PcapReader) parseOptions(b []byte) []pcapngOption {
+	var opts []pcapngOption
+	for len(b) >= 4 {
+		code, length := r.order.Uint16(b[0:2]), int(r.order.Uint16(b[2:4]))
+		if code == pcapngOptEnd || 4+length > len(b) {
+			break
+		}
+		opts = append(opts, pcapngOption{code: code, value: b[4 : 4+length]})
+		b = b[4+length+pad4(length):]
+	}
+	return opts
+}
+
+// tsresolUnits はif_tsresolを1秒あたりの単位の数にする
+// 最上位bitが0なら10のマイナスn乗秒、1なら2のマイナスn乗秒
+// uint64に収まらない(10^19や2^63より細かい)ときはfalseを返す
+func tsresolUnits(v byte) (uint64, bool) {
+	if v&0x80 != 0 {
+		if v&0x7f > 63 {
+			return 0, false
+		}
+		return 1 << (v & 0x7f), true
+	}
+	if v > 19 {
+		return 0, false
+	}
+	units := uint64(1)
+	for i := byte(0); i < v; i++ {
+		units *= 10
+	}
+	return units, true
+}
+
+func pcapTimestamp(ts, unitsPerSecond uint64) time.Time {
+	sec := ts / unitsPerSecond
+	frac := ts % unitsPerSecond
+	return time.Unix(int64(sec), int64(float64(frac)*1e9/float64(unitsPerSecond)))
+}
+
+// CaptureLinkEndpoint はリンクで送受信したフレームをpcapngに書き出しながら中継する
+type CaptureLinkEndpoint struct {
+	link LinkEndpoint
+	w    *PcapngWriter
+	ifid int
+}
+
+// NewCaptureLinkEndpoint はlinkをnameという名前のインターフェイスとしてwに書き出す
+// NetInterfaceのLinkにしてからAddInterfaceする
+func NewCaptureLinkEndpoint(link LinkEndpoint, w *PcapngWriter, name string) (*CaptureLinkEndpoint, error) {
+	ifid, err := w.AddInterface(name, PcapLinkTypeEthernet)
+	if err != nil {
+		return nil, err
+	}
+	return &CaptureLinkEndpoint{link: link, w: w, ifid: ifid}, nil
+}
+
+// 書き出せなくても送受信は止めない
+func (l *CaptureLinkEndpoint) WriteFrame(frame []byte) error {
+	l.w.WritePacket(l.ifid, time.Now(), frame, PcapDirectionOutbound)
+	return l.link.WriteFrame(frame)
+}
+
+func (l *CaptureLinkEndpoint) ReadFrame() ([]byte, error) {
+	frame, err := l.link.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	l.w.WritePacket(l.ifid, time.Now(), frame, PcapDirectionInbound)
+	return frame, nil
+}
+
+func (l *CaptureLinkEndpoint) MTU() int {
+	return l.link.MTU()
+}
+
+func (l *CaptureLinkEndpoint) Close() error {
+	return l.link.Close()
+}
+
+// PcapReplayLinkEndpoint はファイルのEthernetフレームをReadFrameで順に返すリンク
+// AddInterfaceするとStackが受け取ったフレームとして処理する。自分宛てのフレームだけ受け取るので、
+// NetInterfaceのMACアドレスはキャプチャしたホストに合わせておく
+// 読み終わるとReadFrameがio.EOFを返して受信が止まる。送ったフレームは捨てる
+type PcapReplayLinkEndpoint struct {
+	r   *PcapReader
+	mtu int
+	// trueならキャプチャしたときと同じ間隔を空けて返す
+	Realtime bool
+	// 空でなければこの名前のインターフェイスのパケットだけ返す
+	Interface string
+	// trueなら送信したパケット(PcapDirectionOutbound)も返す
+	IncludeOutbound bool
+
+	mu     sync.Mutex
+	prev   time.Time
+	sent   time.Time
+	closed chan struct{}
+	once   sync.Once
+}
+
+func NewPcapReplayLinkEndpoint(r *PcapReader, mtu int) *PcapReplayLinkEndpoint {
+	return &PcapReplayLinkEndpoint{r: r, mtu: mtu, closed: make(chan struct{})}
+}
+
+func (l *PcapReplayLinkEndpoint) WriteFrame(frame []byte) error {
+	select {
+	case <-l.closed:
+		return ErrLinkClosed
+	default:
+		return nil
+	}
+}
+
+func (l *PcapReplayLinkEndpoint) ReadFrame() ([]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for {
+		select {
+		case <-l.closed:
+			return nil, ErrLinkClosed
+		default:
+		}
+		p, err := l.r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if p.LinkType != PcapLinkTypeEthernet || (l.Interface != "" && p.InterfaceName != l.Interface) ||
+			(p.Direction == PcapDirectionOutbound && !l.IncludeOutbound) {
+			continue
+		}
+		if l.Realtime {
+			if !l.prev.IsZero() {
+				wait := time.Until(l.sent.Add(p.Timestamp.Sub(l.prev)))
+				select {
+				case <-l.closed:
+					return nil, ErrLinkClosed
+				case <-time.After(wait):
+				}
+			}
+			l.prev, l.sent = p.Timestamp, time.Now()
+		}
+		return p.Data, nil
+	}
+}
+
+func (l *PcapReplayLinkEndpoint) MTU() int {
+	return l.mtu
+}
+
+func (l *PcapReplayLinkEndpoint) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
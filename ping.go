@@ -0,0 +1,285 @@
+package tcpip
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// PingReply は1つのEcho Requestへの結果
+type PingReply struct {
+	From []byte
+	Seq  int
+	// ICMPヘッダを含むバイト数
+	Size int
+	TTL  int
+	RTT  time.Duration
+	// Time ExceededやDestination Unreachableが返ってきたときはそのエラー
+	Err error
+}
+
+// PingStatistics はpingの集計結果
+type PingStatistics struct {
+	Transmitted int
+	Received    int
+	Errors      int
+	Duplicates  int
+	// パケットロスの割合(%)
+	Loss float64
+	Min  time.Duration
+	Avg  time.Duration
+	Max  time.Duration
+	Mdev time.Duration
+	// 最初に送ってから最後に待ち終わるまでの時間
+	Time time.Duration
+}
+
+// Pinger はStackからICMP Echo Requestを送ってReplyの往復時間を測る
+type Pinger struct {
+	Stack *Stack
+	Dest  []byte
+	// 送る回数。0なら止めるまで送り続ける
+	Count    int
+	Interval time.Duration
+	// ICMPヘッダの後ろに付けるデータのバイト数
+	Size int
+	// Replyを待つ時間
+	Timeout time.Duration
+	TTL     byte
+	// 空でなければこのインターフェイスから送る
+	Ifname string
+	// Replyかエラーを受け取るたびに呼ばれる
+	OnRecv func(PingReply)
+
+	id uint16
+}
+
+func NewPinger(stack *Stack, dest string) *Pinger {
+	return &Pinger{
+		Stack:    stack,
+		Dest:     Iptobyte(dest),
+		Count:    4,
+		Interval: time.Second,
+		Size:     56,
+		Timeout:  time.Second,
+		TTL:      0x40,
+		id:       binary.BigEndian.Uint16(randomByte(2)),
+	}
+}
+
+type pingState struct {
+	mu sync.Mutex
+	// Sequence Numberは16bitで一周するので、Timeoutまでのものだけを下位16bitで覚えておく
+	sent map[uint16]*pingSent
+	// 返事もTimeoutも来ていない数
+	pending int
+	rtts    []time.Duration
+	stats   PingStatistics
+	// 送ったもの全部に返事が来たら閉じる
+	done chan struct{}
+	last bool
+}
+
+type pingSent struct {
+	seq      int
+	at       time.Time
+	received bool
+}
+
+// expire はTimeoutを過ぎたものを忘れる。state.muを持って呼ぶ
+func (state *pingState) expire(now time.Time, timeout time.Duration) {
+	for key, sent := range state.sent {
+		if now.Sub(sent.at) > timeout {
+			if !sent.received {
+				state.pending--
+			}
+			delete(state.sent, key)
+		}
+	}
+}
+
+// Run はCount回Echo Requestを送って結果を集計する
+// ctxがキャンセルされたらそこまでの結果を返す
+func (p *Pinger) Run(ctx context.Context) (*PingStatistics, error) {
+	if p.Size < 0 {
+		return nil, fmt.Errorf("invalid ping size : %d", p.Size)
+	}
+	state := &pingState{
+		sent: make(map[uint16]*pingSent),
+		done: make(chan struct{}),
+	}
+	p.Stack.RegisterICMPHandler(IPProtoICMP, p.id, func(ifc *NetInterface, header IPHeader, message interface{}) {
+		p.handleReply(state, header, message)
+	})
+	defer p.Stack.UnregisterICMPHandler(IPProtoICMP, p.id)
+
+	start := time.Now()
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	var err error
+	for seq := 1; p.Count == 0 || seq <= p.Count; seq++ {
+		if err = p.send(state, seq); err != nil {
+			break
+		}
+		if p.Count != 0 && seq == p.Count {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return p.finish(state, start), nil
+		case <-ticker.C:
+		}
+	}
+
+	// 最後のReplyを待つ
+	state.mu.Lock()
+	state.last = true
+	if state.pending == 0 {
+		close(state.done)
+	}
+	state.mu.Unlock()
+	select {
+	case <-ctx.Done():
+	case <-state.done:
+	case <-time.After(p.Timeout):
+	}
+
+	return p.finish(state, start), err
+}
+
+func (p *Pinger) send(state *pingState, seq int) error {
+	data := make([]byte, p.Size)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	icmp := NewICMPEcho(ICMPTypeEchoRequest, p.id, uint16(seq), data)
+
+	header := NewIPHeader(nil, p.Dest, "ICMP")
+	header.TTL = []byte{p.TTL}
+	if p.Ifname != "" {
+		ifc := p.Stack.Interface(p.Ifname)
+		if ifc == nil {
+			return fmt.Errorf("no such interface : %s", p.Ifname)
+		}
+		header.SourceIPAddr, _ = p.Stack.interfaceAddr(ifc)
+	}
+
+	state.mu.Lock()
+	now := time.Now()
+	state.expire(now, p.Timeout)
+	// 一周しても同じ番号がまだ残っていたら、古い方は返事が来なかったことにする
+	if old, ok := state.sent[uint16(seq)]; ok && !old.received {
+		state.pending--
+	}
+	state.sent[uint16(seq)] = &pingSent{seq: seq, at: now}
+	state.pending++
+	state.stats.Transmitted++
+	state.mu.Unlock()
+
+	if p.Ifname != "" {
+		return p.Stack.SendIPv4On(p.Ifname, header, toByteArr(icmp))
+	}
+	return p.Stack.SendIPv4(header, toByteArr(icmp))
+}
+
+func (p *Pinger) handleReply(state *pingState, header IPHeader, message interface{}) {
+	now := time.Now()
+	reply := PingReply{
+		From: header.SourceIPAddr,
+		TTL:  int(header.TTL[0]),
+	}
+
+	var seq uint16
+	switch m := message.(type) {
+	case ICMPEcho:
+		seq = binary.BigEndian.Uint16(m.SequenceNumber)
+		reply.Size = len(toByteArr(m.ICMP))
+	case ICMPDestinationUnreachable:
+		reply.Err = &ICMPError{From: header.SourceIPAddr, Type: m.Type[0], Code: m.Code[0], Message: m}
+		echo, ok := m.Original.Echo()
+		if !ok {
+			return
+		}
+		seq = binary.BigEndian.Uint16(echo.SequenceNumber)
+	case ICMPTimeExceeded:
+		reply.Err = &ICMPError{From: header.SourceIPAddr, Type: m.Type[0], Code: m.Code[0], Message: m}
+		echo, ok := m.Original.Echo()
+		if !ok {
+			return
+		}
+		seq = binary.BigEndian.Uint16(echo.SequenceNumber)
+	default:
+		return
+	}
+
+	state.mu.Lock()
+	state.expire(now, p.Timeout)
+	sent, ok := state.sent[seq]
+	// 送っていない番号やTimeoutを過ぎて返ってきたものは数えない
+	if !ok {
+		state.mu.Unlock()
+		return
+	}
+	if sent.received {
+		state.stats.Duplicates++
+		state.mu.Unlock()
+		return
+	}
+	sent.received = true
+	state.pending--
+	reply.Seq = sent.seq
+	reply.RTT = now.Sub(sent.at)
+	if reply.Err != nil {
+		state.stats.Errors++
+	} else {
+		state.stats.Received++
+		state.rtts = append(state.rtts, reply.RTT)
+	}
+	finished := state.last && state.pending == 0
+	state.mu.Unlock()
+
+	if p.OnRecv != nil {
+		p.OnRecv(reply)
+	}
+	if finished {
+		close(state.done)
+	}
+}
+
+// finish はRTTの最小、平均、最大と標準偏差を計算する
+// mdevはLinuxのpingと同じでsqrt(avg(rtt^2) - avg(rtt)^2)
+func (p *Pinger) finish(state *pingState, start time.Time) *PingStatistics {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	stats := state.stats
+	stats.Time = time.Since(start)
+	if stats.Transmitted > 0 {
+		stats.Loss = float64(stats.Transmitted-stats.Received) * 100 / float64(stats.Transmitted)
+	}
+	if len(state.rtts) == 0 {
+		return &stats
+	}
+
+	var sum, sum2 float64
+	stats.Min = state.rtts[0]
+	for _, rtt := range state.rtts {
+		if rtt < stats.Min {
+			stats.Min = rtt
+		}
+		if rtt > stats.Max {
+			stats.Max = rtt
+		}
+		sum += float64(rtt)
+		sum2 += float64(rtt) * float64(rtt)
+	}
+	n := float64(len(state.rtts))
+	avg := sum / n
+	stats.Avg = time.Duration(avg)
+	stats.Mdev = time.Duration(math.Sqrt(math.Max(sum2/n-avg*avg, 0)))
+	return &stats
+}
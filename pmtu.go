@@ -0,0 +1,385 @@
+package tcpip
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+const (
+	// IPv4で最低限通らないといけないMTU(RFC791)
+	minIPv4MTU = 68
+	// QUICのパケットが必ず通るとみなすUDPペイロードのサイズ(RFC9000 14)
+	QuicMinDatagramSize = 1200
+	// IPv4ヘッダ20byte + UDPヘッダ8byte
+	udpIPv4Overhead = 28
+	// IPv4ヘッダ20byte + TCPヘッダ20byte
+	tcpIPv4Overhead = 40
+)
+
+// 次のホップのMTUが入っていない古いルータのときに使うMTUの候補(RFC1191 7)
+var mtuPlateaus = []int{65535, 32000, 17914, 8166, 4352, 2002, 1492, 1006, 508, 296, 68}
+
+type pmtuEntry struct {
+	mtu    int
+	expire time.Time
+}
+
+// PMTUCache は宛先ごとに学習したPath MTUを覚えておく
+// https://datatracker.ietf.org/doc/html/rfc1191
+type PMTUCache struct {
+	mu      sync.Mutex
+	entries map[[4]byte]pmtuEntry
+	// 小さくしたPMTUを元に戻して、もう一度調べ直すまでの時間
+	Timeout time.Duration
+}
+
+func NewPMTUCache() *PMTUCache {
+	return &PMTUCache{
+		entries: make(map[[4]byte]pmtuEntry),
+		Timeout: 10 * time.Minute,
+	}
+}
+
+func (c *PMTUCache) Get(dst []byte) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[toIPv4Key(dst)]
+	if !ok {
+		return 0, false
+	}
+	if time.Now().After(entry.expire) {
+		delete(c.entries, toIPv4Key(dst))
+		return 0, false
+	}
+	return entry.mtu, true
+}
+
+// Set は宛先のPMTUを設定する
+func (c *PMTUCache) Set(dst []byte, mtu int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if mtu < minIPv4MTU {
+		mtu = minIPv4MTU
+	}
+	c.entries[toIPv4Key(dst)] = pmtuEntry{mtu: mtu, expire: time.Now().Add(c.Timeout)}
+}
+
+// Reduce はFragmentation Neededを受け取ったときにPMTUを小さくする
+// PMTUは大きくはしない
+func (c *PMTUCache) Reduce(dst []byte, mtu int) {
+	if cur, ok := c.Get(dst); ok && cur <= mtu {
+		return
+	}
+	c.Set(dst, mtu)
+}
+
+func (c *PMTUCache) Delete(dst []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, toIPv4Key(dst))
+}
+
+// nextPlateau は送ったパケットの長さより小さいMTUの候補を返す
+func nextPlateau(size int) int {
+	for _, mtu := range mtuPlateaus {
+		if mtu < size {
+			return mtu
+		}
+	}
+	return minIPv4MTU
+}
+
+// handleFragmentationNeeded はFragmentation NeededからPMTUを学習する
+// 引用されているのが自分の送ったパケットでなければ、ほかのホストが偽ったものとして無視する
+func (s *Stack) handleFragmentationNeeded(unreach ICMPDestinationUnreachable) {
+	original := unreach.Original.IPHeader
+	if !s.isLocalAddr(original.SourceIPAddr) {
+		return
+	}
+	mtu := int(binary.BigEndian.Uint16(unreach.NextHopMTU))
+	sent := int(binary.BigEndian.Uint16(original.TotalPacketLength))
+	// 送ったパケットより大きいMTUは信用しない
+	if mtu == 0 || mtu >= sent {
+		mtu = nextPlateau(sent)
+	}
+	s.PMTU.Reduce(original.DstIPAddr, mtu)
+}
+
+// PathMTU は宛先までのPath MTUを返す
+// 学習していなければ送り出すインターフェイスのMTUになる
+func (s *Stack) PathMTU(dst []byte) int {
+	ifc, _, err := s.lookupRoute(dst)
+	if err != nil {
+		return minIPv4MTU
+	}
+	return s.pathMTU(ifc, dst)
+}
+
+func (s *Stack) pathMTU(ifc *NetInterface, dst []byte) int {
+	mtu := ifc.MTU()
+	if pmtu, ok := s.PMTU.Get(dst); ok && pmtu < mtu {
+		mtu = pmtu
+	}
+	return mtu
+}
+
+// TCPMSS は宛先に合わせたTCPのMSSを返す
+func (s *Stack) TCPMSS(dst []byte) uint16 {
+	return uint16(s.PathMTU(dst) - tcpIPv4Overhead)
+}
+
+// QuicMaxDatagramSize は宛先に送れるQUICのUDPペイロードの最大長を返す
+func (s *Stack) QuicMaxDatagramSize(dst []byte) int {
+	size := s.PathMTU(dst) - udpIPv4Overhead
+	if size < QuicMinDatagramSize {
+		return QuicMinDatagramSize
+	}
+	return size
+}
+
+// QuicMaxDatagramSize はConnectした相手に送れるQUICのUDPペイロードの最大長を返す
+// PLPMTUDを設定していればそれが探したサイズ、なければStackが学習したPath MTUから決める
+func (c *UDPConn) QuicMaxDatagramSize() int {
+	if c.PLPMTUD != nil {
+		return c.PLPMTUD.PLPMTU()
+	}
+	raddr, _ := c.remote()
+	if raddr == nil {
+		return QuicMinDatagramSize
+	}
+	return c.stack.QuicMaxDatagramSize(raddr)
+}
+
+// clampTCPMSS は転送するSYNのMSSオプションが出ていく経路に収まらなければ書き換える
+func clampTCPMSS(packet []byte, mtu int) {
+	hlen := ipHeaderLength(packet)
+	if packet[9] != IPProtoTCP || binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 || len(packet) < hlen+20 {
+		return
+	}
+	tcp := packet[hlen:]
+	if tcp[13]&SYN == 0 {
+		return
+	}
+	// データオフセットが壊れているセグメントは触らない
+	thlen := int(tcp[12]>>4) * 4
+	if thlen < 20 || thlen > len(tcp) {
+		return
+	}
+	maxMSS := uint16(mtu - tcpIPv4Overhead)
+	options := tcp[20:thlen]
+	for i := 0; i < len(options); {
+		switch options[i] {
+		case 0x00:
+			return
+		case 0x01:
+			i++
+			continue
+		}
+		if i+1 >= len(options) || options[i+1] < 2 {
+			return
+		}
+		// オプション番号2がMSS
+		if options[i] == 0x02 && options[i+1] == 4 && i+4 <= len(options) {
+			mss := binary.BigEndian.Uint16(options[i+2 : i+4])
+			if mss <= maxMSS {
+				return
+			}
+			binary.BigEndian.PutUint16(options[i+2:i+4], maxMSS)
+			// MSSの位置が奇数byte目でも16bitの区切りで差分を取る
+			offset := 20 + i + 2
+			if offset%2 == 0 {
+				copy(tcp[16:18], updateChecksum(tcp[16:18], mss, maxMSS))
+			} else {
+				oldWord := uint16(tcp[offset-1])<<8 | mss>>8
+				newWord := uint16(tcp[offset-1])<<8 | maxMSS>>8
+				copy(tcp[16:18], updateChecksum(tcp[16:18], oldWord, newWord))
+				// TCPヘッダの最後なら0で埋めて計算している
+				var next uint16
+				if offset+2 < len(tcp) {
+					next = uint16(tcp[offset+2])
+				}
+				oldWord = (mss&0xff)<<8 | next
+				newWord = (maxMSS&0xff)<<8 | next
+				copy(tcp[16:18], updateChecksum(tcp[16:18], oldWord, newWord))
+			}
+			return
+		}
+		i += int(options[i+1])
+	}
+}
+
+// PLPMTUDの状態(RFC8899 5.2)
+const (
+	PLPMTUDBase = iota
+	PLPMTUDSearching
+	PLPMTUDSearchComplete
+	PLPMTUDError
+)
+
+// PLPMTUD はパケット化レイヤでプローブを送ってPMTUを探す(RFC4821, RFC8899)
+// ICMPが届かない経路でも使えるので、QUICのようなUDPの上のプロトコルで使う
+// プローブの送信とACKの判定は上のレイヤが行い、結果をこれに教える
+type PLPMTUD struct {
+	mu sync.Mutex
+	// 必ず通るとみなすサイズ(QUICなら1200)
+	BasePLPMTU int
+	// 探す上限(インターフェイスのMTUからヘッダを引いたもの)
+	MaxPLPMTU int
+	// 何回ロスしたらそのサイズは通らないとみなすか
+	MaxProbes int
+	// 結果を入れておくキャッシュと宛先
+	Cache *PMTUCache
+	Dest  []byte
+
+	state      int
+	plpmtu     int
+	probedSize int
+	probeCount int
+	// 通らなかった一番小さいサイズ
+	failedSize int
+}
+
+// NewPLPMTUD はUDPペイロードのサイズでPMTUを探す
+func NewPLPMTUD(base, max int) *PLPMTUD {
+	return &PLPMTUD{
+		BasePLPMTU: base,
+		MaxPLPMTU:  max,
+		MaxProbes:  3,
+		state:      PLPMTUDBase,
+		plpmtu:     base,
+		failedSize: max + 1,
+	}
+}
+
+// NewQuicPLPMTUD はStackのインターフェイスのMTUを上限にしてQUIC用に作る
+// UDPConn.PLPMTUDに設定すると、ICMPで知らされたPMTUとSendQuicDatagramのサイズの上限に使われる
+func (s *Stack) NewQuicPLPMTUD(dst []byte) *PLPMTUD {
+	max := QuicMinDatagramSize
+	if ifc, _, err := s.lookupRoute(dst); err == nil && ifc.MTU()-udpIPv4Overhead > max {
+		max = ifc.MTU() - udpIPv4Overhead
+	}
+	d := NewPLPMTUD(QuicMinDatagramSize, max)
+	d.Cache = s.PMTU
+	d.Dest = dst
+	return d
+}
+
+func (d *PLPMTUD) State() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.state
+}
+
+// PLPMTU は今使っていいUDPペイロードの最大長を返す
+func (d *PLPMTUD) PLPMTU() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.plpmtu
+}
+
+// NextProbeSize は次に送るプローブのサイズを返す。探し終わっていればfalse
+// 通ったサイズと通らなかったサイズの間を二分探索する
+func (d *PLPMTUD) NextProbeSize() (int, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.state == PLPMTUDSearchComplete || d.state == PLPMTUDError {
+		return 0, false
+	}
+	if d.probedSize != 0 {
+		return d.probedSize, true
+	}
+	if d.failedSize-d.plpmtu <= 1 {
+		d.complete()
+		return 0, false
+	}
+	d.state = PLPMTUDSearching
+	d.probedSize = d.plpmtu + (d.failedSize-d.plpmtu+1)/2
+	d.probeCount = 0
+	return d.probedSize, true
+}
+
+// probing はsizeが今送っているプローブの長さならtrue
+func (d *PLPMTUD) probing(size int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.probedSize != 0 && size == d.probedSize
+}
+
+// OnProbeAcked はプローブのACKが返ってきたときに呼ぶ
+func (d *PLPMTUD) OnProbeAcked(size int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if size != d.probedSize {
+		return
+	}
+	d.plpmtu = size
+	d.probedSize = 0
+	if d.plpmtu >= d.MaxPLPMTU {
+		d.complete()
+	}
+}
+
+// OnProbeLost はプローブがロスしたと判断したときに呼ぶ
+func (d *PLPMTUD) OnProbeLost(size int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if size != d.probedSize {
+		return
+	}
+	d.probeCount++
+	if d.probeCount < d.MaxProbes {
+		return
+	}
+	d.failedSize = size
+	d.probedSize = 0
+}
+
+// OnPacketTooBig はICMPのFragmentation Neededで知らされたPMTUを使う(RFC8899 4.6)
+// mtuはIPパケットの長さ
+func (d *PLPMTUD) OnPacketTooBig(mtu int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	size := mtu - udpIPv4Overhead
+	// プローブより大きいか、今のPLPMTUより大きければ役に立たないので無視する
+	if size >= d.failedSize || size > d.MaxPLPMTU {
+		return
+	}
+	if size < d.BasePLPMTU {
+		// Baseのサイズも通らないのでエラーにする
+		d.state = PLPMTUDError
+		d.plpmtu = d.BasePLPMTU
+		return
+	}
+	d.failedSize = size + 1
+	if d.plpmtu > size {
+		d.plpmtu = size
+	}
+	d.probedSize = 0
+}
+
+// OnBlackHole は通っていたサイズのパケットが続けてロスしたときに呼ぶ
+// Baseからもう一度探し直す
+func (d *PLPMTUD) OnBlackHole() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.state = PLPMTUDBase
+	d.failedSize = d.plpmtu
+	d.plpmtu = d.BasePLPMTU
+	d.probedSize = 0
+}
+
+// complete は探し終わったのでキャッシュにIPパケットの長さとして入れる
+func (d *PLPMTUD) complete() {
+	d.state = PLPMTUDSearchComplete
+	if d.Cache != nil && d.Dest != nil {
+		d.Cache.Set(d.Dest, d.plpmtu+udpIPv4Overhead)
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"strconv"
 	"syscall"
@@ -26,6 +28,35 @@ func CreateQuicInitialSecret(dstConnId []byte) QuicKeyBlock {
 	}
 }
 
+// CreateQuicHandshakeKeyBlock はTLS1.3のハンドシェイク用のsecretからHandshakeパケットの鍵を作る
+// wがnilでなければ、ClientHelloから始まるhandshake_messagesのrandomで2つのsecretを書き出す
+func CreateQuicHandshakeKeyBlock(keyblock KeyBlockTLS13, handshake_messages []byte, w io.Writer) QuicKeyBlock {
+	if err := writeTLS13HandshakeKeyLog(w, handshake_messages, keyblock); err != nil {
+		log.Printf("key log write err : %v", err)
+	}
+	return quicKeyBlockFromSecret(keyblock.clientHandshakeSecret, keyblock.serverHandshakeSecret)
+}
+
+// CreateQuicAppKeyBlock はApplication Data用のsecretから1-RTTパケットの鍵を作る
+// wがnilでなければ2つのsecretを書き出す
+func CreateQuicAppKeyBlock(keyblock KeyBlockTLS13, handshake_messages []byte, w io.Writer) QuicKeyBlock {
+	if err := writeTLS13AppTrafficKeyLog(w, handshake_messages, keyblock); err != nil {
+		log.Printf("key log write err : %v", err)
+	}
+	return quicKeyBlockFromSecret(keyblock.clientAppSecret, keyblock.serverAppSecret)
+}
+
+func quicKeyBlockFromSecret(clientSecret, serverSecret []byte) QuicKeyBlock {
+	return QuicKeyBlock{
+		ClientKey:              hkdfExpandLabel(clientSecret, quicKeyLabel, nil, 16),
+		ClientIV:               hkdfExpandLabel(clientSecret, quicIVLabel, nil, 12),
+		ClientHeaderProtection: hkdfExpandLabel(clientSecret, quicHPLabel, nil, 16),
+		ServerKey:              hkdfExpandLabel(serverSecret, quicKeyLabel, nil, 16),
+		ServerIV:               hkdfExpandLabel(serverSecret, quicIVLabel, nil, 12),
+		ServerHeaderProtection: hkdfExpandLabel(serverSecret, quicHPLabel, nil, 16),
+	}
+}
+
 // QUICパケットをパースする
 func ParseRawQuicPacket(packet []byte, protected bool) (rawpacket QuicRawPacket) {
 
@@ -362,6 +393,26 @@ func SendQuicPacket(data []byte, udpinfo UDPInfo) QuicRawPacket {
 	return packet
 }
 
+var ErrQuicDatagramTooLarge = errors.New("quic datagram is larger than the path mtu")
+
+// SendQuicDatagram はConnectしたStackのUDPソケットでQUICのパケットを送って、返ってきたパケットを1つ読む
+// SendQuicPacketと違って経路を見て、QuicMaxDatagramSizeより長ければ送らずにエラーを返す
+// PLPMTUDのプローブの長さのときだけはそれを超えてもよい
+func SendQuicDatagram(conn *UDPConn, data []byte) (QuicRawPacket, error) {
+	if len(data) > conn.QuicMaxDatagramSize() && (conn.PLPMTUD == nil || !conn.PLPMTUD.probing(len(data))) {
+		return QuicRawPacket{}, ErrQuicDatagramTooLarge
+	}
+	if _, err := conn.Write(data); err != nil {
+		return QuicRawPacket{}, err
+	}
+	recvBuf := make([]byte, 65535)
+	n, err := conn.Read(recvBuf)
+	if err != nil {
+		return QuicRawPacket{}, err
+	}
+	return ParseRawQuicPacket(recvBuf[0:n], false), nil
+}
+
 // paddingフレームを読み飛ばして、QUICのフレームを配列に入れて返す
 func SkipPaddingFrame(packet []byte) [][]byte {
 	var framesByte [][]byte
@@ -0,0 +1,132 @@
+package tcpip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+)
+
+// Route はルーティングテーブルの1エントリ
+type Route struct {
+	Dest    []byte
+	Netmask []byte
+	// 直接つながっているネットワークならnil
+	Gateway []byte
+	Ifname  string
+}
+
+type RouteTable struct {
+	mu     sync.RWMutex
+	routes []Route
+}
+
+func NewRouteTable() *RouteTable {
+	return &RouteTable{}
+}
+
+func maskLength(mask []byte) int {
+	n := 0
+	for _, b := range mask {
+		for b&0x80 != 0 {
+			n++
+			b <<= 1
+		}
+	}
+	return n
+}
+
+func maskedAddr(ip, mask []byte) []byte {
+	b := make([]byte, 4)
+	for i := 0; i < 4; i++ {
+		b[i] = ip[i] & mask[i]
+	}
+	return b
+}
+
+// 同じ宛先とネットマスクのルートは置き換える
+func (rt *RouteTable) Add(route Route) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	route.Dest = maskedAddr(route.Dest, route.Netmask)
+	for i, r := range rt.routes {
+		if bytes.Equal(r.Dest, route.Dest) && bytes.Equal(r.Netmask, route.Netmask) {
+			rt.routes[i] = route
+			return
+		}
+	}
+	rt.routes = append(rt.routes, route)
+}
+
+func (rt *RouteTable) Delete(dest, netmask []byte) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	dest = maskedAddr(dest, netmask)
+	for i, r := range rt.routes {
+		if bytes.Equal(r.Dest, dest) && bytes.Equal(r.Netmask, netmask) {
+			rt.routes = append(rt.routes[:i], rt.routes[i+1:]...)
+			return
+		}
+	}
+}
+
+// Lookup はロンゲストマッチで宛先に一番合うルートを返す
+func (rt *RouteTable) Lookup(dst []byte) (Route, bool) {
+	return rt.lookup(dst, "")
+}
+
+// LookupOn はifnameのインターフェイスから出ていくルートの中でロンゲストマッチする
+func (rt *RouteTable) LookupOn(dst []byte, ifname string) (Route, bool) {
+	return rt.lookup(dst, ifname)
+}
+
+func (rt *RouteTable) lookup(dst []byte, ifname string) (Route, bool) {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	var best Route
+	bestLen := -1
+	for _, r := range rt.routes {
+		if ifname != "" && r.Ifname != ifname {
+			continue
+		}
+		if !bytes.Equal(maskedAddr(dst, r.Netmask), r.Dest) {
+			continue
+		}
+		if l := maskLength(r.Netmask); l > bestLen {
+			best = r
+			bestLen = l
+		}
+	}
+	return best, bestLen >= 0
+}
+
+func (rt *RouteTable) Routes() []Route {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	routes := make([]Route, len(rt.routes))
+	copy(routes, rt.routes)
+	return routes
+}
+
+// サブネットのブロードキャストアドレスか
+func isBroadcastAddr(ip, netmask []byte) bool {
+	if len(ip) != 4 {
+		return false
+	}
+	if binary.BigEndian.Uint32(ip) == 0xffffffff {
+		return true
+	}
+	// /31と/32にはブロードキャストアドレスがない
+	if netmask == nil || maskLength(netmask) >= 31 {
+		return false
+	}
+	for i := 0; i < 4; i++ {
+		if ip[i]|netmask[i] != 0xff {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,531 @@
+package tcpip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrNoRoute         = errors.New("no route to host")
+	ErrHostUnreachable = errors.New("host unreachable")
+)
+
+var broadcastMacAddr = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// NetInterface はスタックが持つインターフェイス
+type NetInterface struct {
+	Name    string
+	MacAddr []byte
+	IpAddr  []byte
+	Netmask []byte
+	Link    LinkEndpoint
+}
+
+// NewNetInterface はOSのNICの情報を読んでAF_PACKETで送受信するインターフェイスを作る
+func NewNetInterface(ifname string) (*NetInterface, error) {
+	nif, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, err
+	}
+	link, err := NewRawLinkEndpoint(ifname)
+	if err != nil {
+		return nil, err
+	}
+	ifc := &NetInterface{
+		Name:    ifname,
+		MacAddr: nif.HardwareAddr,
+		Link:    link,
+	}
+	addrs, err := nif.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			ifc.IpAddr = ipnet.IP.To4()
+			ifc.Netmask = net.IP(ipnet.Mask).To4()
+			break
+		}
+	}
+	return ifc, nil
+}
+
+func (ifc *NetInterface) MTU() int {
+	return ifc.Link.MTU()
+}
+
+func (s *Stack) localIpMacAddr(ifc *NetInterface) LocalIpMacAddr {
+	ip, _ := s.interfaceAddr(ifc)
+	return LocalIpMacAddr{
+		LocalMacAddr: ifc.MacAddr,
+		LocalIpAddr:  ip,
+	}
+}
+
+// IPProtocolHandler は自分宛てのIPパケットをプロトコル番号ごとに受け取る
+// packetはIPヘッダを含む
+type IPProtocolHandler func(ifc *NetInterface, packet []byte)
+
+type pendingPacket struct {
+	ifc           *NetInterface
+	packet        []byte
+	onUnreachable func()
+}
+
+// Stack は複数のインターフェイスとルーティングテーブルを持つプロトコルスタック
+type Stack struct {
+	mu           sync.RWMutex
+	interfaces   []*NetInterface
+	handlers     map[byte]IPProtocolHandler
+	icmpHandlers map[icmpEndpoint]ICMPHandler
+	icmpProbes   map[icmpEndpoint]icmpProbeHandler
+	vlans        map[vlanParent]*VLANLinkEndpoint
+	udpConns     map[uint16][]*UDPConn
+	tcpConns     map[tcpConnKey]*TCPConn
+	tcpListeners map[uint16]*TCPListener
+	tcpHandlers  map[uint16]IPProtocolHandler
+	pending      map[[4]byte][]pendingPacket
+	// インターフェイスごとに入っているマルチキャストグループ
+	groups map[multicastGroupKey]*multicastMembership
+	// インターフェイスごとのIGMPの状態
+	igmp map[string]*igmpState
+
+	Routes *RouteTable
+	Arp    *ArpCache
+	PMTU   *PMTUCache
+	// trueにすると自分宛てでないIPパケットをルーティングテーブルに従って転送する
+	Forwarding bool
+	// trueにするとEcho Requestに返事をしない
+	IgnoreEcho bool
+	// trueにすると転送するSYNのMSSを出ていく経路のPMTUに合わせて小さくする
+	ClampMSS bool
+	// 送るIGMPのバージョン(2か3)。0なら3。古いバージョンのQueryを受け取ったらそちらに合わせる
+	IGMPVersion int
+	// nilでなければ転送するパケットのアドレスを変換する
+	NAT *NAT
+	// nilでなければ受け取ったパケットと送るパケットをフックのルールで選ぶ
+	Firewall *Firewall
+	// NATかFirewallを設定したときに、送受信するパケットの接続を追跡する
+	ConnTrack *ConnTrack
+
+	ipID uint32
+	wg   sync.WaitGroup
+}
+
+func NewStack() *Stack {
+	s := &Stack{
+		handlers:     make(map[byte]IPProtocolHandler),
+		icmpHandlers: make(map[icmpEndpoint]ICMPHandler),
+		icmpProbes:   make(map[icmpEndpoint]icmpProbeHandler),
+		vlans:        make(map[vlanParent]*VLANLinkEndpoint),
+		udpConns:     make(map[uint16][]*UDPConn),
+		tcpConns:     make(map[tcpConnKey]*TCPConn),
+		tcpListeners: make(map[uint16]*TCPListener),
+		tcpHandlers:  make(map[uint16]IPProtocolHandler),
+		pending:      make(map[[4]byte][]pendingPacket),
+		groups:       make(map[multicastGroupKey]*multicastMembership),
+		igmp:         make(map[string]*igmpState),
+		Routes:       NewRouteTable(),
+		Arp:          NewArpCache(),
+		PMTU:         NewPMTUCache(),
+		ConnTrack:    NewConnTrack(),
+		ipID:         binary.BigEndian.Uint32(randomByte(4)),
+	}
+	s.handlers[IPProtoICMP] = s.handleICMP
+	s.handlers[IPProtoUDP] = s.handleUDP
+	s.handlers[IPProtoTCP] = s.handleTCP
+	s.handlers[IPProtoIGMP] = s.handleIGMP
+	return s
+}
+
+// AddInterface はインターフェイスを追加して受信を始める
+// 直接つながっているネットワークのルートも追加する
+func (s *Stack) AddInterface(ifc *NetInterface) {
+	s.mu.Lock()
+	s.interfaces = append(s.interfaces, ifc)
+	s.mu.Unlock()
+
+	if ifc.IpAddr != nil && ifc.Netmask != nil {
+		s.Routes.Add(Route{
+			Dest:    ifc.IpAddr,
+			Netmask: ifc.Netmask,
+			Ifname:  ifc.Name,
+		})
+	}
+
+	s.wg.Add(1)
+	go s.readLoop(ifc)
+}
+
+// SetInterfaceAddr はインターフェイスのアドレスとネットマスクを変えて、直接つながっているネットワークのルートも付け替える
+// ipがnilならアドレスを外す
+func (s *Stack) SetInterfaceAddr(ifname string, ip, netmask []byte) error {
+	ifc := s.Interface(ifname)
+	if ifc == nil {
+		return fmt.Errorf("no such interface : %s", ifname)
+	}
+	s.mu.Lock()
+	oldIP, oldMask := ifc.IpAddr, ifc.Netmask
+	ifc.IpAddr, ifc.Netmask = ip, netmask
+	s.mu.Unlock()
+
+	if oldIP != nil && oldMask != nil {
+		s.Routes.Delete(oldIP, oldMask)
+	}
+	if ip != nil && netmask != nil {
+		s.Routes.Add(Route{
+			Dest:    ip,
+			Netmask: netmask,
+			Ifname:  ifname,
+		})
+	}
+	return nil
+}
+
+// interfaceAddr はインターフェイスのアドレスとネットマスクを返す
+// SetInterfaceAddrで変わることがあるので、AddInterfaceした後はこれで読む
+func (s *Stack) interfaceAddr(ifc *NetInterface) (ip, netmask []byte) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return ifc.IpAddr, ifc.Netmask
+}
+
+func (s *Stack) Interfaces() []*NetInterface {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ifcs := make([]*NetInterface, len(s.interfaces))
+	copy(ifcs, s.interfaces)
+	return ifcs
+}
+
+func (s *Stack) Interface(name string) *NetInterface {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, ifc := range s.interfaces {
+		if ifc.Name == name {
+			return ifc
+		}
+	}
+	return nil
+}
+
+// RegisterProtocol はプロトコル番号のハンドラを登録する。nilなら登録を消す
+func (s *Stack) RegisterProtocol(protocol byte, handler IPProtocolHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if handler == nil {
+		delete(s.handlers, protocol)
+		return
+	}
+	s.handlers[protocol] = handler
+}
+
+// Close は全てのインターフェイスのリンクを閉じて受信を止める
+func (s *Stack) Close() {
+	for _, ifc := range s.Interfaces() {
+		ifc.Link.Close()
+	}
+	s.wg.Wait()
+}
+
+func (s *Stack) readLoop(ifc *NetInterface) {
+	defer s.wg.Done()
+	for {
+		frame, err := ifc.Link.ReadFrame()
+		if err != nil {
+			return
+		}
+		s.handleFrame(ifc, frame)
+	}
+}
+
+func (s *Stack) handleFrame(ifc *NetInterface, frame []byte) {
+	eth, err := parseEthernet(frame)
+	if err != nil {
+		return
+	}
+	// VLANタグが付いていればサブインターフェイスに渡す
+	// 宛先のMACアドレスはサブインターフェイスが入っているグループで確かめるので、ここでは見ない
+	if eth.VLANTags != nil {
+		s.handleVLANFrame(ifc, eth, frame)
+		return
+	}
+	// 自分宛てかブロードキャスト、入っているグループのマルチキャストのフレームだけ受け取る
+	if !bytes.Equal(eth.DstMacAddr, ifc.MacAddr) && !bytes.Equal(eth.DstMacAddr, broadcastMacAddr) &&
+		!(isMulticastMacAddr(eth.DstMacAddr) && s.acceptMulticastMac(ifc, eth.DstMacAddr)) {
+		return
+	}
+
+	switch {
+	case bytes.Equal(eth.Type, ARP):
+		s.handleArp(ifc, frame[eth.HeaderLength():])
+	case bytes.Equal(eth.Type, IPv4):
+		s.handleIPv4(ifc, frame[eth.HeaderLength():])
+	}
+}
+
+func (s *Stack) handleArp(ifc *NetInterface, packet []byte) {
+	if len(packet) < 28 {
+		return
+	}
+	arp := parseArpPacket(packet)
+	// 相手のMACアドレスを覚えておく。アドレスがまだなくてもDHCPで借りたアドレスを使っている人がいないか調べるのに使う
+	// probe(送信元0.0.0.0)は覚えない
+	if !isUnspecifiedAddr(arp.SenderIpAddr) {
+		s.Arp.Update(arp.SenderIpAddr, arp.SenderMacAddr)
+	}
+	ip, _ := s.interfaceAddr(ifc)
+	if ip == nil {
+		return
+	}
+
+	// 自分のIPアドレスへのリクエストなら返事をする
+	if arp.Opcode[1] == 0x01 && bytes.Equal(arp.TargetIpAddr, ip) {
+		reply := NewArpReply(LocalIpMacAddr{LocalMacAddr: ifc.MacAddr, LocalIpAddr: ip}, arp)
+		var frame []byte
+		frame = append(frame, toByteArr(NewEthernet(arp.SenderMacAddr, ifc.MacAddr, "ARP"))...)
+		frame = append(frame, toByteArr(reply)...)
+		ifc.Link.WriteFrame(frame)
+	}
+}
+
+// isLocalAddr は自分のインターフェイスのアドレスかブロードキャストならtrue
+func (s *Stack) isLocalAddr(ip []byte) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, ifc := range s.interfaces {
+		if bytes.Equal(ip, ifc.IpAddr) || isBroadcastAddr(ip, ifc.Netmask) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Stack) handleIPv4(ifc *NetInterface, packet []byte) {
+	if !validIPv4Packet(packet) {
+		return
+	}
+	packet = packet[:binary.BigEndian.Uint16(packet[2:4])]
+	ip := parseIP(packet[0:20])
+
+	ref := s.track(packet)
+	if !s.filter(HookPrerouting, ifc, nil, packet, ref) {
+		return
+	}
+	// 返事を元の送信元に戻すのは、自分宛てかどうかを決める前
+	if s.NAT != nil {
+		packet = s.NAT.prerouting(s.ConnTrack, ifc, packet, ref)
+		ip = parseIP(packet[0:20])
+	}
+
+	// マルチキャストは受け取ったインターフェイスが入っているグループのものだけ受け取り、転送はしない
+	if isMulticastAddr(ip.DstIPAddr) {
+		if !s.isJoinedGroup(ifc, ip.DstIPAddr, ip.SourceIPAddr) {
+			return
+		}
+	} else if !s.isLocalAddr(ip.DstIPAddr) {
+		if s.Forwarding {
+			s.forward(ifc, packet, ref)
+		}
+		return
+	}
+
+	// フラグメントの再構築はしていないので、分割されたパケットは捨てる
+	if binary.BigEndian.Uint16(ip.Flags)&0x3fff != 0 {
+		return
+	}
+	if !s.filter(HookInput, ifc, nil, packet, ref) || !s.ConnTrack.confirm(ref) {
+		return
+	}
+
+	s.mu.RLock()
+	handler, ok := s.handlers[ip.Protocol[0]]
+	s.mu.RUnlock()
+	if !ok {
+		// 知らないプロトコルにはProtocol Unreachableを返す
+		s.sendICMPError(ifc, packet, ICMPTypeDestinationUnreachable, ICMPCodeProtocolUnreachable, nil)
+		return
+	}
+	handler(ifc, packet)
+}
+
+// track はNATかFirewallがあるときに、パケットの接続を探す
+// マルチキャストとブロードキャストは追跡しない
+func (s *Stack) track(packet []byte) *connRef {
+	if s.NAT == nil && s.Firewall == nil {
+		return nil
+	}
+	dst := packet[16:20]
+	if isMulticastAddr(dst) || isBroadcastAddr(dst, nil) || s.isLocalBroadcast(dst) {
+		return nil
+	}
+	return s.ConnTrack.track(packet)
+}
+
+func (s *Stack) nextIPID() []byte {
+	return UintTo2byte(uint16(atomic.AddUint32(&s.ipID, 1)))
+}
+
+// lookupRoute は宛先に送るインターフェイスと次に渡すIPアドレスを返す
+func (s *Stack) lookupRoute(dst []byte) (*NetInterface, []byte, error) {
+	route, ok := s.Routes.Lookup(dst)
+	if !ok {
+		return nil, nil, ErrNoRoute
+	}
+	ifc := s.Interface(route.Ifname)
+	if ifc == nil {
+		return nil, nil, ErrNoRoute
+	}
+	nexthop := dst
+	if route.Gateway != nil {
+		nexthop = route.Gateway
+	}
+	return ifc, nexthop, nil
+}
+
+// lookupRouteOn はifnameのインターフェイスから出ていくルートだけを探す
+// 合うルートがなければそのインターフェイスに直接つながっているとみなす
+func (s *Stack) lookupRouteOn(dst []byte, ifname string) (*NetInterface, []byte, error) {
+	ifc := s.Interface(ifname)
+	if ifc == nil {
+		return nil, nil, fmt.Errorf("no such interface : %s", ifname)
+	}
+	route, ok := s.Routes.LookupOn(dst, ifname)
+	if !ok || route.Gateway == nil {
+		return ifc, dst, nil
+	}
+	return ifc, route.Gateway, nil
+}
+
+// SendIPv4 はIPヘッダとペイロードをルーティングテーブルに従って送る
+// 送信元アドレスがnilなら送り出すインターフェイスのアドレスを使う
+func (s *Stack) SendIPv4(header IPHeader, payload []byte) error {
+	ifc, nexthop, err := s.lookupRoute(header.DstIPAddr)
+	if err != nil {
+		return err
+	}
+	return s.sendIPv4(ifc, nexthop, header, payload)
+}
+
+// SendIPv4On はルーティングテーブルに関係なくifnameのインターフェイスから送る
+func (s *Stack) SendIPv4On(ifname string, header IPHeader, payload []byte) error {
+	ifc, nexthop, err := s.lookupRouteOn(header.DstIPAddr, ifname)
+	if err != nil {
+		return err
+	}
+	return s.sendIPv4(ifc, nexthop, header, payload)
+}
+
+func (s *Stack) sendIPv4(ifc *NetInterface, nexthop []byte, header IPHeader, payload []byte) error {
+	if header.SourceIPAddr == nil {
+		header.SourceIPAddr, _ = s.interfaceAddr(ifc)
+	}
+	if bytes.Equal(header.PacketIdentification, []byte{0x00, 0x00}) {
+		header.PacketIdentification = s.nextIPID()
+	}
+	packet := newIPv4Packet(header, payload)
+	ref := s.track(packet)
+	if !s.filter(HookOutput, nil, ifc, packet, ref) || !s.filter(HookPostrouting, nil, ifc, packet, ref) ||
+		!s.ConnTrack.confirm(ref) {
+		return ErrPacketFiltered
+	}
+
+	// DFビットが立っていれば学習したPath MTUより大きいパケットはエラーにする
+	fragments, err := fragmentIPv4(packet, s.pathMTU(ifc, header.DstIPAddr))
+	if err != nil {
+		return err
+	}
+	for _, frag := range fragments {
+		if err := s.writeIPv4(ifc, nexthop, frag, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeIPv4 は次に渡す相手のMACアドレスを調べてIPパケットをフレームにして送る
+// ARPを待つ間は受信処理を止めないように別のgoroutineで送り、
+// 解決できなかったときはonUnreachableを呼ぶ
+func (s *Stack) writeIPv4(ifc *NetInterface, nexthop, packet []byte, onUnreachable func()) error {
+	var dstMac []byte
+	if _, netmask := s.interfaceAddr(ifc); isBroadcastAddr(nexthop, netmask) {
+		dstMac = broadcastMacAddr
+	} else if isMulticastAddr(nexthop) {
+		dstMac = multicastMacAddr(nexthop)
+	} else if mac, ok := s.Arp.Lookup(nexthop); ok {
+		dstMac = mac
+	}
+	if dstMac != nil {
+		var frame []byte
+		frame = append(frame, toByteArr(NewEthernet(dstMac, ifc.MacAddr, "IPv4"))...)
+		frame = append(frame, packet...)
+		return ifc.Link.WriteFrame(frame)
+	}
+
+	key := toIPv4Key(nexthop)
+	s.mu.Lock()
+	queued := len(s.pending[key]) != 0
+	s.pending[key] = append(s.pending[key], pendingPacket{ifc: ifc, packet: packet, onUnreachable: onUnreachable})
+	s.mu.Unlock()
+	if !queued {
+		go s.resolvePending(ifc, nexthop)
+	}
+	return nil
+}
+
+// resolvePending はARPで解決できたら溜まっているパケットを送る
+func (s *Stack) resolvePending(ifc *NetInterface, nexthop []byte) {
+	_, err := s.resolve(ifc, nexthop)
+
+	key := toIPv4Key(nexthop)
+	s.mu.Lock()
+	pending := s.pending[key]
+	delete(s.pending, key)
+	s.mu.Unlock()
+
+	for _, p := range pending {
+		if err != nil {
+			if p.onUnreachable != nil {
+				p.onUnreachable()
+			}
+			continue
+		}
+		s.writeIPv4(p.ifc, nexthop, p.packet, p.onUnreachable)
+	}
+}
+
+// resolve はARPリクエストを送ってMACアドレスを調べる
+// 1秒待って返事がなければ3回まで送り直す
+func (s *Stack) resolve(ifc *NetInterface, ip []byte) ([]byte, error) {
+	for i := 0; i < 3; i++ {
+		wait := s.Arp.waitch(ip)
+		if mac, ok := s.Arp.Lookup(ip); ok {
+			s.Arp.unwait(ip, wait)
+			return mac, nil
+		}
+		var frame []byte
+		frame = append(frame, toByteArr(NewEthernet(broadcastMacAddr, ifc.MacAddr, "ARP"))...)
+		frame = append(frame, toByteArr(NewArpRequest(s.localIpMacAddr(ifc), net.IP(ip).String()))...)
+		if err := ifc.Link.WriteFrame(frame); err != nil {
+			s.Arp.unwait(ip, wait)
+			return nil, err
+		}
+		select {
+		case <-wait:
+		case <-time.After(time.Second):
+		}
+		s.Arp.unwait(ip, wait)
+		if mac, ok := s.Arp.Lookup(ip); ok {
+			return mac, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrHostUnreachable, net.IP(ip))
+}
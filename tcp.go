@@ -6,7 +6,10 @@ import (
 )
 
 const (
+	FIN    = 0x01
 	SYN    = 0x02
+	RST    = 0x04
+	PSH    = 0x08
 	ACK    = 0x10
 	SYNACK = 0x12
 	PSHACK = 0x18
@@ -77,7 +80,7 @@ func NewTCPDummyHeader(header IPHeader, length uint16) TCPDummyHeader {
 		SourceIPAddr: header.SourceIPAddr,
 		DstIPAddr:    header.DstIPAddr,
 		Protocol:     []byte{0x00, 0x06},
-		Length:       []byte{0x00, byte(length)},
+		Length:       UintTo2byte(length),
 	}
 }
 
@@ -93,10 +96,15 @@ func createTCPTimestamp() []byte {
 
 // https://milestone-of-se.nesuke.com/nw-basic/tcp-udp/tcp-option/
 func NewTCPOptions() TCPOptions {
+	// size: 1460 bytes
+	return NewTCPOptionsWithMSS(1460)
+}
+
+// NewTCPOptionsWithMSS はPath MTUに合わせたMSSでオプションを作る
+func NewTCPOptionsWithMSS(mss uint16) TCPOptions {
 	tcpoption := TCPOptions{
 		// オプション番号2, Length, 値(2byte)
-		// size: 1460 bytes
-		MaxsSegmentSize: []byte{0x02, 0x04, 0x05, 0xb4},
+		MaxsSegmentSize: append([]byte{0x02, 0x04}, UintTo2byte(mss)...),
 		// オプション番号4, Length
 		SackPermitted: []byte{0x04, 0x02},
 		// オプション番号1
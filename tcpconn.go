@@ -0,0 +1,1289 @@
+package tcpip
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var ErrTCPConnClosed = errors.New("use of closed tcp connection")
+
+// TCPの状態(RFC793 3.2)
+const (
+	tcpStateClosed = iota
+	tcpStateSynSent
+	tcpStateSynReceived
+	tcpStateEstablished
+	tcpStateFinWait1
+	tcpStateFinWait2
+	tcpStateCloseWait
+	tcpStateClosing
+	tcpStateLastAck
+	tcpStateTimeWait
+)
+
+const (
+	// 相手がMSSオプションを付けてこなかったときのMSS(RFC1122 4.2.2.6)
+	tcpDefaultMSS = 536
+	// ウィンドウスケールは使わないので受信バッファは64KBまで
+	tcpReadBuffer  = 65535
+	tcpWriteBuffer = 262144
+	// 再送タイマー(RFC6298)。最小値はLinuxと同じ200ms
+	tcpInitialRTO = time.Second
+	tcpMinRTO     = 200 * time.Millisecond
+	tcpMaxRTO     = 60 * time.Second
+	tcpSynRetries = 5
+	tcpMaxRetries = 12
+	// 自分から閉じたあとFINを待つ時間とTIME_WAITの長さ
+	tcpFinTimeout = 60 * time.Second
+	tcpTimeWait   = 60 * time.Second
+	tcpBacklog    = 128
+)
+
+type tcpConnKey struct {
+	laddr [4]byte
+	lport uint16
+	raddr [4]byte
+	rport uint16
+}
+
+type tcpPacket struct {
+	header  IPHeader
+	payload []byte
+}
+
+// tcpSegment は受け取ったTCPセグメントの中身
+type tcpSegment struct {
+	seq    uint32
+	ack    uint32
+	flags  byte
+	window uint32
+	// SYNに付いていたMSSオプション。なければ0
+	mss  int
+	data []byte
+}
+
+// length はシーケンス番号をいくつ使うセグメントか返す
+func (seg tcpSegment) length() uint32 {
+	n := uint32(len(seg.data))
+	if seg.flags&SYN != 0 {
+		n++
+	}
+	if seg.flags&FIN != 0 {
+		n++
+	}
+	return n
+}
+
+// シーケンス番号は一周するので差で比べる
+func seqLT(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func seqLE(a, b uint32) bool {
+	return int32(a-b) <= 0
+}
+
+// TCPConn はStackの上のTCPコネクション。net.Connとして使える
+// 再送、フロー制御、Path MTUに合わせたセグメントの大きさだけ実装していて、
+// 順番が入れ替わったセグメントは捨てて再送してもらう
+type TCPConn struct {
+	stack *Stack
+	laddr []byte
+	lport uint16
+	raddr []byte
+	rport uint16
+	// 受動オープンしたときのリスナー。3ウェイハンドシェイクが終わったら渡す
+	listener *TCPListener
+
+	mu    sync.Mutex
+	state int
+	// コネクションが切れた理由
+	err error
+	// ICMPエラー。再送がタイムアウトしたときに返す
+	softErr error
+
+	// 送信側(RFC793 3.2)
+	iss    uint32
+	sndUna uint32
+	sndNxt uint32
+	// 今までに送った一番先のシーケンス番号。再送でsndNxtを戻してもこれまでのACKは受け取る
+	sndMax uint32
+	sndWnd uint32
+	sndMSS int
+	// sndUnaから先の、ACKされていないデータとまだ送っていないデータ
+	sendBuf   []byte
+	finQueued bool
+	finSent   bool
+	dupAcks   int
+	// 送り直したときのsndMax。ここまでACKされるまでは重複ACKで送り直さない(RFC6582)
+	recover uint32
+
+	// 受信側
+	irs     uint32
+	rcvNxt  uint32
+	recvBuf []byte
+	recvFin bool
+
+	// 再送タイマー
+	timer   *time.Timer
+	timerOn bool
+	rto     time.Duration
+	srtt    time.Duration
+	rttvar  time.Duration
+	retries int
+	// RTTを測っているセグメント(Karnのアルゴリズムで再送したものは測らない)
+	rttTiming bool
+	rttSeq    uint32
+	rttStart  time.Time
+
+	// 送るセグメントのキュー。リンクへの書き込みで受信処理が止まらないようにtransmitLoopが送る
+	txq     []tcpPacket
+	txReady chan struct{}
+
+	// 3ウェイハンドシェイクが終わるか失敗したら閉じる
+	established chan struct{}
+	readable    chan struct{}
+	writable    chan struct{}
+
+	readMu        sync.Mutex
+	writeMu       sync.Mutex
+	closed        chan struct{}
+	once          sync.Once
+	readDeadline  *deadline
+	writeDeadline *deadline
+}
+
+// TCPListener はStackの上でTCPの接続を待つ。net.Listenerとして使える
+type TCPListener struct {
+	stack *Stack
+	// 0.0.0.0なら全てのアドレス宛てを受け取る
+	laddr   []byte
+	lport   uint16
+	backlog chan *TCPConn
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newTCPConn(s *Stack, laddr []byte, lport uint16, raddr []byte, rport uint16) *TCPConn {
+	iss := binary.BigEndian.Uint32(randomByte(4))
+	return &TCPConn{
+		stack:         s,
+		laddr:         append([]byte{}, laddr...),
+		lport:         lport,
+		raddr:         append([]byte{}, raddr...),
+		rport:         rport,
+		iss:           iss,
+		recover:       iss,
+		sndMSS:        tcpDefaultMSS,
+		rto:           tcpInitialRTO,
+		txReady:       make(chan struct{}, 1),
+		established:   make(chan struct{}),
+		readable:      make(chan struct{}, 1),
+		writable:      make(chan struct{}, 1),
+		closed:        make(chan struct{}),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+	}
+}
+
+func (c *TCPConn) key() tcpConnKey {
+	return newTCPConnKey(c.laddr, c.lport, c.raddr, c.rport)
+}
+
+func newTCPConnKey(laddr []byte, lport uint16, raddr []byte, rport uint16) tcpConnKey {
+	return tcpConnKey{laddr: toIPv4Key(laddr), lport: lport, raddr: toIPv4Key(raddr), rport: rport}
+}
+
+// DialTCP はraddrにTCPで接続する
+// laddrがnilなら送り出すインターフェイスのアドレスと空いているポートを使う
+func (s *Stack) DialTCP(ctx context.Context, laddr, raddr *net.TCPAddr) (*TCPConn, error) {
+	dst := raddr.IP.To4()
+	if dst == nil || raddr.Port == 0 {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Addr: raddr, Err: syscall.EINVAL}
+	}
+	ifc, _, err := s.lookupRoute(dst)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Addr: raddr, Err: err}
+	}
+	src, _ := s.interfaceAddr(ifc)
+	port := 0
+	if laddr != nil {
+		if laddr.IP != nil && !laddr.IP.IsUnspecified() {
+			src = laddr.IP.To4()
+			if src == nil || !s.isLocalAddr(src) {
+				return nil, &net.OpError{Op: "dial", Net: "tcp", Addr: raddr, Err: syscall.EADDRNOTAVAIL}
+			}
+		}
+		port = laddr.Port
+	}
+
+	c := newTCPConn(s, src, 0, dst, uint16(raddr.Port))
+	if err := s.bindTCP(c, uint16(port)); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Addr: raddr, Err: err}
+	}
+
+	c.mu.Lock()
+	c.state = tcpStateSynSent
+	c.sndUna = c.iss
+	c.sndNxt = c.iss + 1
+	c.sndMax = c.sndNxt
+	c.sendSyn()
+	c.mu.Unlock()
+	go c.transmitLoop()
+
+	select {
+	case <-c.established:
+	case <-ctx.Done():
+		c.mu.Lock()
+		if !isClosedChan(c.established) {
+			c.fail(ctx.Err())
+		}
+		c.mu.Unlock()
+	}
+	c.mu.Lock()
+	err = c.err
+	c.mu.Unlock()
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Addr: raddr, Err: err}
+	}
+	return c, nil
+}
+
+// ListenTCP はladdrで接続を待つリスナーを作る
+// IPアドレスがnilか0.0.0.0なら全てのインターフェイスで待ち、ポートが0なら空いているポートを選ぶ
+func (s *Stack) ListenTCP(laddr *net.TCPAddr) (*TCPListener, error) {
+	ip := []byte{0x00, 0x00, 0x00, 0x00}
+	port := 0
+	if laddr != nil {
+		if laddr.IP != nil && !laddr.IP.IsUnspecified() {
+			ip = laddr.IP.To4()
+			if ip == nil || !s.isLocalAddr(ip) {
+				return nil, &net.OpError{Op: "listen", Net: "tcp", Addr: laddr, Err: syscall.EADDRNOTAVAIL}
+			}
+		}
+		port = laddr.Port
+	}
+	l := &TCPListener{
+		stack:   s,
+		laddr:   append([]byte{}, ip...),
+		backlog: make(chan *TCPConn, tcpBacklog),
+		closed:  make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if port == 0 {
+		port = int(s.freeTCPPort())
+		if port == 0 {
+			return nil, &net.OpError{Op: "listen", Net: "tcp", Addr: laddr, Err: ErrAddrInUse}
+		}
+	}
+	if _, ok := s.tcpListeners[uint16(port)]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "tcp", Addr: laddr, Err: ErrAddrInUse}
+	}
+	l.lport = uint16(port)
+	s.tcpListeners[l.lport] = l
+	s.icmpHandlers[icmpEndpoint{protocol: IPProtoTCP, port: l.lport}] = s.handleTCPError
+	return l, nil
+}
+
+// bindTCP は能動オープンするコネクションを登録する。portが0なら空いているポートを探す
+func (s *Stack) bindTCP(c *TCPConn, port uint16) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if port == 0 {
+		port = s.freeTCPPort()
+		if port == 0 {
+			return ErrAddrInUse
+		}
+	}
+	c.lport = port
+	if _, ok := s.tcpConns[c.key()]; ok {
+		return ErrAddrInUse
+	}
+	s.tcpConns[c.key()] = c
+	s.icmpHandlers[icmpEndpoint{protocol: IPProtoTCP, port: port}] = s.handleTCPError
+	return nil
+}
+
+// freeTCPPort はリスナーもコネクションも使っていないポートを探す。s.muを取ってから呼ぶ
+func (s *Stack) freeTCPPort() uint16 {
+	used := make(map[uint16]bool)
+	for key := range s.tcpConns {
+		used[key.lport] = true
+	}
+	start := ephemeralPortMin + int(binary.BigEndian.Uint16(randomByte(2)))%(ephemeralPortMax-ephemeralPortMin+1)
+	for i := 0; i <= ephemeralPortMax-ephemeralPortMin; i++ {
+		p := uint16(ephemeralPortMin + (start-ephemeralPortMin+i)%(ephemeralPortMax-ephemeralPortMin+1))
+		if _, ok := s.tcpHandlers[p]; ok {
+			continue
+		}
+		if _, ok := s.tcpListeners[p]; !ok && !used[p] {
+			return p
+		}
+	}
+	return 0
+}
+
+func (s *Stack) unbindTCP(c *TCPConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tcpConns[c.key()] != c {
+		return
+	}
+	delete(s.tcpConns, c.key())
+	s.releaseTCPPort(c.lport)
+}
+
+// releaseTCPPort は誰もポートを使わなくなったらICMPのハンドラを消す。s.muを取ってから呼ぶ
+func (s *Stack) releaseTCPPort(port uint16) {
+	if _, ok := s.tcpListeners[port]; ok {
+		return
+	}
+	for key := range s.tcpConns {
+		if key.lport == port {
+			return
+		}
+	}
+	delete(s.icmpHandlers, icmpEndpoint{protocol: IPProtoTCP, port: port})
+}
+
+func (s *Stack) lookupTCPConn(dst []byte, dport uint16, src []byte, sport uint16) *TCPConn {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tcpConns[newTCPConnKey(dst, dport, src, sport)]
+}
+
+func (s *Stack) lookupTCPListener(dst []byte, dport uint16) *TCPListener {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	l, ok := s.tcpListeners[dport]
+	if !ok || (!isUnspecifiedAddr(l.laddr) && !bytes.Equal(l.laddr, dst)) {
+		return nil
+	}
+	return l
+}
+
+// handleTCP は自分宛てのTCPセグメントをコネクションかリスナーに渡す
+// どこにも届けられないセグメントにはRSTを返す
+func (s *Stack) handleTCP(ifc *NetInterface, packet []byte) {
+	ip := parseIP(packet[0:20])
+	raw := packet[ipHeaderLength(packet):]
+	if len(raw) < 20 {
+		return
+	}
+	hlen := int(raw[12]>>4) * 4
+	if hlen < 20 || hlen > len(raw) || !validTCPChecksum(ip, raw) {
+		return
+	}
+	// TCPはユニキャストだけなので、マルチキャストやブロードキャストにはRSTも返さない
+	if isMulticastAddr(ip.DstIPAddr) || s.isLocalBroadcast(ip.DstIPAddr) {
+		return
+	}
+	tcp := parseTCP(raw)
+	seg := tcpSegment{
+		seq:    binary.BigEndian.Uint32(tcp.SequenceNumber),
+		ack:    binary.BigEndian.Uint32(tcp.AcknowlegeNumber),
+		flags:  tcp.ControlFlags[0],
+		window: uint32(binary.BigEndian.Uint16(tcp.WindowSize)),
+		mss:    tcpOptionMSS(raw[20:hlen]),
+		data:   append([]byte{}, tcp.TCPData...),
+	}
+	sport := binary.BigEndian.Uint16(tcp.SourcePort)
+	dport := binary.BigEndian.Uint16(tcp.DestPort)
+
+	if handler := s.lookupTCPHandler(dport); handler != nil {
+		handler(ifc, packet)
+	}
+	if c := s.lookupTCPConn(ip.DstIPAddr, dport, ip.SourceIPAddr, sport); c != nil {
+		c.handleSegment(seg)
+		return
+	}
+	if seg.flags&(SYN|ACK|RST) == SYN {
+		if l := s.lookupTCPListener(ip.DstIPAddr, dport); l != nil {
+			l.handleSyn(ip, sport, seg)
+			return
+		}
+	}
+	s.sendTCPReset(ip.DstIPAddr, dport, ip.SourceIPAddr, sport, seg)
+}
+
+// RegisterTCPHandler はportが宛先のTCPセグメントをhandlerにも渡す
+// 自分で作ったSYNへの返事を見たいときに使う。コネクションやリスナーへの配送はそのまま行う
+func (s *Stack) RegisterTCPHandler(port uint16, handler IPProtocolHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tcpHandlers[port] = handler
+}
+
+func (s *Stack) UnregisterTCPHandler(port uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tcpHandlers, port)
+}
+
+func (s *Stack) lookupTCPHandler(port uint16) IPProtocolHandler {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tcpHandlers[port]
+}
+
+// validTCPChecksum は疑似ヘッダを含めてチェックサムを確かめる
+func validTCPChecksum(ip IPHeader, raw []byte) bool {
+	dummy := NewTCPDummyHeader(ip, uint16(len(raw)))
+	sum := sumByteArr(toByteArr(dummy))
+	if len(raw)%2 != 0 {
+		sum += sumByteArr(paddingZero(append([]byte{}, raw...)))
+	} else {
+		sum += sumByteArr(raw)
+	}
+	return bytes.Equal(checksum(sum), []byte{0x00, 0x00})
+}
+
+// tcpOptionMSS はオプションからMSSを取り出す
+func tcpOptionMSS(options []byte) int {
+	for i := 0; i < len(options); {
+		switch options[i] {
+		case 0x00:
+			return 0
+		case 0x01:
+			i++
+			continue
+		}
+		if i+1 >= len(options) || options[i+1] < 2 || i+int(options[i+1]) > len(options) {
+			return 0
+		}
+		if options[i] == 0x02 && options[i+1] == 4 {
+			return int(binary.BigEndian.Uint16(options[i+2 : i+4]))
+		}
+		i += int(options[i+1])
+	}
+	return 0
+}
+
+// newTCPSegment はチェックサムを計算したTCPセグメントを作る
+func newTCPSegment(ipheader IPHeader, sport, dport uint16, seq, ack uint32, flags byte, window uint16, options, data []byte) []byte {
+	tcpheader := NewTCPHeader(UintTo2byte(sport), UintTo2byte(dport), "")
+	tcpheader.SequenceNumber = UintTo4byte(seq)
+	tcpheader.AcknowlegeNumber = UintTo4byte(ack)
+	tcpheader.ControlFlags = []byte{flags}
+	tcpheader.WindowSize = UintTo2byte(window)
+	tcpheader.TCPOptionByte = options
+	num := toByteLen(tcpheader)
+	tcpheader.HeaderLength = []byte{byte(num << 2)}
+	tcpheader.TCPData = data
+
+	dummy := NewTCPDummyHeader(ipheader, num+uint16(len(data)))
+	sum := sumByteArr(toByteArr(dummy))
+	if len(data)%2 != 0 {
+		sum += sumByteArr(paddingZero(toByteArr(tcpheader)))
+	} else {
+		sum += sumByteArr(toByteArr(tcpheader))
+	}
+	tcpheader.Checksum = checksum(sum)
+	return toByteArr(tcpheader)
+}
+
+// sendTCPReset は受け取れないセグメントにRSTを返す(RFC793 3.4)
+func (s *Stack) sendTCPReset(src []byte, sport uint16, dst []byte, dport uint16, seg tcpSegment) {
+	if seg.flags&RST != 0 {
+		return
+	}
+	header := NewIPHeader(src, dst, "TCP")
+	var payload []byte
+	if seg.flags&ACK != 0 {
+		payload = newTCPSegment(header, sport, dport, seg.ack, 0, RST, 0, nil, nil)
+	} else {
+		payload = newTCPSegment(header, sport, dport, 0, seg.seq+seg.length(), RST|ACK, 0, nil, nil)
+	}
+	s.SendIPv4(header, payload)
+}
+
+// handleTCPError はTCPが送ったセグメントへのICMPエラーを受け取る
+func (s *Stack) handleTCPError(ifc *NetInterface, header IPHeader, message interface{}) {
+	var original ICMPQuote
+	var icmpType, code byte
+	switch m := message.(type) {
+	case ICMPDestinationUnreachable:
+		original, icmpType, code = m.Original, m.Type[0], m.Code[0]
+	case ICMPTimeExceeded:
+		original, icmpType, code = m.Original, m.Type[0], m.Code[0]
+	default:
+		return
+	}
+	sport, dport, ok := original.Ports()
+	if !ok {
+		return
+	}
+	c := s.lookupTCPConn(original.IPHeader.SourceIPAddr, sport, original.IPHeader.DstIPAddr, dport)
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Path MTUはStackが覚えたので、小さいセグメントで送り直す
+	if icmpType == ICMPTypeDestinationUnreachable && code == ICMPCodeFragmentationNeeded {
+		c.retransmit()
+		return
+	}
+	err := &ICMPError{From: header.SourceIPAddr, Type: icmpType, Code: code, Message: message}
+	// 接続中に届いたUnreachableは諦める。それ以外は再送がタイムアウトしたときに返す
+	if c.state == tcpStateSynSent && icmpType == ICMPTypeDestinationUnreachable {
+		c.fail(err)
+		return
+	}
+	c.softErr = err
+}
+
+// handleSyn はSYNを受け取ったらコネクションを作ってSYNACKを返す
+func (l *TCPListener) handleSyn(ip IPHeader, sport uint16, seg tcpSegment) {
+	select {
+	case <-l.closed:
+		return
+	default:
+	}
+	s := l.stack
+	c := newTCPConn(s, ip.DstIPAddr, l.lport, ip.SourceIPAddr, sport)
+	c.listener = l
+
+	s.mu.Lock()
+	if _, ok := s.tcpConns[c.key()]; ok {
+		s.mu.Unlock()
+		return
+	}
+	s.tcpConns[c.key()] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.state = tcpStateSynReceived
+	c.irs = seg.seq
+	c.rcvNxt = seg.seq + 1
+	c.sndUna = c.iss
+	c.sndNxt = c.iss + 1
+	c.sndMax = c.sndNxt
+	c.sndWnd = seg.window
+	c.setMSS(seg.mss)
+	c.sendSyn()
+	c.mu.Unlock()
+	go c.transmitLoop()
+}
+
+// Accept は3ウェイハンドシェイクが終わったコネクションを1つ返す
+func (l *TCPListener) Accept() (net.Conn, error) {
+	return l.AcceptTCP()
+}
+
+func (l *TCPListener) AcceptTCP() (*TCPConn, error) {
+	select {
+	case c := <-l.backlog:
+		return c, nil
+	case <-l.closed:
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: l.Addr(), Err: ErrTCPConnClosed}
+	}
+}
+
+// Close は接続を待つのをやめて、Acceptされていないコネクションをリセットする
+func (l *TCPListener) Close() error {
+	err := ErrTCPConnClosed
+	l.once.Do(func() {
+		close(l.closed)
+		s := l.stack
+		s.mu.Lock()
+		delete(s.tcpListeners, l.lport)
+		s.releaseTCPPort(l.lport)
+		s.mu.Unlock()
+		for {
+			select {
+			case c := <-l.backlog:
+				c.abort()
+				continue
+			default:
+			}
+			break
+		}
+		err = nil
+	})
+	return err
+}
+
+func (l *TCPListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IP(l.laddr), Port: int(l.lport)}
+}
+
+// handleSegment はコネクションに届いたセグメントを処理する(RFC793 3.9 SEGMENT ARRIVES)
+func (c *TCPConn) handleSegment(seg tcpSegment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case tcpStateClosed:
+		return
+	case tcpStateSynSent:
+		c.handleSynSent(seg)
+		return
+	}
+
+	if seg.flags&SYN != 0 && c.state == tcpStateSynReceived && seg.seq == c.irs {
+		// SYNACKが届かなかったので送り直す
+		c.sendSyn()
+		return
+	}
+	if !c.acceptable(seg) {
+		// 古いセグメントや窓の外のセグメントには今の状態をACKで知らせる
+		if seg.flags&RST == 0 {
+			c.sendAck()
+		}
+		return
+	}
+	if seg.flags&RST != 0 {
+		c.fail(syscall.ECONNRESET)
+		return
+	}
+	if seg.flags&SYN != 0 {
+		// 接続したあとのSYNはチャレンジACKを返して捨てる(RFC5961)
+		c.sendAck()
+		return
+	}
+	if seg.flags&ACK == 0 {
+		return
+	}
+	if c.state == tcpStateSynReceived {
+		if !seqLT(c.sndUna, seg.ack) || seqLT(c.sndNxt, seg.ack) {
+			c.stack.sendTCPReset(c.laddr, c.lport, c.raddr, c.rport, seg)
+			return
+		}
+		c.sndUna++
+		c.state = tcpStateEstablished
+		c.sndWnd = seg.window
+		c.retries = 0
+		c.stopTimer()
+		close(c.established)
+		select {
+		case <-c.listener.closed:
+			c.sendReset()
+			c.fail(syscall.ECONNREFUSED)
+			return
+		case c.listener.backlog <- c:
+		default:
+			// Acceptが追いつかないときはリセットする
+			c.sendReset()
+			c.fail(syscall.ECONNREFUSED)
+			return
+		}
+	}
+	if !c.handleAck(seg) {
+		return
+	}
+	c.handleData(seg)
+	c.output()
+}
+
+// handleSynSent はSYNを送ったあとに届いたセグメントを処理する
+func (c *TCPConn) handleSynSent(seg tcpSegment) {
+	if seg.flags&ACK != 0 && (seqLE(seg.ack, c.iss) || seqLT(c.sndNxt, seg.ack)) {
+		c.stack.sendTCPReset(c.laddr, c.lport, c.raddr, c.rport, seg)
+		return
+	}
+	if seg.flags&RST != 0 {
+		if seg.flags&ACK != 0 {
+			c.fail(syscall.ECONNREFUSED)
+		}
+		return
+	}
+	// 同時オープンには対応しない
+	if seg.flags&(SYN|ACK) != SYN|ACK {
+		return
+	}
+	c.irs = seg.seq
+	c.rcvNxt = seg.seq + 1
+	c.sndUna = seg.ack
+	c.sndWnd = seg.window
+	c.setMSS(seg.mss)
+	c.sampleRTT(seg.ack)
+	c.retries = 0
+	c.stopTimer()
+	c.state = tcpStateEstablished
+	c.sendAck()
+	close(c.established)
+}
+
+// acceptable はセグメントが受信ウィンドウに入っているか調べる(RFC793 3.3)
+func (c *TCPConn) acceptable(seg tcpSegment) bool {
+	wnd := uint32(c.rcvWindow())
+	n := seg.length()
+	if n == 0 {
+		if wnd == 0 {
+			return seg.seq == c.rcvNxt
+		}
+		return seqLE(c.rcvNxt, seg.seq) && seqLT(seg.seq, c.rcvNxt+wnd)
+	}
+	if wnd == 0 {
+		return false
+	}
+	last := seg.seq + n - 1
+	return (seqLE(c.rcvNxt, seg.seq) && seqLT(seg.seq, c.rcvNxt+wnd)) ||
+		(seqLE(c.rcvNxt, last) && seqLT(last, c.rcvNxt+wnd))
+}
+
+// handleAck は相手が受け取った分を送信バッファから消す
+// 処理を続けてよければtrueを返す
+func (c *TCPConn) handleAck(seg tcpSegment) bool {
+	if seqLT(c.sndMax, seg.ack) {
+		// まだ送っていないところへのACK
+		c.sendAck()
+		return false
+	}
+	if !seqLT(c.sndUna, seg.ack) {
+		// 同じACKが3回続いたら、タイムアウトを待たずに送り直す(RFC5681 3.2)
+		if seg.ack == c.sndUna && len(seg.data) == 0 && seg.flags&FIN == 0 && c.sndMax != c.sndUna && seg.window == c.sndWnd {
+			c.dupAcks++
+			if c.dupAcks == 3 && !seqLT(c.sndUna, c.recover) {
+				c.retransmit()
+			}
+		}
+		if seg.ack == c.sndUna {
+			c.sndWnd = seg.window
+		}
+		return true
+	}
+
+	acked := int(seg.ack - c.sndUna)
+	n := acked
+	if n > len(c.sendBuf) {
+		n = len(c.sendBuf)
+	}
+	c.sendBuf = c.sendBuf[n:]
+	c.sndUna = seg.ack
+	if seqLT(c.sndNxt, c.sndUna) {
+		// 送り直す前に送っていた分がACKされた
+		c.sndNxt = c.sndUna
+	}
+	c.sndWnd = seg.window
+	c.dupAcks = 0
+	c.retries = 0
+	c.sampleRTT(seg.ack)
+	// データより先がACKされていたらFINが届いている
+	finAcked := c.finQueued && acked > n
+	if finAcked {
+		c.finSent = true
+	}
+	if c.sndUna == c.sndMax {
+		c.stopTimer()
+	} else {
+		c.armTimer()
+	}
+	notify(c.writable)
+
+	if !finAcked {
+		return true
+	}
+	switch c.state {
+	case tcpStateFinWait1:
+		c.state = tcpStateFinWait2
+		c.armTimerAfter(tcpFinTimeout)
+	case tcpStateClosing:
+		c.enterTimeWait()
+	case tcpStateLastAck:
+		c.fail(nil)
+		return false
+	}
+	return true
+}
+
+// handleData は順番通りに届いたデータとFINを受信バッファに入れる
+func (c *TCPConn) handleData(seg tcpSegment) {
+	switch c.state {
+	case tcpStateEstablished, tcpStateFinWait1, tcpStateFinWait2:
+	default:
+		return
+	}
+	data := seg.data
+	fin := seg.flags&FIN != 0
+	seq := seg.seq
+	// 前に受け取った部分は切り捨てる
+	if seqLT(seq, c.rcvNxt) {
+		skip := int(c.rcvNxt - seq)
+		if skip > len(data) {
+			return
+		}
+		data = data[skip:]
+		seq = c.rcvNxt
+	}
+	if seq != c.rcvNxt {
+		// 順番が入れ替わったものは捨てて、欲しいところをACKで知らせる
+		c.sendAck()
+		return
+	}
+	if room := c.rcvWindow(); len(data) > room {
+		data = data[:room]
+		fin = false
+	}
+	if len(data) == 0 && !fin {
+		return
+	}
+	c.recvBuf = append(c.recvBuf, data...)
+	c.rcvNxt += uint32(len(data))
+	if fin {
+		c.rcvNxt++
+		c.recvFin = true
+		switch c.state {
+		case tcpStateEstablished:
+			c.state = tcpStateCloseWait
+		case tcpStateFinWait1:
+			c.state = tcpStateClosing
+		case tcpStateFinWait2:
+			c.enterTimeWait()
+		}
+	}
+	c.sendAck()
+	notify(c.readable)
+}
+
+func (c *TCPConn) enterTimeWait() {
+	c.state = tcpStateTimeWait
+	c.armTimerAfter(tcpTimeWait)
+}
+
+// rcvWindow は受信バッファの空きを返す
+func (c *TCPConn) rcvWindow() int {
+	return tcpReadBuffer - len(c.recvBuf)
+}
+
+// setMSS は相手のMSSとPath MTUから送るセグメントの大きさを決める
+func (c *TCPConn) setMSS(mss int) {
+	if mss == 0 {
+		mss = tcpDefaultMSS
+	}
+	c.sndMSS = mss
+}
+
+func (c *TCPConn) mss() int {
+	mss := c.sndMSS
+	if pmtu := c.stack.PathMTU(c.raddr) - tcpIPv4Overhead; pmtu < mss {
+		mss = pmtu
+	}
+	return mss
+}
+
+// sendSegment はseqから始まるセグメントを送る
+func (c *TCPConn) sendSegment(flags byte, seq uint32, options, data []byte) {
+	header := NewIPHeader(c.laddr, c.raddr, "TCP")
+	var ack uint32
+	if flags&ACK != 0 {
+		ack = c.rcvNxt
+	}
+	window := uint16(c.rcvWindow())
+	c.txq = append(c.txq, tcpPacket{header: header, payload: newTCPSegment(header, c.lport, c.rport, seq, ack, flags, window, options, data)})
+	notify(c.txReady)
+}
+
+// transmitLoop は送信キューのセグメントを送る。コネクションが閉じたら残りを送って終わる
+func (c *TCPConn) transmitLoop() {
+	for {
+		c.mu.Lock()
+		q := c.txq
+		c.txq = nil
+		done := c.state == tcpStateClosed
+		c.mu.Unlock()
+
+		for _, p := range q {
+			c.stack.SendIPv4(p.header, p.payload)
+		}
+		if done {
+			return
+		}
+		<-c.txReady
+	}
+}
+
+// sendSyn はMSSオプションを付けてSYNかSYNACKを送る
+func (c *TCPConn) sendSyn() {
+	options := NewTCPOptionsWithMSS(c.stack.TCPMSS(c.raddr)).MaxsSegmentSize
+	if c.state == tcpStateSynReceived {
+		c.sendSegment(SYNACK, c.iss, options, nil)
+	} else {
+		c.sendSegment(SYN, c.iss, options, nil)
+	}
+	c.armTimer()
+}
+
+func (c *TCPConn) sendAck() {
+	c.sendSegment(ACK, c.sndNxt, nil, nil)
+}
+
+func (c *TCPConn) sendReset() {
+	c.sendSegment(RST|ACK, c.sndNxt, nil, nil)
+}
+
+// output は送信ウィンドウに入るだけデータを送り、全部送ったらFINを送る
+func (c *TCPConn) output() {
+	switch c.state {
+	case tcpStateEstablished, tcpStateCloseWait, tcpStateFinWait1, tcpStateClosing, tcpStateLastAck:
+	default:
+		return
+	}
+	mss := c.mss()
+	for !c.finSent {
+		sent := int(c.sndNxt - c.sndUna)
+		if unsent := len(c.sendBuf) - sent; unsent > 0 {
+			n := unsent
+			if n > mss {
+				n = mss
+			}
+			if room := int(c.sndWnd) - sent; n > room {
+				n = room
+			}
+			if n <= 0 {
+				// ウィンドウが0のときは再送タイマーでプローブを送る
+				break
+			}
+			c.sendData(sent, n)
+			continue
+		}
+		if c.finQueued {
+			c.sendSegment(FIN|ACK, c.sndNxt, nil, nil)
+			c.sndNxt++
+			c.finSent = true
+			c.updateSndMax()
+		}
+		break
+	}
+	if (c.sndMax != c.sndUna || len(c.sendBuf) != 0) && !c.timerOn {
+		c.armTimer()
+	}
+}
+
+// sendData は送信バッファのoffsetからnバイトを送る
+func (c *TCPConn) sendData(offset, n int) {
+	flags := byte(ACK)
+	if offset+n == len(c.sendBuf) {
+		flags |= PSH
+	}
+	if !c.rttTiming {
+		c.rttTiming, c.rttSeq, c.rttStart = true, c.sndNxt, time.Now()
+	}
+	c.sendSegment(flags, c.sndNxt, nil, c.sendBuf[offset:offset+n])
+	c.sndNxt += uint32(n)
+	c.updateSndMax()
+}
+
+func (c *TCPConn) updateSndMax() {
+	if seqLT(c.sndMax, c.sndNxt) {
+		c.sndMax = c.sndNxt
+	}
+}
+
+// retransmit はACKされていないところから送り直す(go-back-N)
+// ウィンドウが0でも1セグメントは送るので、ゼロウィンドウのプローブにもなる
+func (c *TCPConn) retransmit() {
+	switch c.state {
+	case tcpStateSynSent, tcpStateSynReceived:
+		c.sendSyn()
+		return
+	case tcpStateEstablished, tcpStateCloseWait, tcpStateFinWait1, tcpStateClosing, tcpStateLastAck:
+	default:
+		return
+	}
+	c.rttTiming = false
+	c.dupAcks = 0
+	c.recover = c.sndMax
+	c.sndNxt = c.sndUna
+	c.finSent = false
+	if len(c.sendBuf) != 0 && c.sndWnd == 0 {
+		c.sendData(0, 1)
+		c.rttTiming = false
+	}
+	c.output()
+	c.armTimer()
+}
+
+// onTimeout は再送タイマーが切れたときに呼ばれる
+func (c *TCPConn) onTimeout() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.timerOn {
+		return
+	}
+	c.timerOn = false
+
+	switch c.state {
+	case tcpStateClosed:
+		return
+	case tcpStateTimeWait:
+		c.fail(nil)
+		return
+	case tcpStateFinWait2:
+		c.fail(os.ErrDeadlineExceeded)
+		return
+	}
+	if c.sndMax == c.sndUna && len(c.sendBuf) == 0 && c.state != tcpStateSynSent && c.state != tcpStateSynReceived {
+		return
+	}
+	c.retries++
+	limit := tcpMaxRetries
+	if c.state == tcpStateSynSent || c.state == tcpStateSynReceived {
+		limit = tcpSynRetries
+	}
+	if c.retries > limit {
+		err := c.softErr
+		if err == nil {
+			err = syscall.ETIMEDOUT
+		}
+		c.fail(err)
+		return
+	}
+	// 送り直すたびに待つ時間を倍にする
+	c.rto *= 2
+	if c.rto > tcpMaxRTO {
+		c.rto = tcpMaxRTO
+	}
+	c.retransmit()
+}
+
+func (c *TCPConn) armTimer() {
+	c.armTimerAfter(c.rto)
+}
+
+func (c *TCPConn) armTimerAfter(d time.Duration) {
+	c.timerOn = true
+	if c.timer == nil {
+		c.timer = time.AfterFunc(d, c.onTimeout)
+		return
+	}
+	c.timer.Reset(d)
+}
+
+func (c *TCPConn) stopTimer() {
+	c.timerOn = false
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
+
+// sampleRTT は測っていたセグメントがACKされたらRTOを計算し直す(RFC6298)
+func (c *TCPConn) sampleRTT(ack uint32) {
+	if !c.rttTiming || !seqLT(c.rttSeq, ack) {
+		return
+	}
+	c.rttTiming = false
+	rtt := time.Since(c.rttStart)
+	if c.srtt == 0 {
+		c.srtt = rtt
+		c.rttvar = rtt / 2
+	} else {
+		diff := c.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		c.rttvar = (3*c.rttvar + diff) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	c.rto = c.srtt + 4*c.rttvar
+	if c.rto < tcpMinRTO {
+		c.rto = tcpMinRTO
+	}
+	if c.rto > tcpMaxRTO {
+		c.rto = tcpMaxRTO
+	}
+}
+
+// fail はコネクションを捨てる。errがnilでなければ次のReadかWriteで返す
+func (c *TCPConn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.state = tcpStateClosed
+	c.stopTimer()
+	c.stack.unbindTCP(c)
+	if !isClosedChan(c.established) {
+		if c.err == nil {
+			c.err = ErrTCPConnClosed
+		}
+		close(c.established)
+	}
+	notify(c.readable)
+	notify(c.writable)
+	notify(c.txReady)
+}
+
+// abort はRSTを送ってコネクションを捨てる
+func (c *TCPConn) abort() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != tcpStateClosed {
+		c.sendReset()
+		c.fail(syscall.ECONNRESET)
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Read は届いたデータを読む。相手がFINを送ってきたらio.EOFを返す
+func (c *TCPConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for {
+		c.mu.Lock()
+		if len(c.recvBuf) != 0 {
+			before := c.rcvWindow()
+			n := copy(p, c.recvBuf)
+			c.recvBuf = c.recvBuf[:copy(c.recvBuf, c.recvBuf[n:])]
+			// 閉じかけていたウィンドウが開いたら相手に知らせる
+			if before < c.mss() && c.rcvWindow() >= c.mss() && c.state != tcpStateClosed {
+				c.sendAck()
+			}
+			c.mu.Unlock()
+			return n, nil
+		}
+		recvFin, err := c.recvFin, c.err
+		c.mu.Unlock()
+		if recvFin {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, c.opError("read", err)
+		}
+		select {
+		case <-c.closed:
+			return 0, c.opError("read", ErrTCPConnClosed)
+		case <-c.readDeadline.wait():
+			return 0, c.opError("read", os.ErrDeadlineExceeded)
+		case <-c.readable:
+		}
+	}
+}
+
+// Write は送信バッファにデータを入れて送る。バッファがいっぱいならACKされるまで待つ
+func (c *TCPConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	for written < len(p) {
+		select {
+		case <-c.closed:
+			return written, c.opError("write", ErrTCPConnClosed)
+		case <-c.writeDeadline.wait():
+			return written, c.opError("write", os.ErrDeadlineExceeded)
+		default:
+		}
+		c.mu.Lock()
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return written, c.opError("write", err)
+		}
+		if c.finQueued {
+			c.mu.Unlock()
+			return written, c.opError("write", syscall.EPIPE)
+		}
+		if room := tcpWriteBuffer - len(c.sendBuf); room > 0 {
+			n := len(p) - written
+			if n > room {
+				n = room
+			}
+			c.sendBuf = append(c.sendBuf, p[written:written+n]...)
+			written += n
+			c.output()
+			c.mu.Unlock()
+			continue
+		}
+		c.mu.Unlock()
+		select {
+		case <-c.closed:
+		case <-c.writeDeadline.wait():
+		case <-c.writable:
+		}
+	}
+	return written, nil
+}
+
+func (c *TCPConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "tcp", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: err}
+}
+
+// Close はFINを送って閉じる。FINのやり取りはClose()から戻ったあとも続く
+// 読まれていないデータが残っていたらRSTを送る(RFC2525 2.17)
+func (c *TCPConn) Close() error {
+	err := ErrTCPConnClosed
+	c.once.Do(func() {
+		close(c.closed)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		err = nil
+		if len(c.recvBuf) != 0 && c.state != tcpStateClosed {
+			c.sendReset()
+			c.fail(ErrTCPConnClosed)
+			return
+		}
+		switch c.state {
+		case tcpStateSynSent:
+			c.fail(ErrTCPConnClosed)
+		case tcpStateSynReceived, tcpStateEstablished:
+			c.state = tcpStateFinWait1
+		case tcpStateCloseWait:
+			c.state = tcpStateLastAck
+		default:
+			return
+		}
+		c.finQueued = true
+		c.output()
+	})
+	return err
+}
+
+// CloseWrite はFINを送って送信だけ閉じる。相手からのデータはまだ読める
+func (c *TCPConn) CloseWrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case tcpStateEstablished:
+		c.state = tcpStateFinWait1
+	case tcpStateCloseWait:
+		c.state = tcpStateLastAck
+	default:
+		return c.opError("close", syscall.ENOTCONN)
+	}
+	c.finQueued = true
+	c.output()
+	return nil
+}
+
+func (c *TCPConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IP(c.laddr), Port: int(c.lport)}
+}
+
+func (c *TCPConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IP(c.raddr), Port: int(c.rport)}
+}
+
+func (c *TCPConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *TCPConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *TCPConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
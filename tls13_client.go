@@ -0,0 +1,864 @@
+package tcpip
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// TLS1.3のクライアント
+// https://datatracker.ietf.org/doc/html/rfc8446
+// 暗号スイートはTLS_CHACHA20_POLY1305_SHA256、鍵交換はX25519だけを使う
+
+const (
+	// 暗号化する前のレコードの最大長
+	tlsMaxPlaintext = 16384
+	// 暗号化したレコードの最大長
+	tlsMaxCiphertext = tlsMaxPlaintext + 256
+
+	HandshakeTypeKeyUpdate = 0x18
+
+	TLSAlertCloseNotify       = 0
+	TLSAlertUnexpectedMessage = 10
+	TLSAlertBadRecordMAC      = 20
+	TLSAlertHandshakeFailure  = 40
+	TLSAlertBadCertificate    = 42
+	TLSAlertIllegalParameter  = 47
+	TLSAlertDecodeError       = 50
+	TLSAlertDecryptError      = 51
+)
+
+// HelloRetryRequestのときにServerHelloのRandomに入っている値
+var tlsHelloRetryRequestRandom = strtoByte("cf21ad74e59a6111be1d8c021e65b891c2a211167abb8c5e079e09e2c8a8339c")
+
+// TLSAlertError は相手から受け取ったか、相手に送ったアラート
+type TLSAlertError struct {
+	Description uint8
+	// 相手から受け取ったときにtrue
+	Remote bool
+}
+
+func (e *TLSAlertError) Error() string {
+	if e.Remote {
+		return fmt.Sprintf("tls: remote alert %d", e.Description)
+	}
+	return fmt.Sprintf("tls: local alert %d", e.Description)
+}
+
+// TLS13Config はTLS13Connの設定
+type TLS13Config struct {
+	// SNIで送る名前で、証明書もこの名前で確かめる
+	ServerName string
+	// 証明書を確かめるルート証明書。nilならOSにインストールされているものを使う
+	RootCAs *x509.CertPool
+	// trueなら証明書を確かめない
+	InsecureSkipVerify bool
+	// ALPNで送るプロトコル。HTTP/2なら"h2"
+	NextProtos []string
+	// NSS Key Log Formatで鍵を書き出す先。nilならパッケージのKeyLogWriterを使う
+	KeyLogWriter io.Writer
+}
+
+// TLS13Conn はnet.Connの上でTLS1.3を話すクライアント
+// 最初のReadかWriteでハンドシェイクをする
+type TLS13Conn struct {
+	conn   net.Conn
+	config TLS13Config
+
+	handshakeMu  sync.Mutex
+	handshakeErr error
+	handshaked   bool
+	// ハンドシェイクを終えてApplication Dataを送れるようになったらtrue
+	established bool
+
+	// 鍵とシーケンス番号。サーバ側はreadMu、クライアント側はwriteMuで守る
+	tlsinfo TLSInfo
+	// サーバが選んだALPNのプロトコル
+	protocol string
+	// サーバの証明書
+	peerCertificates []*x509.Certificate
+
+	readMu sync.Mutex
+	// 読んだがまだレコードになりきっていないデータ
+	rawInput []byte
+	// 復号してまだReadで返していないApplication Data
+	input []byte
+	// まだメッセージになりきっていないハンドシェイクのデータ
+	hsbuf []byte
+	// サーバから読むときの鍵が決まったらtrue
+	decrypting bool
+	readErr    error
+
+	writeMu sync.Mutex
+	closed  bool
+}
+
+// TLS13Client はconnの上でTLS1.3のクライアントとして話すコネクションを作る
+func TLS13Client(conn net.Conn, config *TLS13Config) *TLS13Conn {
+	c := &TLS13Conn{conn: conn}
+	if config != nil {
+		c.config = *config
+	}
+	return c
+}
+
+// Handshake はまだならハンドシェイクをする
+func (c *TLS13Conn) Handshake() error {
+	c.handshakeMu.Lock()
+	defer c.handshakeMu.Unlock()
+
+	if c.handshaked {
+		return c.handshakeErr
+	}
+	c.handshaked = true
+	c.handshakeErr = c.clientHandshake()
+	if alert, ok := c.handshakeErr.(*TLSAlertError); ok && !alert.Remote {
+		c.sendAlert(alert.Description)
+	}
+	return c.handshakeErr
+}
+
+// NegotiatedProtocol はALPNでサーバが選んだプロトコルを返す
+func (c *TLS13Conn) NegotiatedProtocol() string {
+	c.handshakeMu.Lock()
+	defer c.handshakeMu.Unlock()
+	return c.protocol
+}
+
+// PeerCertificates はサーバから送られてきた証明書を返す
+func (c *TLS13Conn) PeerCertificates() []*x509.Certificate {
+	c.handshakeMu.Lock()
+	defer c.handshakeMu.Unlock()
+	return c.peerCertificates
+}
+
+func (c *TLS13Conn) clientHello() ([]byte, ECDHEKeys) {
+	// 先頭のLengthを外して、SNIとALPNを足す
+	ext, keys := setTLS13Extension(false)
+	ext = ext[2:]
+	if name := c.config.ServerName; name != "" && net.ParseIP(name) == nil {
+		ext = append(ext, tlsServerNameExtension(name)...)
+	}
+	if len(c.config.NextProtos) != 0 {
+		ext = append(ext, tlsALPNExtension(c.config.NextProtos)...)
+	}
+
+	handshake := ClientHello{
+		HandshakeType:      []byte{HandshakeTypeClientHello},
+		Length:             []byte{0x00, 0x00, 0x00},
+		Version:            TLS1_2,
+		Random:             randomByte(32),
+		SessionIDLength:    []byte{0x20},
+		SessionID:          randomByte(32),
+		CipherSuitesLength: []byte{0x00, 0x02},
+		// TLS_CHACHA20_POLY1305_SHA256
+		CipherSuites:      []byte{0x13, 0x03},
+		CompressionLength: []byte{0x01},
+		CompressionMethod: []byte{0x00},
+		Extensions:        append(UintTo2byte(uint16(len(ext))), ext...),
+	}
+	// Typeの1byteとLengthの3byteを合計から引く
+	handshake.Length = UintTo3byte(uint32(toByteLen(handshake) - 4))
+
+	return toByteArr(handshake), keys
+}
+
+// 3. Server Name Indication
+// https://datatracker.ietf.org/doc/html/rfc6066#section-3
+func tlsServerNameExtension(name string) []byte {
+	// host_nameは0
+	entry := append([]byte{0x00}, UintTo2byte(uint16(len(name)))...)
+	entry = append(entry, name...)
+	list := append(UintTo2byte(uint16(len(entry))), entry...)
+
+	ext := []byte{0x00, 0x00}
+	ext = append(ext, UintTo2byte(uint16(len(list)))...)
+	return append(ext, list...)
+}
+
+// 3.1. The Application-Layer Protocol Negotiation Extension
+// https://datatracker.ietf.org/doc/html/rfc7301#section-3.1
+func tlsALPNExtension(protos []string) []byte {
+	var list []byte
+	for _, proto := range protos {
+		list = append(list, byte(len(proto)))
+		list = append(list, proto...)
+	}
+	list = append(UintTo2byte(uint16(len(list))), list...)
+
+	ext := []byte{0x00, 0x10}
+	ext = append(ext, UintTo2byte(uint16(len(list)))...)
+	return append(ext, list...)
+}
+
+func (c *TLS13Conn) clientHandshake() error {
+	hello, keys := c.clientHello()
+	c.tlsinfo.ECDHEKeys = keys
+	c.tlsinfo.Handshakemessages = hello
+
+	record := NewTLSRecordHeader("Handshake", uint16(len(hello)))
+	if _, err := c.conn.Write(append(record, hello...)); err != nil {
+		return err
+	}
+
+	// ServerHelloは暗号化されずに来る
+	msg, err := c.readHandshake(HandshakeTypeServerHello)
+	if err != nil {
+		return err
+	}
+	serverKey, err := parseTLS13ServerHello(msg, hello[39:71])
+	if err != nil {
+		return err
+	}
+	c.tlsinfo.Handshakemessages = append(c.tlsinfo.Handshakemessages, msg...)
+
+	sharedkey, err := curve25519.X25519(keys.PrivateKey, serverKey)
+	if err != nil {
+		return &TLSAlertError{Description: TLSAlertIllegalParameter}
+	}
+	c.tlsinfo.ECDHEKeys.SharedKey = sharedkey
+	c.tlsinfo.KeyBlockTLS13 = keyscheduleHandshake(sharedkey, c.tlsinfo.Handshakemessages)
+	if err := writeTLS13HandshakeKeyLog(c.keyLogWriter(), c.tlsinfo.Handshakemessages, c.tlsinfo.KeyBlockTLS13); err != nil {
+		return err
+	}
+	c.tlsinfo.State = ContentTypeHandShake
+	c.decrypting = true
+
+	// ここから先は暗号化されている
+	msg, err = c.readHandshake(HandshakeTypeEncryptedExtensions)
+	if err != nil {
+		return err
+	}
+	if err := c.handleEncryptedExtensions(msg); err != nil {
+		return err
+	}
+	c.tlsinfo.Handshakemessages = append(c.tlsinfo.Handshakemessages, msg...)
+
+	// クライアント証明書を求められたら、空のCertificateを返す
+	var certRequestContext []byte
+	certRequested := false
+	msg, err = c.readHandshake(0)
+	if err != nil {
+		return err
+	}
+	if msg[0] == HandshakeTypeCertificateRequest {
+		if len(msg) < 5 || len(msg) < 5+int(msg[4]) {
+			return &TLSAlertError{Description: TLSAlertDecodeError}
+		}
+		certRequested = true
+		certRequestContext = append([]byte{}, msg[5:5+int(msg[4])]...)
+		c.tlsinfo.Handshakemessages = append(c.tlsinfo.Handshakemessages, msg...)
+		if msg, err = c.readHandshake(HandshakeTypeCertificate); err != nil {
+			return err
+		}
+	}
+	if msg[0] != HandshakeTypeCertificate {
+		return &TLSAlertError{Description: TLSAlertUnexpectedMessage}
+	}
+	certs, err := parseTLS13Certificate(msg)
+	if err != nil {
+		return err
+	}
+	if err := c.verifyCertificates(certs); err != nil {
+		return err
+	}
+	c.peerCertificates = certs
+	c.tlsinfo.Handshakemessages = append(c.tlsinfo.Handshakemessages, msg...)
+
+	// 4.4.3. Certificate Verify
+	msg, err = c.readHandshake(HandshakeTypeCertificateVerify)
+	if err != nil {
+		return err
+	}
+	if len(msg) < 8 || len(msg) != 8+int(binary.BigEndian.Uint16(msg[6:8])) {
+		return &TLSAlertError{Description: TLSAlertDecodeError}
+	}
+	scheme := binary.BigEndian.Uint16(msg[4:6])
+	if err := verifyTLS13Signature(certs[0].PublicKey, scheme, msg[8:], c.tlsinfo.Handshakemessages); err != nil {
+		return err
+	}
+	c.tlsinfo.Handshakemessages = append(c.tlsinfo.Handshakemessages, msg...)
+
+	// 4.4.4. Finished
+	msg, err = c.readHandshake(HandshakeTypeFinished)
+	if err != nil {
+		return err
+	}
+	expected := tls13FinishedData(c.tlsinfo.KeyBlockTLS13.ServerFinishedKey, c.tlsinfo.Handshakemessages)
+	if !hmac.Equal(msg[4:], expected) {
+		return &TLSAlertError{Description: TLSAlertDecryptError}
+	}
+	c.tlsinfo.Handshakemessages = append(c.tlsinfo.Handshakemessages, msg...)
+
+	// Application Data用の鍵はサーバのFinishedまでのメッセージから作る
+	c.tlsinfo.KeyBlockTLS13 = keyscheduleAppTraffic(c.tlsinfo.KeyBlockTLS13, c.tlsinfo.Handshakemessages)
+	if err := writeTLS13AppTrafficKeyLog(c.keyLogWriter(), c.tlsinfo.Handshakemessages, c.tlsinfo.KeyBlockTLS13); err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	// ミドルボックス対策のChangeCipherSpecを送る
+	if _, err := c.conn.Write(NewChangeCipherSpec()); err != nil {
+		return err
+	}
+	if certRequested {
+		cert := []byte{HandshakeTypeCertificate}
+		body := append([]byte{byte(len(certRequestContext))}, certRequestContext...)
+		body = append(body, 0x00, 0x00, 0x00)
+		cert = append(cert, UintTo3byte(uint32(len(body)))...)
+		cert = append(cert, body...)
+		if err := c.writeRecord(ContentTypeHandShake, cert); err != nil {
+			return err
+		}
+		c.tlsinfo.Handshakemessages = append(c.tlsinfo.Handshakemessages, cert...)
+	}
+	fin := []byte{HandshakeTypeFinished}
+	fin = append(fin, UintTo3byte(32)...)
+	fin = append(fin, tls13FinishedData(c.tlsinfo.KeyBlockTLS13.ClientFinishedKey, c.tlsinfo.Handshakemessages)...)
+	if err := c.writeRecord(ContentTypeHandShake, fin); err != nil {
+		return err
+	}
+	c.tlsinfo.Handshakemessages = append(c.tlsinfo.Handshakemessages, fin...)
+
+	c.tlsinfo.State = ContentTypeApplicationData
+	c.established = true
+	return nil
+}
+
+// parseTLS13ServerHello はServerHelloを確かめて、サーバのX25519の公開鍵を返す
+func parseTLS13ServerHello(msg, sessionID []byte) ([]byte, error) {
+	decodeErr := &TLSAlertError{Description: TLSAlertDecodeError}
+	// Type(1) + Length(3) + Version(2) + Random(32) + SessionIDLength(1)
+	if len(msg) < 39 {
+		return nil, decodeErr
+	}
+	if bytes.Equal(msg[6:38], tlsHelloRetryRequestRandom) {
+		return nil, errors.New("tls: HelloRetryRequest is not supported")
+	}
+	body := msg[38:]
+	sidlen := int(body[0])
+	// SessionID + CipherSuite(2) + Compression(1) + ExtensionLength(2)
+	if len(body) < 1+sidlen+5 {
+		return nil, decodeErr
+	}
+	if !bytes.Equal(body[1:1+sidlen], sessionID) {
+		return nil, &TLSAlertError{Description: TLSAlertIllegalParameter}
+	}
+	body = body[1+sidlen:]
+	if !bytes.Equal(body[0:2], []byte{0x13, 0x03}) || body[2] != 0x00 {
+		return nil, &TLSAlertError{Description: TLSAlertIllegalParameter}
+	}
+
+	var version, serverKey []byte
+	exts, err := parseTLSExtensions(body[3:])
+	if err != nil {
+		return nil, err
+	}
+	for typ, value := range exts {
+		switch typ {
+		// supported_versions
+		case 0x002b:
+			version = value
+		// key_share
+		case 0x0033:
+			if len(value) != 36 || binary.BigEndian.Uint16(value[0:2]) != CurveIDx25519 || binary.BigEndian.Uint16(value[2:4]) != 32 {
+				return nil, &TLSAlertError{Description: TLSAlertIllegalParameter}
+			}
+			serverKey = value[4:]
+		}
+	}
+	if !bytes.Equal(version, TLS1_3) || serverKey == nil {
+		return nil, &TLSAlertError{Description: TLSAlertHandshakeFailure}
+	}
+	return serverKey, nil
+}
+
+// parseTLSExtensions は2byteのLengthから始まるExtensionsをTypeごとに分ける
+func parseTLSExtensions(b []byte) (map[uint16][]byte, error) {
+	decodeErr := &TLSAlertError{Description: TLSAlertDecodeError}
+	if len(b) < 2 || len(b) != 2+int(binary.BigEndian.Uint16(b[0:2])) {
+		return nil, decodeErr
+	}
+	exts := make(map[uint16][]byte)
+	b = b[2:]
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, decodeErr
+		}
+		length := int(binary.BigEndian.Uint16(b[2:4]))
+		if len(b) < 4+length {
+			return nil, decodeErr
+		}
+		exts[binary.BigEndian.Uint16(b[0:2])] = b[4 : 4+length]
+		b = b[4+length:]
+	}
+	return exts, nil
+}
+
+func (c *TLS13Conn) handleEncryptedExtensions(msg []byte) error {
+	exts, err := parseTLSExtensions(msg[4:])
+	if err != nil {
+		return err
+	}
+	alpn, ok := exts[0x0010]
+	if !ok {
+		return nil
+	}
+	// プロトコルは1つだけ選ばれている
+	if len(alpn) < 3 || int(binary.BigEndian.Uint16(alpn[0:2])) != len(alpn)-2 || int(alpn[2]) != len(alpn)-3 {
+		return &TLSAlertError{Description: TLSAlertDecodeError}
+	}
+	proto := string(alpn[3:])
+	for _, p := range c.config.NextProtos {
+		if p == proto {
+			c.protocol = proto
+			return nil
+		}
+	}
+	return &TLSAlertError{Description: TLSAlertIllegalParameter}
+}
+
+// parseTLS13Certificate はTLS1.3のCertificateメッセージから証明書を取り出す
+// TLS1.2と違い、証明書ごとにExtensionsが付いている
+func parseTLS13Certificate(msg []byte) ([]*x509.Certificate, error) {
+	decodeErr := &TLSAlertError{Description: TLSAlertDecodeError}
+	body := msg[4:]
+	if len(body) < 1 || len(body) < 1+int(body[0])+3 {
+		return nil, decodeErr
+	}
+	body = body[1+int(body[0]):]
+	if int(sum3BytetoLength(body[0:3])) != len(body)-3 {
+		return nil, decodeErr
+	}
+	body = body[3:]
+
+	var certs []*x509.Certificate
+	for len(body) > 0 {
+		if len(body) < 3 {
+			return nil, decodeErr
+		}
+		length := int(sum3BytetoLength(body[0:3]))
+		if len(body) < 3+length+2 {
+			return nil, decodeErr
+		}
+		cert, err := x509.ParseCertificate(body[3 : 3+length])
+		if err != nil {
+			return nil, &TLSAlertError{Description: TLSAlertBadCertificate}
+		}
+		certs = append(certs, cert)
+		body = body[3+length:]
+		extlen := int(binary.BigEndian.Uint16(body[0:2]))
+		if len(body) < 2+extlen {
+			return nil, decodeErr
+		}
+		body = body[2+extlen:]
+	}
+	if len(certs) == 0 {
+		return nil, &TLSAlertError{Description: TLSAlertBadCertificate}
+	}
+	return certs, nil
+}
+
+func (c *TLS13Conn) verifyCertificates(certs []*x509.Certificate) error {
+	if c.config.InsecureSkipVerify {
+		return nil
+	}
+	if c.config.ServerName == "" {
+		return errors.New("tls: either ServerName or InsecureSkipVerify must be specified")
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       c.config.ServerName,
+		Roots:         c.config.RootCAs,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		c.sendAlert(TLSAlertBadCertificate)
+		return err
+	}
+	return nil
+}
+
+// verifyTLS13Signature はCertificateVerifyの署名を確かめる
+// signature_algorithmsで送ったもののうちRSA-PSS, ECDSA, Ed25519に対応する
+func verifyTLS13Signature(pubkey crypto.PublicKey, scheme uint16, signature, handshake_messages []byte) error {
+	// 64回繰り返されるオクテット32（0x20）、コンテキスト文字列、0、メッセージのハッシュ
+	signed := strtoByte(str0x20x64)
+	signed = append(signed, serverCertificateContextString...)
+	signed = append(signed, 0x00)
+	signed = append(signed, WriteHash(handshake_messages)...)
+
+	var hash crypto.Hash
+	switch scheme {
+	case 0x0804, 0x0403:
+		hash = crypto.SHA256
+	case 0x0805:
+		hash = crypto.SHA384
+	case 0x0806:
+		hash = crypto.SHA512
+	}
+
+	var ok bool
+	switch scheme {
+	// rsa_pss_rsae_sha256, sha384, sha512
+	case 0x0804, 0x0805, 0x0806:
+		if key, isRSA := pubkey.(*rsa.PublicKey); isRSA {
+			h := hash.New()
+			h.Write(signed)
+			signOpts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}
+			ok = rsa.VerifyPSS(key, hash, h.Sum(nil), signature, signOpts) == nil
+		}
+	// ecdsa_secp256r1_sha256
+	case 0x0403:
+		if key, isECDSA := pubkey.(*ecdsa.PublicKey); isECDSA {
+			digest := sha256.Sum256(signed)
+			ok = ecdsa.VerifyASN1(key, digest[:], signature)
+		}
+	// ed25519
+	case 0x0807:
+		if key, isEd25519 := pubkey.(ed25519.PublicKey); isEd25519 {
+			ok = ed25519.Verify(key, signed, signature)
+		}
+	default:
+		return &TLSAlertError{Description: TLSAlertIllegalParameter}
+	}
+	if !ok {
+		return &TLSAlertError{Description: TLSAlertDecryptError}
+	}
+	return nil
+}
+
+// tls13FinishedData はFinishedメッセージのverify_dataを計算する
+func tls13FinishedData(key, handshake_messages []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(WriteHash(handshake_messages))
+	return mac.Sum(nil)
+}
+
+// readHandshake はハンドシェイクメッセージを1つ読む
+// typが0でなければ、そのTypeのメッセージでなければエラーにする
+func (c *TLS13Conn) readHandshake(typ byte) ([]byte, error) {
+	for {
+		if msg, ok := c.nextHandshake(); ok {
+			if typ != 0 && msg[0] != typ {
+				return nil, &TLSAlertError{Description: TLSAlertUnexpectedMessage}
+			}
+			return msg, nil
+		}
+		ctype, data, err := c.readRecord()
+		if err != nil {
+			return nil, err
+		}
+		switch ctype {
+		case ContentTypeHandShake:
+			c.hsbuf = append(c.hsbuf, data...)
+		case ContentTypeAlert:
+			return nil, alertFrom(data)
+		default:
+			return nil, &TLSAlertError{Description: TLSAlertUnexpectedMessage}
+		}
+	}
+}
+
+// nextHandshake はhsbufにメッセージが揃っていれば1つ取り出す
+func (c *TLS13Conn) nextHandshake() ([]byte, bool) {
+	if len(c.hsbuf) < 4 {
+		return nil, false
+	}
+	length := 4 + int(sum3BytetoLength(c.hsbuf[1:4]))
+	if len(c.hsbuf) < length {
+		return nil, false
+	}
+	msg := c.hsbuf[:length:length]
+	c.hsbuf = c.hsbuf[length:]
+	return msg, true
+}
+
+// readRecord はレコードを1つ読んで、復号したContent Typeとデータを返す
+// ChangeCipherSpecは読み飛ばす
+func (c *TLS13Conn) readRecord() (byte, []byte, error) {
+	for {
+		if err := c.fillRecord(); err != nil {
+			return 0, nil, err
+		}
+		header := c.rawInput[0:5]
+		length := int(binary.BigEndian.Uint16(header[3:5]))
+		record := c.rawInput[: 5+length : 5+length]
+		c.rawInput = c.rawInput[5+length:]
+
+		ctype := header[0]
+		if ctype == HandshakeTypeChangeCipherSpec && !c.established {
+			continue
+		}
+		if !c.decrypting {
+			return ctype, record[5:], nil
+		}
+		if ctype != ContentTypeApplicationData {
+			return 0, nil, &TLSAlertError{Description: TLSAlertUnexpectedMessage}
+		}
+
+		key, iv, seq := c.serverKey()
+		plaintext, err := openChacha20(key, iv, *seq, record)
+		if err != nil {
+			return 0, nil, &TLSAlertError{Description: TLSAlertBadRecordMAC}
+		}
+		*seq++
+
+		// 5.4. Record Padding 末尾の0を取り除くと、最後の1byteが本当のContent Type
+		i := len(plaintext) - 1
+		for i >= 0 && plaintext[i] == 0x00 {
+			i--
+		}
+		if i < 0 {
+			return 0, nil, &TLSAlertError{Description: TLSAlertUnexpectedMessage}
+		}
+		return plaintext[i], plaintext[:i], nil
+	}
+}
+
+// fillRecord はrawInputにレコードが1つ揃うまで読む
+// タイムアウトしても読んだ分は残るので、もう一度呼べば続きから読める
+func (c *TLS13Conn) fillRecord() error {
+	for {
+		if len(c.rawInput) >= 5 {
+			length := int(binary.BigEndian.Uint16(c.rawInput[3:5]))
+			if length > tlsMaxCiphertext {
+				return &TLSAlertError{Description: TLSAlertDecodeError}
+			}
+			if len(c.rawInput) >= 5+length {
+				return nil
+			}
+		}
+		buf := make([]byte, 4096)
+		n, err := c.conn.Read(buf)
+		c.rawInput = append(c.rawInput, buf[:n]...)
+		if err != nil {
+			if err == io.EOF && len(c.rawInput) != 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+}
+
+func (c *TLS13Conn) serverKey() (key, iv []byte, seq *int) {
+	if c.tlsinfo.State == ContentTypeHandShake {
+		return c.tlsinfo.KeyBlockTLS13.serverHandshakeKey, c.tlsinfo.KeyBlockTLS13.serverHandshakeIV, &c.tlsinfo.ServerHandshakeSeq
+	}
+	return c.tlsinfo.KeyBlockTLS13.serverAppKey, c.tlsinfo.KeyBlockTLS13.serverAppIV, &c.tlsinfo.ServerAppSeq
+}
+
+func (c *TLS13Conn) clientKey() (key, iv []byte, seq *int) {
+	if c.tlsinfo.State == ContentTypeHandShake {
+		return c.tlsinfo.KeyBlockTLS13.clientHandshakeKey, c.tlsinfo.KeyBlockTLS13.clientHandshakeIV, &c.tlsinfo.ClientHandshakeSeq
+	}
+	return c.tlsinfo.KeyBlockTLS13.clientAppKey, c.tlsinfo.KeyBlockTLS13.clientAppIV, &c.tlsinfo.ClientAppSeq
+}
+
+// writeRecord はContent Typeを末尾に付けて暗号化して送る
+func (c *TLS13Conn) writeRecord(ctype byte, data []byte) error {
+	key, iv, seq := c.clientKey()
+	message := append(append([]byte{}, data...), ctype)
+	record := sealChacha20(key, iv, *seq, message)
+	*seq++
+	_, err := c.conn.Write(record)
+	return err
+}
+
+// sendAlert は致命的なアラートを送る。鍵が決まる前なら暗号化せずに送る
+func (c *TLS13Conn) sendAlert(desc uint8) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return
+	}
+	alert := []byte{0x02, desc}
+	if desc == TLSAlertCloseNotify {
+		alert[0] = 0x01
+	}
+	if c.decrypting {
+		c.writeRecord(ContentTypeAlert, alert)
+		return
+	}
+	c.conn.Write(append(NewTLSRecordHeader("Alert", 2), alert...))
+}
+
+func alertFrom(data []byte) error {
+	if len(data) != 2 {
+		return &TLSAlertError{Description: TLSAlertDecodeError}
+	}
+	if data[1] == TLSAlertCloseNotify {
+		return io.EOF
+	}
+	return &TLSAlertError{Description: data[1], Remote: true}
+}
+
+func (c *TLS13Conn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.input) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		ctype, data, err := c.readRecord()
+		if err != nil {
+			// タイムアウトならもう一度読めるようにしておく
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return 0, err
+			}
+			c.readErr = err
+			continue
+		}
+		switch ctype {
+		case ContentTypeApplicationData:
+			c.input = data
+		case ContentTypeHandShake:
+			c.hsbuf = append(c.hsbuf, data...)
+			if err := c.handlePostHandshake(); err != nil {
+				c.readErr = err
+			}
+		case ContentTypeAlert:
+			c.readErr = alertFrom(data)
+		default:
+			c.readErr = &TLSAlertError{Description: TLSAlertUnexpectedMessage}
+		}
+	}
+	n := copy(b, c.input)
+	c.input = c.input[n:]
+	return n, nil
+}
+
+// handlePostHandshake はハンドシェイクのあとに来るメッセージを処理する
+func (c *TLS13Conn) handlePostHandshake() error {
+	for {
+		msg, ok := c.nextHandshake()
+		if !ok {
+			return nil
+		}
+		switch msg[0] {
+		// セッションの再開はしないので捨てる
+		case HandshakeTypeNewSessionTicket:
+		// 4.6.3. Key and Initialization Vector Update
+		case HandshakeTypeKeyUpdate:
+			if len(msg) != 5 {
+				return &TLSAlertError{Description: TLSAlertDecodeError}
+			}
+			c.updateServerKey()
+			// 相手もこちらの鍵の更新を求めている
+			if msg[4] == 1 {
+				if err := c.updateClientKey(); err != nil {
+					return err
+				}
+			}
+		default:
+			return &TLSAlertError{Description: TLSAlertUnexpectedMessage}
+		}
+	}
+}
+
+func (c *TLS13Conn) keyLogWriter() io.Writer {
+	if c.config.KeyLogWriter != nil {
+		return c.config.KeyLogWriter
+	}
+	return KeyLogWriter
+}
+
+func (c *TLS13Conn) updateServerKey() {
+	keyblock := &c.tlsinfo.KeyBlockTLS13
+	keyblock.serverAppSecret = hkdfExpandLabel(keyblock.serverAppSecret, []byte(`traffic upd`), nil, 32)
+	keyblock.serverAppKey = hkdfExpandLabel(keyblock.serverAppSecret, []byte(`key`), nil, 32)
+	keyblock.serverAppIV = hkdfExpandLabel(keyblock.serverAppSecret, []byte(`iv`), nil, 12)
+	c.tlsinfo.ServerAppSeq = 0
+}
+
+// updateClientKey はKeyUpdateを古い鍵で送ってから鍵を新しくする
+func (c *TLS13Conn) updateClientKey() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.writeRecord(ContentTypeHandShake, []byte{HandshakeTypeKeyUpdate, 0x00, 0x00, 0x01, 0x00}); err != nil {
+		return err
+	}
+	keyblock := &c.tlsinfo.KeyBlockTLS13
+	keyblock.clientAppSecret = hkdfExpandLabel(keyblock.clientAppSecret, []byte(`traffic upd`), nil, 32)
+	keyblock.clientAppKey = hkdfExpandLabel(keyblock.clientAppSecret, []byte(`key`), nil, 32)
+	keyblock.clientAppIV = hkdfExpandLabel(keyblock.clientAppSecret, []byte(`iv`), nil, 12)
+	c.tlsinfo.ClientAppSeq = 0
+	return nil
+}
+
+func (c *TLS13Conn) Write(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+
+	var n int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > tlsMaxPlaintext {
+			chunk = chunk[:tlsMaxPlaintext]
+		}
+		if err := c.writeRecord(ContentTypeApplicationData, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+// Close はハンドシェイクが終わっていればclose_notifyを送ってから閉じる
+func (c *TLS13Conn) Close() error {
+	c.writeMu.Lock()
+	if !c.closed && c.established {
+		c.writeRecord(ContentTypeAlert, []byte{0x01, TLSAlertCloseNotify})
+	}
+	c.closed = true
+	c.writeMu.Unlock()
+	return c.conn.Close()
+}
+
+func (c *TLS13Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *TLS13Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *TLS13Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *TLS13Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *TLS13Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -86,30 +86,21 @@ func setTLS13Extension(http2 bool) ([]byte, ECDHEKeys) {
 
 // https://pkg.go.dev/golang.org/x/crypto@v0.0.0-20220411220226-7b82a4e95df4/chacha20poly1305
 func DecryptChacha20(message []byte, tlsinfo TLSInfo) []byte {
-	header := message[0:5]
-	chipertext := message[5:]
-	var key, iv, nonce []byte
+	var key, iv []byte
+	var seq int
 
 	if tlsinfo.State == ContentTypeHandShake {
 		key = tlsinfo.KeyBlockTLS13.serverHandshakeKey
 		iv = tlsinfo.KeyBlockTLS13.serverHandshakeIV
-		nonce = getNonce(tlsinfo.ServerHandshakeSeq, 8)
+		seq = tlsinfo.ServerHandshakeSeq
 	} else {
 		key = tlsinfo.KeyBlockTLS13.serverAppKey
 		iv = tlsinfo.KeyBlockTLS13.serverAppIV
-		nonce = getNonce(tlsinfo.ServerAppSeq, 8)
+		seq = tlsinfo.ServerAppSeq
 	}
 
 	//fmt.Printf("key is %x, iv is %x\n", key, iv)
-	aead, err := chacha20poly1305.New(key)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	xornonce := getXORNonce(nonce, iv)
-
-	//fmt.Printf("decrypt nonce is %x xornonce is %x, chipertext is %x, add is %x\n", nonce, xornonce, chipertext, header)
-	plaintext, err := aead.Open(nil, xornonce, chipertext, header)
+	plaintext, err := openChacha20(key, iv, seq, message)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -118,40 +109,60 @@ func DecryptChacha20(message []byte, tlsinfo TLSInfo) []byte {
 }
 
 func EncryptChacha20(message []byte, tlsinfo TLSInfo) []byte {
-	var key, iv, nonce []byte
+	var key, iv []byte
+	var seq int
 
 	// Finishedメッセージを送るとき
 	if tlsinfo.State == ContentTypeHandShake {
 		key = tlsinfo.KeyBlockTLS13.clientHandshakeKey
 		iv = tlsinfo.KeyBlockTLS13.clientHandshakeIV
-		nonce = getNonce(tlsinfo.ClientHandshakeSeq, 8)
+		seq = tlsinfo.ClientHandshakeSeq
 	} else {
 		// Application Dataを送る時
 		key = tlsinfo.KeyBlockTLS13.clientAppKey
 		iv = tlsinfo.KeyBlockTLS13.clientAppIV
-		nonce = getNonce(tlsinfo.ClientAppSeq, 8)
+		seq = tlsinfo.ClientAppSeq
 	}
 
-	fmt.Printf("key is %x, iv is %x\n", key, iv)
+	return sealChacha20(key, iv, seq, message)
+}
+
+// openChacha20 はレコードヘッダの付いたApplication Dataを1つ復号する
+// 改ざんされていたらエラーを返す
+func openChacha20(key, iv []byte, seq int, message []byte) ([]byte, error) {
+	if len(message) < 5 {
+		return nil, fmt.Errorf("tls record is too short : %d", len(message))
+	}
+	header := message[0:5]
+	chipertext := message[5:]
 
 	aead, err := chacha20poly1305.New(key)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+
+	xornonce := getXORNonce(getNonce(seq, 8), iv)
+	return aead.Open(nil, xornonce, chipertext, header)
+}
+
+// sealChacha20 は平文を暗号化してレコードヘッダを付ける
+func sealChacha20(key, iv []byte, seq int, message []byte) []byte {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		// 鍵は常に32byteなのでここには来ない
+		panic(err)
 	}
 	// ivとnonceをxorのbit演算をする
 	// 5.3. レコードごとのノンス
 	// 2.埋め込まれたシーケンス番号は、静的なclient_write_ivまたはserver_write_iv（役割に応じて）とXORされます。
-	xornonce := getXORNonce(nonce, iv)
+	xornonce := getXORNonce(getNonce(seq, 8), iv)
 	header := strtoByte("170303")
 	// 平文→暗号化したときのOverHeadを足す
-	totalLength := len(message) + 16
+	totalLength := len(message) + aead.Overhead()
 
 	header = append(header, UintTo2byte(uint16(totalLength))...)
 
-	fmt.Printf("encrypt now nonce is %x xornonce is %x, plaintext is %x, add is %x\n", nonce, xornonce, message, header)
-	ciphertext := aead.Seal(header, xornonce, message, header)
-
-	return ciphertext
+	return aead.Seal(header, xornonce, message, header)
 }
 
 // HKDF-Extractは、上部からSalt引数を、左側からIKM引数を取り
@@ -189,7 +200,18 @@ func deriveSecret(secret, label, messages_byte []byte) []byte {
 	return hkdfExpandLabel(secret, label, messages_byte, 32)
 }
 
+// KeyscheduleToMasterSecret はハンドシェイク用の鍵を作る
+// KeyLogWriterがあればClientHelloのrandomでsecretを書き出す
 func KeyscheduleToMasterSecret(sharedkey, handshake_messages []byte) KeyBlockTLS13 {
+	keyblock := keyscheduleHandshake(sharedkey, handshake_messages)
+	if err := writeTLS13HandshakeKeyLog(KeyLogWriter, handshake_messages, keyblock); err != nil {
+		log.Printf("key log write err : %v", err)
+	}
+	return keyblock
+}
+
+// keyscheduleHandshake はECDHEの共通鍵とClientHello, ServerHelloからハンドシェイク用の鍵を作る
+func keyscheduleHandshake(sharedkey, handshake_messages []byte) KeyBlockTLS13 {
 
 	zero := noRandomByte(32)
 	zerohash := WriteHash(nil)
@@ -198,50 +220,34 @@ func KeyscheduleToMasterSecret(sharedkey, handshake_messages []byte) KeyBlockTLS
 
 	// {client} derive secret for handshake "tls13 derived"
 	derivedSecretForhs := deriveSecret(earlySecret, DerivedLabel, zerohash)
-	fmt.Printf("derivedSecretForhs %x\n", derivedSecretForhs)
 
 	// {client} extract secret "handshake":
 	handshake_secret := hkdfExtract(sharedkey, derivedSecretForhs)
-	fmt.Printf("handshake_secret is : %x\n", handshake_secret)
 
 	hash_messages := WriteHash(handshake_messages)
-	fmt.Printf("hashed messages is %x\n", hash_messages)
 
 	// {client} derive secret "tls13 c hs traffic":
 	chstraffic := deriveSecret(handshake_secret, ClienthsTraffic, hash_messages)
-	fmt.Printf("CLIENT_HANDSHAKE_TRAFFIC_SECRET %x %x\n", zero, chstraffic)
 
 	// Finished message用のキー
 	clientfinkey := deriveSecret(chstraffic, FinishedLabel, nil)
-	//fmt.Printf("clientfinkey is : %x\n", clientfinkey)
 
 	// {client} derive secret "tls13 s hs traffic":
 	shstraffic := deriveSecret(handshake_secret, ServerhsTraffic, hash_messages)
-	fmt.Printf("SERVER_HANDSHAKE_TRAFFIC_SECRET %x %x\n", zero, shstraffic)
 
 	// Finished message用のキー
 	serverfinkey := deriveSecret(shstraffic, FinishedLabel, nil)
-	fmt.Printf("serverfinkey is : %x\n", serverfinkey)
 
 	derivedSecretFormaster := deriveSecret(handshake_secret, DerivedLabel, zerohash)
-	fmt.Printf("derivedSecretFormaster is : %x\n", derivedSecretFormaster)
 
 	extractSecretMaster := hkdfExtract(zero, derivedSecretFormaster)
-	fmt.Printf("extractSecretMaster is : %x\n", extractSecretMaster)
 
 	// {client} derive write traffic keys for handshake data from server hs traffic:
 	// 7.3. トラフィックキーの計算
 	clienttraffickey := hkdfExpandLabel(chstraffic, []byte(`key`), nil, 32)
-	fmt.Printf("client traffic key is : %x\n", clienttraffickey)
-
 	clienttrafficiv := hkdfExpandLabel(chstraffic, []byte(`iv`), nil, 12)
-	fmt.Printf("client traffic iv is : %x\n", clienttrafficiv)
-
 	servertraffickey := hkdfExpandLabel(shstraffic, []byte(`key`), nil, 32)
-	fmt.Printf("server traffic key is : %x\n", servertraffickey)
-
 	servertrafficiv := hkdfExpandLabel(shstraffic, []byte(`iv`), nil, 12)
-	fmt.Printf("server traffic iv is : %x\n", servertrafficiv)
 
 	return KeyBlockTLS13{
 		handshakeSecret:       handshake_secret,
@@ -258,27 +264,28 @@ func KeyscheduleToMasterSecret(sharedkey, handshake_messages []byte) KeyBlockTLS
 }
 
 func KeyscheduleToAppTraffic(tlsinfo TLSInfo) TLSInfo {
-	hash_messages := WriteHash(tlsinfo.Handshakemessages)
-	fmt.Printf("hashed messages is %x\n", hash_messages)
+	tlsinfo.KeyBlockTLS13 = keyscheduleAppTraffic(tlsinfo.KeyBlockTLS13, tlsinfo.Handshakemessages)
+	if err := writeTLS13AppTrafficKeyLog(KeyLogWriter, tlsinfo.Handshakemessages, tlsinfo.KeyBlockTLS13); err != nil {
+		log.Printf("key log write err : %v", err)
+	}
+	return tlsinfo
+}
 
-	zero := noRandomByte(32)
+// keyscheduleAppTraffic はサーバのFinishedまでのメッセージからApplication Data用の鍵を作る
+func keyscheduleAppTraffic(keyblock KeyBlockTLS13, handshake_messages []byte) KeyBlockTLS13 {
+	hash_messages := WriteHash(handshake_messages)
 
 	// {client} derive secret "tls13 c ap traffic":
-	captraffic := deriveSecret(tlsinfo.KeyBlockTLS13.masterSecret, ClientapTraffic, hash_messages)
-	fmt.Printf("CLIENT_TRAFFIC_SECRET_0 %x %x\n", zero, captraffic)
-	saptraffic := deriveSecret(tlsinfo.KeyBlockTLS13.masterSecret, ServerapTraffic, hash_messages)
-	fmt.Printf("SERVER_TRAFFIC_SECRET_0 %x %x\n", zero, saptraffic)
+	keyblock.clientAppSecret = deriveSecret(keyblock.masterSecret, ClientapTraffic, hash_messages)
+	keyblock.serverAppSecret = deriveSecret(keyblock.masterSecret, ServerapTraffic, hash_messages)
 
 	// 7.3. トラフィックキーの計算, Application用
-	tlsinfo.KeyBlockTLS13.clientAppKey = hkdfExpandLabel(captraffic, []byte(`key`), nil, 32)
-	tlsinfo.KeyBlockTLS13.clientAppIV = hkdfExpandLabel(captraffic, []byte(`iv`), nil, 12)
-	fmt.Printf("clientAppKey and IV is : %x, %x\n", tlsinfo.KeyBlockTLS13.clientAppKey, tlsinfo.KeyBlockTLS13.clientAppIV)
+	keyblock.clientAppKey = hkdfExpandLabel(keyblock.clientAppSecret, []byte(`key`), nil, 32)
+	keyblock.clientAppIV = hkdfExpandLabel(keyblock.clientAppSecret, []byte(`iv`), nil, 12)
+	keyblock.serverAppKey = hkdfExpandLabel(keyblock.serverAppSecret, []byte(`key`), nil, 32)
+	keyblock.serverAppIV = hkdfExpandLabel(keyblock.serverAppSecret, []byte(`iv`), nil, 12)
 
-	tlsinfo.KeyBlockTLS13.serverAppKey = hkdfExpandLabel(saptraffic, []byte(`key`), nil, 32)
-	tlsinfo.KeyBlockTLS13.serverAppIV = hkdfExpandLabel(saptraffic, []byte(`iv`), nil, 12)
-	fmt.Printf("serverAppkey and IV is : %x, %x\n", tlsinfo.KeyBlockTLS13.serverAppKey, tlsinfo.KeyBlockTLS13.serverAppIV)
-
-	return tlsinfo
+	return keyblock
 }
 
 // 4.4.3. Certificate Verify
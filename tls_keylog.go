@@ -0,0 +1,71 @@
+package tcpip
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// NSS Key Log Formatのラベル
+// https://firefox-source-docs.mozilla.org/security/nss/legacy/key_log_format/index.html
+const (
+	KeyLogLabelTLS12           = "CLIENT_RANDOM"
+	KeyLogLabelClientHandshake = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	KeyLogLabelServerHandshake = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	KeyLogLabelClientTraffic   = "CLIENT_TRAFFIC_SECRET_0"
+	KeyLogLabelServerTraffic   = "SERVER_TRAFFIC_SECRET_0"
+)
+
+// KeyLogWriter は関数で鍵を作るAPI(KeyscheduleToMasterSecret, CreateMasterandKeyblockなど)が
+// NSS Key Log Formatで鍵を書き出す先。nilなら書き出さない
+// 接続ごとに分けるときはTLS13Config.KeyLogWriterかMasterSecretInfo.KeyLogWriterを使う
+// WiresharkのTLSの(Pre)-Master-Secret log filenameに指定すると復号できる
+var KeyLogWriter io.Writer
+
+// 複数の接続から同じファイルに書いても行が混ざらないようにする
+var keyLogMu sync.Mutex
+
+// writeKeyLog は1行を書き出す。wがnilなら何もしない
+func writeKeyLog(w io.Writer, label string, clientRandom, secret []byte) error {
+	if w == nil {
+		return nil
+	}
+	keyLogMu.Lock()
+	defer keyLogMu.Unlock()
+	_, err := fmt.Fprintf(w, "%s %x %x\n", label, clientRandom, secret)
+	return err
+}
+
+// clientRandomFromHello はハンドシェイクメッセージの先頭のClientHelloからrandomを取り出す
+// Typeの1byte, Lengthの3byte, Versionの2byteの後の32byte
+func clientRandomFromHello(handshake_messages []byte) []byte {
+	if len(handshake_messages) < 38 || handshake_messages[0] != HandshakeTypeClientHello {
+		return nil
+	}
+	return handshake_messages[6:38]
+}
+
+// writeTLS13HandshakeKeyLog はハンドシェイク用の2つのsecretを書き出す
+// QUICもTLS1.3と同じラベルなので、QUICのClientHelloから始まるメッセージでもよい
+func writeTLS13HandshakeKeyLog(w io.Writer, handshake_messages []byte, keyblock KeyBlockTLS13) error {
+	random := clientRandomFromHello(handshake_messages)
+	if w == nil || random == nil {
+		return nil
+	}
+	if err := writeKeyLog(w, KeyLogLabelClientHandshake, random, keyblock.clientHandshakeSecret); err != nil {
+		return err
+	}
+	return writeKeyLog(w, KeyLogLabelServerHandshake, random, keyblock.serverHandshakeSecret)
+}
+
+// writeTLS13AppTrafficKeyLog はApplication Data用の2つのsecretを書き出す
+func writeTLS13AppTrafficKeyLog(w io.Writer, handshake_messages []byte, keyblock KeyBlockTLS13) error {
+	random := clientRandomFromHello(handshake_messages)
+	if w == nil || random == nil {
+		return nil
+	}
+	if err := writeKeyLog(w, KeyLogLabelClientTraffic, random, keyblock.clientAppSecret); err != nil {
+		return err
+	}
+	return writeKeyLog(w, KeyLogLabelServerTraffic, random, keyblock.serverAppSecret)
+}
@@ -68,7 +68,13 @@ func CreateMasterandKeyblock(premasterBytes MasterSecretInfo) ([]byte, KeyBlock)
 
 	// master secretを作成する
 	master := prf(premasterBytes.PreMasterSecret, MasterSecretLable, random, 48)
-	fmt.Printf("CLIENT_RANDOM %x %x\n", premasterBytes.ClientRandom, master)
+	w := premasterBytes.KeyLogWriter
+	if w == nil {
+		w = KeyLogWriter
+	}
+	if err := writeKeyLog(w, KeyLogLabelTLS12, premasterBytes.ClientRandom, master); err != nil {
+		log.Printf("key log write err : %v", err)
+	}
 
 	fmt.Printf("keyrandom : %x\n", keyrandom)
 	keyblockbyte := prf(master, KeyLable, keyrandom, 40)
@@ -2,6 +2,7 @@ package tcpip
 
 import (
 	"crypto/x509"
+	"io"
 )
 
 const (
@@ -173,6 +174,8 @@ type MasterSecretInfo struct {
 	PreMasterSecret []byte
 	ServerRandom    []byte
 	ClientRandom    []byte
+	// この接続のmaster secretを書き出す先。nilならパッケージのKeyLogWriterを使う
+	KeyLogWriter io.Writer
 }
 
 type KeyBlock struct {
@@ -0,0 +1,333 @@
+package tcpip
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TracerouteProbe は1つのプローブの結果
+type TracerouteProbe struct {
+	TTL   int
+	Probe int
+	// 返事をしてきたルータかホストのアドレス。タイムアウトならnil
+	From []byte
+	RTT  time.Duration
+	// 宛先から返事が来たらtrue
+	Reached bool
+	// 宛先以外から返ってきたDestination Unreachableなど、Time Exceeded以外のエラー
+	Err error
+}
+
+type TracerouteHop struct {
+	TTL    int
+	Probes []TracerouteProbe
+}
+
+// Tracerouter はTTLを1つずつ増やしながらプローブを送って経路を調べる
+// https://datatracker.ietf.org/doc/html/rfc1393
+type Tracerouter struct {
+	Stack *Stack
+	Dest  []byte
+	// "UDP", "ICMP", "TCP"のどれか
+	Method string
+	// UDPなら最初の宛先ポート、TCPなら宛先ポート
+	Port     uint16
+	FirstTTL int
+	MaxTTL   int
+	// 1ホップあたりのプローブの数
+	Probes  int
+	Timeout time.Duration
+	// trueならParis tracerouteのようにフローを識別するヘッダ(ポート番号やICMPのチェックサム)を
+	// 全てのプローブで同じにして、ロードバランサで経路が変わらないようにする
+	Paris bool
+	// 空でなければこのインターフェイスから送る
+	Ifname string
+	// プローブの結果が出るたびに呼ばれる
+	OnProbe func(TracerouteProbe)
+
+	id uint16
+}
+
+func NewTracerouter(stack *Stack, dest string) *Tracerouter {
+	return &Tracerouter{
+		Stack:    stack,
+		Dest:     Iptobyte(dest),
+		Method:   "UDP",
+		Port:     33434,
+		FirstTTL: 1,
+		MaxTTL:   30,
+		Probes:   3,
+		Timeout:  3 * time.Second,
+		// 送信元ポートかICMPのIdentifierとして使う
+		id: binary.BigEndian.Uint16(randomByte(2)) | 0x8000,
+	}
+}
+
+type traceState struct {
+	mu      sync.Mutex
+	pending map[uint16]*traceProbe
+	// 返事を受け取るたびに通知する
+	notify chan struct{}
+}
+
+type traceProbe struct {
+	result TracerouteProbe
+	sentAt time.Time
+	done   bool
+}
+
+// Run は宛先にたどり着くかMaxTTLになるまでホップごとの結果を返す
+func (t *Tracerouter) Run(ctx context.Context) ([]TracerouteHop, error) {
+	state := &traceState{
+		pending: make(map[uint16]*traceProbe),
+		notify:  make(chan struct{}, 1),
+	}
+
+	if t.Probes <= 0 {
+		return nil, fmt.Errorf("invalid number of probes : %d", t.Probes)
+	}
+	var protocol byte
+	switch t.Method {
+	case "UDP":
+		protocol = IPProtoUDP
+	case "ICMP":
+		protocol = IPProtoICMP
+	case "TCP":
+		protocol = IPProtoTCP
+		// 送信元ポートに返ってくる宛先からのSYNACKかRSTを受け取る
+		t.Stack.RegisterTCPHandler(t.id, func(ifc *NetInterface, packet []byte) {
+			t.handleTCP(state, packet)
+		})
+		defer t.Stack.UnregisterTCPHandler(t.id)
+	default:
+		return nil, fmt.Errorf("unsupported traceroute method : %s", t.Method)
+	}
+	// 同じポートのUDPソケットやPingerのハンドラを上書きしないように、プローブとして登録する
+	t.Stack.registerICMPProbe(protocol, t.id, func(ifc *NetInterface, header IPHeader, message interface{}) bool {
+		return t.handleICMP(state, header, message)
+	})
+	defer t.Stack.unregisterICMPProbe(protocol, t.id)
+
+	var hops []TracerouteHop
+	var probeID uint16
+	for ttl := t.FirstTTL; ttl <= t.MaxTTL; ttl++ {
+		hop := TracerouteHop{TTL: ttl}
+		var probes []*traceProbe
+		var ids []uint16
+		for i := 0; i < t.Probes; i++ {
+			probeID++
+			probe := &traceProbe{result: TracerouteProbe{TTL: ttl, Probe: i}}
+			state.mu.Lock()
+			state.pending[probeID] = probe
+			probe.sentAt = time.Now()
+			state.mu.Unlock()
+			if err := t.send(ttl, probeID); err != nil {
+				return hops, err
+			}
+			probes = append(probes, probe)
+			ids = append(ids, probeID)
+		}
+
+		// このホップのプローブに全部返事が来るかタイムアウトするまで待つ
+		deadline := time.After(t.Timeout)
+	wait:
+		for !t.hopDone(state, probes) {
+			select {
+			case <-ctx.Done():
+				return hops, ctx.Err()
+			case <-deadline:
+				break wait
+			case <-state.notify:
+			}
+		}
+
+		// 宛先にたどり着いたか、全部のプローブがUnreachableになったら終わり
+		reached := false
+		unreachable := 0
+		state.mu.Lock()
+		for i, probe := range probes {
+			delete(state.pending, ids[i])
+			hop.Probes = append(hop.Probes, probe.result)
+			if probe.result.Reached {
+				reached = true
+			}
+			if probe.result.Err != nil {
+				unreachable++
+			}
+		}
+		state.mu.Unlock()
+		if t.OnProbe != nil {
+			for _, probe := range hop.Probes {
+				t.OnProbe(probe)
+			}
+		}
+		hops = append(hops, hop)
+		if reached || unreachable == len(probes) {
+			break
+		}
+	}
+	return hops, nil
+}
+
+func (t *Tracerouter) hopDone(state *traceState, probes []*traceProbe) bool {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	for _, probe := range probes {
+		if !probe.done {
+			return false
+		}
+	}
+	return true
+}
+
+// send はTTLを指定してプローブを1つ送る
+// UDPとTCPはIPヘッダのIdentification、ICMPはEchoのSequence Numberでプローブを見分ける
+func (t *Tracerouter) send(ttl int, probeID uint16) error {
+	header := NewIPHeader(nil, t.Dest, t.Method)
+	header.TTL = []byte{byte(ttl)}
+	header.PacketIdentification = UintTo2byte(probeID)
+	if t.Ifname != "" {
+		ifc := t.Stack.Interface(t.Ifname)
+		if ifc == nil {
+			return fmt.Errorf("no such interface : %s", t.Ifname)
+		}
+		header.SourceIPAddr, _ = t.Stack.interfaceAddr(ifc)
+	} else {
+		ifc, _, err := t.Stack.lookupRoute(t.Dest)
+		if err != nil {
+			return err
+		}
+		header.SourceIPAddr, _ = t.Stack.interfaceAddr(ifc)
+	}
+
+	var payload []byte
+	switch t.Method {
+	case "UDP":
+		destport := t.Port
+		if !t.Paris {
+			// 普通のtracerouteはプローブごとに宛先ポートを1つずつ増やす
+			destport += probeID - 1
+		}
+		payload = newUDPPacket(header, t.id, destport, make([]byte, 32))
+	case "ICMP":
+		data := make([]byte, 32)
+		if t.Paris {
+			// Sequence Numberが変わってもチェックサムが同じになるように補正値を入れる
+			binary.BigEndian.PutUint16(data[0:2], ^probeID)
+		}
+		payload = toByteArr(NewICMPEcho(ICMPTypeEchoRequest, t.id, probeID, data))
+	case "TCP":
+		payload = t.newTCPSyn(header, probeID)
+	}
+
+	if t.Ifname != "" {
+		return t.Stack.SendIPv4On(t.Ifname, header, payload)
+	}
+	return t.Stack.SendIPv4(header, payload)
+}
+
+// newTCPSyn はSequence NumberにプローブのIDを入れたSYNを作る
+func (t *Tracerouter) newTCPSyn(ipheader IPHeader, probeID uint16) []byte {
+	tcpheader := NewTCPHeader(UintTo2byte(t.id), UintTo2byte(t.Port), "SYN")
+	tcpheader.SequenceNumber = UintTo4byte(uint32(probeID))
+	num := toByteLen(tcpheader)
+	tcpheader.HeaderLength = []byte{byte(num << 2)}
+
+	dummy := NewTCPDummyHeader(ipheader, num)
+	sum := sumByteArr(toByteArr(dummy))
+	sum += sumByteArr(toByteArr(tcpheader))
+	tcpheader.Checksum = checksum(sum)
+
+	return toByteArr(tcpheader)
+}
+
+// finishProbe は返事が来たプローブの結果を埋める
+// 待っているプローブでなければfalseを返す
+func (t *Tracerouter) finishProbe(state *traceState, probeID uint16, from []byte, reached bool, err error) bool {
+	now := time.Now()
+	state.mu.Lock()
+	probe, ok := state.pending[probeID]
+	if !ok || probe.done {
+		state.mu.Unlock()
+		return false
+	}
+	probe.done = true
+	probe.result.From = append([]byte{}, from...)
+	probe.result.RTT = now.Sub(probe.sentAt)
+	probe.result.Reached = reached
+	probe.result.Err = err
+	state.mu.Unlock()
+
+	select {
+	case state.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// 引用された元のパケットからプローブのIDを取り出す
+func (t *Tracerouter) quotedProbeID(original ICMPQuote) (uint16, bool) {
+	if !bytes.Equal(original.IPHeader.DstIPAddr, t.Dest) {
+		return 0, false
+	}
+	if t.Method == "ICMP" {
+		echo, ok := original.Echo()
+		if !ok {
+			return 0, false
+		}
+		return binary.BigEndian.Uint16(echo.SequenceNumber), true
+	}
+	return binary.BigEndian.Uint16(original.IPHeader.PacketIdentification), true
+}
+
+// handleICMP はプローブへの返事ならtrueを返す
+func (t *Tracerouter) handleICMP(state *traceState, header IPHeader, message interface{}) bool {
+	from := header.SourceIPAddr
+	fromDest := bytes.Equal(from, t.Dest)
+
+	switch m := message.(type) {
+	case ICMPEcho:
+		// ICMPのときは宛先からのEcho Replyでたどり着いたことがわかる
+		if m.Type[0] == ICMPTypeEchoReply && fromDest {
+			return t.finishProbe(state, binary.BigEndian.Uint16(m.SequenceNumber), from, true, nil)
+		}
+	case ICMPTimeExceeded:
+		if id, ok := t.quotedProbeID(m.Original); ok {
+			return t.finishProbe(state, id, from, false, nil)
+		}
+	case ICMPDestinationUnreachable:
+		id, ok := t.quotedProbeID(m.Original)
+		if !ok {
+			return false
+		}
+		// UDPのときは宛先からのPort Unreachableでたどり着いたことがわかる
+		if fromDest && m.Code[0] == ICMPCodePortUnreachable {
+			return t.finishProbe(state, id, from, true, nil)
+		}
+		return t.finishProbe(state, id, from, fromDest, &ICMPError{From: from, Type: m.Type[0], Code: m.Code[0], Message: m})
+	}
+	return false
+}
+
+// handleTCP は宛先からのSYNACKかRSTを受け取ったらたどり着いたことにする
+func (t *Tracerouter) handleTCP(state *traceState, packet []byte) {
+	ip := parseIP(packet[0:20])
+	hlen := ipHeaderLength(packet)
+	if !bytes.Equal(ip.SourceIPAddr, t.Dest) || len(packet) < hlen+20 {
+		return
+	}
+	tcp := parseTCP(packet[hlen:])
+	if binary.BigEndian.Uint16(tcp.DestPort) != t.id || binary.BigEndian.Uint16(tcp.SourcePort) != t.Port {
+		return
+	}
+	// ACK番号は送ったSequence Number+1になっている
+	ack := binary.BigEndian.Uint32(tcp.AcknowlegeNumber) - 1
+	if ack > 0xffff {
+		return
+	}
+	t.finishProbe(state, uint16(ack), ip.SourceIPAddr, true, nil)
+}
@@ -1,7 +1,6 @@
 package tcpip
 
 import (
-	"bytes"
 	"fmt"
 	"log"
 	"syscall"
@@ -60,32 +59,6 @@ func (*UDPHeader) Send(packet []byte) {
 	syscall.Close(sendfd)
 }
 
-func (*UDPHeader) recv(localip []byte) {
-
-	recvfd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_UDP)
-	if err != nil {
-		log.Fatalf("create udp sendfd err : %v\n", err)
-	}
-	syscall.Bind(recvfd, &syscall.SockaddrInet4{
-		Addr: [4]byte{localip[0], localip[1], localip[2], localip[3]},
-		Port: 42279,
-	})
-
-	for {
-		recvBuf := make([]byte, 300)
-		_, _, err := syscall.Recvfrom(recvfd, recvBuf, 0)
-		if err != nil {
-			log.Fatalf("read err : %v", err)
-		}
-		ip := parseIP(recvBuf[0:20])
-		if recvBuf[9] == 0x11 && bytes.Equal(ip.DstIPAddr, localip) {
-			// Ethernetが14byte, IPヘッダが20byteなので34byte目からがICMPパケット
-			fmt.Printf("dns packet : %s\n", printByteArr(recvBuf[28:]))
-		}
-	}
-
-}
-
 func udpSend() {
 	localmac := []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
 
@@ -125,3 +98,30 @@ func udpSend() {
 
 	udpheader.Send(packet)
 }
+
+// newUDPPacket はIPヘッダの送信元と宛先からチェックサムを計算してUDPヘッダ+データを作る
+func newUDPPacket(ipheader IPHeader, sourceport, destport uint16, data []byte) []byte {
+	udpheader := NewUDPHeader(UintTo2byte(sourceport), UintTo2byte(destport))
+	udpheader.PacketLenth = UintTo2byte(toByteLen(udpheader) + uint16(len(data)))
+
+	dummyHeader := NewUDPDummyHeader(ipheader)
+	dummyHeader.Length = udpheader.PacketLenth
+
+	sum := sumByteArr(toByteArr(dummyHeader))
+	sum += sumByteArr(toByteArr(udpheader))
+	if len(data)%2 != 0 {
+		sum += sumByteArr(paddingZero(append([]byte{}, data...)))
+	} else {
+		sum += sumByteArr(data)
+	}
+	udpheader.Checksum = checksum(sum)
+	// 計算結果が0のときは0xffffを入れる(0はチェックサムなしの意味になる)
+	if udpheader.Checksum[0] == 0 && udpheader.Checksum[1] == 0 {
+		udpheader.Checksum = []byte{0xff, 0xff}
+	}
+
+	var packet []byte
+	packet = append(packet, toByteArr(udpheader)...)
+	packet = append(packet, data...)
+	return packet
+}
@@ -0,0 +1,408 @@
+package tcpip
+
+import (
+	"bytes"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// UDPMessage はまとめて送受信するデータグラム1つ分
+type UDPMessage struct {
+	// 送るデータか受け取るバッファ
+	Buffer []byte
+	// 送り先か送り元。Connectしたソケットで送るときはnilでいい
+	Addr *net.UDPAddr
+	// 送ったか受け取ったバイト数
+	N int
+	// 0でなければBufferはこの長さのデータグラムを繋げたもの(最後だけ短くてもいい)
+	// 送るときは分割して送り(GSO)、受け取るときはまとめられていればその長さが入る(GRO)
+	SegmentSize int
+}
+
+// segments はGSOのバッファをデータグラムごとに分ける
+func (m *UDPMessage) segments(p []byte) [][]byte {
+	if m.SegmentSize <= 0 || len(p) <= m.SegmentSize {
+		return [][]byte{p}
+	}
+	var segs [][]byte
+	for len(p) > m.SegmentSize {
+		segs = append(segs, p[:m.SegmentSize])
+		p = p[m.SegmentSize:]
+	}
+	return append(segs, p)
+}
+
+// WriteBatch はmsgsをまとめて送って、送れたメッセージの数を返す
+// 同じ宛先が続く間は経路を1回だけ調べ、SegmentSizeがあれば分割して送る
+func (c *UDPConn) WriteBatch(msgs []UDPMessage) (int, error) {
+	raddr, rport := c.remote()
+
+	var ifc *NetInterface
+	var nexthop, lastDst []byte
+	var lastPort uint16
+	for i := range msgs {
+		m := &msgs[i]
+		dst, dport := raddr, rport
+		if m.Addr != nil {
+			if raddr != nil {
+				return i, &net.OpError{Op: "write", Net: "udp", Source: c.LocalAddr(), Addr: m.Addr, Err: syscall.EISCONN}
+			}
+			dst, dport = m.Addr.IP.To4(), uint16(m.Addr.Port)
+		}
+		if dst == nil {
+			return i, &net.OpError{Op: "write", Net: "udp", Source: c.LocalAddr(), Err: ErrNotConnected}
+		}
+		if err := c.writable(); err != nil {
+			return i, &net.OpError{Op: "write", Net: "udp", Source: c.LocalAddr(), Addr: m.Addr, Err: err}
+		}
+		if ifc == nil || !bytes.Equal(dst, lastDst) || dport != lastPort {
+			var err error
+			ifc, nexthop, err = c.route(dst)
+			if err != nil {
+				return i, &net.OpError{Op: "write", Net: "udp", Source: c.LocalAddr(), Addr: m.Addr, Err: err}
+			}
+			lastDst, lastPort = dst, dport
+		}
+		for _, seg := range m.segments(m.Buffer) {
+			if err := c.send(ifc, nexthop, seg, dst, dport); err != nil {
+				return i, &net.OpError{Op: "write", Net: "udp", Source: c.LocalAddr(), Addr: m.Addr, Err: err}
+			}
+		}
+		m.N = len(m.Buffer)
+	}
+	return len(msgs), nil
+}
+
+// ReadBatch は届いているデータグラムをまとめて受け取って、埋めたメッセージの数を返す
+// 1つも届いていなければ1つ届くまで待つ
+// GROがtrueなら同じ相手からの同じ長さのデータグラムを1つのメッセージにまとめる
+func (c *UDPConn) ReadBatch(msgs []UDPMessage) (int, error) {
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	d, err := c.nextDatagram()
+	if err != nil {
+		return 0, &net.OpError{Op: "read", Net: "udp", Source: c.LocalAddr(), Err: err}
+	}
+	n := 0
+	for {
+		m := &msgs[n]
+		m.Addr = d.addr()
+		m.N = copy(m.Buffer, d.data)
+		m.SegmentSize = 0
+		if c.GRO {
+			c.coalesce(m, len(d.data))
+		}
+		n++
+		if n == len(msgs) {
+			return n, nil
+		}
+		var ok bool
+		if d, ok = c.pollDatagram(); !ok {
+			return n, nil
+		}
+	}
+}
+
+// coalesce は続けて届いている同じ相手からのデータグラムをmの後ろに繋げる
+// 長さがsegSizeと同じ間だけ繋げ、短いものが来たらそれを最後にする
+func (c *UDPConn) coalesce(m *UDPMessage, segSize int) {
+	if segSize == 0 || m.N != segSize {
+		return
+	}
+	for {
+		next, ok := c.peekDatagram()
+		if !ok {
+			return
+		}
+		if !bytes.Equal(next.from, m.Addr.IP) || int(next.port) != m.Addr.Port ||
+			len(next.data) > segSize || len(next.data) == 0 || m.N+len(next.data) > len(m.Buffer) {
+			return
+		}
+		c.pollDatagram()
+		m.N += copy(m.Buffer[m.N:], next.data)
+		m.SegmentSize = segSize
+		if len(next.data) < segSize {
+			return
+		}
+	}
+}
+
+// LinuxのUDPソケットのGSO/GRO
+// https://github.com/torvalds/linux/blob/master/include/uapi/linux/udp.h
+const (
+	solUDP     = 17
+	udpSegment = 103
+	udpGRO     = 104
+	// syscallパッケージにはアーキテクチャによってsendmmsgの番号がないのでx/sys/unixのものを使う
+	sysSendmmsg = unix.SYS_SENDMMSG
+	sysRecvmmsg = unix.SYS_RECVMMSG
+	// 1回のsendmmsg/recvmmsgで渡せる最大数(UIO_MAXIOV)
+	maxMmsgBatch = 1024
+)
+
+// mmsghdr はsendmmsg/recvmmsgに渡す構造体
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// KernelUDPConn はカーネルのUDPソケットでsendmmsg/recvmmsgを使ってまとめて送受信する
+type KernelUDPConn struct {
+	fd int
+	// カーネルがUDP_SEGMENTに対応していればtrue
+	gso bool
+	gro bool
+}
+
+// NewKernelUDPConn はladdrにバインドしたカーネルのUDPソケットを作る
+func NewKernelUDPConn(laddr *net.UDPAddr) (*KernelUDPConn, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, err
+	}
+	sa := &syscall.SockaddrInet4{}
+	if laddr != nil {
+		sa.Port = laddr.Port
+		if ip := laddr.IP.To4(); ip != nil {
+			copy(sa.Addr[:], ip)
+		}
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	c := &KernelUDPConn{fd: fd}
+	// 古いカーネルはUDP_SEGMENTを知らないのでエラーになる
+	if _, err := syscall.GetsockoptInt(fd, solUDP, udpSegment); err == nil {
+		c.gso = true
+	}
+	return c, nil
+}
+
+// EnableGRO は受信したデータグラムをカーネルにまとめてもらう
+func (c *KernelUDPConn) EnableGRO() error {
+	if err := syscall.SetsockoptInt(c.fd, solUDP, udpGRO, 1); err != nil {
+		return err
+	}
+	c.gro = true
+	return nil
+}
+
+func (c *KernelUDPConn) LocalAddr() net.Addr {
+	sa, err := syscall.Getsockname(c.fd)
+	if err != nil {
+		return nil
+	}
+	sa4 := sa.(*syscall.SockaddrInet4)
+	return &net.UDPAddr{IP: net.IP(append([]byte{}, sa4.Addr[:]...)), Port: sa4.Port}
+}
+
+// SetReadTimeout は受信を待つ時間を決める。過ぎるとReadFromやReadBatchがEAGAINを返す
+func (c *KernelUDPConn) SetReadTimeout(d time.Duration) error {
+	tv := syscall.NsecToTimeval(d.Nanoseconds())
+	return syscall.SetsockoptTimeval(c.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+}
+
+// SetReadBuffer はソケットの受信バッファの大きさを変える
+func (c *KernelUDPConn) SetReadBuffer(bytes int) error {
+	return syscall.SetsockoptInt(c.fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, bytes)
+}
+
+func (c *KernelUDPConn) Close() error {
+	return syscall.Close(c.fd)
+}
+
+// WriteTo は1回のsendtoでデータグラムを1つ送る
+func (c *KernelUDPConn) WriteTo(p []byte, addr *net.UDPAddr) (int, error) {
+	sa := &syscall.SockaddrInet4{Port: addr.Port}
+	copy(sa.Addr[:], addr.IP.To4())
+	if err := syscall.Sendto(c.fd, p, 0, sa); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ReadFrom は1回のrecvfromでデータグラムを1つ受け取る
+func (c *KernelUDPConn) ReadFrom(p []byte) (int, *net.UDPAddr, error) {
+	n, from, err := syscall.Recvfrom(c.fd, p, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	sa4, ok := from.(*syscall.SockaddrInet4)
+	if !ok {
+		return n, nil, nil
+	}
+	return n, &net.UDPAddr{IP: net.IP(append([]byte{}, sa4.Addr[:]...)), Port: sa4.Port}, nil
+}
+
+// WriteBatch はsendmmsgでmsgsをまとめて送って、送れたメッセージの数を返す
+// SegmentSizeがあればUDP_SEGMENTでカーネルに分割してもらう。対応していなければ自分で分割する
+func (c *KernelUDPConn) WriteBatch(msgs []UDPMessage) (int, error) {
+	if c.gso {
+		return c.sendmmsg(msgs)
+	}
+	split := splitSegments(msgs)
+	sent, err := c.sendmmsg(split)
+	// 分割したデータグラムの数を元のメッセージの数に直す
+	n := 0
+	for i := 0; i < sent; i++ {
+		if split[i].SegmentSize == 0 {
+			msgs[n].N = len(msgs[n].Buffer)
+			n++
+		}
+	}
+	return n, err
+}
+
+func (c *KernelUDPConn) sendmmsg(msgs []UDPMessage) (int, error) {
+	sent := 0
+	for sent < len(msgs) {
+		batch := msgs[sent:]
+		if len(batch) > maxMmsgBatch {
+			batch = batch[:maxMmsgBatch]
+		}
+		hdrs := make([]mmsghdr, len(batch))
+		iovs := make([]syscall.Iovec, len(batch))
+		names := make([]syscall.RawSockaddrInet4, len(batch))
+		oob := make([]byte, len(batch)*syscall.CmsgSpace(2))
+		for i := range batch {
+			m := &batch[i]
+			if len(m.Buffer) > 0 {
+				iovs[i].Base = &m.Buffer[0]
+			}
+			iovs[i].SetLen(len(m.Buffer))
+			hdrs[i].hdr.Iov = &iovs[i]
+			hdrs[i].hdr.Iovlen = 1
+			if m.Addr != nil {
+				putRawSockaddrInet4(&names[i], m.Addr)
+				hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&names[i]))
+				hdrs[i].hdr.Namelen = syscall.SizeofSockaddrInet4
+			}
+			if m.SegmentSize > 0 && len(m.Buffer) > m.SegmentSize {
+				cmsg := oob[i*syscall.CmsgSpace(2) : (i+1)*syscall.CmsgSpace(2)]
+				putSegmentCmsg(cmsg, uint16(m.SegmentSize))
+				hdrs[i].hdr.Control = &cmsg[0]
+				hdrs[i].hdr.SetControllen(len(cmsg))
+			}
+		}
+		r, _, errno := syscall.Syscall6(sysSendmmsg, uintptr(c.fd), uintptr(unsafe.Pointer(&hdrs[0])), uintptr(len(hdrs)), 0, 0, 0)
+		if errno != 0 {
+			return sent, errno
+		}
+		for i := 0; i < int(r); i++ {
+			batch[i].N = int(hdrs[i].len)
+		}
+		sent += int(r)
+	}
+	return sent, nil
+}
+
+// splitSegments はSegmentSizeのあるメッセージをデータグラムごとに分ける
+// 分けたものは最後以外のSegmentSizeを-1にして、元のメッセージの数を数えられるようにする
+func splitSegments(msgs []UDPMessage) []UDPMessage {
+	var split []UDPMessage
+	for i := range msgs {
+		segs := msgs[i].segments(msgs[i].Buffer)
+		for j, seg := range segs {
+			m := UDPMessage{Buffer: seg, Addr: msgs[i].Addr}
+			if j != len(segs)-1 {
+				m.SegmentSize = -1
+			}
+			split = append(split, m)
+		}
+	}
+	return split
+}
+
+// ReadBatch はrecvmmsgで届いているデータグラムをまとめて受け取って、埋めたメッセージの数を返す
+// 1つも届いていなければ1つ届くまで待つ
+func (c *KernelUDPConn) ReadBatch(msgs []UDPMessage) (int, error) {
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+	if len(msgs) > maxMmsgBatch {
+		msgs = msgs[:maxMmsgBatch]
+	}
+	oobLen := syscall.CmsgSpace(4)
+	hdrs := make([]mmsghdr, len(msgs))
+	iovs := make([]syscall.Iovec, len(msgs))
+	names := make([]syscall.RawSockaddrInet4, len(msgs))
+	oob := make([]byte, len(msgs)*oobLen)
+	for i := range msgs {
+		m := &msgs[i]
+		if len(m.Buffer) > 0 {
+			iovs[i].Base = &m.Buffer[0]
+		}
+		iovs[i].SetLen(len(m.Buffer))
+		hdrs[i].hdr.Iov = &iovs[i]
+		hdrs[i].hdr.Iovlen = 1
+		hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&names[i]))
+		hdrs[i].hdr.Namelen = syscall.SizeofSockaddrInet4
+		if c.gro {
+			hdrs[i].hdr.Control = &oob[i*oobLen]
+			hdrs[i].hdr.SetControllen(oobLen)
+		}
+	}
+	// 1つ目が届くまでは待ち、そのあとは届いている分だけ受け取る
+	r, _, errno := syscall.Syscall6(sysRecvmmsg, uintptr(c.fd), uintptr(unsafe.Pointer(&hdrs[0])), uintptr(len(hdrs)), syscall.MSG_WAITFORONE, 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	for i := 0; i < int(r); i++ {
+		m := &msgs[i]
+		m.N = int(hdrs[i].len)
+		m.Addr = rawSockaddrInet4ToUDPAddr(&names[i])
+		m.SegmentSize = 0
+		if c.gro {
+			m.SegmentSize = groSegmentSize(oob[i*oobLen : i*oobLen+int(hdrs[i].hdr.Controllen)])
+		}
+	}
+	return int(r), nil
+}
+
+func putRawSockaddrInet4(sa *syscall.RawSockaddrInet4, addr *net.UDPAddr) {
+	sa.Family = syscall.AF_INET
+	port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	port[0] = byte(addr.Port >> 8)
+	port[1] = byte(addr.Port)
+	copy(sa.Addr[:], addr.IP.To4())
+}
+
+func rawSockaddrInet4ToUDPAddr(sa *syscall.RawSockaddrInet4) *net.UDPAddr {
+	port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	return &net.UDPAddr{
+		IP:   net.IP(append([]byte{}, sa.Addr[:]...)),
+		Port: int(port[0])<<8 | int(port[1]),
+	}
+}
+
+// putSegmentCmsg はUDP_SEGMENTの制御メッセージを書き込む
+func putSegmentCmsg(b []byte, segSize uint16) {
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = solUDP
+	h.Type = udpSegment
+	h.SetLen(syscall.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&b[syscall.CmsgLen(0)])) = segSize
+}
+
+// groSegmentSize はUDP_GROの制御メッセージからまとめられたデータグラムの長さを取り出す
+func groSegmentSize(oob []byte) int {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level == solUDP && msg.Header.Type == udpGRO && len(msg.Data) >= 4 {
+			return int(*(*int32)(unsafe.Pointer(&msg.Data[0])))
+		}
+	}
+	return 0
+}
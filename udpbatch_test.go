@@ -0,0 +1,137 @@
+package tcpip
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+const benchUDPSize = 1200
+
+// newUDPBenchConns はチャネルのリンクでつないだ2つのStackの上に送る側と受け取る側のソケットを作る
+func newUDPBenchConns(b *testing.B) (*UDPConn, *UDPConn) {
+	la, lb := NewChannelLinkPair(1500)
+	tx, rx := NewStack(), NewStack()
+	tx.AddInterface(&NetInterface{Name: "a0", MacAddr: []byte{0x02, 0, 0, 0, 0, 0x01}, IpAddr: []byte{10, 0, 0, 1}, Netmask: []byte{255, 255, 255, 0}, Link: la})
+	rx.AddInterface(&NetInterface{Name: "b0", MacAddr: []byte{0x02, 0, 0, 0, 0, 0x02}, IpAddr: []byte{10, 0, 0, 2}, Netmask: []byte{255, 255, 255, 0}, Link: lb})
+	b.Cleanup(func() {
+		tx.Close()
+		rx.Close()
+	})
+
+	r, err := rx.ListenUDP(&net.UDPAddr{Port: 9000})
+	if err != nil {
+		b.Fatal(err)
+	}
+	// 受信側が追いつかずに捨てられないように全部溜めておけるようにする
+	r.SetReadBuffer(1 << 30)
+	w, err := tx.DialUDP(nil, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 9000})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		w.Close()
+		r.Close()
+	})
+
+	// ARPを解決しておく
+	w.Write([]byte("warmup"))
+	r.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, _, err := r.ReadFrom(make([]byte, 16)); err != nil {
+		b.Fatal(err)
+	}
+	r.SetReadDeadline(time.Time{})
+	return w, r
+}
+
+// receiveUDPBench はn個のデータグラムを受け取るか、しばらく届かなくなるまで読む
+func receiveUDPBench(r *UDPConn, n int, gro bool, done chan<- int) {
+	r.GRO = gro
+	msgs := make([]UDPMessage, 64)
+	for i := range msgs {
+		msgs[i].Buffer = make([]byte, 65536)
+	}
+	got := 0
+	for got < n {
+		r.SetReadDeadline(time.Now().Add(time.Second))
+		m, err := r.ReadBatch(msgs)
+		if err != nil {
+			break
+		}
+		for _, msg := range msgs[:m] {
+			if msg.SegmentSize > 0 {
+				got += (msg.N + msg.SegmentSize - 1) / msg.SegmentSize
+			} else {
+				got++
+			}
+		}
+	}
+	done <- got
+}
+
+func benchmarkUDPSend(b *testing.B, gro bool, send func(w *UDPConn, n int) error) {
+	w, r := newUDPBenchConns(b)
+	done := make(chan int)
+	b.SetBytes(benchUDPSize)
+	b.ResetTimer()
+	go receiveUDPBench(r, b.N, gro, done)
+	if err := send(w, b.N); err != nil {
+		b.Fatal(err)
+	}
+	got := <-done
+	b.StopTimer()
+	if got < b.N {
+		b.Fatalf("received %d of %d datagrams", got, b.N)
+	}
+}
+
+func BenchmarkUDPWrite(b *testing.B) {
+	benchmarkUDPSend(b, false, func(w *UDPConn, n int) error {
+		buf := make([]byte, benchUDPSize)
+		for i := 0; i < n; i++ {
+			if _, err := w.Write(buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkUDPWriteBatch(b *testing.B) {
+	benchmarkUDPSend(b, false, func(w *UDPConn, n int) error {
+		msgs := make([]UDPMessage, 64)
+		for i := range msgs {
+			msgs[i].Buffer = make([]byte, benchUDPSize)
+		}
+		for n > 0 {
+			batch := msgs
+			if n < len(batch) {
+				batch = batch[:n]
+			}
+			sent, err := w.WriteBatch(batch)
+			if err != nil {
+				return err
+			}
+			n -= sent
+		}
+		return nil
+	})
+}
+
+func BenchmarkUDPWriteGSO(b *testing.B) {
+	benchmarkUDPSend(b, true, func(w *UDPConn, n int) error {
+		buf := make([]byte, 64*benchUDPSize)
+		for n > 0 {
+			segs := 64
+			if n < segs {
+				segs = n
+			}
+			msg := []UDPMessage{{Buffer: buf[:segs*benchUDPSize], SegmentSize: benchUDPSize}}
+			if _, err := w.WriteBatch(msg); err != nil {
+				return err
+			}
+			n -= segs
+		}
+		return nil
+	})
+}
@@ -0,0 +1,666 @@
+package tcpip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrAddrInUse     = errors.New("address already in use")
+	ErrNotConnected  = errors.New("udp socket is not connected")
+	ErrUDPConnClosed = errors.New("use of closed udp socket")
+)
+
+const (
+	// 自動で割り当てるポートの範囲(RFC6335)
+	ephemeralPortMin = 49152
+	ephemeralPortMax = 65535
+	// ソケットごとの受信キューに溜めておけるバイト数(Linuxのrmem_defaultと同じ)
+	udpDefaultReadBuffer = 212992
+)
+
+type udpDatagram struct {
+	from []byte
+	port uint16
+	data []byte
+}
+
+// UDPConn はStackの上のUDPソケット
+// net.PacketConnとして使え、Connectしたあとはnet.Connとしても使える
+type UDPConn struct {
+	stack *Stack
+	// 0.0.0.0なら全てのアドレス宛てを受け取る
+	laddr []byte
+	lport uint16
+	// ListenUDPReuseで作ったソケット同士は同じアドレスとポートにバインドできる
+	reuse bool
+	// 空でなければSO_BINDTODEVICEのように、このインターフェイスに届いたものだけを受け取る
+	ifname string
+
+	mu sync.Mutex
+	// Connectした相手。nilならConnectしていない
+	raddr []byte
+	rport uint16
+	// Connectしているときに受け取ったICMPエラー。次のReadかWriteで返す
+	softErr error
+	// 送るIPパケットのTTL
+	TTL byte
+	// マルチキャストを送るときのTTL
+	MulticastTTL byte
+	// マルチキャストを送り出すインターフェイスの名前。空ならルーティングテーブルに従う
+	MulticastInterface string
+	// JoinGroup, JoinSourceGroupしたグループ
+	groups map[multicastGroupKey]*multicastMembership
+	// trueならDFビットを立てて、Path MTUより大きいデータグラムはフラグメントせずにエラーにする
+	DontFragment bool
+	// 設定するとFragmentation Neededで知らされたPMTUを渡す(RFC8899 4.6)
+	// QuicMaxDatagramSizeはこれが探したサイズを使う
+	PLPMTUD *PLPMTUD
+	// trueならReadBatchで同じ相手からの同じ長さのデータグラムを1つのバッファにまとめる(GRO)
+	GRO bool
+
+	// 受信キュー。溜まっているバイト数がreadBufferを超えるデータグラムは捨てる
+	readMu     sync.Mutex
+	qmu        sync.Mutex
+	queue      []udpDatagram
+	queued     int
+	readBuffer int
+	// データグラムかICMPエラーが届いたら通知する
+	readable      chan struct{}
+	closed        chan struct{}
+	once          sync.Once
+	readDeadline  *deadline
+	writeDeadline *deadline
+}
+
+// ListenUDP はladdrにバインドしたUDPソケットを作る
+// IPアドレスがnilか0.0.0.0なら全てのインターフェイスで受け取り、ポートが0なら空いているポートを選ぶ
+// マルチキャストのグループのアドレスにバインドすると、そのグループ宛てだけを受け取る
+func (s *Stack) ListenUDP(laddr *net.UDPAddr) (*UDPConn, error) {
+	return s.listenUDP(laddr, false, "")
+}
+
+// ListenUDPReuse はSO_REUSEADDRを付けたようにUDPソケットを作る
+// 同じくListenUDPReuseで作ったソケットとなら、重なるアドレスとポートにもバインドできる
+// マルチキャストとブロードキャストは当てはまる全てのソケットに届き、ユニキャストはそのうち1つに届く
+func (s *Stack) ListenUDPReuse(laddr *net.UDPAddr) (*UDPConn, error) {
+	return s.listenUDP(laddr, true, "")
+}
+
+func (s *Stack) listenUDP(laddr *net.UDPAddr, reuse bool, ifname string) (*UDPConn, error) {
+	ip := []byte{0x00, 0x00, 0x00, 0x00}
+	port := 0
+	if laddr != nil {
+		if laddr.IP != nil && !laddr.IP.IsUnspecified() {
+			ip = laddr.IP.To4()
+			if ip == nil || !(s.isLocalAddr(ip) || isMulticastAddr(ip)) {
+				return nil, &net.OpError{Op: "listen", Net: "udp", Addr: laddr, Err: syscall.EADDRNOTAVAIL}
+			}
+		}
+		port = laddr.Port
+	}
+
+	c := &UDPConn{
+		stack:         s,
+		laddr:         append([]byte{}, ip...),
+		reuse:         reuse,
+		ifname:        ifname,
+		TTL:           0x40,
+		MulticastTTL:  1,
+		readBuffer:    udpDefaultReadBuffer,
+		readable:      make(chan struct{}, 1),
+		closed:        make(chan struct{}),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+	}
+	if err := s.bindUDP(c, uint16(port)); err != nil {
+		return nil, &net.OpError{Op: "listen", Net: "udp", Addr: laddr, Err: err}
+	}
+	return c, nil
+}
+
+// DialUDP はraddrにConnectしたUDPソケットを作る
+func (s *Stack) DialUDP(laddr, raddr *net.UDPAddr) (*UDPConn, error) {
+	c, err := s.ListenUDP(laddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Connect(raddr); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// bindUDP はソケットをポートに登録する。portが0なら空いているポートを探す
+func (s *Stack) bindUDP(c *UDPConn, port uint16) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if port == 0 {
+		start := ephemeralPortMin + int(binary.BigEndian.Uint16(randomByte(2)))%(ephemeralPortMax-ephemeralPortMin+1)
+		for i := 0; i <= ephemeralPortMax-ephemeralPortMin; i++ {
+			p := uint16(ephemeralPortMin + (start-ephemeralPortMin+i)%(ephemeralPortMax-ephemeralPortMin+1))
+			if len(s.udpConns[p]) == 0 {
+				port = p
+				break
+			}
+		}
+		if port == 0 {
+			return ErrAddrInUse
+		}
+	}
+	// 同じポートでもバインドするアドレスが重ならなければ使える。どちらもreuseなら重なってもよい
+	for _, other := range s.udpConns[port] {
+		if c.reuse && other.reuse {
+			continue
+		}
+		if bytes.Equal(other.laddr, c.laddr) || isUnspecifiedAddr(other.laddr) || isUnspecifiedAddr(c.laddr) {
+			return ErrAddrInUse
+		}
+	}
+	c.lport = port
+	s.udpConns[port] = append(s.udpConns[port], c)
+	s.icmpHandlers[icmpEndpoint{protocol: IPProtoUDP, port: port}] = s.handleUDPError
+	return nil
+}
+
+func (s *Stack) unbindUDP(c *UDPConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conns := s.udpConns[c.lport]
+	for i, other := range conns {
+		if other == c {
+			conns = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(s.udpConns, c.lport)
+		delete(s.icmpHandlers, icmpEndpoint{protocol: IPProtoUDP, port: c.lport})
+		return
+	}
+	s.udpConns[c.lport] = conns
+}
+
+// lookupUDPConn は受け取ったデータグラムを渡すソケットを探す
+// Connectしていて相手が一致するもの、アドレスが一致するもの、0.0.0.0にバインドしたものの順に選ぶ
+func (s *Stack) lookupUDPConn(ifname string, dst []byte, dport uint16, src []byte, sport uint16) *UDPConn {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var best *UDPConn
+	bestScore := -1
+	for _, c := range s.udpConns[dport] {
+		if c.ifname != "" && c.ifname != ifname {
+			continue
+		}
+		score := 0
+		if !isUnspecifiedAddr(c.laddr) {
+			if !bytes.Equal(c.laddr, dst) {
+				continue
+			}
+			score++
+		}
+		raddr, rport := c.remote()
+		if raddr != nil {
+			if !bytes.Equal(raddr, src) || rport != sport {
+				continue
+			}
+			score += 2
+		}
+		if score > bestScore {
+			best, bestScore = c, score
+		}
+	}
+	return best
+}
+
+// lookupUDPConns はマルチキャストとブロードキャストを渡す、当てはまる全てのソケットを返す
+func (s *Stack) lookupUDPConns(ifname string, dst []byte, dport uint16, src []byte, sport uint16) []*UDPConn {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var conns []*UDPConn
+	for _, c := range s.udpConns[dport] {
+		if c.ifname != "" && c.ifname != ifname {
+			continue
+		}
+		if !isUnspecifiedAddr(c.laddr) && !bytes.Equal(c.laddr, dst) {
+			continue
+		}
+		if raddr, rport := c.remote(); raddr != nil && (!bytes.Equal(raddr, src) || rport != sport) {
+			continue
+		}
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+func isUnspecifiedAddr(ip []byte) bool {
+	return bytes.Equal(ip, []byte{0x00, 0x00, 0x00, 0x00})
+}
+
+// handleUDP は自分宛てのUDPをソケットの受信キューに入れる
+// 誰も待っていないポートならPort Unreachableを返す
+func (s *Stack) handleUDP(ifc *NetInterface, packet []byte) {
+	ip := parseIP(packet[0:20])
+	udp := packet[ipHeaderLength(packet):]
+	if len(udp) < 8 {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(udp[4:6]))
+	if length < 8 || length > len(udp) {
+		return
+	}
+	udp = udp[:length]
+	if !validUDPChecksum(ip, udp) {
+		return
+	}
+
+	sport := binary.BigEndian.Uint16(udp[0:2])
+	dport := binary.BigEndian.Uint16(udp[2:4])
+	// マルチキャストとブロードキャストは当てはまる全てのソケットにコピーを届ける
+	// ICMPエラーは返さないので、誰も受け取らなくてもそのまま捨てる
+	if isMulticastAddr(ip.DstIPAddr) || isBroadcastAddr(ip.DstIPAddr, nil) || s.isLocalBroadcast(ip.DstIPAddr) {
+		for _, c := range s.lookupUDPConns(ifc.Name, ip.DstIPAddr, dport, ip.SourceIPAddr, sport) {
+			if isMulticastAddr(ip.DstIPAddr) && !c.acceptsMulticast(ifc.Name, ip.DstIPAddr, ip.SourceIPAddr) {
+				continue
+			}
+			c.deliver(udpDatagram{
+				from: append([]byte{}, ip.SourceIPAddr...),
+				port: sport,
+				data: append([]byte{}, udp[8:]...),
+			})
+		}
+		return
+	}
+	c := s.lookupUDPConn(ifc.Name, ip.DstIPAddr, dport, ip.SourceIPAddr, sport)
+	if c == nil {
+		s.sendICMPError(ifc, packet, ICMPTypeDestinationUnreachable, ICMPCodePortUnreachable, nil)
+		return
+	}
+	c.deliver(udpDatagram{
+		from: append([]byte{}, ip.SourceIPAddr...),
+		port: sport,
+		data: append([]byte{}, udp[8:]...),
+	})
+}
+
+// validUDPChecksum は疑似ヘッダを含めてチェックサムを確かめる
+// チェックサムが0なら計算されていないのでそのまま受け取る
+func validUDPChecksum(ip IPHeader, udp []byte) bool {
+	if udp[6] == 0 && udp[7] == 0 {
+		return true
+	}
+	dummyHeader := NewUDPDummyHeader(ip)
+	dummyHeader.Length = udp[4:6]
+
+	sum := sumByteArr(toByteArr(dummyHeader))
+	if len(udp)%2 != 0 {
+		sum += sumByteArr(paddingZero(append([]byte{}, udp...)))
+	} else {
+		sum += sumByteArr(udp)
+	}
+	return bytes.Equal(checksum(sum), []byte{0x00, 0x00})
+}
+
+// handleUDPError はUDPソケットが送ったデータグラムへのICMPエラーを受け取る
+// Connectしているソケットにだけ届ける(Linuxと同じ)
+func (s *Stack) handleUDPError(ifc *NetInterface, header IPHeader, message interface{}) {
+	var original ICMPQuote
+	var icmpType, code byte
+	switch m := message.(type) {
+	case ICMPDestinationUnreachable:
+		original, icmpType, code = m.Original, m.Type[0], m.Code[0]
+	case ICMPTimeExceeded:
+		original, icmpType, code = m.Original, m.Type[0], m.Code[0]
+	case ICMPParameterProblem:
+		original, icmpType, code = m.Original, m.Type[0], m.Code[0]
+	default:
+		return
+	}
+	sport, dport, ok := original.Ports()
+	if !ok {
+		return
+	}
+	c := s.lookupUDPConn(ifc.Name, original.IPHeader.SourceIPAddr, sport, original.IPHeader.DstIPAddr, dport)
+	if c == nil {
+		return
+	}
+	// Path MTUはhandleICMPでStackが覚えたので、それをPLPMTUDにも教える
+	if c.PLPMTUD != nil && icmpType == ICMPTypeDestinationUnreachable && code == ICMPCodeFragmentationNeeded {
+		if mtu, ok := s.PMTU.Get(original.IPHeader.DstIPAddr); ok {
+			c.PLPMTUD.OnPacketTooBig(mtu)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.raddr == nil {
+		return
+	}
+	c.softErr = &ICMPError{From: header.SourceIPAddr, Type: icmpType, Code: code, Message: message}
+	// Readで待っていれば起こす
+	c.notifyReadable()
+}
+
+// Connect はデータグラムを送る相手を決めて、その相手からのものだけ受け取るようにする
+// nilを渡すとConnectをやめる
+func (c *UDPConn) Connect(raddr *net.UDPAddr) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if raddr == nil {
+		c.raddr, c.rport = nil, 0
+		return nil
+	}
+	ip := raddr.IP.To4()
+	if ip == nil || raddr.Port == 0 {
+		return &net.OpError{Op: "connect", Net: "udp", Addr: raddr, Err: syscall.EINVAL}
+	}
+	c.raddr, c.rport = append([]byte{}, ip...), uint16(raddr.Port)
+	c.softErr = nil
+	return nil
+}
+
+func (c *UDPConn) remote() ([]byte, uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.raddr, c.rport
+}
+
+// takeSoftErr は溜まっているICMPエラーを1回だけ返す
+func (c *UDPConn) takeSoftErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.softErr
+	c.softErr = nil
+	return err
+}
+
+// deliver は受信キューにデータグラムを入れる。いっぱいなら捨てる
+func (c *UDPConn) deliver(d udpDatagram) {
+	c.qmu.Lock()
+	if c.queued+len(d.data) > c.readBuffer {
+		c.qmu.Unlock()
+		return
+	}
+	c.queue = append(c.queue, d)
+	c.queued += len(d.data)
+	c.qmu.Unlock()
+	c.notifyReadable()
+}
+
+func (c *UDPConn) notifyReadable() {
+	select {
+	case c.readable <- struct{}{}:
+	default:
+	}
+}
+
+// SetReadBuffer は受信キューに溜めておけるバイト数を変える
+func (c *UDPConn) SetReadBuffer(bytes int) error {
+	c.qmu.Lock()
+	defer c.qmu.Unlock()
+	c.readBuffer = bytes
+	return nil
+}
+
+// ReadFrom はデータグラムを1つ受け取る
+// pに入りきらない分は捨てる
+func (c *UDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.readFrom(p)
+	if err != nil {
+		return n, nil, &net.OpError{Op: "read", Net: "udp", Source: c.LocalAddr(), Err: err}
+	}
+	return n, addr, nil
+}
+
+func (c *UDPConn) readFrom(p []byte) (int, *net.UDPAddr, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	d, err := c.nextDatagram()
+	if err != nil {
+		return 0, nil, err
+	}
+	n := copy(p, d.data)
+	return n, d.addr(), nil
+}
+
+// nextDatagram はデータグラムが届くまで待って1つ取り出す。readMuを取ってから呼ぶ
+func (c *UDPConn) nextDatagram() (udpDatagram, error) {
+	for {
+		if err := c.takeSoftErr(); err != nil {
+			return udpDatagram{}, err
+		}
+		if d, ok := c.pollDatagram(); ok {
+			return d, nil
+		}
+		select {
+		case <-c.closed:
+			return udpDatagram{}, ErrUDPConnClosed
+		case <-c.readDeadline.wait():
+			return udpDatagram{}, os.ErrDeadlineExceeded
+		case <-c.readable:
+		}
+	}
+}
+
+// pollDatagram は待たずにデータグラムを1つ取り出す
+func (c *UDPConn) pollDatagram() (udpDatagram, bool) {
+	c.qmu.Lock()
+	defer c.qmu.Unlock()
+	if len(c.queue) == 0 {
+		return udpDatagram{}, false
+	}
+	d := c.queue[0]
+	c.queue[0] = udpDatagram{}
+	c.queue = c.queue[1:]
+	c.queued -= len(d.data)
+	return d, true
+}
+
+// peekDatagram は次に取り出すデータグラムを取り出さずに返す
+func (c *UDPConn) peekDatagram() (udpDatagram, bool) {
+	c.qmu.Lock()
+	defer c.qmu.Unlock()
+	if len(c.queue) == 0 {
+		return udpDatagram{}, false
+	}
+	return c.queue[0], true
+}
+
+func (d udpDatagram) addr() *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IP(d.from), Port: int(d.port)}
+}
+
+// WriteTo はaddrにデータグラムを1つ送る
+func (c *UDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	raddr, ok := addr.(*net.UDPAddr)
+	if !ok || raddr.IP.To4() == nil {
+		return 0, &net.OpError{Op: "write", Net: "udp", Source: c.LocalAddr(), Addr: addr, Err: syscall.EINVAL}
+	}
+	if connected, _ := c.remote(); connected != nil {
+		return 0, &net.OpError{Op: "write", Net: "udp", Source: c.LocalAddr(), Addr: addr, Err: syscall.EISCONN}
+	}
+	if err := c.writeTo(p, raddr.IP.To4(), uint16(raddr.Port)); err != nil {
+		return 0, &net.OpError{Op: "write", Net: "udp", Source: c.LocalAddr(), Addr: addr, Err: err}
+	}
+	return len(p), nil
+}
+
+func (c *UDPConn) writeTo(p []byte, dst []byte, dport uint16) error {
+	if err := c.writable(); err != nil {
+		return err
+	}
+	ifc, nexthop, err := c.route(dst)
+	if err != nil {
+		return err
+	}
+	return c.send(ifc, nexthop, p, dst, dport)
+}
+
+// route は宛先に送るインターフェイスと次に渡すIPアドレスを返す
+func (c *UDPConn) route(dst []byte) (*NetInterface, []byte, error) {
+	if isMulticastAddr(dst) {
+		return c.multicastRoute(dst)
+	}
+	return c.stack.lookupRoute(dst)
+}
+
+// writable は閉じていたり期限を過ぎていたりしたらエラーを返す
+func (c *UDPConn) writable() error {
+	select {
+	case <-c.closed:
+		return ErrUDPConnClosed
+	case <-c.writeDeadline.wait():
+		return os.ErrDeadlineExceeded
+	default:
+	}
+	return c.takeSoftErr()
+}
+
+// send は経路を調べ終わったデータグラムを1つ送る
+func (c *UDPConn) send(ifc *NetInterface, nexthop, p, dst []byte, dport uint16) error {
+	if len(p) > 0xffff-udpIPv4Overhead {
+		return syscall.EMSGSIZE
+	}
+	header := NewIPHeader(nil, dst, "UDP")
+	header.TTL = []byte{c.TTL}
+	if isMulticastAddr(dst) {
+		header.TTL = []byte{c.MulticastTTL}
+	}
+	// グループのアドレスは送信元にできないので、バインドしていてもインターフェイスのアドレスで送る
+	if isUnspecifiedAddr(c.laddr) || isMulticastAddr(c.laddr) {
+		header.SourceIPAddr, _ = c.stack.interfaceAddr(ifc)
+	} else {
+		header.SourceIPAddr = c.laddr
+	}
+	if !c.DontFragment {
+		header.Flags = []byte{0x00, 0x00}
+	}
+	return c.stack.sendIPv4(ifc, nexthop, header, newUDPPacket(header, c.lport, dport, p))
+}
+
+// Read はConnectした相手からのデータグラムを受け取る
+func (c *UDPConn) Read(p []byte) (int, error) {
+	n, _, err := c.ReadFrom(p)
+	return n, err
+}
+
+// Write はConnectした相手にデータグラムを送る
+func (c *UDPConn) Write(p []byte) (int, error) {
+	raddr, rport := c.remote()
+	if raddr == nil {
+		return 0, &net.OpError{Op: "write", Net: "udp", Source: c.LocalAddr(), Err: ErrNotConnected}
+	}
+	if err := c.writeTo(p, raddr, rport); err != nil {
+		return 0, &net.OpError{Op: "write", Net: "udp", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: err}
+	}
+	return len(p), nil
+}
+
+func (c *UDPConn) Close() error {
+	err := ErrUDPConnClosed
+	c.once.Do(func() {
+		close(c.closed)
+		c.stack.unbindUDP(c)
+		c.leaveAllGroups()
+		err = nil
+	})
+	return err
+}
+
+func (c *UDPConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IP(c.laddr), Port: int(c.lport)}
+}
+
+// RemoteAddr はConnectした相手を返す。Connectしていなければnil
+func (c *UDPConn) RemoteAddr() net.Addr {
+	raddr, rport := c.remote()
+	if raddr == nil {
+		return nil
+	}
+	return &net.UDPAddr{IP: net.IP(raddr), Port: int(rport)}
+}
+
+func (c *UDPConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *UDPConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *UDPConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// deadline は時刻になったら閉じるチャネルを持つ
+// 待っている途中で時刻を変えても反映されるようにnet.Pipeと同じ作りにする
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// タイマーが動き出していたらチャネルが閉じられるのを待つ
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,119 @@
+package tcpip
+
+import (
+	"fmt"
+	"sync"
+)
+
+// VLANLinkEndpoint は親のリンクの上でVLANタグを付け外しするリンク
+// 受信は親のインターフェイスを読んでいるStackがタグを外して渡す
+type VLANLinkEndpoint struct {
+	parent LinkEndpoint
+	tags   []VLANTag
+	in     chan []byte
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newVLANLinkEndpoint(parent LinkEndpoint, tags []VLANTag) *VLANLinkEndpoint {
+	return &VLANLinkEndpoint{
+		parent: parent,
+		tags:   tags,
+		in:     make(chan []byte, 256),
+		closed: make(chan struct{}),
+	}
+}
+
+// WriteFrame は送信元MACアドレスの後ろにタグを入れて親のリンクから送る
+func (l *VLANLinkEndpoint) WriteFrame(frame []byte) error {
+	select {
+	case <-l.closed:
+		return ErrLinkClosed
+	default:
+	}
+	var tagged []byte
+	tagged = append(tagged, frame[0:12]...)
+	for _, tag := range l.tags {
+		tagged = append(tagged, toByteArr(tag)...)
+	}
+	tagged = append(tagged, frame[12:]...)
+	return l.parent.WriteFrame(tagged)
+}
+
+func (l *VLANLinkEndpoint) ReadFrame() ([]byte, error) {
+	select {
+	case <-l.closed:
+		return nil, ErrLinkClosed
+	case frame := <-l.in:
+		return frame, nil
+	}
+}
+
+// deliver はタグを外したフレームを受信キューに入れる。いっぱいなら捨てる
+func (l *VLANLinkEndpoint) deliver(frame []byte) {
+	select {
+	case <-l.closed:
+	case l.in <- frame:
+	default:
+	}
+}
+
+// タグを付けても親のMTUは変わらない
+func (l *VLANLinkEndpoint) MTU() int {
+	return l.parent.MTU()
+}
+
+func (l *VLANLinkEndpoint) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+// vlanKey はTPIDとVIDの並びでサブインターフェイスを見分ける
+// PCPとDEIはフレームごとに変わるので見ない
+func vlanKey(tags []VLANTag) string {
+	var key string
+	for _, tag := range tags {
+		key += fmt.Sprintf("%x:%d/", tag.TPID, tag.VID())
+	}
+	return key
+}
+
+type vlanParent struct {
+	ifc  *NetInterface
+	tags string
+}
+
+// AddVLANInterface はparentの上にVLANのサブインターフェイスを作ってStackに追加する
+// QinQなら外側のタグから順番に渡す
+func (s *Stack) AddVLANInterface(parent *NetInterface, name string, ipaddr, netmask []byte, tags ...VLANTag) *NetInterface {
+	link := newVLANLinkEndpoint(parent.Link, tags)
+	ifc := &NetInterface{
+		Name:    name,
+		MacAddr: parent.MacAddr,
+		IpAddr:  ipaddr,
+		Netmask: netmask,
+		Link:    link,
+	}
+
+	s.mu.Lock()
+	s.vlans[vlanParent{ifc: parent, tags: vlanKey(tags)}] = link
+	s.mu.Unlock()
+
+	s.AddInterface(ifc)
+	return ifc
+}
+
+// handleVLANFrame はタグの付いたフレームをタグを外してサブインターフェイスに渡す
+func (s *Stack) handleVLANFrame(ifc *NetInterface, eth EthernetFrame, frame []byte) {
+	s.mu.RLock()
+	link, ok := s.vlans[vlanParent{ifc: ifc, tags: vlanKey(eth.Tags())}]
+	s.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	untagged := make([]byte, 0, len(frame)-len(eth.VLANTags))
+	untagged = append(untagged, frame[0:12]...)
+	untagged = append(untagged, frame[eth.HeaderLength()-2:]...)
+	link.deliver(untagged)
+}